@@ -1,8 +1,6 @@
 package main
 
 import (
-	"encoding/json"
-	"fmt"
 	"strings"
 	"time"
 
@@ -11,61 +9,57 @@ import (
 	"github.com/simonz05/util/session"
 )
 
+const (
+	apiIndex      = "api-token"
+	sessionPrefix = "session:"
+)
+
 type RedisBackend struct {
-	region        string
-	apiIndex      string
-	sessionPrefix string
-	db            *kvstore.KVStore
+	db *kvstore.KVStore
 }
 
+// NewRedisBackend returns a backend storing keys in the namespace of the
+// lower cased region.
 func NewRedisBackend(db *kvstore.KVStore, region string) *RedisBackend {
-	region = strings.ToLower(region)
 	return &RedisBackend{
-		region:        region,
-		apiIndex:      fmt.Sprintf("%s:api-token", region),
-		sessionPrefix: fmt.Sprintf("%s:session", region),
-		db:            db,
+		db: db.Namespace(strings.ToLower(region)),
 	}
 }
 
 func (w *RedisBackend) Count() (int, error) {
 	conn := w.db.Get()
 	defer conn.Close()
-	return redis.Int(conn.Do("ZCARD", w.apiIndex))
+	return redis.Int(conn.Do("ZCARD", apiIndex))
 }
 
 func (w *RedisBackend) Get() ([]string, error) {
-	conn := w.db.Get()
+	conn := w.db.GetReadOnly()
 	defer conn.Close()
-	return redis.Strings(conn.Do("ZRANGE", w.apiIndex, 0, -1))
+	return redis.Strings(conn.Do("ZRANGE", apiIndex, 0, -1))
 }
 
 func (w *RedisBackend) sessionKey(token string) string {
-	return fmt.Sprintf("%s:%s", w.sessionPrefix, token)
+	return sessionPrefix + token
 }
 
 func (w *RedisBackend) Set(token string, ses *session.Session) error {
-	data, err := json.Marshal(ses)
+	data, err := session.Encode(ses, session.JSONCodec)
 
 	if err != nil {
 		return err
 	}
 
-	conn := w.db.Get()
-	defer conn.Close()
-	conn.Send("MULTI")
-	conn.Do("ZADD", w.apiIndex, time.Now().UTC().Unix(), token)
-	conn.Do("SET", w.sessionKey(token), data)
-	_, err = conn.Do("EXEC")
+	_, err = w.db.Tx(nil, 0, func(tx *kvstore.Tx) error {
+		tx.Send("ZADD", apiIndex, time.Now().UTC().Unix(), token)
+		return tx.Send("SET", w.sessionKey(token), data)
+	})
 	return err
 }
 
 func (w *RedisBackend) Delete(token string) error {
-	conn := w.db.Get()
-	defer conn.Close()
-	conn.Send("MULTI")
-	conn.Send("ZREM", w.apiIndex, token)
-	conn.Send("DEL", w.sessionKey(token))
-	_, err := conn.Do("EXEC")
+	_, err := w.db.Tx(nil, 0, func(tx *kvstore.Tx) error {
+		tx.Send("ZREM", apiIndex, token)
+		return tx.Send("DEL", w.sessionKey(token))
+	})
 	return err
 }
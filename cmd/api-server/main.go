@@ -1,6 +1,7 @@
 package main
 
 import (
+	"expvar"
 	"flag"
 	"fmt"
 	"html/template"
@@ -32,8 +33,12 @@ type Key struct {
 }
 
 type Config struct {
-	Laddr   string
-	Regions map[string]*Region
+	Laddr string
+	// DebugLaddr is where /debug/vars is served, if set. It exposes the
+	// command line and memory statistics and must only be reachable
+	// internally.
+	DebugLaddr string
+	Regions    map[string]*Region
 }
 
 type Region struct {
@@ -146,7 +151,7 @@ func createKey(region *Region) (*Key, error) {
 	id, _ := uuid.NewV4()
 	key := &Key{ID: fmt.Sprintf("%s", id)}
 	perm := &session.Session{}
-	perm.Set(session.FullMask)
+	perm.GrantScope(session.ScopeFull)
 	err := region.Backend.Set(key.ID, perm)
 	return key, err
 }
@@ -203,6 +208,17 @@ func runServer() {
 	router.HandleFunc("/", creatorHandler).Methods("POST").Name("key-create")
 	router.HandleFunc("/{key:[0-9A-Za-z-]+}/", deleteHandler).Methods("DELETE").Name("key-delete")
 	router.HandleFunc("/select-region/", selectRegionHandler).Methods("POST").Name("select-region")
+
+	if config.DebugLaddr != "" {
+		debug := http.NewServeMux()
+		debug.Handle("/debug/vars", expvar.Handler())
+
+		go func() {
+			log.Printf("Debug listen on %s\n", config.DebugLaddr)
+			log.Println(http.ListenAndServe(config.DebugLaddr, debug))
+		}()
+	}
+
 	log.Printf("Listen on %s\n", config.Laddr)
 	http.ListenAndServe(config.Laddr, router)
 }
@@ -241,6 +257,7 @@ func main() {
 			log.Fatalf("region %s: %v", k, err)
 		}
 
+		store.PublishStats("kvstore." + k)
 		v.Backend = NewRedisBackend(store, v.Codename)
 	}
 
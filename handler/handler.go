@@ -10,8 +10,10 @@ package handler
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"runtime"
@@ -169,6 +171,9 @@ const (
 const (
 	SessionHeader = "Authorization-Session"
 	TokenHeader   = "Authorization-Token"
+	// SessionCookie is the cookie read by the session handler when the
+	// request has no session header.
+	SessionCookie = "session"
 )
 
 type authHandler struct {
@@ -176,11 +181,14 @@ type authHandler struct {
 	backend    session.Storage
 	contextKey contextKey
 	headerKey  string
+	cookieName string
 	mustAuth   bool
+	// recordSeen writes the activity of the client to the session.
+	recordSeen bool
 }
 
 func (a *authHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if err := a.loadSession(r); err != nil {
+	if err := a.loadSession(w, r); err != nil {
 		log.Println("handler error: ", err)
 
 		if a.mustAuth {
@@ -203,7 +211,7 @@ func (a *authHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 // Tries to load a session from the auth backend for the given authentication
-func (a *authHandler) loadSession(r *http.Request) error {
+func (a *authHandler) loadSession(w http.ResponseWriter, r *http.Request) error {
 	value := r.Header[a.headerKey]
 	var id string
 
@@ -213,6 +221,12 @@ func (a *authHandler) loadSession(r *http.Request) error {
 		id = r.URL.Query().Get("session")
 	}
 
+	if id == "" && a.cookieName != "" {
+		if c, err := r.Cookie(a.cookieName); err == nil {
+			id = c.Value
+		}
+	}
+
 	if id == "" {
 		return fmt.Errorf("Header %s and session was empty", a.headerKey)
 	}
@@ -223,12 +237,72 @@ func (a *authHandler) loadSession(r *http.Request) error {
 		return err
 	}
 
+	// activity is written at most once per session.LastSeenInterval, and
+	// failing to write it does not fail the request
+	if a.recordSeen && ses.Seen(time.Now(), remoteIP(r), r.UserAgent()) {
+		if err := a.writeSeen(ses); err != nil {
+			log.Println("handler error: ", err)
+		}
+	}
+
+	// the id changes when read through the alias of a regenerated
+	// session, or when the storage encodes the session in its id
+	if ses.Id != id {
+		sendID(w, r, a.headerKey, a.cookieName != "", ses)
+	}
+
 	context.Set(r, a.contextKey, ses)
 	return nil
 }
 
+// writeSeen writes the activity recorded in ses. It is dropped if the
+// session was written or removed since read, rather than overwriting a
+// concurrent change with the copy of this request.
+func (a *authHandler) writeSeen(ses *session.Session) error {
+	cas, ok := a.backend.(session.CompareAndSwapper)
+
+	if !ok {
+		return a.backend.Write(ses)
+	}
+
+	switch err := cas.CompareAndWrite(ses); err {
+	case nil, session.ErrConflict, session.ErrNotFound:
+		return nil
+	default:
+		return err
+	}
+}
+
+// sendID sends the id of ses in the response header headerKey, and in the
+// session cookie if cookie is set and the request has it.
+func sendID(w http.ResponseWriter, r *http.Request, headerKey string, cookie bool, ses *session.Session) {
+	w.Header().Set(headerKey, ses.Id)
+
+	if !cookie {
+		return
+	}
+
+	if _, err := r.Cookie(SessionCookie); err == nil {
+		SetSessionCookie(w, ses, ses.Lifetime)
+	}
+}
+
+// remoteIP returns the IP of the client of r. Behind a proxy, r.RemoteAddr
+// must be set from its headers first.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
 // NewAuthSessionHandler creates a AuthSessionHandler for the specified
-// backend. It loads a session from a session key.
+// backend. It loads a session from a session key, given in the session
+// header, the session query parameter or the session cookie, and records
+// the activity of the client on it.
 func NewAuthSessionHandler(sessionStorage session.Storage, must bool) func(http.Handler) http.Handler {
 	return func(h http.Handler) http.Handler {
 		return &authHandler{
@@ -236,13 +310,16 @@ func NewAuthSessionHandler(sessionStorage session.Storage, must bool) func(http.
 			backend:    sessionStorage,
 			contextKey: sessionKey,
 			headerKey:  SessionHeader,
+			cookieName: SessionCookie,
 			mustAuth:   must,
+			recordSeen: true,
 		}
 	}
 }
 
 // NewAuthTokenHandler creates a AuthTokenHandler for the specified
-// It loads a session from a token key.
+// It loads a session from a token key. Tokens are only read, so that
+// requests do not rewrite them or refresh their expiry.
 func NewAuthTokenHandler(tokenStorage session.Storage) func(http.Handler) http.Handler {
 	return func(h http.Handler) http.Handler {
 		return &authHandler{
@@ -255,6 +332,68 @@ func NewAuthTokenHandler(tokenStorage session.Storage) func(http.Handler) http.H
 	}
 }
 
+// SetSessionCookie sets the session cookie to ses.Id on w, expiring after
+// maxAge seconds, or with the browser session if zero. The cookie is
+// secure, HttpOnly and SameSite=Lax, so it is only sent over HTTPS, is
+// hidden from scripts and is not sent on cross site subrequests.
+func SetSessionCookie(w http.ResponseWriter, ses *session.Session, maxAge int) {
+	c := &http.Cookie{
+		Name:     SessionCookie,
+		Value:    ses.Id,
+		Path:     "/",
+		MaxAge:   maxAge,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+
+	if maxAge > 0 {
+		c.Expires = time.Now().Add(time.Duration(maxAge) * time.Second)
+	}
+
+	http.SetCookie(w, c)
+}
+
+// ClearSessionCookie removes the session cookie, as on logout.
+func ClearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		Expires:  time.Unix(0, 0),
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// SendSessionID sends the id of ses, once changed, to the client: in the
+// session response header, and in the session cookie if the request has
+// it, expiring after the lifetime of ses if set or with the browser
+// session.
+func SendSessionID(w http.ResponseWriter, r *http.Request, ses *session.Session) {
+	sendID(w, r, SessionHeader, true, ses)
+}
+
+// RegenerateSession moves the current session to a new id in storage and
+// sends it to the client. Call it after a login or a gain of rights, and
+// before writing the response.
+func RegenerateSession(w http.ResponseWriter, r *http.Request, storage session.Storage) error {
+	ses := CurrentSession(r)
+
+	if ses == nil {
+		return errors.New("handler: no current session")
+	}
+
+	if err := session.Regenerate(storage, ses); err != nil {
+		return err
+	}
+
+	SendSessionID(w, r, ses)
+	return nil
+}
+
 // CurrentSession returns the matched session for the current request, if any.
 func CurrentSession(r *http.Request) *session.Session {
 	if rv := context.Get(r, sessionKey); rv != nil {
@@ -0,0 +1,194 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/simonz05/util/assert"
+	"github.com/simonz05/util/session"
+)
+
+func TestAuthSessionHandler(t *testing.T) {
+	ast := assert.NewAssert(t)
+	storage := session.NewMemoryStorage(nil)
+	defer storage.Close()
+
+	ses := &session.Session{ProfileID: 1}
+	ast.Nil(storage.New(ses))
+
+	var current *session.Session
+	h := Use(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current = CurrentSession(r)
+	}), NewAuthSessionHandler(storage, true))
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Header.Set(SessionHeader, ses.Id)
+	r.Header.Set("User-Agent", "test")
+	r.RemoteAddr = "192.0.2.1:1234"
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	ast.Equal(http.StatusOK, w.Code)
+	ast.Equal(ses.Id, current.Id)
+	ast.Equal(1, current.ProfileID)
+
+	// the activity of the client is recorded
+	stored, err := storage.Read(ses.Id)
+	ast.Nil(err)
+	ast.Equal("192.0.2.1", stored.IP)
+	ast.Equal("test", stored.UserAgent)
+	ast.True(stored.LastSeenAt >= ses.CreatedAt)
+
+	r, _ = http.NewRequest("GET", "/?session=unknown", nil)
+	w = httptest.NewRecorder()
+	current = nil
+	h.ServeHTTP(w, r)
+	ast.Equal(http.StatusUnauthorized, w.Code)
+	ast.True(current == nil)
+}
+
+// racingStorage changes every session it reads before returning it, as a
+// concurrent request would.
+type racingStorage struct {
+	*session.MemoryStorage
+}
+
+func (s racingStorage) Read(id string) (*session.Session, error) {
+	ses, err := s.MemoryStorage.Read(id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	other := *ses
+	other.ProfileID = 2
+
+	if err := s.MemoryStorage.Write(&other); err != nil {
+		return nil, err
+	}
+
+	return ses, nil
+}
+
+func TestSeenConflict(t *testing.T) {
+	ast := assert.NewAssert(t)
+	storage := session.NewMemoryStorage(nil)
+	defer storage.Close()
+
+	ses := &session.Session{ProfileID: 1}
+	ast.Nil(storage.New(ses))
+
+	h := Use(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		NewAuthSessionHandler(racingStorage{storage}, true))
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Header.Set(SessionHeader, ses.Id)
+	r.Header.Set("User-Agent", "test")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	ast.Equal(http.StatusOK, w.Code)
+
+	// the activity is dropped rather than undoing the concurrent write
+	stored, err := storage.Read(ses.Id)
+	ast.Nil(err)
+	ast.Equal(2, stored.ProfileID)
+	ast.Equal("", stored.UserAgent)
+}
+
+func TestRegenerateSession(t *testing.T) {
+	ast := assert.NewAssert(t)
+	storage := session.NewMemoryStorage(nil)
+	defer storage.Close()
+
+	ses := &session.Session{}
+	ast.Nil(storage.New(ses))
+	old := ses.Id
+
+	login := Use(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		CurrentSession(r).ProfileID = 1
+		ast.Nil(RegenerateSession(w, r, storage))
+	}), NewAuthSessionHandler(storage, true))
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Header.Set("Cookie", SessionCookie+"="+old)
+	w := httptest.NewRecorder()
+	login.ServeHTTP(w, r)
+	id := w.Header().Get(SessionHeader)
+	ast.True(id != "" && id != old)
+	ast.True(strings.HasPrefix(w.Header().Get("Set-Cookie"), SessionCookie+"="+id+";"))
+
+	// requests in flight with the old id find the session and learn the
+	// new id
+	var current *session.Session
+	h := Use(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current = CurrentSession(r)
+	}), NewAuthSessionHandler(storage, true))
+
+	r, _ = http.NewRequest("GET", "/", nil)
+	r.Header.Set(SessionHeader, old)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	ast.Equal(http.StatusOK, w.Code)
+	ast.Equal(1, current.ProfileID)
+	ast.Equal(id, w.Header().Get(SessionHeader))
+	ast.Equal("", w.Header().Get("Set-Cookie"))
+}
+
+func TestSessionCookie(t *testing.T) {
+	ast := assert.NewAssert(t)
+	storage, err := session.NewCookieStorage([][]byte{make([]byte, 32)}, nil)
+	ast.Nil(err)
+
+	ses := &session.Session{ProfileID: 1}
+	ast.Nil(storage.New(ses))
+
+	w := httptest.NewRecorder()
+	SetSessionCookie(w, ses, 3600)
+	cookie := w.Header().Get("Set-Cookie")
+	ast.True(strings.Contains(cookie, "HttpOnly") && strings.Contains(cookie, "Secure") && strings.Contains(cookie, "SameSite=Lax"), cookie)
+
+	var current *session.Session
+	h := Use(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current = CurrentSession(r)
+	}), NewAuthSessionHandler(storage, true))
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Header.Set("Cookie", strings.SplitN(cookie, ";", 2)[0])
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	ast.Equal(http.StatusOK, w.Code)
+	ast.Equal(1, current.ProfileID)
+
+	w = httptest.NewRecorder()
+	ClearSessionCookie(w)
+	ast.True(strings.Contains(w.Header().Get("Set-Cookie"), "Max-Age=0"))
+}
+
+func TestAuthTokenHandler(t *testing.T) {
+	ast := assert.NewAssert(t)
+	storage := session.NewMemoryStorage(nil)
+	defer storage.Close()
+
+	token := &session.Session{ProfileID: 1}
+	ast.Nil(storage.New(token))
+
+	var current *session.Session
+	h := Use(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current = CurrentToken(r)
+	}), NewAuthTokenHandler(storage))
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Header.Set(TokenHeader, token.Id)
+	r.Header.Set("User-Agent", "test")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	ast.Equal(http.StatusOK, w.Code)
+	ast.Equal(1, current.ProfileID)
+
+	// the token is not written back
+	stored, err := storage.Read(token.Id)
+	ast.Nil(err)
+	ast.Equal(token.Revision, stored.Revision)
+	ast.Equal("", stored.UserAgent)
+}
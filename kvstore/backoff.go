@@ -0,0 +1,42 @@
+package kvstore
+
+import (
+	"math/rand"
+	"time"
+)
+
+// backoff returns how long to wait before retry attempt n, counting from
+// zero. The delay doubles from min with each attempt up to max, and is
+// jittered down by up to half to spread out competing clients.
+func backoff(n int, min, max time.Duration) time.Duration {
+	d := min
+
+	for i := 0; i < n && d < max; i++ {
+		d *= 2
+	}
+
+	if d > max {
+		d = max
+	}
+
+	if d <= 1 {
+		return d
+	}
+
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// sleep waits for d or until done is closed. It reports false if done was
+// closed first.
+func sleep(d time.Duration, done <-chan struct{}) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-done:
+		return false
+	}
+}
@@ -0,0 +1,256 @@
+package kvstore
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+var (
+	// ErrCacheMiss is returned by Cache.Get when key is not cached.
+	ErrCacheMiss = errors.New("kvstore: cache miss")
+	// ErrNotFound is returned by a Cache loader to report that the value
+	// does not exist. It is cached if negative caching is enabled.
+	ErrNotFound = errors.New("kvstore: not found")
+)
+
+// Cached values carry a one byte header which tells found values from
+// negatively cached ones.
+const (
+	cacheValue    = 'v'
+	cacheNotFound = 'n'
+)
+
+// CacheOptions configures a Cache. The zero value is valid.
+type CacheOptions struct {
+	// Codec encodes cached values. Defaults to JSONCodec.
+	Codec Codec
+	// TTL is the time to live of cached values. Defaults to one minute.
+	TTL time.Duration
+	// Jitter randomizes each TTL by up to this fraction in either
+	// direction, so that entries written together do not expire
+	// together. For example 0.1 gives TTL ± 10%.
+	Jitter float64
+	// NegativeTTL is how long an ErrNotFound from the loader is cached.
+	// Zero disables negative caching.
+	NegativeTTL time.Duration
+	// LockTTL is the lease of the redis lock which keeps other processes
+	// from loading the same key at the same time. Zero disables the
+	// lock, leaving only the in-process deduplication.
+	LockTTL time.Duration
+	// LockWait is how long a process waits for another process holding
+	// the lock to fill the cache before loading the value itself.
+	// Defaults to LockTTL.
+	LockWait time.Duration
+}
+
+// A Cache is a read-through cache of values stored under prefix.
+type Cache struct {
+	kv     *KVStore
+	prefix string
+	opts   CacheOptions
+	calls  callGroup
+}
+
+// NewCache returns a Cache storing keys under prefix. opts may be nil.
+func (kv *KVStore) NewCache(prefix string, opts *CacheOptions) *Cache {
+	c := &Cache{kv: kv, prefix: prefix}
+
+	if opts != nil {
+		c.opts = *opts
+	}
+
+	if c.opts.Codec == nil {
+		c.opts.Codec = JSONCodec
+	}
+
+	if c.opts.TTL <= 0 {
+		c.opts.TTL = time.Minute
+	}
+
+	if c.opts.LockWait <= 0 {
+		c.opts.LockWait = c.opts.LockTTL
+	}
+
+	return c
+}
+
+func (c *Cache) key(key string) string {
+	return c.prefix + ":" + key
+}
+
+// Get decodes the cached value of key into v. It returns ErrCacheMiss if
+// the key is not cached and ErrNotFound if it is negatively cached.
+func (c *Cache) Get(key string, v interface{}) error {
+	data, err := c.fetch(key)
+
+	if err != nil {
+		return err
+	}
+
+	return c.decode(data, v)
+}
+
+// Set caches v under key with the default TTL.
+func (c *Cache) Set(key string, v interface{}) error {
+	return c.SetTTL(key, v, c.opts.TTL)
+}
+
+// SetTTL caches v under key for ttl, jittered.
+func (c *Cache) SetTTL(key string, v interface{}, ttl time.Duration) error {
+	data, err := c.encode(v)
+
+	if err != nil {
+		return err
+	}
+
+	return c.store(key, data, ttl)
+}
+
+// Delete removes key from the cache.
+func (c *Cache) Delete(key string) error {
+	conn := c.kv.Get()
+	defer conn.Close()
+	_, err := conn.Do("DEL", c.key(key))
+	return err
+}
+
+// GetOrLoad decodes the cached value of key into v. On a miss it calls
+// load, caches the result and decodes it into v. Concurrent misses for the
+// same key share one call to load within the process and, if LockTTL is
+// set, across processes. If load returns ErrNotFound, GetOrLoad returns
+// ErrNotFound and caches that for NegativeTTL.
+func (c *Cache) GetOrLoad(key string, v interface{}, load func() (interface{}, error)) error {
+	data, err := c.fetch(key)
+
+	if err == ErrCacheMiss {
+		data, err = c.calls.do(key, func() ([]byte, error) {
+			return c.load(key, load)
+		})
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return c.decode(data, v)
+}
+
+// load fills key, holding the cross-process lock if enabled. If another
+// process holds the lock, load waits for it to fill the cache.
+func (c *Cache) load(key string, load func() (interface{}, error)) ([]byte, error) {
+	if c.opts.LockTTL > 0 {
+		m := c.kv.NewMutex(c.key(key)+":lock", c.opts.LockTTL)
+		err := m.TryLock()
+
+		switch err {
+		case nil:
+			defer m.Unlock()
+
+			// another process may have filled the cache just
+			// before we took the lock
+			if data, err := c.fetch(key); err != ErrCacheMiss {
+				return data, err
+			}
+		case ErrNotObtained:
+			if data, err := c.wait(key); err != ErrCacheMiss {
+				return data, err
+			}
+		}
+
+		// if redis failed to take the lock the value is loaded
+		// anyway, trading the stampede protection for availability
+	}
+
+	val, err := load()
+
+	if err == ErrNotFound && c.opts.NegativeTTL > 0 {
+		data := []byte{cacheNotFound}
+		c.store(key, data, c.opts.NegativeTTL)
+		return data, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := c.encode(val)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// a failure to cache does not fail the read
+	c.store(key, data, c.opts.TTL)
+	return data, nil
+}
+
+// wait polls for key until it is filled or LockWait passes.
+func (c *Cache) wait(key string) ([]byte, error) {
+	deadline := time.Now().Add(c.opts.LockWait)
+
+	for n := 0; time.Now().Before(deadline); n++ {
+		time.Sleep(backoff(n, 5*time.Millisecond, 100*time.Millisecond))
+		data, err := c.fetch(key)
+
+		if err != ErrCacheMiss {
+			return data, err
+		}
+	}
+
+	return nil, ErrCacheMiss
+}
+
+func (c *Cache) fetch(key string) ([]byte, error) {
+	conn := c.kv.Get()
+	defer conn.Close()
+	data, err := redis.Bytes(conn.Do("GET", c.key(key)))
+
+	if err == redis.ErrNil {
+		return nil, ErrCacheMiss
+	}
+
+	return data, err
+}
+
+func (c *Cache) store(key string, data []byte, ttl time.Duration) error {
+	if c.opts.Jitter > 0 {
+		ttl += time.Duration((rand.Float64()*2 - 1) * c.opts.Jitter * float64(ttl))
+	}
+
+	if ttl < time.Millisecond {
+		ttl = time.Millisecond
+	}
+
+	conn := c.kv.Get()
+	defer conn.Close()
+	_, err := conn.Do("PSETEX", c.key(key), millis(ttl), data)
+	return err
+}
+
+func (c *Cache) encode(v interface{}) ([]byte, error) {
+	data, err := c.opts.Codec.Marshal(v)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte{cacheValue}, data...), nil
+}
+
+func (c *Cache) decode(data []byte, v interface{}) error {
+	if len(data) == 0 {
+		return errors.New("kvstore: empty cache entry")
+	}
+
+	switch data[0] {
+	case cacheValue:
+		return c.opts.Codec.Unmarshal(data[1:], v)
+	case cacheNotFound:
+		return ErrNotFound
+	}
+
+	return errors.New("kvstore: corrupt cache entry")
+}
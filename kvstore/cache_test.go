@@ -0,0 +1,109 @@
+package kvstore_test
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/simonz05/util/assert"
+	"github.com/simonz05/util/kvstore"
+	"github.com/simonz05/util/kvstore/kvtest"
+)
+
+type profile struct {
+	ID   int
+	Name string
+}
+
+func TestCache(t *testing.T) {
+	ast := assert.NewAssert(t)
+	srv, err := kvtest.NewServer()
+	ast.Nil(err)
+	defer srv.Close()
+
+	db, err := kvstore.Open(srv.DSN(0))
+	ast.Nil(err)
+	defer db.Close()
+
+	cache := db.NewCache("profile", &kvstore.CacheOptions{
+		TTL:         time.Minute,
+		Jitter:      0.1,
+		NegativeTTL: 10 * time.Second,
+	})
+
+	var loads int32
+	load := func() (interface{}, error) {
+		atomic.AddInt32(&loads, 1)
+		time.Sleep(20 * time.Millisecond)
+		return &profile{ID: 1, Name: "simon"}, nil
+	}
+
+	var p profile
+	ast.Equal(kvstore.ErrCacheMiss, cache.Get("1", &p))
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var p profile
+
+			if err := cache.GetOrLoad("1", &p, load); err != nil || p.Name != "simon" {
+				t.Errorf("GetOrLoad = %v, %v", p, err)
+			}
+		}()
+	}
+
+	wg.Wait()
+	ast.Equal(int32(1), loads)
+
+	ast.Nil(cache.Get("1", &p))
+	ast.Equal(1, p.ID)
+
+	srv.Advance(2 * time.Minute)
+	ast.Equal(kvstore.ErrCacheMiss, cache.Get("1", &p))
+
+	// not found results are cached
+	missing := func() (interface{}, error) {
+		atomic.AddInt32(&loads, 1)
+		return nil, kvstore.ErrNotFound
+	}
+
+	atomic.StoreInt32(&loads, 0)
+	ast.Equal(kvstore.ErrNotFound, cache.GetOrLoad("2", &p, missing))
+	ast.Equal(kvstore.ErrNotFound, cache.GetOrLoad("2", &p, missing))
+	ast.Equal(int32(1), loads)
+
+	srv.Advance(11 * time.Second)
+	ast.Equal(kvstore.ErrNotFound, cache.GetOrLoad("2", &p, missing))
+	ast.Equal(int32(2), loads)
+
+	ast.Nil(cache.Delete("2"))
+	ast.Equal(kvstore.ErrCacheMiss, cache.Get("2", &p))
+}
+
+func TestCodecs(t *testing.T) {
+	ast := assert.NewAssert(t)
+	in := &profile{ID: 7, Name: "x"}
+
+	for _, codec := range []kvstore.Codec{kvstore.JSONCodec, kvstore.GobCodec} {
+		data, err := codec.Marshal(in)
+		ast.Nil(err)
+
+		var out profile
+		ast.Nil(codec.Unmarshal(data, &out))
+		ast.Equal(*in, out)
+	}
+
+	data, err := kvstore.RawCodec.Marshal("raw")
+	ast.Nil(err)
+
+	var b []byte
+	ast.Nil(kvstore.RawCodec.Unmarshal(data, &b))
+	ast.Equal("raw", string(b))
+
+	_, err = kvstore.RawCodec.Marshal(in)
+	ast.NotNil(err)
+}
@@ -0,0 +1,59 @@
+package kvstore
+
+import (
+	"errors"
+	"sync"
+)
+
+// errCallPanicked is returned to the callers waiting on a call whose fn
+// panicked. The panic itself goes to the caller which ran fn.
+var errCallPanicked = errors.New("kvstore: load panicked")
+
+// call is an in-flight or completed callGroup.do call.
+type call struct {
+	wg  sync.WaitGroup
+	val []byte
+	err error
+}
+
+// callGroup collapses concurrent calls for the same key into one, so a
+// cold key is loaded once per process no matter how many goroutines ask
+// for it.
+type callGroup struct {
+	mu sync.Mutex // guards m
+	m  map[string]*call
+}
+
+// do runs fn for key, unless a call for key is already in flight, in which
+// case it waits for that call and returns its result. If fn panics, the
+// panic propagates to the caller and the waiters get errCallPanicked.
+func (g *callGroup) do(key string, fn func() ([]byte, error)) ([]byte, error) {
+	g.mu.Lock()
+
+	if g.m == nil {
+		g.m = make(map[string]*call)
+	}
+
+	if c, ok := g.m[key]; ok {
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.val, c.err
+	}
+
+	c := new(call)
+	c.wg.Add(1)
+	g.m[key] = c
+	g.mu.Unlock()
+
+	c.err = errCallPanicked
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.m, key)
+		g.mu.Unlock()
+		c.wg.Done()
+	}()
+
+	c.val, c.err = fn()
+	return c.val, c.err
+}
@@ -0,0 +1,51 @@
+package kvstore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/simonz05/util/assert"
+)
+
+func TestCallGroupPanic(t *testing.T) {
+	ast := assert.NewAssert(t)
+	var g callGroup
+	started := make(chan struct{})
+	release := make(chan struct{})
+	recovered := make(chan interface{})
+
+	go func() {
+		defer func() {
+			recovered <- recover()
+		}()
+
+		g.do("key", func() ([]byte, error) {
+			close(started)
+			<-release
+			panic("boom")
+		})
+	}()
+
+	<-started
+	waited := make(chan error)
+
+	go func() {
+		_, err := g.do("key", func() ([]byte, error) {
+			return []byte("unused"), nil
+		})
+		waited <- err
+	}()
+
+	// let the second call find the first in flight
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	ast.Equal("boom", <-recovered)
+	ast.Equal(errCallPanicked, <-waited)
+
+	// the key is free again
+	v, err := g.do("key", func() ([]byte, error) {
+		return []byte("v"), nil
+	})
+	ast.Nil(err)
+	ast.Equal("v", string(v))
+}
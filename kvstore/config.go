@@ -0,0 +1,316 @@
+package kvstore
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultDSN = "redis://:@localhost:6379/0"
+
+type config struct {
+	network  string
+	addr     string
+	password string
+	db       uint8
+
+	tls           *tls.Config
+	tlsServerName bool // set explicitly rather than from the host
+
+	// read replicas, which share the password, db and TLS settings
+	replicas     []string
+	maxLag       int64
+	replicaCheck time.Duration
+
+	maxIdle      int
+	maxActive    int
+	idleTimeout  time.Duration
+	wait         bool
+	dialTimeout  time.Duration
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+
+	slowThreshold time.Duration
+}
+
+func newConfig() *config {
+	return &config{
+		network:      "tcp",
+		maxIdle:      64,
+		maxActive:    64,
+		idleTimeout:  60 * time.Second,
+		replicaCheck: 5 * time.Second,
+	}
+}
+
+// parseDSN parses a data source name of the form
+//
+//	redis://:password@host:port/db?param=value
+//	rediss://:password@host:port/db?param=value
+//	unix://:password@/path/to/redis.sock?db=N&param=value
+//
+// The rediss scheme dials the server over TLS. Recognized parameters are
+// max_idle, max_active, idle_timeout, wait, dial_timeout, read_timeout,
+// write_timeout and slow_threshold for all schemes, tls_ca, tls_cert, tls_key,
+// tls_server_name and tls_skip_verify for rediss and db for unix.
+//
+// The redis and rediss schemes also accept read replicas as host:port in
+// replica, which may be repeated or hold a comma separated list, together
+// with max_lag, how many bytes of the replication stream a replica may be
+// behind its primary and still be read from, and replica_check_interval,
+// how often replicas are checked.
+func parseDSN(dsn string) (*config, error) {
+	cfg := newConfig()
+
+	if dsn == "" {
+		dsn = defaultDSN
+	}
+
+	u, err := url.Parse(dsn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if u.User != nil {
+		if pass, ok := u.User.Password(); ok {
+			cfg.password = pass
+		}
+	}
+
+	query := u.Query()
+	var db string
+
+	switch u.Scheme {
+	case "redis", "rediss":
+		cfg.addr = u.Host
+		db = u.Path
+
+		if len(db) > 0 && db[0] == '/' {
+			db = db[1:]
+		}
+	case "unix":
+		cfg.network = "unix"
+		cfg.addr = u.Path
+		db = query.Get("db")
+		query.Del("db")
+	default:
+		return nil, fmt.Errorf("kvstore: unsupported scheme %q", u.Scheme)
+	}
+
+	if cfg.addr == "" {
+		return nil, fmt.Errorf("kvstore: missing address in %q", dsn)
+	}
+
+	if db != "" {
+		idb, err := strconv.ParseUint(db, 10, 8)
+
+		if err != nil {
+			return nil, fmt.Errorf("kvstore: invalid db %q", db)
+		}
+
+		cfg.db = uint8(idb)
+	}
+
+	if err := cfg.parseParams(query); err != nil {
+		return nil, err
+	}
+
+	if u.Scheme == "rediss" {
+		if err := cfg.parseTLS(query); err != nil {
+			return nil, err
+		}
+	}
+
+	if u.Scheme != "unix" {
+		if err := cfg.parseReplicas(query); err != nil {
+			return nil, err
+		}
+	}
+
+	for k := range query {
+		return nil, fmt.Errorf("kvstore: unknown parameter %q", k)
+	}
+
+	return cfg, nil
+}
+
+// parseParams reads the pool and timeout parameters from query. Every
+// parameter consumed is removed from query.
+func (cfg *config) parseParams(query url.Values) error {
+	ints := map[string]*int{
+		"max_idle":   &cfg.maxIdle,
+		"max_active": &cfg.maxActive,
+	}
+
+	for k, p := range ints {
+		if v, ok := pop(query, k); ok {
+			n, err := strconv.Atoi(v)
+
+			if err != nil || n < 0 {
+				return fmt.Errorf("kvstore: invalid %s %q", k, v)
+			}
+
+			*p = n
+		}
+	}
+
+	durations := map[string]*time.Duration{
+		"idle_timeout":   &cfg.idleTimeout,
+		"dial_timeout":   &cfg.dialTimeout,
+		"read_timeout":   &cfg.readTimeout,
+		"write_timeout":  &cfg.writeTimeout,
+		"slow_threshold": &cfg.slowThreshold,
+	}
+
+	for k, p := range durations {
+		if v, ok := pop(query, k); ok {
+			d, err := time.ParseDuration(v)
+
+			if err != nil || d < 0 {
+				return fmt.Errorf("kvstore: invalid %s %q", k, v)
+			}
+
+			*p = d
+		}
+	}
+
+	if v, ok := pop(query, "wait"); ok {
+		b, err := strconv.ParseBool(v)
+
+		if err != nil {
+			return fmt.Errorf("kvstore: invalid wait %q", v)
+		}
+
+		cfg.wait = b
+	}
+
+	return nil
+}
+
+// parseTLS builds the TLS configuration from query. Every parameter
+// consumed is removed from query.
+func (cfg *config) parseTLS(query url.Values) error {
+	host, _, err := net.SplitHostPort(cfg.addr)
+
+	if err != nil {
+		host = cfg.addr
+	}
+
+	tc := &tls.Config{ServerName: host}
+
+	if v, ok := pop(query, "tls_server_name"); ok {
+		tc.ServerName = v
+		cfg.tlsServerName = true
+	}
+
+	if v, ok := pop(query, "tls_skip_verify"); ok {
+		b, err := strconv.ParseBool(v)
+
+		if err != nil {
+			return fmt.Errorf("kvstore: invalid tls_skip_verify %q", v)
+		}
+
+		tc.InsecureSkipVerify = b
+	}
+
+	if v, ok := pop(query, "tls_ca"); ok {
+		pem, err := ioutil.ReadFile(v)
+
+		if err != nil {
+			return err
+		}
+
+		tc.RootCAs = x509.NewCertPool()
+
+		if !tc.RootCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("kvstore: no certificates found in %s", v)
+		}
+	}
+
+	cert, certOk := pop(query, "tls_cert")
+	key, keyOk := pop(query, "tls_key")
+
+	if certOk != keyOk {
+		return fmt.Errorf("kvstore: tls_cert and tls_key must be given together")
+	}
+
+	if certOk {
+		pair, err := tls.LoadX509KeyPair(cert, key)
+
+		if err != nil {
+			return err
+		}
+
+		tc.Certificates = []tls.Certificate{pair}
+	}
+
+	cfg.tls = tc
+	return nil
+}
+
+// parseReplicas reads the replica parameters from query. Every parameter
+// consumed is removed from query.
+func (cfg *config) parseReplicas(query url.Values) error {
+	for _, v := range query["replica"] {
+		for _, addr := range strings.Split(v, ",") {
+			if addr = strings.TrimSpace(addr); addr == "" {
+				continue
+			}
+
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				return fmt.Errorf("kvstore: invalid replica %q", addr)
+			}
+
+			cfg.replicas = append(cfg.replicas, addr)
+		}
+	}
+
+	query.Del("replica")
+
+	if v, ok := pop(query, "max_lag"); ok {
+		n, err := strconv.ParseInt(v, 10, 64)
+
+		if err != nil || n < 0 {
+			return fmt.Errorf("kvstore: invalid max_lag %q", v)
+		}
+
+		cfg.maxLag = n
+	}
+
+	if v, ok := pop(query, "replica_check_interval"); ok {
+		d, err := time.ParseDuration(v)
+
+		if err != nil || d <= 0 {
+			return fmt.Errorf("kvstore: invalid replica_check_interval %q", v)
+		}
+
+		cfg.replicaCheck = d
+	}
+
+	return nil
+}
+
+// pop removes key from query and returns its value. It reports false if
+// the key is absent.
+func pop(query url.Values, key string) (string, bool) {
+	v, ok := query[key]
+
+	if !ok {
+		return "", false
+	}
+
+	query.Del(key)
+
+	if len(v) == 0 {
+		return "", true
+	}
+
+	return v[0], true
+}
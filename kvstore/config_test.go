@@ -0,0 +1,83 @@
+package kvstore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/simonz05/util/assert"
+)
+
+func TestParseDSN(t *testing.T) {
+	ast := assert.NewAssert(t)
+
+	cfg, err := parseDSN("")
+	ast.Nil(err)
+	ast.Equal("tcp", cfg.network)
+	ast.Equal("localhost:6379", cfg.addr)
+	ast.Equal(64, cfg.maxIdle)
+	ast.Equal(64, cfg.maxActive)
+	ast.Equal(60*time.Second, cfg.idleTimeout)
+	ast.True(cfg.tls == nil)
+
+	cfg, err = parseDSN("redis://:secret@10.0.0.1:6380/15?max_idle=4&max_active=8&idle_timeout=5m&wait=true&dial_timeout=1s&read_timeout=2s&write_timeout=3s")
+	ast.Nil(err)
+	ast.Equal("10.0.0.1:6380", cfg.addr)
+	ast.Equal("secret", cfg.password)
+	ast.Equal(15, cfg.db)
+	ast.Equal(4, cfg.maxIdle)
+	ast.Equal(8, cfg.maxActive)
+	ast.Equal(5*time.Minute, cfg.idleTimeout)
+	ast.True(cfg.wait)
+	ast.Equal(time.Second, cfg.dialTimeout)
+	ast.Equal(2*time.Second, cfg.readTimeout)
+	ast.Equal(3*time.Second, cfg.writeTimeout)
+
+	cfg, err = parseDSN("unix://:pw@/var/run/redis.sock?db=2")
+	ast.Nil(err)
+	ast.Equal("unix", cfg.network)
+	ast.Equal("/var/run/redis.sock", cfg.addr)
+	ast.Equal("pw", cfg.password)
+	ast.Equal(2, cfg.db)
+
+	cfg, err = parseDSN("rediss://cache.example.com:6380/0?tls_skip_verify=true")
+	ast.Nil(err)
+	ast.NotNil(cfg.tls)
+	ast.Equal("cache.example.com", cfg.tls.ServerName)
+	ast.True(cfg.tls.InsecureSkipVerify)
+
+	cfg, err = parseDSN("rediss://10.0.0.1:6380/0?tls_server_name=cache.internal")
+	ast.Nil(err)
+	ast.Equal("cache.internal", cfg.tls.ServerName)
+
+	cfg, err = parseDSN("redis://10.0.0.1:6379/0?replica=10.0.0.2:6379,10.0.0.3:6379&replica=10.0.0.4:6379&max_lag=1048576&replica_check_interval=1s")
+	ast.Nil(err)
+	ast.Equal([]string{"10.0.0.2:6379", "10.0.0.3:6379", "10.0.0.4:6379"}, cfg.replicas)
+	ast.Equal(int64(1048576), cfg.maxLag)
+	ast.Equal(time.Second, cfg.replicaCheck)
+}
+
+func TestParseDSNErrors(t *testing.T) {
+	ast := assert.NewAssert(t)
+
+	bad := []string{
+		"redis://localhost:6379/x",
+		"redis://localhost:6379/256",
+		"redis://localhost:6379/0?max_idle=-1",
+		"redis://localhost:6379/0?idle_timeout=forever",
+		"redis://localhost:6379/0?wait=maybe",
+		"redis://localhost:6379/0?unknown=1",
+		"redis://localhost:6379/0?tls_ca=ca.pem",
+		"redis://localhost:6379/0?db=1",
+		"rediss://localhost:6379/0?tls_cert=cert.pem",
+		"memcache://localhost:11211",
+		"unix://",
+		"redis://localhost:6379/0?replica=10.0.0.2",
+		"redis://localhost:6379/0?replica_check_interval=0s",
+		"unix://:pw@/var/run/redis.sock?replica=10.0.0.2:6379",
+	}
+
+	for _, dsn := range bad {
+		_, err := parseDSN(dsn)
+		ast.NotNil(err, "expected error for", dsn)
+	}
+}
@@ -74,3 +74,86 @@ func Bytes(reply interface{}, err error) ([][]byte, error) {
 	}
 	return nil, fmt.Errorf("kvstore: unexpected type for Bytes, got type %T", reply)
 }
+
+// ScanReply is a helper that converts the reply of SCAN, SSCAN, HSCAN or
+// ZSCAN to the next cursor and the returned elements. If err is not equal
+// to nil, then ScanReply returns 0, nil, err.
+func ScanReply(reply interface{}, err error) (int64, [][]byte, error) {
+	if err != nil {
+		return 0, nil, err
+	}
+	switch reply := reply.(type) {
+	case []interface{}:
+		if len(reply) != 2 {
+			return 0, nil, fmt.Errorf("kvstore: unexpected length for ScanReply, got %d", len(reply))
+		}
+
+		p, ok := reply[0].([]byte)
+		if !ok {
+			return 0, nil, fmt.Errorf("kvstore: unexpected cursor type for ScanReply, got type %T", reply[0])
+		}
+
+		cursor, err := strconv.ParseInt(string(p), 10, 64)
+
+		if err != nil {
+			return 0, nil, err
+		}
+
+		items, err := Bytes(reply[1], nil)
+
+		if err != nil {
+			return 0, nil, err
+		}
+
+		return cursor, items, nil
+	case nil:
+		return 0, nil, redis.ErrNil
+	case redis.Error:
+		return 0, nil, reply
+	}
+	return 0, nil, fmt.Errorf("kvstore: unexpected type for ScanReply, got type %T", reply)
+}
+
+// StreamEntries is a helper that converts the entries of an XRANGE,
+// XREADGROUP or XAUTOCLAIM reply. Entries deleted from the stream while
+// pending have nil Fields. If err is not equal to nil, then StreamEntries
+// returns nil, err.
+func StreamEntries(reply interface{}, err error) ([]*StreamEntry, error) {
+	values, err := redis.Values(reply, err)
+
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*StreamEntry, 0, len(values))
+
+	for _, v := range values {
+		pair, err := redis.Values(v, nil)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("kvstore: unexpected length for StreamEntries, got %d", len(pair))
+		}
+
+		id, err := redis.String(pair[0], nil)
+
+		if err != nil {
+			return nil, err
+		}
+
+		e := &StreamEntry{ID: id}
+
+		if pair[1] != nil {
+			if e.Fields, err = redis.StringMap(pair[1], nil); err != nil {
+				return nil, err
+			}
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
@@ -1,107 +1,148 @@
 package kvstore
 
 import (
-	"net/url"
-	"strconv"
+	"crypto/tls"
+	"net"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
 )
 
 type KVStore struct {
-	cfg  *config
-	Pool *redis.Pool
+	cfg       *config
+	Pool      *redis.Pool
+	namespace string
+	replicas  *replicaSet
+	inst      *instruments
 }
 
-type config struct {
-	password string
-	db       uint8
-	addr     string
-}
-
-func parseDSN(dsn string) (*config, error) {
-	cfg := new(config)
-
-	if dsn == "" {
-		dsn = "redis://:@localhost:6379/0"
-	}
+// Open returns a KVStore for the given data source name. See parseDSN for
+// the accepted forms. An empty name connects to redis on localhost.
+func Open(dataSourceName string) (*KVStore, error) {
+	var err error
 
-	u, err := url.Parse(dsn)
+	kvstore := new(KVStore)
+	kvstore.cfg, err = parseDSN(dataSourceName)
 
 	if err != nil {
 		return nil, err
 	}
 
-	if pass, ok := u.User.Password(); ok {
-		cfg.password = pass
-	}
-
-	db := u.Path
-
-	if len(db) > 1 && db[0] == '/' {
-		db = db[1:]
-	}
-
-	idb, err := strconv.ParseUint(db, 10, 8)
+	kvstore.inst = &instruments{slow: kvstore.cfg.slowThreshold}
+	kvstore.Pool = kvstore.newPool(kvstore.cfg.addr)
 
-	if err != nil {
-		idb = 0
+	if len(kvstore.cfg.replicas) > 0 {
+		kvstore.replicas = newReplicaSet(kvstore)
 	}
 
-	cfg.db = uint8(idb)
-	cfg.addr = u.Host
-	return cfg, nil
+	return kvstore, nil
 }
 
-func Open(dataSourceName string) (*KVStore, error) {
-	var err error
-
-	kvstore := new(KVStore)
-	kvstore.cfg, err = parseDSN(dataSourceName)
-
-	if err != nil {
-		return nil, err
-	}
-
-	kvstore.Pool = &redis.Pool{
-		MaxIdle:     64,
-		MaxActive:   64,
-		IdleTimeout: 60 * time.Second,
+func (kvstore *KVStore) newPool(addr string) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     kvstore.cfg.maxIdle,
+		MaxActive:   kvstore.cfg.maxActive,
+		IdleTimeout: kvstore.cfg.idleTimeout,
+		Wait:        kvstore.cfg.wait,
 		Dial: func() (redis.Conn, error) {
-			return kvstore.dial()
+			conn, err := kvstore.dialAddr(addr, kvstore.cfg.readTimeout)
+			kvstore.inst.dialed(err)
+			return conn, err
 		},
 		TestOnBorrow: func(c redis.Conn, t time.Time) error {
 			_, err := c.Do("PING")
 			return err
 		},
 	}
-	return kvstore, nil
 }
 
+// Get returns a connection to the primary from the pool, which adds the
+// namespace of the view to keys if kvstore was returned by Namespace.
 func (kvstore *KVStore) Get() redis.Conn {
-	return kvstore.Pool.Get()
+	return kvstore.wrap(kvstore.getConn(kvstore.Pool))
 }
 
+// GetReadOnly returns a connection for reads. It goes to one of the
+// healthy read replicas in turn, or to the primary if no replica is
+// configured or qualifies. Replicas lag behind the primary, so a read may
+// not see a write which just happened.
+func (kvstore *KVStore) GetReadOnly() redis.Conn {
+	if kvstore.replicas != nil {
+		if pool := kvstore.replicas.pick(); pool != nil {
+			return kvstore.wrap(kvstore.getConn(pool))
+		}
+	}
+
+	return kvstore.Get()
+}
+
+func (kvstore *KVStore) wrap(conn redis.Conn) redis.Conn {
+	if kvstore.namespace != "" {
+		return &namespaceConn{Conn: conn, prefix: kvstore.namespace}
+	}
+
+	return conn
+}
+
+// Close closes the connection pools and stops checking replicas.
 func (kvstore *KVStore) Close() error {
+	if kvstore.replicas != nil {
+		kvstore.replicas.close()
+	}
+
 	return kvstore.Pool.Close()
 }
 
-func (kvstore *KVStore) dial() (redis.Conn, error) {
-	conn, err := redis.Dial("tcp", kvstore.cfg.addr)
+// dialReadTimeout opens a new connection to the primary which is not part
+// of the pool, overriding the configured read timeout.
+func (kvstore *KVStore) dialReadTimeout(readTimeout time.Duration) (redis.Conn, error) {
+	return kvstore.dialAddr(kvstore.cfg.addr, readTimeout)
+}
+
+// dialAddr opens a new connection to the server at addr, which is the
+// primary or a replica.
+func (kvstore *KVStore) dialAddr(addr string, readTimeout time.Duration) (redis.Conn, error) {
+	cfg := kvstore.cfg
+	netConn, err := net.DialTimeout(cfg.network, addr, cfg.dialTimeout)
 
 	if err != nil {
 		return nil, err
 	}
 
-	if kvstore.cfg.password != "" {
-		if _, err := conn.Do("AUTH", kvstore.cfg.password); err != nil {
+	if cfg.tls != nil {
+		tc := cfg.tls
+
+		if addr != cfg.addr && !cfg.tlsServerName {
+			tc = tc.Clone()
+			tc.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+
+		tlsConn := tls.Client(netConn, tc)
+
+		if cfg.dialTimeout > 0 {
+			tlsConn.SetDeadline(time.Now().Add(cfg.dialTimeout))
+		}
+
+		if err := tlsConn.Handshake(); err != nil {
+			netConn.Close()
+			return nil, err
+		}
+
+		tlsConn.SetDeadline(time.Time{})
+		netConn = tlsConn
+	}
+
+	conn := redis.NewConn(netConn, readTimeout, cfg.writeTimeout)
+
+	if cfg.password != "" {
+		if _, err := conn.Do("AUTH", cfg.password); err != nil {
 			conn.Close()
 			return nil, err
 		}
 	}
 
-	if kvstore.cfg.db != 0 {
-		if _, err := conn.Do("SELECT", kvstore.cfg.db); err != nil {
+	if cfg.db != 0 {
+		if _, err := conn.Do("SELECT", cfg.db); err != nil {
 			conn.Close()
 			return nil, err
 		}
@@ -0,0 +1,1507 @@
+package kvtest
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type command struct {
+	fn func(c *client, args []string)
+	// arity is the exact number of arguments including the command
+	// name, or the negated minimum if the command is variadic.
+	arity int
+	// immediate commands run even inside MULTI.
+	immediate bool
+	// pubsub commands are allowed in subscriber mode.
+	pubsub bool
+}
+
+var commands map[string]*command
+
+func init() {
+	commands = map[string]*command{
+		// connection
+		"PING":   {fn: cmdPing, arity: -1, pubsub: true},
+		"ECHO":   {fn: cmdEcho, arity: 2},
+		"AUTH":   {fn: cmdAuth, arity: -2},
+		"SELECT": {fn: cmdSelect, arity: 2},
+		"INFO":   {fn: cmdInfo, arity: -1},
+		"CLIENT": {fn: cmdClient, arity: -2},
+		"TIME":   {fn: cmdTime, arity: 1},
+
+		// keys
+		"DEL":      {fn: cmdDel, arity: -2},
+		"EXISTS":   {fn: cmdExists, arity: -2},
+		"EXPIRE":   {fn: cmdExpire, arity: 3},
+		"PEXPIRE":  {fn: cmdExpire, arity: 3},
+		"TTL":      {fn: cmdTTL, arity: 2},
+		"PTTL":     {fn: cmdTTL, arity: 2},
+		"PERSIST":  {fn: cmdPersist, arity: 2},
+		"TYPE":     {fn: cmdType, arity: 2},
+		"DBSIZE":   {fn: cmdDBSize, arity: 1},
+		"FLUSHDB":  {fn: cmdFlushDB, arity: -1},
+		"FLUSHALL": {fn: cmdFlushAll, arity: -1},
+		"KEYS":     {fn: cmdKeys, arity: 2},
+		"SCAN":     {fn: cmdScan, arity: -2},
+		"SSCAN":    {fn: cmdScan, arity: -3},
+		"HSCAN":    {fn: cmdScan, arity: -3},
+		"ZSCAN":    {fn: cmdScan, arity: -3},
+
+		// strings
+		"GET":    {fn: cmdGet, arity: 2},
+		"SET":    {fn: cmdSet, arity: -3},
+		"SETEX":  {fn: cmdSetEx, arity: 4},
+		"PSETEX": {fn: cmdSetEx, arity: 4},
+		"SETNX":  {fn: cmdSetNX, arity: 3},
+		"MGET":   {fn: cmdMGet, arity: -2},
+		"MSET":   {fn: cmdMSet, arity: -3},
+		"INCR":   {fn: cmdIncr, arity: 2},
+		"INCRBY": {fn: cmdIncr, arity: 3},
+		"DECR":   {fn: cmdIncr, arity: 2},
+		"DECRBY": {fn: cmdIncr, arity: 3},
+
+		// hashes
+		"HSET":    {fn: cmdHSet, arity: -4},
+		"HMSET":   {fn: cmdHSet, arity: -4},
+		"HGET":    {fn: cmdHGet, arity: 3},
+		"HMGET":   {fn: cmdHMGet, arity: -3},
+		"HDEL":    {fn: cmdHDel, arity: -3},
+		"HEXISTS": {fn: cmdHExists, arity: 3},
+		"HLEN":    {fn: cmdHLen, arity: 2},
+		"HGETALL": {fn: cmdHGetAll, arity: 2},
+		"HKEYS":   {fn: cmdHGetAll, arity: 2},
+		"HVALS":   {fn: cmdHGetAll, arity: 2},
+		"HINCRBY": {fn: cmdHIncrBy, arity: 4},
+
+		// lists
+		"LPUSH":      {fn: cmdPush, arity: -3},
+		"RPUSH":      {fn: cmdPush, arity: -3},
+		"LPOP":       {fn: cmdPop, arity: 2},
+		"RPOP":       {fn: cmdPop, arity: 2},
+		"LLEN":       {fn: cmdLLen, arity: 2},
+		"LINDEX":     {fn: cmdLIndex, arity: 3},
+		"LRANGE":     {fn: cmdLRange, arity: 4},
+		"LREM":       {fn: cmdLRem, arity: 4},
+		"RPOPLPUSH":  {fn: cmdRPopLPush, arity: 3},
+		"BRPOPLPUSH": {fn: cmdBRPopLPush, arity: 4},
+
+		// sets
+		"SADD":      {fn: cmdSAdd, arity: -3},
+		"SREM":      {fn: cmdSRem, arity: -3},
+		"SCARD":     {fn: cmdSCard, arity: 2},
+		"SISMEMBER": {fn: cmdSIsMember, arity: 3},
+		"SMEMBERS":  {fn: cmdSMembers, arity: 2},
+
+		// sorted sets
+		"ZADD":             {fn: cmdZAdd, arity: -4},
+		"ZINCRBY":          {fn: cmdZIncrBy, arity: 4},
+		"ZREM":             {fn: cmdZRem, arity: -3},
+		"ZCARD":            {fn: cmdZCard, arity: 2},
+		"ZSCORE":           {fn: cmdZScore, arity: 3},
+		"ZRANGE":           {fn: cmdZRange, arity: -4},
+		"ZREVRANGE":        {fn: cmdZRange, arity: -4},
+		"ZRANGEBYSCORE":    {fn: cmdZRangeByScore, arity: -4},
+		"ZREMRANGEBYSCORE": {fn: cmdZRemRangeByScore, arity: 4},
+
+		// streams
+		"XADD":       {fn: cmdXAdd, arity: -5},
+		"XLEN":       {fn: cmdXLen, arity: 2},
+		"XDEL":       {fn: cmdXDel, arity: -3},
+		"XRANGE":     {fn: cmdXRange, arity: -4},
+		"XGROUP":     {fn: cmdXGroup, arity: -2},
+		"XREADGROUP": {fn: cmdXReadGroup, arity: -7},
+		"XACK":       {fn: cmdXAck, arity: -4},
+		"XPENDING":   {fn: cmdXPending, arity: -3},
+		"XAUTOCLAIM": {fn: cmdXAutoClaim, arity: -6},
+
+		// scripting
+		"EVAL":    {fn: cmdEval, arity: -3},
+		"EVALSHA": {fn: cmdEval, arity: -3},
+		"SCRIPT":  {fn: cmdScript, arity: -2},
+
+		// pub/sub
+		"SUBSCRIBE":    {fn: cmdSubscribe, arity: -2, pubsub: true},
+		"PSUBSCRIBE":   {fn: cmdSubscribe, arity: -2, pubsub: true},
+		"UNSUBSCRIBE":  {fn: cmdUnsubscribe, arity: -1, pubsub: true},
+		"PUNSUBSCRIBE": {fn: cmdUnsubscribe, arity: -1, pubsub: true},
+		"PUBLISH":      {fn: cmdPublish, arity: 3},
+
+		// transactions
+		"MULTI":   {fn: cmdMulti, arity: 1, immediate: true},
+		"EXEC":    {fn: cmdExec, arity: 1, immediate: true},
+		"DISCARD": {fn: cmdDiscard, arity: 1, immediate: true},
+		"WATCH":   {fn: cmdWatch, arity: -2, immediate: true},
+		"UNWATCH": {fn: cmdUnwatch, arity: 1},
+	}
+}
+
+func cmdPing(c *client, args []string) {
+	if c.subscribed() {
+		c.w.array(2)
+		c.w.bulk("pong")
+
+		if len(args) > 1 {
+			c.w.bulk(args[1])
+		} else {
+			c.w.bulk("")
+		}
+
+		return
+	}
+
+	if len(args) > 1 {
+		c.w.bulk(args[1])
+	} else {
+		c.w.status("PONG")
+	}
+}
+
+func cmdEcho(c *client, args []string) {
+	c.w.bulk(args[1])
+}
+
+// cmdTime reports the server clock, which moves with Advance.
+func cmdTime(c *client, args []string) {
+	now := c.now()
+	c.w.bulks([]string{
+		strconv.FormatInt(now.Unix(), 10),
+		strconv.Itoa(now.Nanosecond() / 1000),
+	})
+}
+
+// cmdInfo reports the replication section only.
+func cmdInfo(c *client, args []string) {
+	var b strings.Builder
+	b.WriteString("# Replication\r\n")
+
+	if s := c.srv; s.primary == "" {
+		b.WriteString("role:master\r\nconnected_slaves:0\r\n")
+		fmt.Fprintf(&b, "master_repl_offset:%d\r\n", s.replOffset)
+	} else {
+		host, port, _ := net.SplitHostPort(s.primary)
+		link := "down"
+
+		if s.linkUp {
+			link = "up"
+		}
+
+		fmt.Fprintf(&b, "role:slave\r\nmaster_host:%s\r\nmaster_port:%s\r\n", host, port)
+		fmt.Fprintf(&b, "master_link_status:%s\r\nmaster_sync_in_progress:0\r\n", link)
+		fmt.Fprintf(&b, "slave_repl_offset:%d\r\nmaster_repl_offset:%d\r\n", s.replOffset, s.replOffset)
+	}
+
+	c.w.bulk(b.String())
+}
+
+func cmdAuth(c *client, args []string) {
+	if c.srv.password == "" {
+		c.w.error("ERR Client sent AUTH, but no password is set")
+		return
+	}
+
+	if args[len(args)-1] != c.srv.password {
+		c.authed = false
+		c.w.error("WRONGPASS invalid username-password pair")
+		return
+	}
+
+	c.authed = true
+	c.w.ok()
+}
+
+func cmdSelect(c *client, args []string) {
+	n, err := strconv.Atoi(args[1])
+
+	if err != nil {
+		c.w.error("ERR invalid DB index")
+		return
+	}
+
+	if n < 0 || n > 15 {
+		c.w.error("ERR DB index is out of range")
+		return
+	}
+
+	c.dbIndex = n
+	c.w.ok()
+}
+
+func cmdDel(c *client, args []string) {
+	var n int64
+
+	for _, key := range args[1:] {
+		if c.db().del(key, c.now()) {
+			c.touch(key)
+			n++
+		}
+	}
+
+	c.w.int(n)
+}
+
+func cmdExists(c *client, args []string) {
+	var n int64
+
+	for _, key := range args[1:] {
+		if c.db().get(key, c.now()) != nil {
+			n++
+		}
+	}
+
+	c.w.int(n)
+}
+
+func cmdExpire(c *client, args []string) {
+	n, err := strconv.ParseInt(args[2], 10, 64)
+
+	if err != nil {
+		c.w.error(errNotInt)
+		return
+	}
+
+	d := time.Duration(n) * time.Second
+
+	if strings.EqualFold(args[0], "PEXPIRE") {
+		d = time.Duration(n) * time.Millisecond
+	}
+
+	it := c.db().get(args[1], c.now())
+
+	if it == nil {
+		c.w.int(0)
+		return
+	}
+
+	if d <= 0 {
+		c.db().del(args[1], c.now())
+	} else {
+		it.expireAt = c.now().Add(d)
+	}
+
+	c.touch(args[1])
+	c.w.int(1)
+}
+
+func cmdTTL(c *client, args []string) {
+	it := c.db().get(args[1], c.now())
+
+	switch {
+	case it == nil:
+		c.w.int(-2)
+	case it.expireAt.IsZero():
+		c.w.int(-1)
+	default:
+		d := it.expireAt.Sub(c.now())
+
+		if strings.EqualFold(args[0], "PTTL") {
+			c.w.int(int64(d / time.Millisecond))
+		} else {
+			c.w.int(int64((d + time.Second/2) / time.Second))
+		}
+	}
+}
+
+func cmdPersist(c *client, args []string) {
+	it := c.db().get(args[1], c.now())
+
+	if it == nil || it.expireAt.IsZero() {
+		c.w.int(0)
+		return
+	}
+
+	it.expireAt = time.Time{}
+	c.touch(args[1])
+	c.w.int(1)
+}
+
+func cmdType(c *client, args []string) {
+	it := c.db().get(args[1], c.now())
+
+	if it == nil {
+		c.w.status("none")
+		return
+	}
+
+	c.w.status(typeName(it.value))
+}
+
+func cmdDBSize(c *client, args []string) {
+	c.w.int(int64(len(c.db().keys(c.now()))))
+}
+
+func cmdFlushDB(c *client, args []string) {
+	c.db().flush()
+	c.srv.invalidate(c, nil)
+	c.w.ok()
+}
+
+func cmdFlushAll(c *client, args []string) {
+	for _, d := range c.srv.dbs {
+		d.flush()
+	}
+
+	c.srv.invalidate(c, nil)
+	c.w.ok()
+}
+
+func cmdGet(c *client, args []string) {
+	s, exists, ok := c.stringAt(args[1])
+
+	if !ok {
+		return
+	}
+
+	if !exists {
+		c.w.null()
+		return
+	}
+
+	c.w.bulk(s)
+}
+
+// setString stores value at key, replacing any previous value and ttl. A
+// zero ttl means the key does not expire.
+func (c *client) setString(key, value string, ttl time.Duration) {
+	it := &item{value: value}
+
+	if ttl > 0 {
+		it.expireAt = c.now().Add(ttl)
+	}
+
+	c.db().items[key] = it
+	c.touch(key)
+}
+
+func cmdSet(c *client, args []string) {
+	var (
+		ttl          time.Duration
+		nx, xx, keep bool
+	)
+
+	for i := 3; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "KEEPTTL":
+			keep = true
+		case "EX", "PX":
+			if i+1 >= len(args) {
+				c.w.error(errSyntax)
+				return
+			}
+
+			n, err := strconv.ParseInt(args[i+1], 10, 64)
+
+			if err != nil {
+				c.w.error(errNotInt)
+				return
+			}
+
+			if n <= 0 {
+				c.w.error("ERR invalid expire time in 'set' command")
+				return
+			}
+
+			if strings.EqualFold(args[i], "EX") {
+				ttl = time.Duration(n) * time.Second
+			} else {
+				ttl = time.Duration(n) * time.Millisecond
+			}
+			i++
+		default:
+			c.w.error(errSyntax)
+			return
+		}
+	}
+
+	if nx && xx {
+		c.w.error(errSyntax)
+		return
+	}
+
+	it := c.db().get(args[1], c.now())
+
+	if (nx && it != nil) || (xx && it == nil) {
+		c.w.null()
+		return
+	}
+
+	if keep && it != nil && ttl == 0 && !it.expireAt.IsZero() {
+		ttl = it.expireAt.Sub(c.now())
+	}
+
+	c.setString(args[1], args[2], ttl)
+	c.w.ok()
+}
+
+func cmdSetEx(c *client, args []string) {
+	n, err := strconv.ParseInt(args[2], 10, 64)
+
+	if err != nil {
+		c.w.error(errNotInt)
+		return
+	}
+
+	if n <= 0 {
+		c.w.error("ERR invalid expire time in 'setex' command")
+		return
+	}
+
+	ttl := time.Duration(n) * time.Second
+
+	if strings.EqualFold(args[0], "PSETEX") {
+		ttl = time.Duration(n) * time.Millisecond
+	}
+
+	c.setString(args[1], args[3], ttl)
+	c.w.ok()
+}
+
+func cmdSetNX(c *client, args []string) {
+	if c.db().get(args[1], c.now()) != nil {
+		c.w.int(0)
+		return
+	}
+
+	c.setString(args[1], args[2], 0)
+	c.w.int(1)
+}
+
+func cmdMGet(c *client, args []string) {
+	c.w.array(len(args) - 1)
+
+	for _, key := range args[1:] {
+		if it := c.db().get(key, c.now()); it != nil {
+			if s, ok := it.value.(string); ok {
+				c.w.bulk(s)
+				continue
+			}
+		}
+
+		c.w.null()
+	}
+}
+
+func cmdMSet(c *client, args []string) {
+	if len(args)%2 != 1 {
+		c.w.error("ERR wrong number of arguments for 'mset' command")
+		return
+	}
+
+	for i := 1; i < len(args); i += 2 {
+		c.setString(args[i], args[i+1], 0)
+	}
+
+	c.w.ok()
+}
+
+func cmdIncr(c *client, args []string) {
+	delta := int64(1)
+
+	if len(args) == 3 {
+		var err error
+		delta, err = strconv.ParseInt(args[2], 10, 64)
+
+		if err != nil {
+			c.w.error(errNotInt)
+			return
+		}
+	}
+
+	if strings.HasPrefix(strings.ToUpper(args[0]), "DECR") {
+		delta = -delta
+	}
+
+	s, exists, ok := c.stringAt(args[1])
+
+	if !ok {
+		return
+	}
+
+	var n int64
+
+	if exists {
+		var err error
+		n, err = strconv.ParseInt(s, 10, 64)
+
+		if err != nil {
+			c.w.error(errNotInt)
+			return
+		}
+	}
+
+	n += delta
+	it := c.db().get(args[1], c.now())
+
+	if it != nil {
+		it.value = strconv.FormatInt(n, 10)
+		c.touch(args[1])
+	} else {
+		c.setString(args[1], strconv.FormatInt(n, 10), 0)
+	}
+
+	c.w.int(n)
+}
+
+func cmdHSet(c *client, args []string) {
+	if len(args)%2 != 0 {
+		c.w.error("ERR wrong number of arguments for '" + strings.ToLower(args[0]) + "' command")
+		return
+	}
+
+	h, ok := c.hashAt(args[1], true)
+
+	if !ok {
+		return
+	}
+
+	var n int64
+
+	for i := 2; i < len(args); i += 2 {
+		if _, exists := h[args[i]]; !exists {
+			n++
+		}
+
+		h[args[i]] = args[i+1]
+	}
+
+	c.touch(args[1])
+
+	if strings.EqualFold(args[0], "HMSET") {
+		c.w.ok()
+	} else {
+		c.w.int(n)
+	}
+}
+
+func cmdHGet(c *client, args []string) {
+	h, ok := c.hashAt(args[1], false)
+
+	if !ok {
+		return
+	}
+
+	v, exists := h[args[2]]
+
+	if !exists {
+		c.w.null()
+		return
+	}
+
+	c.w.bulk(v)
+}
+
+func cmdHMGet(c *client, args []string) {
+	h, ok := c.hashAt(args[1], false)
+
+	if !ok {
+		return
+	}
+
+	c.w.array(len(args) - 2)
+
+	for _, field := range args[2:] {
+		if v, exists := h[field]; exists {
+			c.w.bulk(v)
+		} else {
+			c.w.null()
+		}
+	}
+}
+
+func cmdHDel(c *client, args []string) {
+	h, ok := c.hashAt(args[1], false)
+
+	if !ok {
+		return
+	}
+
+	var n int64
+
+	for _, field := range args[2:] {
+		if _, exists := h[field]; exists {
+			delete(h, field)
+			n++
+		}
+	}
+
+	if n > 0 {
+		c.touch(args[1])
+		c.db().reap(args[1])
+	}
+
+	c.w.int(n)
+}
+
+func cmdHExists(c *client, args []string) {
+	h, ok := c.hashAt(args[1], false)
+
+	if !ok {
+		return
+	}
+
+	_, exists := h[args[2]]
+	c.w.bool(exists)
+}
+
+func cmdHLen(c *client, args []string) {
+	h, ok := c.hashAt(args[1], false)
+
+	if !ok {
+		return
+	}
+
+	c.w.int(int64(len(h)))
+}
+
+func cmdHGetAll(c *client, args []string) {
+	h, ok := c.hashAt(args[1], false)
+
+	if !ok {
+		return
+	}
+
+	fields := make([]string, 0, len(h))
+
+	for f := range h {
+		fields = append(fields, f)
+	}
+
+	sort.Strings(fields)
+	var reply []string
+
+	for _, f := range fields {
+		switch strings.ToUpper(args[0]) {
+		case "HKEYS":
+			reply = append(reply, f)
+		case "HVALS":
+			reply = append(reply, h[f])
+		default:
+			reply = append(reply, f, h[f])
+		}
+	}
+
+	c.w.bulks(reply)
+}
+
+func cmdHIncrBy(c *client, args []string) {
+	delta, err := strconv.ParseInt(args[3], 10, 64)
+
+	if err != nil {
+		c.w.error(errNotInt)
+		return
+	}
+
+	h, ok := c.hashAt(args[1], false)
+
+	if !ok {
+		return
+	}
+
+	var n int64
+
+	if v, exists := h[args[2]]; exists {
+		n, err = strconv.ParseInt(v, 10, 64)
+
+		if err != nil {
+			c.w.error("ERR hash value is not an integer")
+			return
+		}
+	}
+
+	if h == nil {
+		h, _ = c.hashAt(args[1], true)
+	}
+
+	n += delta
+	h[args[2]] = strconv.FormatInt(n, 10)
+	c.touch(args[1])
+	c.w.int(n)
+}
+
+func cmdPush(c *client, args []string) {
+	l, ok := c.listAt(args[1], true)
+
+	if !ok {
+		return
+	}
+
+	for _, v := range args[2:] {
+		if strings.EqualFold(args[0], "LPUSH") {
+			*l = append(list{v}, *l...)
+		} else {
+			*l = append(*l, v)
+		}
+	}
+
+	c.touch(args[1])
+	c.w.int(int64(len(*l)))
+}
+
+func cmdPop(c *client, args []string) {
+	l, ok := c.listAt(args[1], false)
+
+	if !ok {
+		return
+	}
+
+	if l == nil || len(*l) == 0 {
+		c.w.null()
+		return
+	}
+
+	var v string
+
+	if strings.EqualFold(args[0], "LPOP") {
+		v = (*l)[0]
+		*l = (*l)[1:]
+	} else {
+		v = (*l)[len(*l)-1]
+		*l = (*l)[:len(*l)-1]
+	}
+
+	c.touch(args[1])
+	c.db().reap(args[1])
+	c.w.bulk(v)
+}
+
+func cmdLLen(c *client, args []string) {
+	l, ok := c.listAt(args[1], false)
+
+	if !ok {
+		return
+	}
+
+	if l == nil {
+		c.w.int(0)
+		return
+	}
+
+	c.w.int(int64(len(*l)))
+}
+
+func cmdLIndex(c *client, args []string) {
+	i, err := strconv.Atoi(args[2])
+
+	if err != nil {
+		c.w.error(errNotInt)
+		return
+	}
+
+	l, ok := c.listAt(args[1], false)
+
+	if !ok {
+		return
+	}
+
+	if l == nil {
+		c.w.null()
+		return
+	}
+
+	if i < 0 {
+		i += len(*l)
+	}
+
+	if i < 0 || i >= len(*l) {
+		c.w.null()
+		return
+	}
+
+	c.w.bulk((*l)[i])
+}
+
+func cmdLRange(c *client, args []string) {
+	start, err1 := strconv.Atoi(args[2])
+	stop, err2 := strconv.Atoi(args[3])
+
+	if err1 != nil || err2 != nil {
+		c.w.error(errNotInt)
+		return
+	}
+
+	l, ok := c.listAt(args[1], false)
+
+	if !ok {
+		return
+	}
+
+	if l == nil {
+		c.w.array(0)
+		return
+	}
+
+	lo, hi := span(start, stop, len(*l))
+	c.w.bulks((*l)[lo:hi])
+}
+
+func cmdLRem(c *client, args []string) {
+	count, err := strconv.Atoi(args[2])
+
+	if err != nil {
+		c.w.error(errNotInt)
+		return
+	}
+
+	l, ok := c.listAt(args[1], false)
+
+	if !ok {
+		return
+	}
+
+	if l == nil {
+		c.w.int(0)
+		return
+	}
+
+	limit := count
+
+	if limit < 0 {
+		limit = -limit
+	}
+
+	removed := 0
+	keep := make([]bool, len(*l))
+
+	for i := range *l {
+		j := i
+
+		if count < 0 {
+			j = len(*l) - 1 - i
+		}
+
+		keep[j] = true
+
+		if (*l)[j] == args[3] && (limit == 0 || removed < limit) {
+			keep[j] = false
+			removed++
+		}
+	}
+
+	out := make(list, 0, len(*l)-removed)
+
+	for i, v := range *l {
+		if keep[i] {
+			out = append(out, v)
+		}
+	}
+
+	*l = out
+
+	if removed > 0 {
+		c.touch(args[1])
+		c.db().reap(args[1])
+	}
+
+	c.w.int(int64(removed))
+}
+
+func cmdRPopLPush(c *client, args []string) {
+	src, ok := c.listAt(args[1], false)
+
+	if !ok {
+		return
+	}
+
+	if _, ok := c.listAt(args[2], false); !ok {
+		return
+	}
+
+	if src == nil || len(*src) == 0 {
+		c.w.null()
+		return
+	}
+
+	v := (*src)[len(*src)-1]
+	*src = (*src)[:len(*src)-1]
+	c.touch(args[1])
+	c.db().reap(args[1])
+
+	dst, _ := c.listAt(args[2], true)
+	*dst = append(list{v}, *dst...)
+	c.touch(args[2])
+	c.w.bulk(v)
+}
+
+// cmdBRPopLPush is RPOPLPUSH which waits for the source list to be
+// non-empty.
+func cmdBRPopLPush(c *client, args []string) {
+	timeout, ok := parseTimeout(c, args[3], time.Second)
+
+	if !ok {
+		return
+	}
+
+	c.block(timeout, func() bool {
+		it := c.db().get(args[1], c.now())
+
+		if it == nil {
+			return false
+		}
+
+		l, isList := it.value.(*list)
+		return !isList || len(*l) > 0
+	})
+
+	cmdRPopLPush(c, args[:3])
+}
+
+func cmdSAdd(c *client, args []string) {
+	s, ok := c.setAt(args[1], true)
+
+	if !ok {
+		return
+	}
+
+	var n int64
+
+	for _, m := range args[2:] {
+		if _, exists := s[m]; !exists {
+			s[m] = struct{}{}
+			n++
+		}
+	}
+
+	c.touch(args[1])
+	c.w.int(n)
+}
+
+func cmdSRem(c *client, args []string) {
+	s, ok := c.setAt(args[1], false)
+
+	if !ok {
+		return
+	}
+
+	var n int64
+
+	for _, m := range args[2:] {
+		if _, exists := s[m]; exists {
+			delete(s, m)
+			n++
+		}
+	}
+
+	if n > 0 {
+		c.touch(args[1])
+		c.db().reap(args[1])
+	}
+
+	c.w.int(n)
+}
+
+func cmdSCard(c *client, args []string) {
+	s, ok := c.setAt(args[1], false)
+
+	if ok {
+		c.w.int(int64(len(s)))
+	}
+}
+
+func cmdSIsMember(c *client, args []string) {
+	s, ok := c.setAt(args[1], false)
+
+	if ok {
+		_, exists := s[args[2]]
+		c.w.bool(exists)
+	}
+}
+
+func cmdSMembers(c *client, args []string) {
+	s, ok := c.setAt(args[1], false)
+
+	if !ok {
+		return
+	}
+
+	members := make([]string, 0, len(s))
+
+	for m := range s {
+		members = append(members, m)
+	}
+
+	sort.Strings(members)
+	c.w.bulks(members)
+}
+
+func cmdZAdd(c *client, args []string) {
+	var nx, xx, ch bool
+	i := 2
+
+flags:
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "CH":
+			ch = true
+		default:
+			break flags
+		}
+	}
+
+	pairs := args[i:]
+
+	if len(pairs) == 0 || len(pairs)%2 != 0 || (nx && xx) {
+		c.w.error(errSyntax)
+		return
+	}
+
+	scores := make([]float64, len(pairs)/2)
+
+	for j := range scores {
+		f, err := parseFloat(pairs[2*j])
+
+		if err != nil {
+			c.w.error(errNotFloat)
+			return
+		}
+
+		scores[j] = f
+	}
+
+	z, ok := c.zsetAt(args[1], true)
+
+	if !ok {
+		return
+	}
+
+	var added, changed int64
+
+	for j, score := range scores {
+		m := pairs[2*j+1]
+		old, exists := z[m]
+
+		if (nx && exists) || (xx && !exists) {
+			continue
+		}
+
+		if !exists {
+			added++
+		} else if old != score {
+			changed++
+		}
+
+		z[m] = score
+	}
+
+	c.touch(args[1])
+	c.db().reap(args[1])
+
+	if ch {
+		c.w.int(added + changed)
+	} else {
+		c.w.int(added)
+	}
+}
+
+func cmdZIncrBy(c *client, args []string) {
+	delta, err := parseFloat(args[2])
+
+	if err != nil {
+		c.w.error(errNotFloat)
+		return
+	}
+
+	z, ok := c.zsetAt(args[1], true)
+
+	if !ok {
+		return
+	}
+
+	z[args[3]] += delta
+	c.touch(args[1])
+	c.w.bulk(formatFloat(z[args[3]]))
+}
+
+func cmdZRem(c *client, args []string) {
+	z, ok := c.zsetAt(args[1], false)
+
+	if !ok {
+		return
+	}
+
+	var n int64
+
+	for _, m := range args[2:] {
+		if _, exists := z[m]; exists {
+			delete(z, m)
+			n++
+		}
+	}
+
+	if n > 0 {
+		c.touch(args[1])
+		c.db().reap(args[1])
+	}
+
+	c.w.int(n)
+}
+
+func cmdZCard(c *client, args []string) {
+	z, ok := c.zsetAt(args[1], false)
+
+	if ok {
+		c.w.int(int64(len(z)))
+	}
+}
+
+func cmdZScore(c *client, args []string) {
+	z, ok := c.zsetAt(args[1], false)
+
+	if !ok {
+		return
+	}
+
+	score, exists := z[args[2]]
+
+	if !exists {
+		c.w.null()
+		return
+	}
+
+	c.w.bulk(formatFloat(score))
+}
+
+func cmdZRange(c *client, args []string) {
+	start, err1 := strconv.Atoi(args[2])
+	stop, err2 := strconv.Atoi(args[3])
+
+	if err1 != nil || err2 != nil {
+		c.w.error(errNotInt)
+		return
+	}
+
+	withScores := false
+
+	for _, a := range args[4:] {
+		if !strings.EqualFold(a, "WITHSCORES") {
+			c.w.error(errSyntax)
+			return
+		}
+
+		withScores = true
+	}
+
+	z, ok := c.zsetAt(args[1], false)
+
+	if !ok {
+		return
+	}
+
+	members := z.sorted()
+
+	if strings.EqualFold(args[0], "ZREVRANGE") {
+		for i, j := 0, len(members)-1; i < j; i, j = i+1, j-1 {
+			members[i], members[j] = members[j], members[i]
+		}
+	}
+
+	lo, hi := span(start, stop, len(members))
+	c.writeScored(members[lo:hi], withScores)
+}
+
+func cmdZRangeByScore(c *client, args []string) {
+	min, err1 := parseBound(args[2])
+	max, err2 := parseBound(args[3])
+
+	if err1 != nil || err2 != nil {
+		c.w.error("ERR min or max is not a float")
+		return
+	}
+
+	withScores := false
+	offset, count := 0, -1
+
+	for i := 4; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "WITHSCORES":
+			withScores = true
+		case "LIMIT":
+			if i+2 >= len(args) {
+				c.w.error(errSyntax)
+				return
+			}
+
+			var err error
+
+			if offset, err = strconv.Atoi(args[i+1]); err != nil {
+				c.w.error(errNotInt)
+				return
+			}
+
+			if count, err = strconv.Atoi(args[i+2]); err != nil {
+				c.w.error(errNotInt)
+				return
+			}
+
+			i += 2
+		default:
+			c.w.error(errSyntax)
+			return
+		}
+	}
+
+	z, ok := c.zsetAt(args[1], false)
+
+	if !ok {
+		return
+	}
+
+	var members []scored
+
+	for _, m := range z.sorted() {
+		if min.below(m.score) && max.above(m.score) {
+			members = append(members, m)
+		}
+	}
+
+	if offset >= len(members) || offset < 0 {
+		members = nil
+	} else {
+		members = members[offset:]
+	}
+
+	if count >= 0 && count < len(members) {
+		members = members[:count]
+	}
+
+	c.writeScored(members, withScores)
+}
+
+func cmdZRemRangeByScore(c *client, args []string) {
+	min, err1 := parseBound(args[2])
+	max, err2 := parseBound(args[3])
+
+	if err1 != nil || err2 != nil {
+		c.w.error("ERR min or max is not a float")
+		return
+	}
+
+	z, ok := c.zsetAt(args[1], false)
+
+	if !ok {
+		return
+	}
+
+	var n int64
+
+	for m, score := range z {
+		if min.below(score) && max.above(score) {
+			delete(z, m)
+			n++
+		}
+	}
+
+	if n > 0 {
+		c.touch(args[1])
+		c.db().reap(args[1])
+	}
+
+	c.w.int(n)
+}
+
+func (c *client) writeScored(members []scored, withScores bool) {
+	if withScores {
+		c.w.array(2 * len(members))
+	} else {
+		c.w.array(len(members))
+	}
+
+	for _, m := range members {
+		c.w.bulk(m.member)
+
+		if withScores {
+			c.w.bulk(formatFloat(m.score))
+		}
+	}
+}
+
+func cmdMulti(c *client, args []string) {
+	if c.multi {
+		c.w.error("ERR MULTI calls can not be nested")
+		return
+	}
+
+	c.multi = true
+	c.multiErr = false
+	c.queued = nil
+	c.w.ok()
+}
+
+func cmdExec(c *client, args []string) {
+	if !c.multi {
+		c.w.error("ERR EXEC without MULTI")
+		return
+	}
+
+	queued, failed, changed := c.queued, c.multiErr, c.watchChanged()
+	c.multi, c.multiErr, c.queued, c.watched = false, false, nil, nil
+
+	if failed {
+		c.w.error("EXECABORT Transaction discarded because of previous errors.")
+		return
+	}
+
+	if changed {
+		c.w.nullArray()
+		return
+	}
+
+	c.w.array(len(queued))
+	c.exec = true
+
+	for _, args := range queued {
+		commands[strings.ToUpper(args[0])].fn(c, args)
+	}
+
+	c.exec = false
+}
+
+func cmdDiscard(c *client, args []string) {
+	if !c.multi {
+		c.w.error("ERR DISCARD without MULTI")
+		return
+	}
+
+	c.multi, c.multiErr, c.queued, c.watched = false, false, nil, nil
+	c.w.ok()
+}
+
+func cmdWatch(c *client, args []string) {
+	if c.multi {
+		c.w.error("ERR WATCH inside MULTI is not allowed")
+		return
+	}
+
+	if c.watched == nil {
+		c.watched = make(map[watchKey]uint64)
+	}
+
+	for _, key := range args[1:] {
+		c.watched[watchKey{c.dbIndex, key}] = c.db().versions[key]
+	}
+
+	c.w.ok()
+}
+
+func cmdUnwatch(c *client, args []string) {
+	c.watched = nil
+	c.w.ok()
+}
+
+// watchChanged reports whether any watched key was modified since WATCH.
+func (c *client) watchChanged() bool {
+	for k, version := range c.watched {
+		if c.srv.db(k.db).versions[k.key] != version {
+			return true
+		}
+	}
+
+	return false
+}
+
+// span converts the inclusive, possibly negative, range start..stop over n
+// elements into a slice range.
+func span(start, stop, n int) (int, int) {
+	if start < 0 {
+		start += n
+	}
+
+	if stop < 0 {
+		stop += n
+	}
+
+	if start < 0 {
+		start = 0
+	}
+
+	if stop >= n {
+		stop = n - 1
+	}
+
+	if start > stop || start >= n {
+		return 0, 0
+	}
+
+	return start, stop + 1
+}
+
+func parseFloat(s string) (float64, error) {
+	switch strings.ToLower(s) {
+	case "inf", "+inf":
+		return math.Inf(1), nil
+	case "-inf":
+		return math.Inf(-1), nil
+	}
+
+	return strconv.ParseFloat(s, 64)
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	}
+
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// parseTimeout parses the timeout of a blocking command in unit. It writes
+// an error and reports false if s is not a non-negative number.
+func parseTimeout(c *client, s string, unit time.Duration) (time.Duration, bool) {
+	f, err := strconv.ParseFloat(s, 64)
+
+	if err != nil || f < 0 {
+		c.w.error("ERR timeout is not a float or out of range")
+		return 0, false
+	}
+
+	return time.Duration(f * float64(unit)), true
+}
+
+// bound is a score interval endpoint as used by ZRANGEBYSCORE.
+type bound struct {
+	value     float64
+	exclusive bool
+}
+
+func parseBound(s string) (bound, error) {
+	b := bound{}
+
+	if strings.HasPrefix(s, "(") {
+		b.exclusive = true
+		s = s[1:]
+	}
+
+	f, err := parseFloat(s)
+	b.value = f
+	return b, err
+}
+
+// below reports whether b as a lower bound admits score.
+func (b bound) below(score float64) bool {
+	if b.exclusive {
+		return b.value < score
+	}
+	return b.value <= score
+}
+
+// above reports whether b as an upper bound admits score.
+func (b bound) above(score float64) bool {
+	if b.exclusive {
+		return score < b.value
+	}
+	return score <= b.value
+}
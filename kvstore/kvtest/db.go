@@ -0,0 +1,157 @@
+package kvtest
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	errWrongType = "WRONGTYPE Operation against a key holding the wrong kind of value"
+	errNotInt    = "ERR value is not an integer or out of range"
+	errNotFloat  = "ERR value is not a valid float"
+	errSyntax    = "ERR syntax error"
+)
+
+// item is a value in the keyspace. value holds one of string, hash, list,
+// set, zset or stream.
+type item struct {
+	value    interface{}
+	expireAt time.Time
+}
+
+type (
+	hash map[string]string
+	list []string
+	set  map[string]struct{}
+	zset map[string]float64
+)
+
+func typeName(v interface{}) string {
+	switch v.(type) {
+	case string:
+		return "string"
+	case hash:
+		return "hash"
+	case *list:
+		return "list"
+	case set:
+		return "set"
+	case zset:
+		return "zset"
+	case *stream:
+		return "stream"
+	}
+	return "none"
+}
+
+type db struct {
+	items    map[string]*item
+	versions map[string]uint64
+}
+
+func newDB() *db {
+	return &db{
+		items:    make(map[string]*item),
+		versions: make(map[string]uint64),
+	}
+}
+
+// touch bumps the version of key so that transactions watching it abort.
+func (d *db) touch(key string) {
+	d.versions[key]++
+}
+
+func (d *db) flush() {
+	for k := range d.items {
+		d.touch(k)
+	}
+
+	d.items = make(map[string]*item)
+}
+
+// get returns the live item at key. Expired items are removed.
+func (d *db) get(key string, now time.Time) *item {
+	it, ok := d.items[key]
+
+	if !ok {
+		return nil
+	}
+
+	if !it.expireAt.IsZero() && !now.Before(it.expireAt) {
+		delete(d.items, key)
+		return nil
+	}
+
+	return it
+}
+
+func (d *db) del(key string, now time.Time) bool {
+	if d.get(key, now) == nil {
+		return false
+	}
+
+	delete(d.items, key)
+	return true
+}
+
+// keys returns the sorted live keys.
+func (d *db) keys(now time.Time) []string {
+	keys := make([]string, 0, len(d.items))
+
+	for k := range d.items {
+		if d.get(k, now) != nil {
+			keys = append(keys, k)
+		}
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// reap removes key if its collection has become empty.
+func (d *db) reap(key string) {
+	it, ok := d.items[key]
+
+	if !ok {
+		return
+	}
+
+	empty := false
+
+	switch v := it.value.(type) {
+	case hash:
+		empty = len(v) == 0
+	case *list:
+		empty = len(*v) == 0
+	case set:
+		empty = len(v) == 0
+	case zset:
+		empty = len(v) == 0
+	}
+
+	if empty {
+		delete(d.items, key)
+	}
+}
+
+type scored struct {
+	member string
+	score  float64
+}
+
+// sorted returns the members of z ordered by score, then member.
+func (z zset) sorted() []scored {
+	s := make([]scored, 0, len(z))
+
+	for m, score := range z {
+		s = append(s, scored{m, score})
+	}
+
+	sort.Slice(s, func(i, j int) bool {
+		if s[i].score != s[j].score {
+			return s[i].score < s[j].score
+		}
+		return s[i].member < s[j].member
+	})
+	return s
+}
@@ -0,0 +1,112 @@
+package kvtest
+
+// match reports whether s matches the redis glob pattern, which supports
+// *, ?, [...] character classes with ranges and ^ negation, and \ escapes.
+func match(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+
+			if len(pattern) == 1 {
+				return true
+			}
+
+			for i := 0; i <= len(s); i++ {
+				if match(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+
+			pattern, s = pattern[1:], s[1:]
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+
+			end := 1
+
+			for end < len(pattern) && pattern[end] != ']' {
+				if pattern[end] == '\\' {
+					end++
+				}
+				end++
+			}
+
+			if end >= len(pattern) {
+				// unterminated class matches a literal '['
+				if s[0] != '[' {
+					return false
+				}
+
+				pattern, s = pattern[1:], s[1:]
+				continue
+			}
+
+			if !matchClass(pattern[1:end], s[0]) {
+				return false
+			}
+
+			pattern, s = pattern[end+1:], s[1:]
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+
+			pattern, s = pattern[1:], s[1:]
+		}
+	}
+
+	return len(s) == 0
+}
+
+func matchClass(class string, b byte) bool {
+	negate := len(class) > 0 && class[0] == '^'
+
+	if negate {
+		class = class[1:]
+	}
+
+	found := false
+
+	for i := 0; i < len(class); i++ {
+		c := class[i]
+
+		if c == '\\' && i+1 < len(class) {
+			i++
+			c = class[i]
+		} else if i+2 < len(class) && class[i+1] == '-' {
+			lo, hi := c, class[i+2]
+
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+
+			if lo <= b && b <= hi {
+				found = true
+			}
+
+			i += 2
+			continue
+		}
+
+		if c == b {
+			found = true
+		}
+	}
+
+	return found != negate
+}
@@ -0,0 +1,477 @@
+/*
+Package kvtest implements an in-process fake redis server for tests.
+
+The server speaks the redis protocol over a local TCP socket and supports
+the commands used by this repository: strings, hashes, lists, sets, sorted
+sets, streams with consumer groups, key expiry, MULTI/EXEC transactions,
+pub/sub and the broadcasting mode of client side caching. Scripts run on
+an interpreter of the subset of Lua used by redis scripts, without
+function definitions. Time on the server only moves when the test calls
+Advance, so expiry can be tested without sleeping. Blocking commands wait
+in real time.
+
+	srv, err := kvtest.NewServer()
+	defer srv.Close()
+	db, err := kvstore.Open(srv.DSN(0))
+*/
+package kvtest
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server is an in-process fake redis server.
+type Server struct {
+	l  net.Listener
+	wg sync.WaitGroup
+
+	mu       sync.Mutex // guards fields below
+	changed  *sync.Cond // broadcast on writes, for blocking commands
+	password string
+	now      time.Time
+	dbs      map[int]*db
+	clients  map[*client]struct{}
+	nextID   int64
+	disabled map[string]bool
+	scripts  map[string]*script
+	closed   bool
+
+	// replication state reported by INFO
+	primary    string
+	linkUp     bool
+	replOffset int64
+}
+
+// NewServer starts a server listening on a random local port.
+func NewServer() (*Server, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		l:       l,
+		now:     time.Now(),
+		dbs:     make(map[int]*db),
+		clients: make(map[*client]struct{}),
+	}
+
+	s.changed = sync.NewCond(&s.mu)
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Addr returns the address the server is listening on.
+func (s *Server) Addr() string {
+	return s.l.Addr().String()
+}
+
+// DSN returns a data source name for kvstore.Open which selects db.
+func (s *Server) DSN(db int) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fmt.Sprintf("redis://:%s@%s/%d", s.password, s.Addr(), db)
+}
+
+// RequirePass makes clients authenticate with AUTH before issuing other
+// commands. An empty password disables authentication.
+func (s *Server) RequirePass(password string) {
+	s.mu.Lock()
+	s.password = password
+	s.mu.Unlock()
+}
+
+// Now returns the current server time.
+func (s *Server) Now() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.now
+}
+
+// Advance moves the server clock forward by d, expiring keys whose time
+// to live has passed.
+func (s *Server) Advance(d time.Duration) {
+	s.mu.Lock()
+	s.now = s.now.Add(d)
+	s.mu.Unlock()
+}
+
+// SetReplicaOf makes INFO report the server as a replica of primary, with
+// its link to the primary up or down. An empty primary makes it a primary
+// again. No data is replicated.
+func (s *Server) SetReplicaOf(primary string, linkUp bool) {
+	s.mu.Lock()
+	s.primary, s.linkUp = primary, linkUp
+	s.mu.Unlock()
+}
+
+// SetReplOffset sets the replication offset reported by INFO, of the
+// stream written by a primary or processed by a replica.
+func (s *Server) SetReplOffset(offset int64) {
+	s.mu.Lock()
+	s.replOffset = offset
+	s.mu.Unlock()
+}
+
+// DisableCommand makes the server reject the commands names as unknown,
+// like an older redis.
+func (s *Server) DisableCommand(names ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.disabled == nil {
+		s.disabled = make(map[string]bool)
+	}
+
+	for _, name := range names {
+		s.disabled[strings.ToUpper(name)] = true
+	}
+}
+
+// FlushAll removes every key from every database.
+func (s *Server) FlushAll() {
+	s.mu.Lock()
+	for _, d := range s.dbs {
+		d.flush()
+	}
+	s.invalidate(nil, nil)
+	s.mu.Unlock()
+}
+
+// DisconnectAll closes the connections of all clients, as if the server
+// had restarted. Data is kept.
+func (s *Server) DisconnectAll() {
+	s.mu.Lock()
+	for c := range s.clients {
+		c.conn.Close()
+	}
+	s.mu.Unlock()
+}
+
+// Close stops the server and disconnects all clients.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	err := s.l.Close()
+
+	for c := range s.clients {
+		c.conn.Close()
+	}
+
+	s.changed.Broadcast()
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.l.Accept()
+
+		if err != nil {
+			return
+		}
+
+		c := &client{
+			srv:  s,
+			conn: conn,
+			r:    bufio.NewReader(conn),
+			w:    writer{bufio.NewWriter(conn)},
+		}
+
+		s.mu.Lock()
+
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+
+		s.nextID++
+		c.id = s.nextID
+		s.clients[c] = struct{}{}
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go c.serve()
+	}
+}
+
+func (s *Server) db(i int) *db {
+	d, ok := s.dbs[i]
+
+	if !ok {
+		d = newDB()
+		s.dbs[i] = d
+	}
+
+	return d
+}
+
+type watchKey struct {
+	db  int
+	key string
+}
+
+type client struct {
+	srv  *Server
+	id   int64
+	conn net.Conn
+	r    *bufio.Reader
+	w    writer
+
+	// guarded by srv.mu
+	dbIndex  int
+	authed   bool
+	multi    bool
+	multiErr bool
+	exec     bool
+	queued   [][]string
+	watched  map[watchKey]uint64
+	channels map[string]struct{}
+	patterns map[string]struct{}
+	tracking *tracking
+}
+
+func (c *client) serve() {
+	defer c.srv.wg.Done()
+	defer c.close()
+
+	for {
+		args, err := readCommand(c.r)
+
+		if err != nil {
+			if err == errProtocol {
+				c.w.error("ERR Protocol error")
+				c.w.Flush()
+			}
+			return
+		}
+
+		if len(args) == 0 {
+			continue
+		}
+
+		// Replies are written with srv.mu held, since PUBLISH writes
+		// to the connections of other clients.
+		c.srv.mu.Lock()
+		quit := strings.EqualFold(args[0], "QUIT")
+
+		if quit {
+			c.w.ok()
+		} else {
+			c.dispatch(args)
+		}
+
+		if quit || c.r.Buffered() == 0 {
+			err = c.w.Flush()
+		}
+
+		c.srv.mu.Unlock()
+
+		if quit || err != nil {
+			return
+		}
+	}
+}
+
+func (c *client) close() {
+	c.srv.mu.Lock()
+	delete(c.srv.clients, c)
+	c.srv.mu.Unlock()
+	c.conn.Close()
+}
+
+// dispatch runs or queues a single command. The caller holds srv.mu.
+func (c *client) dispatch(args []string) {
+	name := strings.ToUpper(args[0])
+	cmd, ok := commands[name]
+
+	if !ok || c.srv.disabled[name] {
+		c.w.error(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		c.multiErr = c.multi
+		return
+	}
+
+	if (cmd.arity > 0 && len(args) != cmd.arity) || (cmd.arity < 0 && len(args) < -cmd.arity) {
+		c.w.error(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+		c.multiErr = c.multi
+		return
+	}
+
+	if c.srv.password != "" && !c.authed && name != "AUTH" {
+		c.w.error("NOAUTH Authentication required.")
+		c.multiErr = c.multi
+		return
+	}
+
+	if c.subscribed() && !cmd.pubsub {
+		c.w.error(fmt.Sprintf("ERR Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context", strings.ToLower(name)))
+		return
+	}
+
+	if c.multi && !cmd.immediate {
+		c.queued = append(c.queued, args)
+		c.w.status("QUEUED")
+		return
+	}
+
+	cmd.fn(c, args)
+}
+
+func (c *client) db() *db {
+	return c.srv.db(c.dbIndex)
+}
+
+func (c *client) now() time.Time {
+	return c.srv.now
+}
+
+// touch records a modification of key for WATCH, wakes up blocked
+// clients and invalidates the key for clients tracking it.
+func (c *client) touch(key string) {
+	c.db().touch(key)
+	c.srv.changed.Broadcast()
+	c.srv.invalidate(c, []string{key})
+}
+
+// block waits until ready reports true, d passes or the server closes,
+// releasing the server lock meanwhile. A zero d waits forever. Blocking
+// timeouts run in real time, not server time. Inside a transaction block
+// returns at once.
+func (c *client) block(d time.Duration, ready func() bool) {
+	if c.exec || ready() {
+		return
+	}
+
+	var deadline time.Time
+
+	if d > 0 {
+		deadline = time.Now().Add(d)
+		t := time.AfterFunc(d, func() {
+			c.srv.mu.Lock()
+			c.srv.changed.Broadcast()
+			c.srv.mu.Unlock()
+		})
+		defer t.Stop()
+	}
+
+	for !c.srv.closed && (deadline.IsZero() || time.Now().Before(deadline)) {
+		if c.w.Flush() != nil {
+			return
+		}
+
+		c.srv.changed.Wait()
+
+		if ready() {
+			return
+		}
+	}
+}
+
+// value returns the value at key if it has the given type. If the key is
+// missing it returns nil, or a new empty value stored at key when create
+// is set. It writes an error and reports false on a type mismatch.
+func (c *client) value(key, kind string, create bool) (interface{}, bool) {
+	d := c.db()
+	it := d.get(key, c.now())
+
+	if it == nil {
+		if !create {
+			return nil, true
+		}
+
+		var v interface{}
+
+		switch kind {
+		case "hash":
+			v = make(hash)
+		case "list":
+			v = new(list)
+		case "set":
+			v = make(set)
+		case "zset":
+			v = make(zset)
+		case "stream":
+			v = newStream()
+		}
+
+		d.items[key] = &item{value: v}
+		return v, true
+	}
+
+	if typeName(it.value) != kind {
+		c.w.error(errWrongType)
+		return nil, false
+	}
+
+	return it.value, true
+}
+
+func (c *client) hashAt(key string, create bool) (hash, bool) {
+	v, ok := c.value(key, "hash", create)
+
+	if v == nil {
+		return nil, ok
+	}
+
+	return v.(hash), ok
+}
+
+func (c *client) listAt(key string, create bool) (*list, bool) {
+	v, ok := c.value(key, "list", create)
+
+	if v == nil {
+		return nil, ok
+	}
+
+	return v.(*list), ok
+}
+
+func (c *client) setAt(key string, create bool) (set, bool) {
+	v, ok := c.value(key, "set", create)
+
+	if v == nil {
+		return nil, ok
+	}
+
+	return v.(set), ok
+}
+
+func (c *client) zsetAt(key string, create bool) (zset, bool) {
+	v, ok := c.value(key, "zset", create)
+
+	if v == nil {
+		return nil, ok
+	}
+
+	return v.(zset), ok
+}
+
+// stringAt returns the string at key. It reports exists false if the key
+// is missing, and writes an error and reports ok false on a type mismatch.
+func (c *client) stringAt(key string) (s string, exists, ok bool) {
+	it := c.db().get(key, c.now())
+
+	if it == nil {
+		return "", false, true
+	}
+
+	s, isString := it.value.(string)
+
+	if !isString {
+		c.w.error(errWrongType)
+		return "", false, false
+	}
+
+	return s, true, true
+}
@@ -0,0 +1,306 @@
+package kvtest_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/simonz05/util/assert"
+	"github.com/simonz05/util/kvstore"
+	"github.com/simonz05/util/kvstore/kvtest"
+)
+
+func open(t *testing.T) (*kvtest.Server, *kvstore.KVStore) {
+	srv, err := kvtest.NewServer()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := kvstore.Open(srv.DSN(1))
+
+	if err != nil {
+		srv.Close()
+		t.Fatal(err)
+	}
+
+	return srv, db
+}
+
+func TestStrings(t *testing.T) {
+	ast := assert.NewAssert(t)
+	srv, db := open(t)
+	defer srv.Close()
+	defer db.Close()
+
+	conn := db.Get()
+	defer conn.Close()
+
+	_, err := redis.String(conn.Do("GET", "k"))
+	ast.Equal(redis.ErrNil, err)
+
+	_, err = conn.Do("SET", "k", "v")
+	ast.Nil(err)
+
+	v, err := redis.String(conn.Do("GET", "k"))
+	ast.Nil(err)
+	ast.Equal("v", v)
+
+	ok, err := conn.Do("SET", "k", "w", "NX")
+	ast.Nil(err)
+	ast.True(ok == nil)
+
+	n, err := redis.Int(conn.Do("INCRBY", "n", 5))
+	ast.Nil(err)
+	ast.Equal(5, n)
+
+	_, err = conn.Do("INCR", "k")
+	ast.NotNil(err)
+
+	n, err = redis.Int(conn.Do("DEL", "k", "n", "missing"))
+	ast.Nil(err)
+	ast.Equal(2, n)
+}
+
+func TestExpiry(t *testing.T) {
+	ast := assert.NewAssert(t)
+	srv, db := open(t)
+	defer srv.Close()
+	defer db.Close()
+
+	conn := db.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("SETEX", "k", 10, "v")
+	ast.Nil(err)
+
+	ttl, err := redis.Int(conn.Do("TTL", "k"))
+	ast.Nil(err)
+	ast.Equal(10, ttl)
+
+	srv.Advance(9 * time.Second)
+
+	ttl, err = redis.Int(conn.Do("TTL", "k"))
+	ast.Nil(err)
+	ast.Equal(1, ttl)
+
+	srv.Advance(time.Second)
+
+	_, err = redis.String(conn.Do("GET", "k"))
+	ast.Equal(redis.ErrNil, err)
+
+	ttl, err = redis.Int(conn.Do("TTL", "k"))
+	ast.Nil(err)
+	ast.Equal(-2, ttl)
+
+	now, err := redis.Int64s(conn.Do("TIME"))
+	ast.Nil(err)
+	ast.Equal(srv.Now().Unix(), now[0])
+}
+
+func TestCollections(t *testing.T) {
+	ast := assert.NewAssert(t)
+	srv, db := open(t)
+	defer srv.Close()
+	defer db.Close()
+
+	conn := db.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("HSET", "h", "a", "1", "b", "2")
+	ast.Nil(err)
+
+	m, err := redis.StringMap(conn.Do("HGETALL", "h"))
+	ast.Nil(err)
+	ast.Equal(map[string]string{"a": "1", "b": "2"}, m)
+
+	_, err = conn.Do("RPUSH", "l", "a", "b", "c")
+	ast.Nil(err)
+
+	l, err := redis.Strings(conn.Do("LRANGE", "l", 0, -1))
+	ast.Nil(err)
+	ast.Equal([]string{"a", "b", "c"}, l)
+
+	_, err = conn.Do("LPUSH", "h", "x")
+	ast.NotNil(err)
+
+	_, err = conn.Do("ZADD", "z", 3, "c", 1, "a", 2, "b")
+	ast.Nil(err)
+
+	z, err := redis.Strings(conn.Do("ZRANGE", "z", 0, -1, "WITHSCORES"))
+	ast.Nil(err)
+	ast.Equal([]string{"a", "1", "b", "2", "c", "3"}, z)
+
+	z, err = redis.Strings(conn.Do("ZRANGEBYSCORE", "z", "(1", "+inf"))
+	ast.Nil(err)
+	ast.Equal([]string{"b", "c"}, z)
+
+	n, err := redis.Int(conn.Do("ZREM", "z", "a", "b", "c"))
+	ast.Nil(err)
+	ast.Equal(3, n)
+
+	n, err = redis.Int(conn.Do("EXISTS", "z"))
+	ast.Nil(err)
+	ast.Equal(0, n)
+}
+
+func TestBlocking(t *testing.T) {
+	ast := assert.NewAssert(t)
+	srv, db := open(t)
+	defer srv.Close()
+	defer db.Close()
+
+	conn := db.Get()
+	defer conn.Close()
+
+	_, err := redis.String(conn.Do("BRPOPLPUSH", "src", "dst", 0.01))
+	ast.Equal(redis.ErrNil, err)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		c := db.Get()
+		c.Do("LPUSH", "src", "a")
+		c.Close()
+	}()
+
+	v, err := redis.String(conn.Do("BRPOPLPUSH", "src", "dst", 5))
+	ast.Nil(err)
+	ast.Equal("a", v)
+
+	l, err := redis.Strings(conn.Do("LRANGE", "dst", 0, -1))
+	ast.Nil(err)
+	ast.Equal([]string{"a"}, l)
+}
+
+func TestMulti(t *testing.T) {
+	ast := assert.NewAssert(t)
+	srv, db := open(t)
+	defer srv.Close()
+	defer db.Close()
+
+	conn := db.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("SET", "k", "v")
+	conn.Send("ZADD", "z", 1, "k")
+	reply, err := redis.Values(conn.Do("EXEC"))
+	ast.Nil(err)
+	ast.Equal(2, len(reply))
+
+	_, err = conn.Do("WATCH", "k")
+	ast.Nil(err)
+
+	other := db.Get()
+	_, err = other.Do("SET", "k", "changed")
+	ast.Nil(err)
+	other.Close()
+
+	conn.Send("MULTI")
+	conn.Send("SET", "k", "mine")
+	reply, err = redis.Values(conn.Do("EXEC"))
+	ast.Equal(redis.ErrNil, err)
+
+	v, err := redis.String(conn.Do("GET", "k"))
+	ast.Nil(err)
+	ast.Equal("changed", v)
+}
+
+func TestAuth(t *testing.T) {
+	ast := assert.NewAssert(t)
+	srv, err := kvtest.NewServer()
+	ast.Nil(err)
+	defer srv.Close()
+
+	srv.RequirePass("secret")
+
+	db, err := kvstore.Open(srv.DSN(0))
+	ast.Nil(err)
+	defer db.Close()
+
+	conn := db.Get()
+	_, err = conn.Do("PING")
+	ast.Nil(err)
+	conn.Close()
+
+	db, err = kvstore.Open("redis://:wrong@" + srv.Addr() + "/0")
+	ast.Nil(err)
+	defer db.Close()
+
+	conn = db.Get()
+	_, err = conn.Do("PING")
+	ast.NotNil(err)
+	conn.Close()
+}
+
+func TestScripting(t *testing.T) {
+	ast := assert.NewAssert(t)
+	srv, db := open(t)
+	defer srv.Close()
+	defer db.Close()
+
+	conn := db.Get()
+	defer conn.Close()
+
+	src := `
+local n = 0
+for i, key in ipairs(KEYS) do
+	n = n + redis.call("INCRBY", key, ARGV[i])
+end
+if n > 10 then
+	return redis.error_reply("too large")
+end
+local t = {n, "total:" .. n, {ok = "x"}}
+t[#t + 1] = redis.call("GET", "missing")
+return t
+`
+	reply, err := redis.Values(conn.Do("EVAL", src, 2, "a", "b", 2, 3))
+	ast.Nil(err)
+	ast.Equal(4, len(reply))
+	ast.Equal(int64(5), reply[0])
+	ast.Equal("total:5", string(reply[1].([]byte)))
+	ast.Equal("x", reply[2])
+	ast.True(reply[3] == nil)
+
+	sha, err := redis.String(conn.Do("SCRIPT", "LOAD", src))
+	ast.Nil(err)
+
+	_, err = conn.Do("EVALSHA", sha, 2, "a", "b", 5, 5)
+	ast.Equal("too large", err.Error())
+
+	exists, err := redis.Ints(conn.Do("SCRIPT", "EXISTS", sha, "0000"))
+	ast.Nil(err)
+	ast.Equal([]int{1, 0}, exists)
+
+	srv.FlushScripts()
+
+	_, err = conn.Do("EVALSHA", sha, 0)
+	ast.True(strings.HasPrefix(err.Error(), "NOSCRIPT"))
+
+	// errors of commands abort the script and are returned as they are
+	_, err = conn.Do("SET", "s", "v")
+	ast.Nil(err)
+
+	_, err = conn.Do("EVAL", `redis.call("INCR", KEYS[1]) return 1`, 1, "s")
+	ast.Equal("ERR value is not an integer or out of range", err.Error())
+
+	v, err := redis.Int(conn.Do("EVAL", `
+local r = redis.pcall("INCR", KEYS[1])
+if type(r) == "table" and r.err then
+	return -1
+end
+return r`, 1, "s"))
+	ast.Nil(err)
+	ast.Equal(-1, v)
+
+	_, err = conn.Do("EVAL", "return (", 0)
+	ast.True(strings.HasPrefix(err.Error(), "ERR Error compiling script"))
+
+	_, err = conn.Do("EVAL", "return nil + 1", 0)
+	ast.True(strings.Contains(err.Error(), "attempt to perform arithmetic on a nil value"))
+
+	f, err := redis.String(conn.Do("EVAL", `return string.format("%d-%s", math.floor(7 / 2), tostring(0.5))`, 0))
+	ast.Nil(err)
+	ast.Equal("3-0.5", f)
+}
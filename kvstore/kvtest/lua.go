@@ -0,0 +1,1738 @@
+package kvtest
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// This file implements the subset of Lua 5.1 used by redis scripts: local
+// variables, assignment, if, while, repeat, numeric and generic for,
+// return and break, tables, the arithmetic, comparison, logical, length
+// and concatenation operators, and the library functions set up by
+// newLuaGlobals. Scripts cannot define functions.
+//
+// Values are nil, bool, float64, string, *luaTable and luaFunction. Errors
+// are raised by panicking with a *luaError, recovered by runLua.
+
+type luaFunction func(args []interface{}) []interface{}
+
+type luaTable struct {
+	arr  []interface{}
+	hash map[interface{}]interface{}
+}
+
+func newLuaTable(values ...interface{}) *luaTable {
+	return &luaTable{arr: values}
+}
+
+func (t *luaTable) get(k interface{}) interface{} {
+	if n, ok := k.(float64); ok && n == math.Trunc(n) && n >= 1 && n <= float64(len(t.arr)) {
+		return t.arr[int(n)-1]
+	}
+
+	return t.hash[k]
+}
+
+func (t *luaTable) set(k, v interface{}) {
+	switch k := k.(type) {
+	case nil:
+		luaRaise("table index is nil")
+	case float64:
+		if math.IsNaN(k) {
+			luaRaise("table index is NaN")
+		}
+
+		if k == math.Trunc(k) && k >= 1 && k <= float64(len(t.arr)+1) {
+			i := int(k) - 1
+
+			if i == len(t.arr) {
+				if v == nil {
+					delete(t.hash, k)
+					return
+				}
+
+				t.arr = append(t.arr, v)
+				delete(t.hash, k)
+				t.migrate()
+				return
+			}
+
+			t.arr[i] = v
+
+			for len(t.arr) > 0 && t.arr[len(t.arr)-1] == nil {
+				t.arr = t.arr[:len(t.arr)-1]
+			}
+
+			return
+		}
+	}
+
+	if v == nil {
+		delete(t.hash, k)
+		return
+	}
+
+	if t.hash == nil {
+		t.hash = make(map[interface{}]interface{})
+	}
+
+	t.hash[k] = v
+}
+
+// migrate moves the integer keys following the array part into it.
+func (t *luaTable) migrate() {
+	for {
+		k := float64(len(t.arr) + 1)
+		v, ok := t.hash[k]
+
+		if !ok {
+			return
+		}
+
+		t.arr = append(t.arr, v)
+		delete(t.hash, k)
+	}
+}
+
+func (t *luaTable) len() int {
+	return len(t.arr)
+}
+
+// keys returns the keys of t, those of the array part first and the others
+// in a stable order.
+func (t *luaTable) keys() []interface{} {
+	keys := make([]interface{}, 0, len(t.arr)+len(t.hash))
+
+	for i := range t.arr {
+		keys = append(keys, float64(i+1))
+	}
+
+	var rest []interface{}
+
+	for k := range t.hash {
+		rest = append(rest, k)
+	}
+
+	sort.Slice(rest, func(i, j int) bool {
+		return fmt.Sprintf("%T%v", rest[i], rest[i]) < fmt.Sprintf("%T%v", rest[j], rest[j])
+	})
+
+	return append(keys, rest...)
+}
+
+type luaError struct {
+	msg string
+	// reply errors come from redis.call and are returned unchanged.
+	reply bool
+}
+
+func (e *luaError) Error() string {
+	return e.msg
+}
+
+func luaRaise(format string, args ...interface{}) {
+	panic(&luaError{msg: fmt.Sprintf(format, args...)})
+}
+
+// lexer
+
+const (
+	tokEOF = iota
+	tokName
+	tokNumber
+	tokString
+	tokOp
+)
+
+type luaToken struct {
+	kind int
+	s    string
+	n    float64
+	line int
+}
+
+var luaKeywords = map[string]bool{
+	"and": true, "break": true, "do": true, "else": true, "elseif": true,
+	"end": true, "false": true, "for": true, "function": true, "if": true,
+	"in": true, "local": true, "nil": true, "not": true, "or": true,
+	"repeat": true, "return": true, "then": true, "true": true,
+	"until": true, "while": true,
+}
+
+var luaOps = []string{"...", "..", "==", "~=", "<=", ">=", "+", "-", "*", "/", "%", "^", "#", "<", ">", "=", "(", ")", "{", "}", "[", "]", ";", ":", ",", "."}
+
+func lexLua(src string) []luaToken {
+	var toks []luaToken
+	line := 1
+	i := 0
+
+	for i < len(src) {
+		c := src[i]
+
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case strings.HasPrefix(src[i:], "--"):
+			i += 2
+
+			if level, ok := longBracket(src[i:]); ok {
+				s, n := readLongString(src[i:], level, line)
+				line += strings.Count(s, "\n")
+				i += n
+				continue
+			}
+
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case isLuaLetter(c):
+			j := i
+
+			for j < len(src) && (isLuaLetter(src[j]) || isDigit(src[j])) {
+				j++
+			}
+
+			word := src[i:j]
+			kind := tokName
+
+			if luaKeywords[word] {
+				kind = tokOp
+			}
+
+			toks = append(toks, luaToken{kind: kind, s: word, line: line})
+			i = j
+		case isDigit(c) || c == '.' && i+1 < len(src) && isDigit(src[i+1]):
+			j := i
+
+			for j < len(src) && (isLuaLetter(src[j]) || isDigit(src[j]) || src[j] == '.' ||
+				(src[j] == '-' || src[j] == '+') && (src[j-1] == 'e' || src[j-1] == 'E')) {
+				j++
+			}
+
+			n, ok := parseLuaNumber(src[i:j])
+
+			if !ok {
+				panic(&luaError{msg: fmt.Sprintf("user_script:%d: malformed number near '%s'", line, src[i:j])})
+			}
+
+			toks = append(toks, luaToken{kind: tokNumber, n: n, line: line})
+			i = j
+		case c == '"' || c == '\'':
+			s, n := readQuotedString(src[i:], line)
+			toks = append(toks, luaToken{kind: tokString, s: s, line: line})
+			i += n
+		case c == '[':
+			if level, ok := longBracket(src[i:]); ok {
+				s, n := readLongString(src[i:], level, line)
+				toks = append(toks, luaToken{kind: tokString, s: s, line: line})
+				line += strings.Count(src[i:i+n], "\n")
+				i += n
+				continue
+			}
+
+			fallthrough
+		default:
+			op := ""
+
+			for _, o := range luaOps {
+				if strings.HasPrefix(src[i:], o) {
+					op = o
+					break
+				}
+			}
+
+			if op == "" {
+				panic(&luaError{msg: fmt.Sprintf("user_script:%d: unexpected symbol near '%c'", line, c)})
+			}
+
+			toks = append(toks, luaToken{kind: tokOp, s: op, line: line})
+			i += len(op)
+		}
+	}
+
+	return append(toks, luaToken{kind: tokEOF, line: line})
+}
+
+func isLuaLetter(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// longBracket reports the level of the long bracket [[ or [==[ starting
+// src.
+func longBracket(src string) (int, bool) {
+	if len(src) < 2 || src[0] != '[' {
+		return 0, false
+	}
+
+	level := 1
+
+	for level < len(src) && src[level] == '=' {
+		level++
+	}
+
+	if level < len(src) && src[level] == '[' {
+		return level - 1, true
+	}
+
+	return 0, false
+}
+
+func readLongString(src string, level, line int) (string, int) {
+	open := level + 2
+	close := "]" + strings.Repeat("=", level) + "]"
+	end := strings.Index(src[open:], close)
+
+	if end < 0 {
+		panic(&luaError{msg: fmt.Sprintf("user_script:%d: unfinished long string", line)})
+	}
+
+	s := src[open : open+end]
+
+	// a first newline is skipped
+	if strings.HasPrefix(s, "\r\n") {
+		s = s[2:]
+	} else if strings.HasPrefix(s, "\n") {
+		s = s[1:]
+	}
+
+	return s, open + end + len(close)
+}
+
+func readQuotedString(src string, line int) (string, int) {
+	quote := src[0]
+	var b strings.Builder
+	i := 1
+
+	for {
+		if i >= len(src) || src[i] == '\n' {
+			panic(&luaError{msg: fmt.Sprintf("user_script:%d: unfinished string", line)})
+		}
+
+		c := src[i]
+
+		if c == quote {
+			return b.String(), i + 1
+		}
+
+		if c != '\\' {
+			b.WriteByte(c)
+			i++
+			continue
+		}
+
+		i++
+
+		if i >= len(src) {
+			continue
+		}
+
+		switch e := src[i]; e {
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case 'r':
+			b.WriteByte('\r')
+		case 'a':
+			b.WriteByte('\a')
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'v':
+			b.WriteByte('\v')
+		case '\n':
+			b.WriteByte('\n')
+		default:
+			if !isDigit(e) {
+				b.WriteByte(e)
+				break
+			}
+
+			j := i
+
+			for j < len(src) && j < i+3 && isDigit(src[j]) {
+				j++
+			}
+
+			n, _ := strconv.Atoi(src[i:j])
+			b.WriteByte(byte(n))
+			i = j
+			continue
+		}
+
+		i++
+	}
+}
+
+func parseLuaNumber(s string) (float64, bool) {
+	s = strings.TrimSpace(s)
+
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		n, err := strconv.ParseUint(s[2:], 16, 64)
+		return float64(n), err == nil
+	}
+
+	if s == "" || strings.ContainsAny(s, "xXpP_") || strings.EqualFold(s, "inf") || strings.EqualFold(s, "nan") {
+		return 0, false
+	}
+
+	n, err := strconv.ParseFloat(s, 64)
+	return n, err == nil
+}
+
+// syntax tree
+
+type luaExpr interface{}
+
+type (
+	constExpr struct{ v interface{} }
+	nameExpr  struct{ name string }
+	indexExpr struct{ obj, key luaExpr }
+	callExpr  struct {
+		fn   luaExpr
+		args []luaExpr
+	}
+	parenExpr struct{ e luaExpr }
+	binExpr   struct {
+		op   string
+		l, r luaExpr
+	}
+	unExpr struct {
+		op string
+		e  luaExpr
+	}
+	tableExpr struct {
+		// keys are nil for positional items
+		keys, values []luaExpr
+	}
+)
+
+type luaStmt struct {
+	line int
+	s    interface{}
+}
+
+type (
+	localStmt struct {
+		names []string
+		exprs []luaExpr
+	}
+	assignStmt struct{ targets, exprs []luaExpr }
+	callStmt   struct{ call *callExpr }
+	ifStmt     struct {
+		conds  []luaExpr
+		blocks [][]luaStmt
+		els    []luaStmt
+	}
+	whileStmt struct {
+		cond luaExpr
+		body []luaStmt
+	}
+	repeatStmt struct {
+		body []luaStmt
+		cond luaExpr
+	}
+	numForStmt struct {
+		name               string
+		start, limit, step luaExpr
+		body               []luaStmt
+	}
+	genForStmt struct {
+		names []string
+		exprs []luaExpr
+		body  []luaStmt
+	}
+	doStmt     struct{ body []luaStmt }
+	returnStmt struct{ exprs []luaExpr }
+	breakStmt  struct{}
+)
+
+// parser
+
+type luaParser struct {
+	toks []luaToken
+	pos  int
+}
+
+// parseLua returns the statements of src, or an error in the format of
+// redis compile errors.
+func parseLua(src string) (block []luaStmt, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(*luaError)
+
+			if !ok {
+				panic(r)
+			}
+
+			err = e
+		}
+	}()
+
+	p := &luaParser{toks: lexLua(src)}
+	block = p.block()
+
+	if p.peek().kind != tokEOF {
+		p.fail("'<eof>' expected")
+	}
+
+	return block, nil
+}
+
+func (p *luaParser) peek() luaToken {
+	return p.toks[p.pos]
+}
+
+func (p *luaParser) next() luaToken {
+	t := p.toks[p.pos]
+
+	if t.kind != tokEOF {
+		p.pos++
+	}
+
+	return t
+}
+
+func (p *luaParser) is(op string) bool {
+	t := p.peek()
+	return t.kind == tokOp && t.s == op
+}
+
+func (p *luaParser) accept(op string) bool {
+	if p.is(op) {
+		p.next()
+		return true
+	}
+
+	return false
+}
+
+func (p *luaParser) expect(op string) {
+	if !p.accept(op) {
+		p.fail("'%s' expected", op)
+	}
+}
+
+func (p *luaParser) fail(format string, args ...interface{}) {
+	t := p.peek()
+	near := t.s
+
+	switch t.kind {
+	case tokEOF:
+		near = "<eof>"
+	case tokNumber:
+		near = formatLuaNumber(t.n)
+	}
+
+	panic(&luaError{msg: fmt.Sprintf("user_script:%d: %s near '%s'", t.line, fmt.Sprintf(format, args...), near)})
+}
+
+func (p *luaParser) name() string {
+	t := p.peek()
+
+	if t.kind != tokName {
+		p.fail("<name> expected")
+	}
+
+	p.next()
+	return t.s
+}
+
+func (p *luaParser) block() []luaStmt {
+	var block []luaStmt
+
+	for {
+		t := p.peek()
+
+		if t.kind == tokEOF || t.kind == tokOp && (t.s == "end" || t.s == "else" || t.s == "elseif" || t.s == "until") {
+			return block
+		}
+
+		if p.accept(";") {
+			continue
+		}
+
+		s := p.statement()
+		block = append(block, luaStmt{line: t.line, s: s})
+
+		if _, ok := s.(*returnStmt); ok {
+			p.accept(";")
+			return block
+		}
+
+		if _, ok := s.(*breakStmt); ok {
+			return block
+		}
+	}
+}
+
+func (p *luaParser) statement() interface{} {
+	switch {
+	case p.accept("local"):
+		if p.is("function") {
+			p.fail("functions are not supported")
+		}
+
+		s := &localStmt{names: []string{p.name()}}
+
+		for p.accept(",") {
+			s.names = append(s.names, p.name())
+		}
+
+		if p.accept("=") {
+			s.exprs = p.exprList()
+		}
+
+		return s
+	case p.accept("if"):
+		s := new(ifStmt)
+
+		for {
+			s.conds = append(s.conds, p.expr())
+			p.expect("then")
+			s.blocks = append(s.blocks, p.block())
+
+			if !p.accept("elseif") {
+				break
+			}
+		}
+
+		if p.accept("else") {
+			s.els = p.block()
+		}
+
+		p.expect("end")
+		return s
+	case p.accept("while"):
+		s := &whileStmt{cond: p.expr()}
+		p.expect("do")
+		s.body = p.block()
+		p.expect("end")
+		return s
+	case p.accept("repeat"):
+		s := &repeatStmt{body: p.block()}
+		p.expect("until")
+		s.cond = p.expr()
+		return s
+	case p.accept("for"):
+		names := []string{p.name()}
+
+		if p.accept("=") {
+			s := &numForStmt{name: names[0], start: p.expr()}
+			p.expect(",")
+			s.limit = p.expr()
+
+			if p.accept(",") {
+				s.step = p.expr()
+			}
+
+			p.expect("do")
+			s.body = p.block()
+			p.expect("end")
+			return s
+		}
+
+		for p.accept(",") {
+			names = append(names, p.name())
+		}
+
+		p.expect("in")
+		s := &genForStmt{names: names, exprs: p.exprList()}
+		p.expect("do")
+		s.body = p.block()
+		p.expect("end")
+		return s
+	case p.accept("do"):
+		s := &doStmt{body: p.block()}
+		p.expect("end")
+		return s
+	case p.accept("return"):
+		s := new(returnStmt)
+		t := p.peek()
+
+		if !(t.kind == tokEOF || t.kind == tokOp && (t.s == "end" || t.s == "else" || t.s == "elseif" || t.s == "until" || t.s == ";")) {
+			s.exprs = p.exprList()
+		}
+
+		return s
+	case p.accept("break"):
+		return new(breakStmt)
+	case p.is("function"):
+		p.fail("functions are not supported")
+	}
+
+	e := p.suffixedExpr()
+
+	if call, ok := e.(*callExpr); ok && !p.is("=") && !p.is(",") {
+		return &callStmt{call: call}
+	}
+
+	s := &assignStmt{targets: []luaExpr{e}}
+
+	for p.accept(",") {
+		s.targets = append(s.targets, p.suffixedExpr())
+	}
+
+	for _, target := range s.targets {
+		switch target.(type) {
+		case *nameExpr, *indexExpr:
+		default:
+			p.fail("syntax error")
+		}
+	}
+
+	p.expect("=")
+	s.exprs = p.exprList()
+	return s
+}
+
+func (p *luaParser) exprList() []luaExpr {
+	list := []luaExpr{p.expr()}
+
+	for p.accept(",") {
+		list = append(list, p.expr())
+	}
+
+	return list
+}
+
+// binary operator priorities, left and right, as in the Lua parser
+var luaPriority = map[string][2]int{
+	"or":  {1, 1},
+	"and": {2, 2},
+	"<":   {3, 3},
+	">":   {3, 3},
+	"<=":  {3, 3},
+	">=":  {3, 3},
+	"~=":  {3, 3},
+	"==":  {3, 3},
+	"..":  {5, 4},
+	"+":   {6, 6},
+	"-":   {6, 6},
+	"*":   {7, 7},
+	"/":   {7, 7},
+	"%":   {7, 7},
+	"^":   {10, 9},
+}
+
+const luaUnaryPriority = 8
+
+func (p *luaParser) expr() luaExpr {
+	return p.subExpr(0)
+}
+
+func (p *luaParser) subExpr(limit int) luaExpr {
+	var e luaExpr
+
+	if t := p.peek(); t.kind == tokOp && (t.s == "not" || t.s == "-" || t.s == "#") {
+		p.next()
+		e = &unExpr{op: t.s, e: p.subExpr(luaUnaryPriority)}
+	} else {
+		e = p.simpleExpr()
+	}
+
+	for {
+		t := p.peek()
+		prio, ok := luaPriority[t.s]
+
+		if t.kind != tokOp || !ok || prio[0] <= limit {
+			return e
+		}
+
+		p.next()
+		e = &binExpr{op: t.s, l: e, r: p.subExpr(prio[1])}
+	}
+}
+
+func (p *luaParser) simpleExpr() luaExpr {
+	t := p.peek()
+
+	switch {
+	case t.kind == tokNumber:
+		p.next()
+		return &constExpr{t.n}
+	case t.kind == tokString:
+		p.next()
+		return &constExpr{t.s}
+	case p.accept("nil"):
+		return &constExpr{nil}
+	case p.accept("true"):
+		return &constExpr{true}
+	case p.accept("false"):
+		return &constExpr{false}
+	case p.is("{"):
+		return p.table()
+	case p.is("function"), p.is("..."):
+		p.fail("functions are not supported")
+	}
+
+	return p.suffixedExpr()
+}
+
+func (p *luaParser) suffixedExpr() luaExpr {
+	var e luaExpr
+
+	switch t := p.peek(); {
+	case t.kind == tokName:
+		p.next()
+		e = &nameExpr{t.s}
+	case p.accept("("):
+		e = &parenExpr{p.expr()}
+		p.expect(")")
+	default:
+		p.fail("unexpected symbol")
+	}
+
+	for {
+		t := p.peek()
+
+		switch {
+		case p.accept("."):
+			e = &indexExpr{obj: e, key: &constExpr{p.name()}}
+		case p.accept("["):
+			e = &indexExpr{obj: e, key: p.expr()}
+			p.expect("]")
+		case p.is("("):
+			p.next()
+			call := &callExpr{fn: e}
+
+			if !p.is(")") {
+				call.args = p.exprList()
+			}
+
+			p.expect(")")
+			e = call
+		case t.kind == tokString:
+			p.next()
+			e = &callExpr{fn: e, args: []luaExpr{&constExpr{t.s}}}
+		case p.is("{"):
+			e = &callExpr{fn: e, args: []luaExpr{p.table()}}
+		case p.is(":"):
+			p.fail("method calls are not supported")
+		default:
+			return e
+		}
+	}
+}
+
+func (p *luaParser) table() luaExpr {
+	p.expect("{")
+	t := new(tableExpr)
+
+	for !p.is("}") {
+		var key luaExpr
+
+		if p.accept("[") {
+			key = p.expr()
+			p.expect("]")
+			p.expect("=")
+		} else if p.peek().kind == tokName && p.toks[p.pos+1].kind == tokOp && p.toks[p.pos+1].s == "=" {
+			key = &constExpr{p.name()}
+			p.next()
+		}
+
+		t.keys = append(t.keys, key)
+		t.values = append(t.values, p.expr())
+
+		if !p.accept(",") && !p.accept(";") {
+			break
+		}
+	}
+
+	p.expect("}")
+	return t
+}
+
+// interpreter
+
+type luaScope struct {
+	vars   map[string]interface{}
+	parent *luaScope
+}
+
+func (s *luaScope) lookup(name string) (*luaScope, bool) {
+	for ; s != nil; s = s.parent {
+		if _, ok := s.vars[name]; ok {
+			return s, true
+		}
+	}
+
+	return nil, false
+}
+
+type luaState struct {
+	globals *luaTable
+	line    int
+	// returned holds the values of the return statement being run.
+	returned []interface{}
+}
+
+const (
+	flowNormal = iota
+	flowBreak
+	flowReturn
+)
+
+// runLua runs block with globals and returns the values it returns.
+func runLua(block []luaStmt, globals *luaTable) (results []interface{}, err error) {
+	st := &luaState{globals: globals}
+
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(*luaError)
+
+			if !ok {
+				panic(r)
+			}
+
+			if !e.reply {
+				e = &luaError{msg: fmt.Sprintf("user_script:%d: %s", st.line, e.msg)}
+			}
+
+			err = e
+		}
+	}()
+
+	if st.exec(block, &luaScope{}) == flowReturn {
+		return st.returned, nil
+	}
+
+	return nil, nil
+}
+
+func (st *luaState) exec(block []luaStmt, parent *luaScope) int {
+	scope := &luaScope{vars: make(map[string]interface{}), parent: parent}
+
+	for _, stmt := range block {
+		st.line = stmt.line
+
+		if flow := st.execStmt(stmt.s, scope); flow != flowNormal {
+			return flow
+		}
+	}
+
+	return flowNormal
+}
+
+func (st *luaState) execStmt(s interface{}, scope *luaScope) int {
+	switch s := s.(type) {
+	case *localStmt:
+		values := st.evalList(s.exprs, scope)
+
+		for i, name := range s.names {
+			var v interface{}
+
+			if i < len(values) {
+				v = values[i]
+			}
+
+			scope.vars[name] = v
+		}
+	case *assignStmt:
+		values := st.evalList(s.exprs, scope)
+
+		for i, target := range s.targets {
+			var v interface{}
+
+			if i < len(values) {
+				v = values[i]
+			}
+
+			st.assign(target, v, scope)
+		}
+	case *callStmt:
+		st.call(s.call, scope)
+	case *ifStmt:
+		for i, cond := range s.conds {
+			if luaTruthy(st.eval(cond, scope)) {
+				return st.exec(s.blocks[i], scope)
+			}
+		}
+
+		if s.els != nil {
+			return st.exec(s.els, scope)
+		}
+	case *whileStmt:
+		for luaTruthy(st.eval(s.cond, scope)) {
+			if flow := st.exec(s.body, scope); flow == flowBreak {
+				break
+			} else if flow == flowReturn {
+				return flow
+			}
+		}
+	case *repeatStmt:
+		for {
+			// the condition sees the locals of the body
+			body := &luaScope{vars: make(map[string]interface{}), parent: scope}
+			flow := flowNormal
+
+			for _, stmt := range s.body {
+				st.line = stmt.line
+
+				if flow = st.execStmt(stmt.s, body); flow != flowNormal {
+					break
+				}
+			}
+
+			if flow == flowBreak {
+				break
+			}
+
+			if flow == flowReturn {
+				return flow
+			}
+
+			if luaTruthy(st.eval(s.cond, body)) {
+				break
+			}
+		}
+	case *numForStmt:
+		start := st.number(st.eval(s.start, scope), "'for' initial value")
+		limit := st.number(st.eval(s.limit, scope), "'for' limit")
+		step := 1.0
+
+		if s.step != nil {
+			step = st.number(st.eval(s.step, scope), "'for' step")
+		}
+
+		for i := start; step > 0 && i <= limit || step <= 0 && i >= limit; i += step {
+			body := &luaScope{vars: map[string]interface{}{s.name: i}, parent: scope}
+
+			if flow := st.exec(s.body, body); flow == flowBreak {
+				break
+			} else if flow == flowReturn {
+				return flow
+			}
+		}
+	case *genForStmt:
+		values := st.evalList(s.exprs, scope)
+		values = append(values, nil, nil, nil)
+		fn, ok := values[0].(luaFunction)
+
+		if !ok {
+			luaRaise("attempt to call a %s value", luaType(values[0]))
+		}
+
+		state, control := values[1], values[2]
+
+		for {
+			results := fn([]interface{}{state, control})
+
+			if len(results) == 0 || results[0] == nil {
+				break
+			}
+
+			control = results[0]
+			body := &luaScope{vars: make(map[string]interface{}), parent: scope}
+
+			for i, name := range s.names {
+				var v interface{}
+
+				if i < len(results) {
+					v = results[i]
+				}
+
+				body.vars[name] = v
+			}
+
+			if flow := st.exec(s.body, body); flow == flowBreak {
+				break
+			} else if flow == flowReturn {
+				return flow
+			}
+		}
+	case *doStmt:
+		return st.exec(s.body, scope)
+	case *returnStmt:
+		st.returned = st.evalList(s.exprs, scope)
+		return flowReturn
+	case *breakStmt:
+		return flowBreak
+	}
+
+	return flowNormal
+}
+
+func (st *luaState) assign(target luaExpr, v interface{}, scope *luaScope) {
+	switch t := target.(type) {
+	case *nameExpr:
+		if s, ok := scope.lookup(t.name); ok {
+			s.vars[t.name] = v
+			return
+		}
+
+		st.globals.set(t.name, v)
+	case *indexExpr:
+		obj := st.eval(t.obj, scope)
+		tbl, ok := obj.(*luaTable)
+
+		if !ok {
+			luaRaise("attempt to index a %s value", luaType(obj))
+		}
+
+		tbl.set(st.eval(t.key, scope), v)
+	}
+}
+
+// evalList evaluates exprs, expanding the values of a last call.
+func (st *luaState) evalList(exprs []luaExpr, scope *luaScope) []interface{} {
+	var values []interface{}
+
+	for i, e := range exprs {
+		if call, ok := e.(*callExpr); ok && i == len(exprs)-1 {
+			return append(values, st.call(call, scope)...)
+		}
+
+		values = append(values, st.eval(e, scope))
+	}
+
+	return values
+}
+
+func (st *luaState) call(c *callExpr, scope *luaScope) []interface{} {
+	v := st.eval(c.fn, scope)
+	fn, ok := v.(luaFunction)
+
+	if !ok {
+		luaRaise("attempt to call a %s value", luaType(v))
+	}
+
+	return fn(st.evalList(c.args, scope))
+}
+
+func (st *luaState) eval(e luaExpr, scope *luaScope) interface{} {
+	switch e := e.(type) {
+	case *constExpr:
+		return e.v
+	case *nameExpr:
+		if s, ok := scope.lookup(e.name); ok {
+			return s.vars[e.name]
+		}
+
+		return st.globals.get(e.name)
+	case *indexExpr:
+		obj := st.eval(e.obj, scope)
+		tbl, ok := obj.(*luaTable)
+
+		if !ok {
+			luaRaise("attempt to index a %s value", luaType(obj))
+		}
+
+		return tbl.get(st.eval(e.key, scope))
+	case *callExpr:
+		if results := st.call(e, scope); len(results) > 0 {
+			return results[0]
+		}
+
+		return nil
+	case *parenExpr:
+		return st.eval(e.e, scope)
+	case *tableExpr:
+		t := new(luaTable)
+		n := 0
+
+		for i, value := range e.values {
+			if e.keys[i] != nil {
+				t.set(st.eval(e.keys[i], scope), st.eval(value, scope))
+				continue
+			}
+
+			values := []interface{}{st.eval(value, scope)}
+
+			if call, ok := value.(*callExpr); ok && i == len(e.values)-1 {
+				values = st.call(call, scope)
+			}
+
+			for _, v := range values {
+				n++
+				t.set(float64(n), v)
+			}
+		}
+
+		return t
+	case *unExpr:
+		v := st.eval(e.e, scope)
+
+		switch e.op {
+		case "not":
+			return !luaTruthy(v)
+		case "-":
+			return -st.arith(v)
+		default:
+			switch v := v.(type) {
+			case string:
+				return float64(len(v))
+			case *luaTable:
+				return float64(v.len())
+			}
+
+			luaRaise("attempt to get length of a %s value", luaType(v))
+		}
+	case *binExpr:
+		return st.binary(e, scope)
+	}
+
+	return nil
+}
+
+func (st *luaState) binary(e *binExpr, scope *luaScope) interface{} {
+	l := st.eval(e.l, scope)
+
+	switch e.op {
+	case "and":
+		if !luaTruthy(l) {
+			return l
+		}
+
+		return st.eval(e.r, scope)
+	case "or":
+		if luaTruthy(l) {
+			return l
+		}
+
+		return st.eval(e.r, scope)
+	}
+
+	r := st.eval(e.r, scope)
+
+	switch e.op {
+	case "+":
+		return st.arith(l) + st.arith(r)
+	case "-":
+		return st.arith(l) - st.arith(r)
+	case "*":
+		return st.arith(l) * st.arith(r)
+	case "/":
+		return st.arith(l) / st.arith(r)
+	case "%":
+		a, b := st.arith(l), st.arith(r)
+		return a - math.Floor(a/b)*b
+	case "^":
+		return math.Pow(st.arith(l), st.arith(r))
+	case "..":
+		return st.concat(l) + st.concat(r)
+	case "==":
+		return luaEqual(l, r)
+	case "~=":
+		return !luaEqual(l, r)
+	case "<":
+		return luaLess(l, r)
+	case ">":
+		return luaLess(r, l)
+	case "<=":
+		return !luaLess(r, l)
+	case ">=":
+		return !luaLess(l, r)
+	}
+
+	return nil
+}
+
+func (st *luaState) arith(v interface{}) float64 {
+	if n, ok := luaToNumber(v); ok {
+		return n
+	}
+
+	luaRaise("attempt to perform arithmetic on a %s value", luaType(v))
+	return 0
+}
+
+func (st *luaState) number(v interface{}, what string) float64 {
+	if n, ok := luaToNumber(v); ok {
+		return n
+	}
+
+	luaRaise("%s must be a number", what)
+	return 0
+}
+
+func (st *luaState) concat(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return formatLuaNumber(v)
+	}
+
+	luaRaise("attempt to concatenate a %s value", luaType(v))
+	return ""
+}
+
+func luaTruthy(v interface{}) bool {
+	return v != nil && v != false
+}
+
+func luaEqual(a, b interface{}) bool {
+	return a == b
+}
+
+func luaLess(a, b interface{}) bool {
+	switch a := a.(type) {
+	case float64:
+		if b, ok := b.(float64); ok {
+			return a < b
+		}
+	case string:
+		if b, ok := b.(string); ok {
+			return a < b
+		}
+	}
+
+	if luaType(a) == luaType(b) {
+		luaRaise("attempt to compare two %s values", luaType(a))
+	}
+
+	luaRaise("attempt to compare %s with %s", luaType(a), luaType(b))
+	return false
+}
+
+func luaToNumber(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case string:
+		return parseLuaNumber(v)
+	}
+
+	return 0, false
+}
+
+func luaType(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case *luaTable:
+		return "table"
+	case luaFunction:
+		return "function"
+	}
+
+	return "userdata"
+}
+
+// formatLuaNumber formats n as Lua 5.1 does.
+func formatLuaNumber(n float64) string {
+	switch {
+	case math.IsInf(n, 1):
+		return "inf"
+	case math.IsInf(n, -1):
+		return "-inf"
+	case math.IsNaN(n):
+		return "nan"
+	}
+
+	return strconv.FormatFloat(n, 'g', 14, 64)
+}
+
+func luaToString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return formatLuaNumber(v)
+	case string:
+		return v
+	}
+
+	return fmt.Sprintf("%s: %p", luaType(v), v)
+}
+
+// library
+
+func luaArg(args []interface{}, i int) interface{} {
+	if i < len(args) {
+		return args[i]
+	}
+
+	return nil
+}
+
+func luaNumberArg(args []interface{}, i int, fn string) float64 {
+	n, ok := luaToNumber(luaArg(args, i))
+
+	if !ok {
+		luaRaise("bad argument #%d to '%s' (number expected, got %s)", i+1, fn, luaType(luaArg(args, i)))
+	}
+
+	return n
+}
+
+func luaStringArg(args []interface{}, i int, fn string) string {
+	switch v := luaArg(args, i).(type) {
+	case string:
+		return v
+	case float64:
+		return formatLuaNumber(v)
+	}
+
+	luaRaise("bad argument #%d to '%s' (string expected, got %s)", i+1, fn, luaType(luaArg(args, i)))
+	return ""
+}
+
+func luaTableArg(args []interface{}, i int, fn string) *luaTable {
+	t, ok := luaArg(args, i).(*luaTable)
+
+	if !ok {
+		luaRaise("bad argument #%d to '%s' (table expected, got %s)", i+1, fn, luaType(luaArg(args, i)))
+	}
+
+	return t
+}
+
+func luaNumberFunc(name string, f func(float64) float64) luaFunction {
+	return func(args []interface{}) []interface{} {
+		return []interface{}{f(luaNumberArg(args, 0, name))}
+	}
+}
+
+// newLuaGlobals returns the globals of the standard library subset.
+func newLuaGlobals() *luaTable {
+	g := new(luaTable)
+
+	g.set("tonumber", luaFunction(func(args []interface{}) []interface{} {
+		v := luaArg(args, 0)
+
+		if base, ok := luaToNumber(luaArg(args, 1)); ok && base != 10 {
+			n, err := strconv.ParseInt(strings.TrimSpace(luaToString(v)), int(base), 64)
+
+			if err != nil {
+				return []interface{}{nil}
+			}
+
+			return []interface{}{float64(n)}
+		}
+
+		if n, ok := luaToNumber(v); ok {
+			return []interface{}{n}
+		}
+
+		return []interface{}{nil}
+	}))
+	g.set("tostring", luaFunction(func(args []interface{}) []interface{} {
+		return []interface{}{luaToString(luaArg(args, 0))}
+	}))
+	g.set("type", luaFunction(func(args []interface{}) []interface{} {
+		return []interface{}{luaType(luaArg(args, 0))}
+	}))
+	g.set("error", luaFunction(func(args []interface{}) []interface{} {
+		if t, ok := luaArg(args, 0).(*luaTable); ok {
+			if msg, ok := t.get("err").(string); ok {
+				panic(&luaError{msg: msg, reply: true})
+			}
+		}
+
+		luaRaise("%s", luaToString(luaArg(args, 0)))
+		return nil
+	}))
+	g.set("assert", luaFunction(func(args []interface{}) []interface{} {
+		if !luaTruthy(luaArg(args, 0)) {
+			if msg := luaArg(args, 1); msg != nil {
+				luaRaise("%s", luaToString(msg))
+			}
+
+			luaRaise("assertion failed!")
+		}
+
+		return args
+	}))
+	g.set("pcall", luaFunction(func(args []interface{}) (results []interface{}) {
+		fn, ok := luaArg(args, 0).(luaFunction)
+
+		if !ok {
+			return []interface{}{false, "attempt to call a " + luaType(luaArg(args, 0)) + " value"}
+		}
+
+		defer func() {
+			if r := recover(); r != nil {
+				e, ok := r.(*luaError)
+
+				if !ok {
+					panic(r)
+				}
+
+				results = []interface{}{false, e.msg}
+			}
+		}()
+
+		return append([]interface{}{true}, fn(args[1:])...)
+	}))
+	g.set("unpack", luaFunction(luaUnpack))
+	g.set("ipairs", luaFunction(func(args []interface{}) []interface{} {
+		t := luaTableArg(args, 0, "ipairs")
+
+		next := luaFunction(func(args []interface{}) []interface{} {
+			i, _ := luaToNumber(luaArg(args, 1))
+
+			if v := t.get(i + 1); v != nil {
+				return []interface{}{i + 1, v}
+			}
+
+			return []interface{}{nil}
+		})
+
+		return []interface{}{next, t, 0.0}
+	}))
+	g.set("pairs", luaFunction(func(args []interface{}) []interface{} {
+		t := luaTableArg(args, 0, "pairs")
+		keys := t.keys()
+		i := 0
+
+		next := luaFunction(func([]interface{}) []interface{} {
+			for ; i < len(keys); i++ {
+				if v := t.get(keys[i]); v != nil {
+					i++
+					return []interface{}{keys[i-1], v}
+				}
+			}
+
+			return []interface{}{nil}
+		})
+
+		return []interface{}{next, t, nil}
+	}))
+
+	m := new(luaTable)
+	m.set("floor", luaNumberFunc("floor", math.Floor))
+	m.set("ceil", luaNumberFunc("ceil", math.Ceil))
+	m.set("abs", luaNumberFunc("abs", math.Abs))
+	m.set("sqrt", luaNumberFunc("sqrt", math.Sqrt))
+	m.set("huge", math.Inf(1))
+	m.set("pow", luaFunction(func(args []interface{}) []interface{} {
+		return []interface{}{math.Pow(luaNumberArg(args, 0, "pow"), luaNumberArg(args, 1, "pow"))}
+	}))
+	m.set("fmod", luaFunction(func(args []interface{}) []interface{} {
+		return []interface{}{math.Mod(luaNumberArg(args, 0, "fmod"), luaNumberArg(args, 1, "fmod"))}
+	}))
+	m.set("max", luaFunction(func(args []interface{}) []interface{} {
+		n := luaNumberArg(args, 0, "max")
+
+		for i := 1; i < len(args); i++ {
+			n = math.Max(n, luaNumberArg(args, i, "max"))
+		}
+
+		return []interface{}{n}
+	}))
+	m.set("min", luaFunction(func(args []interface{}) []interface{} {
+		n := luaNumberArg(args, 0, "min")
+
+		for i := 1; i < len(args); i++ {
+			n = math.Min(n, luaNumberArg(args, i, "min"))
+		}
+
+		return []interface{}{n}
+	}))
+	g.set("math", m)
+
+	s := new(luaTable)
+	s.set("len", luaFunction(func(args []interface{}) []interface{} {
+		return []interface{}{float64(len(luaStringArg(args, 0, "len")))}
+	}))
+	s.set("upper", luaFunction(func(args []interface{}) []interface{} {
+		return []interface{}{strings.ToUpper(luaStringArg(args, 0, "upper"))}
+	}))
+	s.set("lower", luaFunction(func(args []interface{}) []interface{} {
+		return []interface{}{strings.ToLower(luaStringArg(args, 0, "lower"))}
+	}))
+	s.set("rep", luaFunction(func(args []interface{}) []interface{} {
+		n := int(luaNumberArg(args, 1, "rep"))
+
+		if n < 0 {
+			n = 0
+		}
+
+		return []interface{}{strings.Repeat(luaStringArg(args, 0, "rep"), n)}
+	}))
+	s.set("sub", luaFunction(func(args []interface{}) []interface{} {
+		str := luaStringArg(args, 0, "sub")
+		i, j := 1.0, -1.0
+
+		if luaArg(args, 1) != nil {
+			i = luaNumberArg(args, 1, "sub")
+		}
+
+		if luaArg(args, 2) != nil {
+			j = luaNumberArg(args, 2, "sub")
+		}
+
+		start, end := luaStringIndex(int(i), len(str)), luaStringIndex(int(j), len(str))
+
+		if start < 1 {
+			start = 1
+		}
+
+		if end > len(str) {
+			end = len(str)
+		}
+
+		if start > end {
+			return []interface{}{""}
+		}
+
+		return []interface{}{str[start-1 : end]}
+	}))
+	s.set("format", luaFunction(luaFormat))
+	g.set("string", s)
+
+	t := new(luaTable)
+	t.set("insert", luaFunction(func(args []interface{}) []interface{} {
+		tbl := luaTableArg(args, 0, "insert")
+
+		if len(args) < 3 {
+			tbl.set(float64(tbl.len()+1), luaArg(args, 1))
+			return nil
+		}
+
+		pos := int(luaNumberArg(args, 1, "insert"))
+
+		for i := tbl.len(); i >= pos; i-- {
+			tbl.set(float64(i+1), tbl.get(float64(i)))
+		}
+
+		tbl.set(float64(pos), args[2])
+		return nil
+	}))
+	t.set("remove", luaFunction(func(args []interface{}) []interface{} {
+		tbl := luaTableArg(args, 0, "remove")
+		n := tbl.len()
+
+		if n == 0 {
+			return []interface{}{nil}
+		}
+
+		pos := n
+
+		if len(args) > 1 {
+			pos = int(luaNumberArg(args, 1, "remove"))
+		}
+
+		v := tbl.get(float64(pos))
+
+		for i := pos; i < n; i++ {
+			tbl.set(float64(i), tbl.get(float64(i+1)))
+		}
+
+		tbl.set(float64(n), nil)
+		return []interface{}{v}
+	}))
+	t.set("concat", luaFunction(func(args []interface{}) []interface{} {
+		tbl := luaTableArg(args, 0, "concat")
+		sep := ""
+
+		if luaArg(args, 1) != nil {
+			sep = luaStringArg(args, 1, "concat")
+		}
+
+		parts := make([]string, tbl.len())
+
+		for i := range parts {
+			parts[i] = luaStringArg([]interface{}{tbl.get(float64(i + 1))}, 0, "concat")
+		}
+
+		return []interface{}{strings.Join(parts, sep)}
+	}))
+	t.set("getn", luaFunction(func(args []interface{}) []interface{} {
+		return []interface{}{float64(luaTableArg(args, 0, "getn").len())}
+	}))
+	g.set("table", t)
+	return g
+}
+
+func luaStringIndex(i, n int) int {
+	if i < 0 {
+		return n + i + 1
+	}
+
+	return i
+}
+
+func luaUnpack(args []interface{}) []interface{} {
+	t := luaTableArg(args, 0, "unpack")
+	i, j := 1, t.len()
+
+	if luaArg(args, 1) != nil {
+		i = int(luaNumberArg(args, 1, "unpack"))
+	}
+
+	if luaArg(args, 2) != nil {
+		j = int(luaNumberArg(args, 2, "unpack"))
+	}
+
+	var values []interface{}
+
+	for ; i <= j; i++ {
+		values = append(values, t.get(float64(i)))
+	}
+
+	return values
+}
+
+// luaFormat implements string.format for the d, i, s, q, f, g, e, x and
+// c conversions.
+func luaFormat(args []interface{}) []interface{} {
+	format := luaStringArg(args, 0, "format")
+	var b strings.Builder
+	n := 1
+
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			b.WriteByte(format[i])
+			continue
+		}
+
+		j := i + 1
+
+		for j < len(format) && strings.IndexByte("-+ #0123456789.", format[j]) >= 0 {
+			j++
+		}
+
+		if j == len(format) {
+			luaRaise("invalid option to 'format'")
+		}
+
+		spec, verb := format[i:j], format[j]
+		i = j
+
+		switch verb {
+		case '%':
+			b.WriteByte('%')
+			continue
+		case 'd', 'i':
+			fmt.Fprintf(&b, spec+"d", int64(luaNumberArg(args, n, "format")))
+		case 'x', 'X':
+			fmt.Fprintf(&b, spec+string(verb), int64(luaNumberArg(args, n, "format")))
+		case 'c':
+			b.WriteByte(byte(luaNumberArg(args, n, "format")))
+		case 'f', 'g', 'e', 'G', 'E':
+			fmt.Fprintf(&b, spec+string(verb), luaNumberArg(args, n, "format"))
+		case 's':
+			fmt.Fprintf(&b, spec+"s", luaToString(luaArg(args, n)))
+		case 'q':
+			b.WriteString(strconv.Quote(luaStringArg(args, n, "format")))
+		default:
+			luaRaise("invalid option '%%%c' to 'format'", verb)
+		}
+
+		n++
+	}
+
+	return []interface{}{b.String()}
+}
@@ -0,0 +1,101 @@
+package kvtest
+
+import (
+	"sort"
+	"strings"
+)
+
+// subscribed reports whether c is in subscriber mode.
+func (c *client) subscribed() bool {
+	return len(c.channels)+len(c.patterns) > 0
+}
+
+func cmdSubscribe(c *client, args []string) {
+	set := &c.channels
+	kind := "subscribe"
+
+	if strings.EqualFold(args[0], "PSUBSCRIBE") {
+		set = &c.patterns
+		kind = "psubscribe"
+	}
+
+	if *set == nil {
+		*set = make(map[string]struct{})
+	}
+
+	for _, name := range args[1:] {
+		(*set)[name] = struct{}{}
+		c.w.array(3)
+		c.w.bulk(kind)
+		c.w.bulk(name)
+		c.w.int(int64(len(c.channels) + len(c.patterns)))
+	}
+}
+
+func cmdUnsubscribe(c *client, args []string) {
+	set := c.channels
+	kind := "unsubscribe"
+
+	if strings.EqualFold(args[0], "PUNSUBSCRIBE") {
+		set = c.patterns
+		kind = "punsubscribe"
+	}
+
+	names := args[1:]
+
+	if len(names) == 0 {
+		for name := range set {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+	}
+
+	if len(names) == 0 {
+		c.w.array(3)
+		c.w.bulk(kind)
+		c.w.null()
+		c.w.int(int64(len(c.channels) + len(c.patterns)))
+		return
+	}
+
+	for _, name := range names {
+		delete(set, name)
+		c.w.array(3)
+		c.w.bulk(kind)
+		c.w.bulk(name)
+		c.w.int(int64(len(c.channels) + len(c.patterns)))
+	}
+}
+
+func cmdPublish(c *client, args []string) {
+	channel, message := args[1], args[2]
+	var n int64
+
+	for other := range c.srv.clients {
+		if _, ok := other.channels[channel]; ok {
+			other.w.array(3)
+			other.w.bulk("message")
+			other.w.bulk(channel)
+			other.w.bulk(message)
+			n++
+		}
+
+		for pattern := range other.patterns {
+			if match(pattern, channel) {
+				other.w.array(4)
+				other.w.bulk("pmessage")
+				other.w.bulk(pattern)
+				other.w.bulk(channel)
+				other.w.bulk(message)
+				n++
+			}
+		}
+
+		if other != c {
+			other.w.Flush()
+		}
+	}
+
+	c.w.int(n)
+}
@@ -0,0 +1,134 @@
+package kvtest
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var errProtocol = errors.New("kvtest: protocol error")
+
+// readCommand reads a single command from r. Commands are either RESP
+// multi-bulk arrays, as sent by redigo, or inline commands separated by
+// spaces, as typed into telnet.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) == 0 {
+		return nil, nil
+	}
+
+	if line[0] != '*' {
+		return strings.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+
+	if err != nil || n < 0 {
+		return nil, errProtocol
+	}
+
+	args := make([]string, 0, n)
+
+	for i := 0; i < n; i++ {
+		line, err := readLine(r)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errProtocol
+		}
+
+		size, err := strconv.Atoi(line[1:])
+
+		if err != nil || size < 0 {
+			return nil, errProtocol
+		}
+
+		buf := make([]byte, size+2)
+
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+
+		if buf[size] != '\r' || buf[size+1] != '\n' {
+			return nil, errProtocol
+		}
+
+		args = append(args, string(buf[:size]))
+	}
+
+	return args, nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// writer encodes replies in the RESP2 format.
+type writer struct {
+	*bufio.Writer
+}
+
+func (w writer) status(s string) {
+	fmt.Fprintf(w, "+%s\r\n", s)
+}
+
+func (w writer) ok() {
+	w.status("OK")
+}
+
+func (w writer) error(s string) {
+	fmt.Fprintf(w, "-%s\r\n", s)
+}
+
+func (w writer) int(n int64) {
+	fmt.Fprintf(w, ":%d\r\n", n)
+}
+
+func (w writer) bool(b bool) {
+	if b {
+		w.int(1)
+	} else {
+		w.int(0)
+	}
+}
+
+func (w writer) bulk(s string) {
+	fmt.Fprintf(w, "$%d\r\n%s\r\n", len(s), s)
+}
+
+func (w writer) null() {
+	w.WriteString("$-1\r\n")
+}
+
+func (w writer) nullArray() {
+	w.WriteString("*-1\r\n")
+}
+
+func (w writer) array(n int) {
+	fmt.Fprintf(w, "*%d\r\n", n)
+}
+
+func (w writer) bulks(values []string) {
+	w.array(len(values))
+
+	for _, v := range values {
+		w.bulk(v)
+	}
+}
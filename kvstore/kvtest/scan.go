@@ -0,0 +1,141 @@
+package kvtest
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The scan commands treat the cursor as an offset into the sorted
+// elements. Like redis, an element may be returned twice if the
+// collection changes during a scan.
+
+func cmdKeys(c *client, args []string) {
+	var keys []string
+
+	for _, k := range c.db().keys(c.now()) {
+		if match(args[1], k) {
+			keys = append(keys, k)
+		}
+	}
+
+	c.w.bulks(keys)
+}
+
+func cmdScan(c *client, args []string) {
+	name := strings.ToUpper(args[0])
+	rest := args[1:]
+	var elements []string
+	var values map[string]string
+
+	if name == "SCAN" {
+		elements = c.db().keys(c.now())
+	} else {
+		key := rest[0]
+		rest = rest[1:]
+		values = make(map[string]string)
+
+		switch name {
+		case "SSCAN":
+			s, ok := c.setAt(key, false)
+
+			if !ok {
+				return
+			}
+
+			for m := range s {
+				elements = append(elements, m)
+			}
+		case "HSCAN":
+			h, ok := c.hashAt(key, false)
+
+			if !ok {
+				return
+			}
+
+			for f, v := range h {
+				elements = append(elements, f)
+				values[f] = v
+			}
+		case "ZSCAN":
+			z, ok := c.zsetAt(key, false)
+
+			if !ok {
+				return
+			}
+
+			for m, score := range z {
+				elements = append(elements, m)
+				values[m] = formatFloat(score)
+			}
+		}
+
+		sort.Strings(elements)
+	}
+
+	cursor, err := strconv.Atoi(rest[0])
+
+	if err != nil || cursor < 0 {
+		c.w.error("ERR invalid cursor")
+		return
+	}
+
+	pattern, kind, count := "*", "", 10
+
+	for i := 1; i < len(rest); i += 2 {
+		if i+1 >= len(rest) {
+			c.w.error(errSyntax)
+			return
+		}
+
+		switch strings.ToUpper(rest[i]) {
+		case "MATCH":
+			pattern = rest[i+1]
+		case "COUNT":
+			if count, err = strconv.Atoi(rest[i+1]); err != nil || count < 1 {
+				c.w.error(errSyntax)
+				return
+			}
+		case "TYPE":
+			if name != "SCAN" {
+				c.w.error(errSyntax)
+				return
+			}
+
+			kind = strings.ToLower(rest[i+1])
+		default:
+			c.w.error(errSyntax)
+			return
+		}
+	}
+
+	next := cursor + count
+
+	if next >= len(elements) {
+		next = 0
+	}
+
+	var reply []string
+
+	for i := cursor; i < cursor+count && i < len(elements); i++ {
+		e := elements[i]
+
+		if !match(pattern, e) {
+			continue
+		}
+
+		if kind != "" && typeName(c.db().get(e, c.now()).value) != kind {
+			continue
+		}
+
+		reply = append(reply, e)
+
+		if values != nil {
+			reply = append(reply, values[e])
+		}
+	}
+
+	c.w.array(2)
+	c.w.bulk(strconv.Itoa(next))
+	c.w.bulks(reply)
+}
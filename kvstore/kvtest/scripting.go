@@ -0,0 +1,393 @@
+package kvtest
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// script is a script cached by EVAL or SCRIPT LOAD.
+type script struct {
+	src   string
+	chunk []luaStmt
+}
+
+func sha1hex(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// loadScript compiles src and caches it under its sha. The caller holds
+// srv.mu.
+func (s *Server) loadScript(src string) (string, error) {
+	sha := sha1hex(src)
+
+	if _, ok := s.scripts[sha]; ok {
+		return sha, nil
+	}
+
+	chunk, err := parseLua(src)
+
+	if err != nil {
+		return "", fmt.Errorf("ERR Error compiling script (new function): %v", err)
+	}
+
+	if s.scripts == nil {
+		s.scripts = make(map[string]*script)
+	}
+
+	s.scripts[sha] = &script{src: src, chunk: chunk}
+	return sha, nil
+}
+
+// FlushScripts empties the script cache, as if the server had restarted.
+func (s *Server) FlushScripts() {
+	s.mu.Lock()
+	s.scripts = nil
+	s.mu.Unlock()
+}
+
+func cmdEval(c *client, args []string) {
+	var sc *script
+
+	if strings.EqualFold(args[0], "EVALSHA") {
+		if sc = c.srv.scripts[strings.ToLower(args[1])]; sc == nil {
+			c.w.error("NOSCRIPT No matching script. Please use EVAL.")
+			return
+		}
+	} else {
+		sha, err := c.srv.loadScript(args[1])
+
+		if err != nil {
+			c.w.error(err.Error())
+			return
+		}
+
+		sc = c.srv.scripts[sha]
+	}
+
+	n, err := strconv.Atoi(args[2])
+
+	switch {
+	case err != nil:
+		c.w.error("ERR value is not an integer or out of range")
+		return
+	case n < 0:
+		c.w.error("ERR Number of keys can't be negative")
+		return
+	case n > len(args)-3:
+		c.w.error("ERR Number of keys can't be greater than number of args")
+		return
+	}
+
+	keys, argv := newLuaTable(), newLuaTable()
+
+	for _, key := range args[3 : 3+n] {
+		keys.set(float64(keys.len()+1), key)
+	}
+
+	for _, arg := range args[3+n:] {
+		argv.set(float64(argv.len()+1), arg)
+	}
+
+	globals := newLuaGlobals()
+	globals.set("KEYS", keys)
+	globals.set("ARGV", argv)
+	globals.set("redis", c.redisLib())
+	results, err := runLua(sc.chunk, globals)
+
+	if err != nil {
+		if e, ok := err.(*luaError); ok && e.reply {
+			c.w.error(e.msg)
+		} else {
+			c.w.error(fmt.Sprintf("ERR Error running script (call to f_%s): @user_script:%s", sha1hex(sc.src), strings.TrimPrefix(err.Error(), "user_script:")))
+		}
+		return
+	}
+
+	var result interface{}
+
+	if len(results) > 0 {
+		result = results[0]
+	}
+
+	c.writeLua(result)
+}
+
+func cmdScript(c *client, args []string) {
+	switch strings.ToUpper(args[1]) {
+	case "LOAD":
+		if len(args) != 3 {
+			c.w.error("ERR wrong number of arguments for 'script|load' command")
+			return
+		}
+
+		sha, err := c.srv.loadScript(args[2])
+
+		if err != nil {
+			c.w.error(err.Error())
+			return
+		}
+
+		c.w.bulk(sha)
+	case "EXISTS":
+		c.w.array(len(args) - 2)
+
+		for _, sha := range args[2:] {
+			_, ok := c.srv.scripts[strings.ToLower(sha)]
+			c.w.bool(ok)
+		}
+	case "FLUSH":
+		c.srv.scripts = nil
+		c.w.ok()
+	default:
+		c.w.error(fmt.Sprintf("ERR unknown subcommand '%s'", args[1]))
+	}
+}
+
+// redisLib returns the redis table of scripts run by c.
+func (c *client) redisLib() *luaTable {
+	lib := new(luaTable)
+	lib.set("call", luaFunction(func(args []interface{}) []interface{} {
+		return []interface{}{c.call(args, false)}
+	}))
+	lib.set("pcall", luaFunction(func(args []interface{}) []interface{} {
+		return []interface{}{c.call(args, true)}
+	}))
+	lib.set("status_reply", luaFunction(func(args []interface{}) []interface{} {
+		t := new(luaTable)
+		t.set("ok", luaStringArg(args, 0, "status_reply"))
+		return []interface{}{t}
+	}))
+	lib.set("error_reply", luaFunction(func(args []interface{}) []interface{} {
+		t := new(luaTable)
+		t.set("err", luaStringArg(args, 0, "error_reply"))
+		return []interface{}{t}
+	}))
+	lib.set("sha1hex", luaFunction(func(args []interface{}) []interface{} {
+		return []interface{}{sha1hex(luaStringArg(args, 0, "sha1hex"))}
+	}))
+	lib.set("replicate_commands", luaFunction(func([]interface{}) []interface{} {
+		return []interface{}{true}
+	}))
+	lib.set("log", luaFunction(func([]interface{}) []interface{} {
+		return nil
+	}))
+
+	for i, level := range []string{"LOG_DEBUG", "LOG_VERBOSE", "LOG_NOTICE", "LOG_WARNING"} {
+		lib.set(level, float64(i))
+	}
+
+	return lib
+}
+
+// call runs a command for redis.call, or redis.pcall if protected, on a
+// client sharing the database of c and returns the reply converted to
+// Lua.
+func (c *client) call(args []interface{}, protected bool) interface{} {
+	fail := func(msg string) interface{} {
+		if protected {
+			t := new(luaTable)
+			t.set("err", msg)
+			return t
+		}
+
+		panic(&luaError{msg: msg, reply: true})
+	}
+
+	if len(args) == 0 {
+		return fail("ERR Please specify at least one argument for this redis lib call")
+	}
+
+	cmdArgs := make([]string, len(args))
+
+	for i, arg := range args {
+		switch arg := arg.(type) {
+		case string:
+			cmdArgs[i] = arg
+		case float64:
+			cmdArgs[i] = formatLuaNumber(arg)
+		default:
+			return fail("ERR Lua redis lib command arguments must be strings or integers")
+		}
+	}
+
+	name := strings.ToUpper(cmdArgs[0])
+	cmd, ok := commands[name]
+
+	if !ok || c.srv.disabled[name] {
+		return fail("ERR Unknown Redis command called from script")
+	}
+
+	if cmd.immediate || cmd.pubsub || name == "EVAL" || name == "EVALSHA" || name == "SCRIPT" {
+		return fail("ERR This Redis command is not allowed from script")
+	}
+
+	if (cmd.arity > 0 && len(cmdArgs) != cmd.arity) || (cmd.arity < 0 && len(cmdArgs) < -cmd.arity) {
+		return fail("ERR Wrong number of args calling Redis command from script")
+	}
+
+	var buf bytes.Buffer
+	sub := &client{
+		srv:     c.srv,
+		id:      c.id,
+		dbIndex: c.dbIndex,
+		authed:  true,
+		exec:    true,
+		w:       writer{bufio.NewWriter(&buf)},
+	}
+
+	cmd.fn(sub, cmdArgs)
+	sub.w.Flush()
+	c.dbIndex = sub.dbIndex
+	reply, err := readReply(bufio.NewReader(&buf))
+
+	if err != nil {
+		luaRaise("%v", err)
+	}
+
+	if e, ok := reply.(replyError); ok {
+		return fail(string(e))
+	}
+
+	return replyToLua(reply)
+}
+
+type (
+	replyStatus string
+	replyError  string
+)
+
+// readReply reads a RESP reply, returning strings for bulks, int64 for
+// integers, nil for nulls and slices for arrays.
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := readLine(r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) == 0 {
+		return nil, errProtocol
+	}
+
+	switch line[0] {
+	case '+':
+		return replyStatus(line[1:]), nil
+	case '-':
+		return replyError(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+
+		if err != nil || n < 0 {
+			return nil, err
+		}
+
+		buf := make([]byte, n+2)
+
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+
+		if err != nil || n < 0 {
+			return nil, err
+		}
+
+		values := make([]interface{}, n)
+
+		for i := range values {
+			if values[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+
+		return values, nil
+	}
+
+	return nil, errors.New("kvtest: unknown reply " + line)
+}
+
+// replyToLua converts a reply as redis does: integers to numbers, bulks
+// to strings, nulls to false, arrays to tables and statuses to tables
+// with an ok field.
+func replyToLua(reply interface{}) interface{} {
+	switch reply := reply.(type) {
+	case int64:
+		return float64(reply)
+	case string:
+		return reply
+	case replyStatus:
+		t := new(luaTable)
+		t.set("ok", string(reply))
+		return t
+	case replyError:
+		t := new(luaTable)
+		t.set("err", string(reply))
+		return t
+	case []interface{}:
+		t := new(luaTable)
+
+		for i, v := range reply {
+			t.set(float64(i+1), replyToLua(v))
+		}
+
+		return t
+	}
+
+	return false
+}
+
+// writeLua writes the value returned by a script as redis converts it:
+// numbers are truncated to integers, false and nil are null, true is 1,
+// tables with an err or ok field are errors or statuses and other tables
+// are arrays up to their first nil.
+func (c *client) writeLua(v interface{}) {
+	switch v := v.(type) {
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			c.w.int(math.MinInt64)
+			return
+		}
+
+		c.w.int(int64(v))
+	case string:
+		c.w.bulk(v)
+	case bool:
+		if v {
+			c.w.int(1)
+		} else {
+			c.w.null()
+		}
+	case *luaTable:
+		if msg, ok := v.get("err").(string); ok {
+			c.w.error(msg)
+			return
+		}
+
+		if msg, ok := v.get("ok").(string); ok {
+			c.w.status(msg)
+			return
+		}
+
+		c.w.array(v.len())
+
+		for _, item := range v.arr {
+			c.writeLua(item)
+		}
+	default:
+		c.w.null()
+	}
+}
@@ -0,0 +1,861 @@
+package kvtest
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// streamID identifies a stream entry by millisecond time and sequence.
+type streamID struct {
+	ms, seq uint64
+}
+
+func (id streamID) String() string {
+	return fmt.Sprintf("%d-%d", id.ms, id.seq)
+}
+
+func (id streamID) less(o streamID) bool {
+	if id.ms != o.ms {
+		return id.ms < o.ms
+	}
+	return id.seq < o.seq
+}
+
+// parseStreamID parses ms-seq, or ms with seq defaulting to def. The
+// special ids - and + are the smallest and largest ids.
+func parseStreamID(s string, def uint64) (streamID, bool) {
+	switch s {
+	case "-":
+		return streamID{}, true
+	case "+":
+		return streamID{math.MaxUint64, math.MaxUint64}, true
+	}
+
+	ms, seq := s, ""
+
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		ms, seq = s[:i], s[i+1:]
+	}
+
+	var (
+		id  streamID
+		err error
+	)
+
+	if id.ms, err = strconv.ParseUint(ms, 10, 64); err != nil {
+		return id, false
+	}
+
+	id.seq = def
+
+	if seq != "" {
+		if id.seq, err = strconv.ParseUint(seq, 10, 64); err != nil {
+			return id, false
+		}
+	}
+
+	return id, true
+}
+
+type streamEntry struct {
+	id     streamID
+	fields []string
+}
+
+// pendingEntry is an entry delivered to a consumer but not acknowledged.
+type pendingEntry struct {
+	consumer  string
+	delivered time.Time
+	count     int64
+}
+
+type group struct {
+	last      streamID
+	pending   map[streamID]*pendingEntry
+	consumers map[string]struct{}
+}
+
+// pendingIDs returns the pending ids in order.
+func (g *group) pendingIDs() []streamID {
+	ids := make([]streamID, 0, len(g.pending))
+
+	for id := range g.pending {
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i].less(ids[j]) })
+	return ids
+}
+
+type stream struct {
+	entries []streamEntry
+	last    streamID
+	groups  map[string]*group
+}
+
+func newStream() *stream {
+	return &stream{groups: make(map[string]*group)}
+}
+
+// after returns the index of the first entry with an id above id.
+func (s *stream) after(id streamID) int {
+	return sort.Search(len(s.entries), func(i int) bool {
+		return id.less(s.entries[i].id)
+	})
+}
+
+// lookup returns the entry with id, or nil if it was deleted.
+func (s *stream) lookup(id streamID) *streamEntry {
+	i := sort.Search(len(s.entries), func(i int) bool {
+		return !s.entries[i].id.less(id)
+	})
+
+	if i < len(s.entries) && s.entries[i].id == id {
+		return &s.entries[i]
+	}
+
+	return nil
+}
+
+func (w writer) entry(e *streamEntry) {
+	w.array(2)
+	w.bulk(e.id.String())
+	w.bulks(e.fields)
+}
+
+func (c *client) streamAt(key string, create bool) (*stream, bool) {
+	v, ok := c.value(key, "stream", create)
+
+	if v == nil {
+		return nil, ok
+	}
+
+	return v.(*stream), ok
+}
+
+// groupAt returns the consumer group of the stream at key. It writes a
+// NOGROUP error and returns nil if either is missing.
+func (c *client) groupAt(key, name, cmd string) *group {
+	s, ok := c.streamAt(key, false)
+
+	if !ok {
+		return nil
+	}
+
+	if s != nil {
+		if g := s.groups[name]; g != nil {
+			return g
+		}
+	}
+
+	c.w.error(fmt.Sprintf("NOGROUP No such key '%s' or consumer group '%s' in %s", key, name, cmd))
+	return nil
+}
+
+func (c *client) nowMillis() uint64 {
+	return uint64(c.now().UnixNano() / int64(time.Millisecond))
+}
+
+// idle returns the milliseconds since p was last delivered.
+func (c *client) idle(p *pendingEntry) int64 {
+	return int64(c.now().Sub(p.delivered) / time.Millisecond)
+}
+
+func cmdXAdd(c *client, args []string) {
+	maxLen := -1
+	i := 2
+
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "MAXLEN":
+			i++
+
+			if i < len(args) && (args[i] == "~" || args[i] == "=") {
+				i++
+			}
+
+			if i >= len(args) {
+				c.w.error(errSyntax)
+				return
+			}
+
+			n, err := strconv.Atoi(args[i])
+
+			if err != nil || n < 0 {
+				c.w.error(errNotInt)
+				return
+			}
+
+			maxLen = n
+			continue
+		}
+
+		break
+	}
+
+	if i >= len(args) || (len(args)-i-1)%2 != 0 || len(args)-i-1 == 0 {
+		c.w.error("ERR wrong number of arguments for 'xadd' command")
+		return
+	}
+
+	s, ok := c.streamAt(args[1], true)
+
+	if !ok {
+		return
+	}
+
+	var id streamID
+
+	if args[i] == "*" {
+		id = streamID{ms: c.nowMillis()}
+
+		if !s.last.less(id) {
+			id = streamID{s.last.ms, s.last.seq + 1}
+		}
+	} else {
+		id, ok = parseStreamID(args[i], 0)
+
+		if !ok {
+			c.w.error("ERR Invalid stream ID specified as stream command argument")
+			return
+		}
+
+		if !s.last.less(id) {
+			c.w.error("ERR The ID specified in XADD is equal or smaller than the target stream top item")
+			return
+		}
+	}
+
+	fields := append([]string(nil), args[i+1:]...)
+	s.entries = append(s.entries, streamEntry{id, fields})
+	s.last = id
+
+	if maxLen >= 0 && len(s.entries) > maxLen {
+		s.entries = append([]streamEntry(nil), s.entries[len(s.entries)-maxLen:]...)
+	}
+
+	c.touch(args[1])
+	c.w.bulk(id.String())
+}
+
+func cmdXLen(c *client, args []string) {
+	s, ok := c.streamAt(args[1], false)
+
+	if !ok {
+		return
+	}
+
+	if s == nil {
+		c.w.int(0)
+		return
+	}
+
+	c.w.int(int64(len(s.entries)))
+}
+
+func cmdXDel(c *client, args []string) {
+	s, ok := c.streamAt(args[1], false)
+
+	if !ok {
+		return
+	}
+
+	var n int64
+
+	for _, arg := range args[2:] {
+		id, valid := parseStreamID(arg, 0)
+
+		if !valid {
+			c.w.error("ERR Invalid stream ID specified as stream command argument")
+			return
+		}
+
+		if s == nil || s.lookup(id) == nil {
+			continue
+		}
+
+		for i := range s.entries {
+			if s.entries[i].id == id {
+				s.entries = append(s.entries[:i], s.entries[i+1:]...)
+				n++
+				break
+			}
+		}
+	}
+
+	if n > 0 {
+		c.touch(args[1])
+	}
+
+	c.w.int(n)
+}
+
+func cmdXRange(c *client, args []string) {
+	start, ok1 := parseStreamID(args[2], 0)
+	end, ok2 := parseStreamID(args[3], math.MaxUint64)
+
+	if !ok1 || !ok2 {
+		c.w.error("ERR Invalid stream ID specified as stream command argument")
+		return
+	}
+
+	count := -1
+
+	if len(args) == 6 && strings.EqualFold(args[4], "COUNT") {
+		n, err := strconv.Atoi(args[5])
+
+		if err != nil {
+			c.w.error(errNotInt)
+			return
+		}
+
+		count = n
+	} else if len(args) != 4 {
+		c.w.error(errSyntax)
+		return
+	}
+
+	s, ok := c.streamAt(args[1], false)
+
+	if !ok {
+		return
+	}
+
+	var entries []*streamEntry
+
+	if s != nil {
+		for i := range s.entries {
+			e := &s.entries[i]
+
+			if e.id.less(start) || end.less(e.id) {
+				continue
+			}
+
+			if count >= 0 && len(entries) == count {
+				break
+			}
+
+			entries = append(entries, e)
+		}
+	}
+
+	c.w.array(len(entries))
+
+	for _, e := range entries {
+		c.w.entry(e)
+	}
+}
+
+func cmdXGroup(c *client, args []string) {
+	switch strings.ToUpper(args[1]) {
+	case "CREATE":
+		if len(args) < 5 || len(args) > 6 || (len(args) == 6 && !strings.EqualFold(args[5], "MKSTREAM")) {
+			c.w.error(errSyntax)
+			return
+		}
+
+		s, ok := c.streamAt(args[2], false)
+
+		if !ok {
+			return
+		}
+
+		if s == nil {
+			if len(args) != 6 {
+				c.w.error("ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.")
+				return
+			}
+
+			s, _ = c.streamAt(args[2], true)
+		}
+
+		if _, exists := s.groups[args[3]]; exists {
+			c.w.error("BUSYGROUP Consumer Group name already exists")
+			return
+		}
+
+		last := s.last
+
+		if args[4] != "$" {
+			id, valid := parseStreamID(args[4], 0)
+
+			if !valid {
+				c.w.error("ERR Invalid stream ID specified as stream command argument")
+				return
+			}
+
+			last = id
+		}
+
+		s.groups[args[3]] = &group{
+			last:      last,
+			pending:   make(map[streamID]*pendingEntry),
+			consumers: make(map[string]struct{}),
+		}
+		c.touch(args[2])
+		c.w.ok()
+	case "DESTROY":
+		if len(args) != 4 {
+			c.w.error(errSyntax)
+			return
+		}
+
+		s, ok := c.streamAt(args[2], false)
+
+		if !ok {
+			return
+		}
+
+		if s == nil || s.groups[args[3]] == nil {
+			c.w.int(0)
+			return
+		}
+
+		delete(s.groups, args[3])
+		c.touch(args[2])
+		c.w.int(1)
+	default:
+		c.w.error(fmt.Sprintf("ERR Unknown subcommand '%s'", args[1]))
+	}
+}
+
+// cmdXReadGroup reads new entries with the id >, waiting up to BLOCK
+// milliseconds for them, or the pending entries of the consumer after any
+// other id.
+func cmdXReadGroup(c *client, args []string) {
+	if !strings.EqualFold(args[1], "GROUP") {
+		c.w.error(errSyntax)
+		return
+	}
+
+	name, consumer := args[2], args[3]
+	count, noack := -1, false
+	var timeout time.Duration
+	blocking := false
+	i := 4
+
+loop:
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "COUNT":
+			if i+1 >= len(args) {
+				c.w.error(errSyntax)
+				return
+			}
+
+			n, err := strconv.Atoi(args[i+1])
+
+			if err != nil {
+				c.w.error(errNotInt)
+				return
+			}
+
+			count = n
+			i++
+		case "BLOCK":
+			if i+1 >= len(args) {
+				c.w.error(errSyntax)
+				return
+			}
+
+			d, ok := parseTimeout(c, args[i+1], time.Millisecond)
+
+			if !ok {
+				return
+			}
+
+			timeout, blocking = d, true
+			i++
+		case "NOACK":
+			noack = true
+		case "STREAMS":
+			i++
+			break loop
+		default:
+			c.w.error(errSyntax)
+			return
+		}
+	}
+
+	rest := args[i:]
+
+	if len(rest) == 0 || len(rest)%2 != 0 {
+		c.w.error("ERR Unbalanced XREADGROUP list of streams: for each stream key an ID or '>' must be specified.")
+		return
+	}
+
+	keys, ids := rest[:len(rest)/2], rest[len(rest)/2:]
+	groups := make([]*group, len(keys))
+	fresh := true
+
+	for j, key := range keys {
+		if groups[j] = c.groupAt(key, name, "XREADGROUP with GROUP option"); groups[j] == nil {
+			return
+		}
+
+		fresh = fresh && ids[j] == ">"
+	}
+
+	if fresh && blocking {
+		c.block(timeout, func() bool {
+			for j, key := range keys {
+				it := c.db().get(key, c.now())
+
+				if it == nil {
+					return true
+				}
+
+				s, _ := it.value.(*stream)
+
+				if s == nil || s.groups[name] != groups[j] || s.after(groups[j].last) < len(s.entries) {
+					return true
+				}
+			}
+
+			return false
+		})
+	}
+
+	type result struct {
+		key     string
+		entries []*streamEntry
+		ids     []streamID
+	}
+
+	var results []result
+
+	for j, key := range keys {
+		g := c.groupAt(key, name, "XREADGROUP with GROUP option")
+
+		if g == nil {
+			return
+		}
+
+		s, _ := c.streamAt(key, false)
+		r := result{key: key}
+		g.consumers[consumer] = struct{}{}
+
+		if ids[j] == ">" {
+			for k := s.after(g.last); k < len(s.entries); k++ {
+				if count > 0 && len(r.entries) == count {
+					break
+				}
+
+				e := &s.entries[k]
+				r.entries = append(r.entries, e)
+				g.last = e.id
+
+				if !noack {
+					g.pending[e.id] = &pendingEntry{consumer, c.now(), 1}
+				}
+			}
+
+			if len(r.entries) == 0 {
+				continue
+			}
+		} else {
+			after, ok := parseStreamID(ids[j], 0)
+
+			if !ok {
+				c.w.error("ERR Invalid stream ID specified as stream command argument")
+				return
+			}
+
+			for _, id := range g.pendingIDs() {
+				if count > 0 && len(r.ids) == count {
+					break
+				}
+
+				if id.less(after) || id == after || g.pending[id].consumer != consumer {
+					continue
+				}
+
+				r.ids = append(r.ids, id)
+				r.entries = append(r.entries, s.lookup(id))
+			}
+		}
+
+		c.touch(key)
+		results = append(results, r)
+	}
+
+	if len(results) == 0 {
+		c.w.nullArray()
+		return
+	}
+
+	c.w.array(len(results))
+
+	for _, r := range results {
+		c.w.array(2)
+		c.w.bulk(r.key)
+		c.w.array(len(r.entries))
+
+		for k, e := range r.entries {
+			if e != nil {
+				c.w.entry(e)
+				continue
+			}
+
+			// a pending entry which was deleted from the stream
+			c.w.array(2)
+			c.w.bulk(r.ids[k].String())
+			c.w.nullArray()
+		}
+	}
+}
+
+func cmdXAck(c *client, args []string) {
+	s, ok := c.streamAt(args[1], false)
+
+	if !ok {
+		return
+	}
+
+	var n int64
+
+	if s != nil && s.groups[args[2]] != nil {
+		g := s.groups[args[2]]
+
+		for _, arg := range args[3:] {
+			id, valid := parseStreamID(arg, 0)
+
+			if !valid {
+				c.w.error("ERR Invalid stream ID specified as stream command argument")
+				return
+			}
+
+			if _, pending := g.pending[id]; pending {
+				delete(g.pending, id)
+				n++
+			}
+		}
+	}
+
+	if n > 0 {
+		c.touch(args[1])
+	}
+
+	c.w.int(n)
+}
+
+// cmdXPending supports the summary form and the extended form with an
+// optional IDLE filter and consumer.
+func cmdXPending(c *client, args []string) {
+	g := c.groupAt(args[1], args[2], "XPENDING")
+
+	if g == nil {
+		return
+	}
+
+	ids := g.pendingIDs()
+
+	if len(args) == 3 {
+		if len(ids) == 0 {
+			c.w.array(4)
+			c.w.int(0)
+			c.w.null()
+			c.w.null()
+			c.w.nullArray()
+			return
+		}
+
+		counts := make(map[string]int64)
+
+		for _, id := range ids {
+			counts[g.pending[id].consumer]++
+		}
+
+		consumers := make([]string, 0, len(counts))
+
+		for name := range counts {
+			consumers = append(consumers, name)
+		}
+
+		sort.Strings(consumers)
+		c.w.array(4)
+		c.w.int(int64(len(ids)))
+		c.w.bulk(ids[0].String())
+		c.w.bulk(ids[len(ids)-1].String())
+		c.w.array(len(consumers))
+
+		for _, name := range consumers {
+			c.w.array(2)
+			c.w.bulk(name)
+			c.w.bulk(strconv.FormatInt(counts[name], 10))
+		}
+
+		return
+	}
+
+	rest := args[3:]
+	minIdle := int64(-1)
+
+	if len(rest) > 1 && strings.EqualFold(rest[0], "IDLE") {
+		n, err := strconv.ParseInt(rest[1], 10, 64)
+
+		if err != nil {
+			c.w.error(errNotInt)
+			return
+		}
+
+		minIdle = n
+		rest = rest[2:]
+	}
+
+	if len(rest) != 3 && len(rest) != 4 {
+		c.w.error(errSyntax)
+		return
+	}
+
+	start, ok1 := parseStreamID(rest[0], 0)
+	end, ok2 := parseStreamID(rest[1], math.MaxUint64)
+	count, err := strconv.Atoi(rest[2])
+
+	if !ok1 || !ok2 || err != nil {
+		c.w.error(errSyntax)
+		return
+	}
+
+	var matched []streamID
+
+	for _, id := range ids {
+		p := g.pending[id]
+
+		if id.less(start) || end.less(id) || c.idle(p) < minIdle {
+			continue
+		}
+
+		if len(rest) == 4 && p.consumer != rest[3] {
+			continue
+		}
+
+		if len(matched) == count {
+			break
+		}
+
+		matched = append(matched, id)
+	}
+
+	c.w.array(len(matched))
+
+	for _, id := range matched {
+		p := g.pending[id]
+		c.w.array(4)
+		c.w.bulk(id.String())
+		c.w.bulk(p.consumer)
+		c.w.int(c.idle(p))
+		c.w.int(p.count)
+	}
+}
+
+// cmdXAutoClaim transfers pending entries idle for at least min-idle-time
+// to the consumer, replying with the next start id, the claimed entries
+// and the ids of deleted entries, which are dropped from the pending list.
+func cmdXAutoClaim(c *client, args []string) {
+	g := c.groupAt(args[1], args[2], "XAUTOCLAIM")
+
+	if g == nil {
+		return
+	}
+
+	minIdle, err := strconv.ParseInt(args[4], 10, 64)
+
+	if err != nil {
+		c.w.error("ERR Invalid min-idle-time argument for XAUTOCLAIM")
+		return
+	}
+
+	start, ok := parseStreamID(args[5], 0)
+
+	if !ok {
+		c.w.error("ERR Invalid stream ID specified as stream command argument")
+		return
+	}
+
+	count, justID := 100, false
+
+	for i := 6; i < len(args); i++ {
+		switch {
+		case strings.EqualFold(args[i], "COUNT") && i+1 < len(args):
+			n, err := strconv.Atoi(args[i+1])
+
+			if err != nil || n <= 0 {
+				c.w.error(errNotInt)
+				return
+			}
+
+			count = n
+			i++
+		case strings.EqualFold(args[i], "JUSTID"):
+			justID = true
+		default:
+			c.w.error(errSyntax)
+			return
+		}
+	}
+
+	s, _ := c.streamAt(args[1], false)
+	next := streamID{}
+	var (
+		claimed []*streamEntry
+		deleted []string
+		scanned int
+	)
+
+	for _, id := range g.pendingIDs() {
+		if id.less(start) {
+			continue
+		}
+
+		if scanned == count {
+			next = id
+			break
+		}
+
+		scanned++
+		p := g.pending[id]
+
+		if c.idle(p) < minIdle {
+			continue
+		}
+
+		e := s.lookup(id)
+
+		if e == nil {
+			delete(g.pending, id)
+			deleted = append(deleted, id.String())
+			continue
+		}
+
+		p.consumer = args[3]
+		p.delivered = c.now()
+
+		if !justID {
+			p.count++
+		}
+
+		claimed = append(claimed, e)
+	}
+
+	g.consumers[args[3]] = struct{}{}
+	c.touch(args[1])
+
+	c.w.array(3)
+	c.w.bulk(next.String())
+	c.w.array(len(claimed))
+
+	for _, e := range claimed {
+		if justID {
+			c.w.bulk(e.id.String())
+		} else {
+			c.w.entry(e)
+		}
+	}
+
+	c.w.bulks(deleted)
+}
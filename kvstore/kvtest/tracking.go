@@ -0,0 +1,169 @@
+package kvtest
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// invalidateChannel carries the invalidations of client side caching to
+// clients speaking RESP2.
+const invalidateChannel = "__redis__:invalidate"
+
+// tracking is the client side caching state of a client. Only the
+// broadcasting mode is supported.
+type tracking struct {
+	redirect int64
+	prefixes []string
+}
+
+func (t *tracking) matches(key string) bool {
+	if len(t.prefixes) == 0 {
+		return true
+	}
+
+	for _, p := range t.prefixes {
+		if strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func cmdClient(c *client, args []string) {
+	switch strings.ToUpper(args[1]) {
+	case "ID":
+		if len(args) != 2 {
+			c.w.error(errSyntax)
+			return
+		}
+
+		c.w.int(c.id)
+	case "TRACKING":
+		clientTracking(c, args[2:])
+	default:
+		c.w.error(fmt.Sprintf("ERR unknown subcommand '%s'", args[1]))
+	}
+}
+
+// clientTracking handles CLIENT TRACKING ON|OFF [REDIRECT id] [BCAST]
+// [PREFIX prefix ...]. As the server speaks RESP2 only, ON needs BCAST and
+// REDIRECT.
+func clientTracking(c *client, args []string) {
+	if len(args) == 0 {
+		c.w.error(errSyntax)
+		return
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "OFF":
+		c.tracking = nil
+		c.w.ok()
+		return
+	case "ON":
+	default:
+		c.w.error(errSyntax)
+		return
+	}
+
+	t := new(tracking)
+	bcast := false
+
+	for i := 1; i < len(args); i++ {
+		switch opt := strings.ToUpper(args[i]); opt {
+		case "BCAST":
+			bcast = true
+		case "REDIRECT", "PREFIX":
+			if i+1 == len(args) {
+				c.w.error(errSyntax)
+				return
+			}
+
+			i++
+
+			if opt == "PREFIX" {
+				t.prefixes = append(t.prefixes, args[i])
+				continue
+			}
+
+			id, err := strconv.ParseInt(args[i], 10, 64)
+
+			if err != nil || c.srv.client(id) == nil {
+				c.w.error("ERR The client ID you want redirect to does not exist")
+				return
+			}
+
+			t.redirect = id
+		default:
+			c.w.error(errSyntax)
+			return
+		}
+	}
+
+	if !bcast || t.redirect == 0 {
+		c.w.error("ERR kvtest supports only CLIENT TRACKING ON with BCAST and REDIRECT")
+		return
+	}
+
+	c.tracking = t
+	c.w.ok()
+}
+
+// client returns the client with id, or nil. The caller holds s.mu.
+func (s *Server) client(id int64) *client {
+	for c := range s.clients {
+		if c.id == id {
+			return c
+		}
+	}
+
+	return nil
+}
+
+// invalidate sends the invalidation of keys, or of all keys if nil, to
+// the redirect targets of the clients tracking them. from is the client
+// which made the change, or nil. The caller holds s.mu.
+func (s *Server) invalidate(from *client, keys []string) {
+	for c := range s.clients {
+		if c.tracking == nil {
+			continue
+		}
+
+		var matched []string
+
+		for _, key := range keys {
+			if c.tracking.matches(key) {
+				matched = append(matched, key)
+			}
+		}
+
+		if keys != nil && len(matched) == 0 {
+			continue
+		}
+
+		target := s.client(c.tracking.redirect)
+
+		if target == nil {
+			continue
+		}
+
+		if _, ok := target.channels[invalidateChannel]; !ok {
+			continue
+		}
+
+		target.w.array(3)
+		target.w.bulk("message")
+		target.w.bulk(invalidateChannel)
+
+		if keys == nil {
+			target.w.nullArray()
+		} else {
+			target.w.bulks(matched)
+		}
+
+		if target != from {
+			target.w.Flush()
+		}
+	}
+}
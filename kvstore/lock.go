@@ -0,0 +1,233 @@
+package kvstore
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+var (
+	// ErrNotObtained is returned by TryLock when another holder owns
+	// the lock.
+	ErrNotObtained = errors.New("kvstore: lock not obtained")
+	// ErrNotHeld is returned when releasing or extending a lock whose
+	// lease has expired or was taken over.
+	ErrNotHeld = errors.New("kvstore: lock not held")
+)
+
+var (
+	releaseScript = RegisterScript("kvstore.lock.release", 1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+	extendScript = RegisterScript("kvstore.lock.extend", 1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+)
+
+// A Mutex is a mutual exclusion lock shared by every process using the
+// same redis server. The lock is a lease: it expires after ttl unless the
+// holder extends it. While held, the lease is extended in the background
+// until Unlock is called or the lease is lost.
+//
+// A Mutex must not be copied, and is not reentrant.
+type Mutex struct {
+	kv  *KVStore
+	key string
+	ttl time.Duration
+
+	// MinBackoff and MaxBackoff bound the delay between attempts in
+	// Lock. They must be set before the first call to Lock.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	mu    sync.Mutex // guards fields below
+	token string
+	lost  chan struct{}
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// NewMutex returns a Mutex stored at key with a lease of ttl.
+func (kv *KVStore) NewMutex(key string, ttl time.Duration) *Mutex {
+	return &Mutex{
+		kv:         kv,
+		key:        key,
+		ttl:        ttl,
+		MinBackoff: 10 * time.Millisecond,
+		MaxBackoff: time.Second,
+	}
+}
+
+// TryLock tries to acquire the lock once without blocking. It returns
+// ErrNotObtained if the lock is held elsewhere.
+func (m *Mutex) TryLock() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.token != "" {
+		return errors.New("kvstore: lock already held by this Mutex")
+	}
+
+	token, err := randomToken()
+
+	if err != nil {
+		return err
+	}
+
+	conn := m.kv.Get()
+	defer conn.Close()
+	_, err = redis.String(conn.Do("SET", m.key, token, "NX", "PX", millis(m.ttl)))
+
+	if err == redis.ErrNil {
+		return ErrNotObtained
+	}
+
+	if err != nil {
+		return err
+	}
+
+	m.token = token
+	m.lost = make(chan struct{})
+	m.stop = make(chan struct{})
+	m.done = make(chan struct{})
+	go m.keepAlive(token, m.lost, m.stop, m.done)
+	return nil
+}
+
+// Lock blocks until the lock is acquired or ctx is done, retrying with
+// exponential backoff.
+func (m *Mutex) Lock(ctx context.Context) error {
+	for n := 0; ; n++ {
+		err := m.TryLock()
+
+		if err != ErrNotObtained {
+			return err
+		}
+
+		if !sleep(backoff(n, m.MinBackoff, m.MaxBackoff), ctx.Done()) {
+			return ctx.Err()
+		}
+	}
+}
+
+// Unlock stops extending the lease and releases the lock. It returns
+// ErrNotHeld if the lease was lost before Unlock was called.
+func (m *Mutex) Unlock() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.token == "" {
+		return ErrNotHeld
+	}
+
+	close(m.stop)
+	<-m.done
+	token := m.token
+	m.token = ""
+
+	conn := m.kv.Get()
+	defer conn.Close()
+	n, err := redis.Int(releaseScript.Do(conn, m.key, token))
+
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return ErrNotHeld
+	}
+
+	return nil
+}
+
+// Extend resets the lease to the full ttl. It returns ErrNotHeld if the
+// lease has already been lost.
+func (m *Mutex) Extend() error {
+	m.mu.Lock()
+	token := m.token
+	m.mu.Unlock()
+
+	if token == "" {
+		return ErrNotHeld
+	}
+
+	return m.extend(token)
+}
+
+// Lost returns a channel which is closed when the lease of the current
+// holder is lost, either because it expired before it could be extended
+// or because another holder took over the key. Unlock must still be
+// called after a loss. It returns nil if the lock is not held.
+func (m *Mutex) Lost() <-chan struct{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lost
+}
+
+func (m *Mutex) extend(token string) error {
+	conn := m.kv.Get()
+	defer conn.Close()
+	n, err := redis.Int(extendScript.Do(conn, m.key, token, millis(m.ttl)))
+
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return ErrNotHeld
+	}
+
+	return nil
+}
+
+// keepAlive extends the lease every third of the ttl until stop is
+// closed. If the lease cannot be extended before it runs out, lost is
+// closed.
+func (m *Mutex) keepAlive(token string, lost, stop, done chan struct{}) {
+	defer close(done)
+	interval := m.ttl / 3
+	deadline := time.Now().Add(m.ttl)
+
+	for {
+		if !sleep(interval, stop) {
+			return
+		}
+
+		err := m.extend(token)
+
+		if err == nil {
+			deadline = time.Now().Add(m.ttl)
+			continue
+		}
+
+		if err == ErrNotHeld || time.Now().After(deadline) {
+			close(lost)
+			return
+		}
+	}
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 16)
+
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+func millis(d time.Duration) int64 {
+	return int64(d / time.Millisecond)
+}
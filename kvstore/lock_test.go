@@ -0,0 +1,119 @@
+package kvstore_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/simonz05/util/assert"
+	"github.com/simonz05/util/kvstore"
+	"github.com/simonz05/util/kvstore/kvtest"
+)
+
+func TestMutex(t *testing.T) {
+	ast := assert.NewAssert(t)
+	srv, err := kvtest.NewServer()
+	ast.Nil(err)
+	defer srv.Close()
+
+	db, err := kvstore.Open(srv.DSN(0))
+	ast.Nil(err)
+	defer db.Close()
+
+	m1 := db.NewMutex("lock:cron", time.Minute)
+	m2 := db.NewMutex("lock:cron", time.Minute)
+
+	ast.Nil(m1.TryLock())
+	ast.NotNil(m1.Lost())
+	ast.Equal(kvstore.ErrNotObtained, m2.TryLock())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	ast.Equal(context.DeadlineExceeded, m2.Lock(ctx))
+
+	// the lease of m1 runs out without being extended
+	srv.Advance(2 * time.Minute)
+	ast.Nil(m2.TryLock())
+
+	// the stale holder neither releases nor extends the lock of m2
+	ast.Equal(kvstore.ErrNotHeld, m1.Extend())
+	ast.Equal(kvstore.ErrNotHeld, m1.Unlock())
+
+	m3 := db.NewMutex("lock:cron", time.Minute)
+	ast.Equal(kvstore.ErrNotObtained, m3.TryLock())
+
+	// extending resets the lease to the full ttl
+	srv.Advance(50 * time.Second)
+	ast.Nil(m2.Extend())
+	srv.Advance(50 * time.Second)
+	ast.Equal(kvstore.ErrNotObtained, m3.TryLock())
+
+	ast.Nil(m2.Unlock())
+	ast.Equal(kvstore.ErrNotHeld, m2.Unlock())
+	ast.Equal(kvstore.ErrNotHeld, m2.Extend())
+
+	ast.Nil(m3.TryLock())
+	ast.Nil(m3.Unlock())
+}
+
+func TestMutexLost(t *testing.T) {
+	ast := assert.NewAssert(t)
+	srv, err := kvtest.NewServer()
+	ast.Nil(err)
+	defer srv.Close()
+
+	db, err := kvstore.Open(srv.DSN(0))
+	ast.Nil(err)
+	defer db.Close()
+
+	m := db.NewMutex("lock:lost", 60*time.Millisecond)
+	ast.Nil(m.TryLock())
+	lost := m.Lost()
+
+	// the lease runs out on the server before it is renewed
+	srv.Advance(time.Second)
+	other := db.NewMutex("lock:lost", time.Minute)
+	ast.Nil(other.TryLock())
+
+	select {
+	case <-lost:
+	case <-time.After(time.Second):
+		t.Fatal("lease lost without closing Lost")
+	}
+
+	ast.Equal(kvstore.ErrNotHeld, m.Unlock())
+	ast.Equal(kvstore.ErrNotObtained, m.TryLock())
+	ast.Nil(other.Unlock())
+}
+
+func TestMutexKeepAlive(t *testing.T) {
+	ast := assert.NewAssert(t)
+	srv, err := kvtest.NewServer()
+	ast.Nil(err)
+	defer srv.Close()
+
+	db, err := kvstore.Open(srv.DSN(0))
+	ast.Nil(err)
+	defer db.Close()
+
+	m := db.NewMutex("lock:alive", 300*time.Millisecond)
+	other := db.NewMutex("lock:alive", time.Minute)
+	ast.Nil(m.TryLock())
+
+	// the lease is renewed in the background well past its ttl
+	for i := 0; i < 5; i++ {
+		time.Sleep(150 * time.Millisecond)
+		srv.Advance(150 * time.Millisecond)
+		ast.Equal(kvstore.ErrNotObtained, other.TryLock())
+	}
+
+	select {
+	case <-m.Lost():
+		t.Fatal("lease lost while kept alive")
+	default:
+	}
+
+	ast.Nil(m.Unlock())
+	ast.Nil(other.TryLock())
+	ast.Nil(other.Unlock())
+}
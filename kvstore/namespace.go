@@ -0,0 +1,476 @@
+package kvstore
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// keySpec gives the positions of the keys among the arguments of a
+// command, not counting the command name. A negative last counts from the
+// end, so -1 is the last argument.
+type keySpec struct {
+	first, last, step int
+}
+
+var (
+	singleKey = keySpec{0, 0, 1}
+	allKeys   = keySpec{0, -1, 1}
+	twoKeys   = keySpec{0, 1, 1}
+)
+
+// keySpecs lists the commands a namespaced connection knows how to
+// rewrite. Commands which take no keys map to nil. Commands with keys in
+// variable positions are handled by rewriteArgs.
+var keySpecs = map[string]*keySpec{
+	// connection and server
+	"PING":   nil,
+	"ECHO":   nil,
+	"AUTH":   nil,
+	"SELECT": nil,
+	"TIME":   nil,
+	"INFO":   nil,
+	"SCRIPT": nil,
+
+	// transactions
+	"MULTI":   nil,
+	"EXEC":    nil,
+	"DISCARD": nil,
+	"UNWATCH": nil,
+	"WATCH":   &allKeys,
+
+	// pub/sub channels are not namespaced
+	"PUBLISH":      nil,
+	"SUBSCRIBE":    nil,
+	"PSUBSCRIBE":   nil,
+	"UNSUBSCRIBE":  nil,
+	"PUNSUBSCRIBE": nil,
+
+	// keys
+	"DEL":       &allKeys,
+	"UNLINK":    &allKeys,
+	"EXISTS":    &allKeys,
+	"TOUCH":     &allKeys,
+	"EXPIRE":    &singleKey,
+	"PEXPIRE":   &singleKey,
+	"EXPIREAT":  &singleKey,
+	"PEXPIREAT": &singleKey,
+	"TTL":       &singleKey,
+	"PTTL":      &singleKey,
+	"PERSIST":   &singleKey,
+	"TYPE":      &singleKey,
+	"RENAME":    &twoKeys,
+	"RENAMENX":  &twoKeys,
+
+	// strings
+	"GET":         &singleKey,
+	"SET":         &singleKey,
+	"SETEX":       &singleKey,
+	"PSETEX":      &singleKey,
+	"SETNX":       &singleKey,
+	"GETSET":      &singleKey,
+	"APPEND":      &singleKey,
+	"STRLEN":      &singleKey,
+	"INCR":        &singleKey,
+	"INCRBY":      &singleKey,
+	"INCRBYFLOAT": &singleKey,
+	"DECR":        &singleKey,
+	"DECRBY":      &singleKey,
+	"GETDEL":      &singleKey,
+	"MGET":        &allKeys,
+	"MSET":        {0, -1, 2},
+	"MSETNX":      {0, -1, 2},
+
+	// hashes
+	"HSET":         &singleKey,
+	"HSETNX":       &singleKey,
+	"HMSET":        &singleKey,
+	"HGET":         &singleKey,
+	"HMGET":        &singleKey,
+	"HDEL":         &singleKey,
+	"HEXISTS":      &singleKey,
+	"HLEN":         &singleKey,
+	"HGETALL":      &singleKey,
+	"HKEYS":        &singleKey,
+	"HVALS":        &singleKey,
+	"HINCRBY":      &singleKey,
+	"HINCRBYFLOAT": &singleKey,
+	"HSCAN":        &singleKey,
+
+	// lists
+	"LPUSH":      &singleKey,
+	"RPUSH":      &singleKey,
+	"LPUSHX":     &singleKey,
+	"RPUSHX":     &singleKey,
+	"LPOP":       &singleKey,
+	"RPOP":       &singleKey,
+	"LLEN":       &singleKey,
+	"LINDEX":     &singleKey,
+	"LSET":       &singleKey,
+	"LINSERT":    &singleKey,
+	"LRANGE":     &singleKey,
+	"LREM":       &singleKey,
+	"LTRIM":      &singleKey,
+	"RPOPLPUSH":  &twoKeys,
+	"BRPOPLPUSH": &twoKeys,
+	"LMOVE":      &twoKeys,
+	"BLMOVE":     &twoKeys,
+	"BLPOP":      {0, -2, 1},
+	"BRPOP":      {0, -2, 1},
+
+	// sets
+	"SADD":        &singleKey,
+	"SREM":        &singleKey,
+	"SCARD":       &singleKey,
+	"SISMEMBER":   &singleKey,
+	"SMEMBERS":    &singleKey,
+	"SPOP":        &singleKey,
+	"SRANDMEMBER": &singleKey,
+	"SSCAN":       &singleKey,
+	"SMOVE":       &twoKeys,
+	"SINTER":      &allKeys,
+	"SUNION":      &allKeys,
+	"SDIFF":       &allKeys,
+	"SINTERSTORE": &allKeys,
+	"SUNIONSTORE": &allKeys,
+	"SDIFFSTORE":  &allKeys,
+
+	// sorted sets
+	"ZADD":             &singleKey,
+	"ZINCRBY":          &singleKey,
+	"ZREM":             &singleKey,
+	"ZCARD":            &singleKey,
+	"ZCOUNT":           &singleKey,
+	"ZSCORE":           &singleKey,
+	"ZRANK":            &singleKey,
+	"ZREVRANK":         &singleKey,
+	"ZRANGE":           &singleKey,
+	"ZREVRANGE":        &singleKey,
+	"ZRANGEBYSCORE":    &singleKey,
+	"ZREVRANGEBYSCORE": &singleKey,
+	"ZREMRANGEBYSCORE": &singleKey,
+	"ZREMRANGEBYRANK":  &singleKey,
+	"ZRANGEBYLEX":      &singleKey,
+	"ZREVRANGEBYLEX":   &singleKey,
+	"ZPOPMIN":          &singleKey,
+	"ZPOPMAX":          &singleKey,
+	"ZSCAN":            &singleKey,
+
+	// streams
+	"XADD":       &singleKey,
+	"XLEN":       &singleKey,
+	"XDEL":       &singleKey,
+	"XTRIM":      &singleKey,
+	"XRANGE":     &singleKey,
+	"XREVRANGE":  &singleKey,
+	"XACK":       &singleKey,
+	"XPENDING":   &singleKey,
+	"XCLAIM":     &singleKey,
+	"XAUTOCLAIM": &singleKey,
+}
+
+// escapeGlob escapes the glob characters of s for use in a pattern.
+func escapeGlob(s string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+
+		b.WriteByte(s[i])
+	}
+
+	return b.String()
+}
+
+// Namespace returns a view of kv which stores every key under ns followed
+// by a colon, so that Namespace("eu").Get() reads the key "eu:user" for
+// "user". Keys returned by SCAN and KEYS have the namespace stripped.
+// Namespaces nest, and views share the connection pool of kv, so closing
+// any of them closes all.
+//
+// Connections of a view reject commands whose key positions they do not
+// know, rather than let them escape the namespace. Pub/sub channels and
+// keys computed inside Lua scripts are not namespaced.
+func (kv *KVStore) Namespace(ns string) *KVStore {
+	return &KVStore{
+		cfg:       kv.cfg,
+		Pool:      kv.Pool,
+		namespace: kv.namespace + ns + ":",
+		replicas:  kv.replicas,
+		inst:      kv.inst,
+	}
+}
+
+// namespaceConn rewrites the keys of the commands it sends.
+type namespaceConn struct {
+	redis.Conn
+	prefix string
+	err    error
+
+	// commands sent and not yet received, and the commands queued in
+	// the current transaction
+	pending []sentCommand
+	queued  []string
+}
+
+type sentCommand struct {
+	name   string
+	queued []string // for EXEC, the queued commands
+}
+
+func (c *namespaceConn) Err() error {
+	if c.err != nil {
+		return c.err
+	}
+
+	return c.Conn.Err()
+}
+
+func (c *namespaceConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	if cmd != "" {
+		var err error
+
+		if args, err = c.rewrite(cmd, args); err != nil {
+			return nil, err
+		}
+
+		c.track(cmd)
+	}
+
+	var last sentCommand
+
+	if n := len(c.pending); n > 0 {
+		last = c.pending[n-1]
+	}
+
+	c.pending = nil
+	reply, err := c.Conn.Do(cmd, args...)
+
+	if err != nil {
+		return reply, err
+	}
+
+	return c.strip(last, reply), nil
+}
+
+func (c *namespaceConn) Send(cmd string, args ...interface{}) error {
+	if c.err != nil {
+		return c.err
+	}
+
+	args, err := c.rewrite(cmd, args)
+
+	if err != nil {
+		return err
+	}
+
+	c.track(cmd)
+	return c.Conn.Send(cmd, args...)
+}
+
+func (c *namespaceConn) Receive() (interface{}, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	var sent sentCommand
+
+	if len(c.pending) > 0 {
+		sent, c.pending = c.pending[0], c.pending[1:]
+	}
+
+	reply, err := c.Conn.Receive()
+
+	if err != nil {
+		return reply, err
+	}
+
+	return c.strip(sent, reply), nil
+}
+
+// track records cmd for stripping its reply.
+func (c *namespaceConn) track(cmd string) {
+	name := strings.ToUpper(cmd)
+	sent := sentCommand{name: name}
+
+	switch name {
+	case "MULTI":
+		c.queued = []string{}
+	case "EXEC":
+		sent.queued, c.queued = c.queued, nil
+	case "DISCARD":
+		c.queued = nil
+	default:
+		if c.queued != nil {
+			c.queued = append(c.queued, name)
+		}
+	}
+
+	c.pending = append(c.pending, sent)
+}
+
+// rewrite returns args with the namespace added to every key. An unknown
+// command fails the connection.
+func (c *namespaceConn) rewrite(cmd string, args []interface{}) ([]interface{}, error) {
+	args, err := rewriteArgs(c.prefix, strings.ToUpper(cmd), args)
+
+	if err != nil {
+		c.err = err
+	}
+
+	return args, err
+}
+
+func rewriteArgs(prefix, cmd string, args []interface{}) ([]interface{}, error) {
+	out := append([]interface{}(nil), args...)
+
+	switch cmd {
+	case "EVAL", "EVALSHA", "ZUNIONSTORE", "ZINTERSTORE":
+		if len(out) < 2 {
+			break
+		}
+
+		n, err := strconv.Atoi(fmt.Sprint(out[1]))
+
+		if err != nil || n < 0 || 2+n > len(out) {
+			return nil, fmt.Errorf("kvstore: %s: invalid number of keys", cmd)
+		}
+
+		if cmd == "ZUNIONSTORE" || cmd == "ZINTERSTORE" {
+			out[0] = prefixKey(prefix, out[0])
+		}
+
+		for i := 2; i < 2+n; i++ {
+			out[i] = prefixKey(prefix, out[i])
+		}
+
+		return out, nil
+	case "XGROUP", "XINFO":
+		if len(out) > 1 {
+			out[1] = prefixKey(prefix, out[1])
+		}
+
+		return out, nil
+	case "XREAD", "XREADGROUP":
+		for i, arg := range out {
+			if s, ok := arg.(string); ok && strings.EqualFold(s, "STREAMS") {
+				keys := out[i+1:]
+
+				for j := 0; j < len(keys)/2; j++ {
+					keys[j] = prefixKey(prefix, keys[j])
+				}
+
+				return out, nil
+			}
+		}
+
+		return nil, fmt.Errorf("kvstore: %s without STREAMS", cmd)
+	case "SCAN":
+		for i := 1; i+1 < len(out); i += 2 {
+			if s, ok := out[i].(string); ok && strings.EqualFold(s, "MATCH") {
+				out[i+1] = escapeGlob(prefix) + fmt.Sprint(out[i+1])
+				return out, nil
+			}
+		}
+
+		return append(out, "MATCH", escapeGlob(prefix)+"*"), nil
+	case "KEYS":
+		if len(out) == 1 {
+			out[0] = escapeGlob(prefix) + fmt.Sprint(out[0])
+		}
+
+		return out, nil
+	}
+
+	spec, known := keySpecs[cmd]
+
+	if !known {
+		return nil, fmt.Errorf("kvstore: command %s is not supported in namespace %q", cmd, strings.TrimSuffix(prefix, ":"))
+	}
+
+	if spec == nil {
+		return out, nil
+	}
+
+	last := spec.last
+
+	if last < 0 {
+		last += len(out)
+	}
+
+	for i := spec.first; i <= last && i < len(out); i += spec.step {
+		out[i] = prefixKey(prefix, out[i])
+	}
+
+	return out, nil
+}
+
+func prefixKey(prefix string, key interface{}) interface{} {
+	switch key := key.(type) {
+	case string:
+		return prefix + key
+	case []byte:
+		return append([]byte(prefix), key...)
+	}
+
+	return prefix + fmt.Sprint(key)
+}
+
+// strip removes the namespace from the keys in the reply of SCAN and KEYS,
+// also within EXEC.
+func (c *namespaceConn) strip(sent sentCommand, reply interface{}) interface{} {
+	switch sent.name {
+	case "KEYS":
+		return c.stripKeys(reply)
+	case "SCAN":
+		values, ok := reply.([]interface{})
+
+		if !ok || len(values) != 2 {
+			return reply
+		}
+
+		return []interface{}{values[0], c.stripKeys(values[1])}
+	case "EXEC":
+		values, ok := reply.([]interface{})
+
+		if !ok || len(values) != len(sent.queued) {
+			return reply
+		}
+
+		for i, name := range sent.queued {
+			values[i] = c.strip(sentCommand{name: name}, values[i])
+		}
+
+		return values
+	}
+
+	return reply
+}
+
+func (c *namespaceConn) stripKeys(reply interface{}) interface{} {
+	keys, ok := reply.([]interface{})
+
+	if !ok {
+		return reply
+	}
+
+	prefix := []byte(c.prefix)
+
+	for i, k := range keys {
+		if b, ok := k.([]byte); ok {
+			keys[i] = bytes.TrimPrefix(b, prefix)
+		}
+	}
+
+	return keys
+}
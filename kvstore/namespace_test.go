@@ -0,0 +1,160 @@
+package kvstore_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/simonz05/util/assert"
+	"github.com/simonz05/util/kvstore"
+	"github.com/simonz05/util/kvstore/kvtest"
+)
+
+func TestNamespace(t *testing.T) {
+	ast := assert.NewAssert(t)
+	srv, err := kvtest.NewServer()
+	ast.Nil(err)
+	defer srv.Close()
+
+	db, err := kvstore.Open(srv.DSN(0))
+	ast.Nil(err)
+	defer db.Close()
+
+	eu := db.Namespace("eu")
+	conn := eu.Get()
+	defer conn.Close()
+
+	_, err = conn.Do("MSET", "a", 1, "b", 2)
+	ast.Nil(err)
+	_, err = conn.Do("RPUSH", "queue", "a")
+	ast.Nil(err)
+	_, err = conn.Do("RPOPLPUSH", "queue", "done")
+	ast.Nil(err)
+
+	raw := db.Get()
+	defer raw.Close()
+	_, err = raw.Do("SET", "a", "global")
+	ast.Nil(err)
+
+	keys, err := redis.Strings(raw.Do("KEYS", "*"))
+	ast.Nil(err)
+	ast.Equal([]string{"a", "eu:a", "eu:b", "eu:done"}, keys)
+
+	v, err := redis.Int(conn.Do("GET", "a"))
+	ast.Nil(err)
+	ast.Equal(1, v)
+
+	keys, err = redis.Strings(conn.Do("KEYS", "*"))
+	ast.Nil(err)
+	ast.Equal([]string{"a", "b", "done"}, keys)
+
+	var scanned []string
+	it := eu.Scan(context.Background(), &kvstore.ScanOptions{Match: "[ab]"})
+
+	for it.Next() {
+		scanned = append(scanned, string(it.Item()))
+	}
+
+	ast.Nil(it.Err())
+	ast.Equal(2, len(scanned))
+
+	// replies within a transaction are stripped too
+	replies, err := eu.Tx([]string{"a"}, 0, func(tx *kvstore.Tx) error {
+		tx.Send("INCR", "a")
+		return tx.Send("KEYS", "b*")
+	})
+	ast.Nil(err)
+	ast.Equal(int64(2), replies[0])
+	keys, err = redis.Strings(replies[1], nil)
+	ast.Nil(err)
+	ast.Equal([]string{"b"}, keys)
+
+	// nested namespaces, with glob characters escaped
+	star := eu.Namespace("*")
+	c := star.Get()
+	_, err = c.Do("SET", "x", 1)
+	ast.Nil(err)
+	keys, err = redis.Strings(c.Do("KEYS", "*"))
+	ast.Nil(err)
+	ast.Equal([]string{"x"}, keys)
+	c.Close()
+
+	n, err := redis.Int(raw.Do("EXISTS", "eu:*:x"))
+	ast.Nil(err)
+	ast.Equal(1, n)
+
+	c = eu.Get()
+	_, err = c.Do("FLUSHDB")
+	ast.NotNil(err)
+	_, err = c.Do("GET", "a")
+	ast.NotNil(err)
+	c.Close()
+}
+
+func TestNamespaceHelpers(t *testing.T) {
+	ast := assert.NewAssert(t)
+	srv, err := kvtest.NewServer()
+	ast.Nil(err)
+	defer srv.Close()
+
+	db, err := kvstore.Open(srv.DSN(0))
+	ast.Nil(err)
+	defer db.Close()
+
+	app := db.Namespace("app")
+
+	// queue
+	q := app.NewQueue("jobs", &kvstore.QueueOptions{MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+	_, err = q.Enqueue([]byte("a"))
+	ast.Nil(err)
+	_, err = q.EnqueueIn([]byte("b"), time.Hour)
+	ast.Nil(err)
+
+	job, err := q.Dequeue("w1", 10*time.Millisecond)
+	ast.Nil(err)
+	ast.Equal("a", string(job.Payload))
+	ast.Nil(q.Fail("w1", job, errors.New("failed")))
+
+	n, err := q.RequeueExpired()
+	ast.Nil(err)
+	ast.Equal(0, n)
+
+	stats, err := q.Stats()
+	ast.Nil(err)
+	ast.Equal(kvstore.QueueStats{Scheduled: 2}, *stats)
+
+	// stream
+	_, err = app.NewStreamProducer("events", 0).Add(map[string]string{"name": "a"})
+	ast.Nil(err)
+
+	g := app.NewConsumerGroup("events", "workers", "c1", &kvstore.ConsumerGroupOptions{StartID: "0", Block: 10 * time.Millisecond})
+	ast.Nil(g.Create())
+
+	entries, err := g.Read()
+	ast.Nil(err)
+	ast.Equal(1, len(entries))
+
+	srv.Advance(time.Hour)
+	entries, _, err = g.Claim("0-0")
+	ast.Nil(err)
+	ast.Equal(1, len(entries))
+
+	entries, err = g.Pending()
+	ast.Nil(err)
+	ast.Equal(1, len(entries))
+	ast.Nil(g.Ack(entries[0].ID))
+
+	// nothing escaped the namespace
+	raw := db.Get()
+	defer raw.Close()
+	keys, err := redis.Strings(raw.Do("KEYS", "*"))
+	ast.Nil(err)
+	ast.True(len(keys) > 0)
+
+	for _, key := range keys {
+		ast.True(strings.HasPrefix(key, "app:"))
+	}
+}
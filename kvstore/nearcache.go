@@ -0,0 +1,414 @@
+package kvstore
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// trackingChannel is where redis sends the invalidations of client side
+// caching to connections speaking RESP2.
+const trackingChannel = "__redis__:invalidate"
+
+// NearCacheOptions configures a NearCache. The zero value is valid.
+type NearCacheOptions struct {
+	// MaxEntries bounds the number of cached keys. The least recently
+	// used key is evicted first. Defaults to 10000.
+	MaxEntries int
+	// TTL is how long a value is kept, which bounds how stale it gets
+	// should an invalidation be lost. It is shortened to the time to
+	// live of the key in redis. Defaults to one minute.
+	TTL time.Duration
+	// Channel is the pub/sub channel of invalidations when the server
+	// does not support client side caching. Defaults to
+	// "kvstore:invalidate".
+	Channel string
+	// PingInterval is passed to the subscriber of invalidations.
+	PingInterval time.Duration
+	// Now returns the current time. Defaults to time.Now.
+	Now func() time.Time
+}
+
+// NearCacheStats are the counters of a NearCache.
+type NearCacheStats struct {
+	Entries int
+	Hits    int64
+	Misses  int64
+	// Invalidations counts the keys removed on invalidation and
+	// Evictions those removed to stay within MaxEntries.
+	Invalidations int64
+	Evictions     int64
+	// Tracking reports whether invalidations come from the client side
+	// caching of redis rather than from pub/sub.
+	Tracking bool
+}
+
+// HitRatio returns the fraction of reads served from memory.
+func (s NearCacheStats) HitRatio() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// A NearCache keeps recently read string values in process memory, in
+// front of redis. Writes through Set and Delete invalidate the key in
+// every process.
+//
+// On redis 6 and later the server itself reports changed keys through
+// client side caching in broadcasting mode, which also covers writes made
+// without the NearCache. Older servers lack it, and invalidations are
+// published on a pub/sub channel instead, so writes must go through Set,
+// Delete or Invalidate. Values are only served from memory while the
+// invalidations are received; everything cached is dropped when the
+// subscriber disconnects.
+type NearCache struct {
+	kv       *KVStore
+	opts     NearCacheOptions
+	sub      *Subscriber
+	tracking int32
+
+	hits, misses, invalidations, evictions int64
+
+	mu      sync.Mutex // guards fields below
+	ready   bool
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type nearEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+	// loading is set while the value is read from redis. An entry
+	// invalidated meanwhile is removed, so the read does not store a
+	// stale value.
+	loading bool
+}
+
+// NewNearCache returns a NearCache for the keys of kv. opts may be nil.
+// The cache must be closed to release its connection.
+func (kv *KVStore) NewNearCache(opts *NearCacheOptions) *NearCache {
+	c := &NearCache{
+		kv:      kv,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+
+	if opts != nil {
+		c.opts = *opts
+	}
+
+	if c.opts.MaxEntries <= 0 {
+		c.opts.MaxEntries = 10000
+	}
+
+	if c.opts.TTL <= 0 {
+		c.opts.TTL = time.Minute
+	}
+
+	if c.opts.Channel == "" {
+		c.opts.Channel = "kvstore:invalidate"
+	}
+
+	if c.opts.Now == nil {
+		c.opts.Now = time.Now
+	}
+
+	c.sub = kv.NewSubscriber(&SubscriberOptions{
+		Handler:      c.receive,
+		StateChanged: c.stateChanged,
+		PingInterval: c.opts.PingInterval,
+		OnConnect:    c.track,
+	})
+
+	c.sub.Subscribe(trackingChannel, c.opts.Channel)
+	return c
+}
+
+// Get returns the value of key, from memory if cached. It returns
+// redis.ErrNil if the key does not exist. The returned slice is shared and
+// must not be modified.
+func (c *NearCache) Get(key string) ([]byte, error) {
+	now := c.opts.Now()
+	c.mu.Lock()
+
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*nearEntry)
+
+		if !e.loading && now.Before(e.expires) {
+			c.lru.MoveToFront(el)
+			c.mu.Unlock()
+			atomic.AddInt64(&c.hits, 1)
+			return e.value, nil
+		}
+	}
+
+	var e *nearEntry
+
+	if c.ready {
+		e = &nearEntry{key: key, loading: true}
+		c.add(e)
+	}
+
+	c.mu.Unlock()
+	atomic.AddInt64(&c.misses, 1)
+	value, ttl, err := c.fetch(key)
+
+	if e != nil {
+		c.fill(e, value, ttl, err)
+	}
+
+	return value, err
+}
+
+// fetch reads key and its time to live from the primary; replicas may
+// still return the value an invalidation was sent for.
+func (c *NearCache) fetch(key string) ([]byte, time.Duration, error) {
+	conn := c.kv.Get()
+	defer conn.Close()
+	conn.Send("GET", key)
+	conn.Send("PTTL", key)
+
+	if err := conn.Flush(); err != nil {
+		return nil, 0, err
+	}
+
+	value, err := redis.Bytes(conn.Receive())
+	ttl, ttlErr := redis.Int64(conn.Receive())
+
+	if err == nil {
+		err = ttlErr
+	}
+
+	return value, time.Duration(ttl) * time.Millisecond, err
+}
+
+// fill stores the value read for e unless it was invalidated meanwhile.
+func (c *NearCache) fill(e *nearEntry, value []byte, ttl time.Duration, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[e.key]
+
+	if !ok || el.Value != e {
+		return
+	}
+
+	if err != nil {
+		c.remove(el)
+		return
+	}
+
+	if ttl <= 0 || ttl > c.opts.TTL {
+		// PTTL is -1 for keys without expiry
+		ttl = c.opts.TTL
+	}
+
+	e.value = value
+	e.expires = c.opts.Now().Add(ttl)
+	e.loading = false
+}
+
+// Set stores value under key, expiring after ttl unless zero, and
+// invalidates the key.
+func (c *NearCache) Set(key string, value interface{}, ttl time.Duration) error {
+	conn := c.kv.Get()
+	var err error
+
+	if ttl > 0 {
+		_, err = conn.Do("PSETEX", key, millis(ttl), value)
+	} else {
+		_, err = conn.Do("SET", key, value)
+	}
+
+	conn.Close()
+
+	// invalidated even on error, as the write may have been applied
+	if ierr := c.Invalidate(key); err == nil {
+		err = ierr
+	}
+
+	return err
+}
+
+// Delete deletes keys and invalidates them.
+func (c *NearCache) Delete(keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	conn := c.kv.Get()
+	_, err := conn.Do("DEL", redis.Args{}.AddFlat(keys)...)
+	conn.Close()
+
+	if ierr := c.Invalidate(keys...); err == nil {
+		err = ierr
+	}
+
+	return err
+}
+
+// Invalidate removes keys from the cache of every process, for keys
+// changed without Set or Delete. It need not be called when the server
+// supports client side caching.
+func (c *NearCache) Invalidate(keys ...string) error {
+	c.mu.Lock()
+
+	for _, key := range keys {
+		if el, ok := c.entries[key]; ok {
+			c.remove(el)
+		}
+	}
+
+	c.mu.Unlock()
+
+	if len(keys) == 0 || atomic.LoadInt32(&c.tracking) == 1 {
+		return nil
+	}
+
+	// the channel is shared by all namespaces, so the keys are sent
+	// with the namespace
+	conn := c.kv.Get()
+	defer conn.Close()
+
+	for _, key := range keys {
+		conn.Send("PUBLISH", c.opts.Channel, c.kv.namespace+key)
+	}
+
+	_, err := conn.Do("")
+	return err
+}
+
+// Stats returns the current counters of c.
+func (c *NearCache) Stats() NearCacheStats {
+	c.mu.Lock()
+	n := len(c.entries)
+	c.mu.Unlock()
+
+	return NearCacheStats{
+		Entries:       n,
+		Hits:          atomic.LoadInt64(&c.hits),
+		Misses:        atomic.LoadInt64(&c.misses),
+		Invalidations: atomic.LoadInt64(&c.invalidations),
+		Evictions:     atomic.LoadInt64(&c.evictions),
+		Tracking:      atomic.LoadInt32(&c.tracking) == 1,
+	}
+}
+
+// Close stops receiving invalidations and empties the cache.
+func (c *NearCache) Close() error {
+	err := c.sub.Close()
+	c.clear(false)
+	return err
+}
+
+// add inserts e as the most recently used entry, replacing an entry of the
+// same key and evicting the least recently used beyond MaxEntries. The
+// caller holds c.mu.
+func (c *NearCache) add(e *nearEntry) {
+	if el, ok := c.entries[e.key]; ok {
+		c.lru.Remove(el)
+	}
+
+	c.entries[e.key] = c.lru.PushFront(e)
+
+	for c.lru.Len() > c.opts.MaxEntries {
+		c.remove(c.lru.Back())
+		atomic.AddInt64(&c.evictions, 1)
+	}
+}
+
+// remove removes el. The caller holds c.mu.
+func (c *NearCache) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*nearEntry).key)
+}
+
+// clear removes all entries and sets whether values may be cached.
+func (c *NearCache) clear(ready bool) {
+	c.mu.Lock()
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+	c.ready = ready
+	c.mu.Unlock()
+}
+
+// track enables client side caching on the connection of the subscriber,
+// with the invalidations of keys in the namespace redirected to itself.
+// Servers without it are left to pub/sub.
+func (c *NearCache) track(conn redis.Conn) error {
+	id, err := redis.Int64(conn.Do("CLIENT", "ID"))
+
+	if err == nil {
+		args := redis.Args{"TRACKING", "ON", "REDIRECT", id, "BCAST"}
+
+		if c.kv.namespace != "" {
+			args = args.Add("PREFIX", c.kv.namespace)
+		}
+
+		_, err = conn.Do("CLIENT", args...)
+	}
+
+	if _, ok := err.(redis.Error); ok {
+		atomic.StoreInt32(&c.tracking, 0)
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	atomic.StoreInt32(&c.tracking, 1)
+	return nil
+}
+
+// stateChanged drops the cache whenever invalidations may have been
+// missed and serves from memory only while connected.
+func (c *NearCache) stateChanged(state SubscriberState, err error) {
+	switch state {
+	case StateConnected:
+		c.clear(true)
+	case StateDisconnected, StateClosed:
+		c.clear(false)
+	}
+}
+
+func (c *NearCache) receive(msg *Message) {
+	var keys []string
+
+	switch msg.Channel {
+	case trackingChannel:
+		if msg.Array == nil && msg.Data == nil {
+			// the database was flushed
+			c.clear(true)
+			return
+		}
+
+		for _, key := range msg.Array {
+			keys = append(keys, string(key))
+		}
+	case c.opts.Channel:
+		keys = append(keys, string(msg.Data))
+	default:
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, key := range keys {
+		if !strings.HasPrefix(key, c.kv.namespace) {
+			continue
+		}
+
+		if el, ok := c.entries[key[len(c.kv.namespace):]]; ok {
+			c.remove(el)
+			atomic.AddInt64(&c.invalidations, 1)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package kvstore_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/simonz05/util/assert"
+	"github.com/simonz05/util/kvstore"
+	"github.com/simonz05/util/kvstore/kvtest"
+)
+
+// cached reads key until it is served from memory, since the cache only
+// stores values once its subscriber is connected.
+func cached(t *testing.T, c *kvstore.NearCache, key string) string {
+	for i := 0; i < 100; i++ {
+		hits := c.Stats().Hits
+		value, err := c.Get(key)
+
+		if err != nil {
+			t.Fatalf("Get(%q) = %v", key, err)
+		}
+
+		if c.Stats().Hits > hits {
+			return string(value)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("%q was never cached", key)
+	return ""
+}
+
+// eventually reads key until it has value.
+func eventually(t *testing.T, c *kvstore.NearCache, key, value string) {
+	for i := 0; i < 100; i++ {
+		if v, err := c.Get(key); err == nil && string(v) == value {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("%q never became %q", key, value)
+}
+
+func TestNearCacheInvalidation(t *testing.T) {
+	for _, tracking := range []bool{true, false} {
+		ast := assert.NewAssert(t)
+		srv, err := kvtest.NewServer()
+		ast.Nil(err)
+
+		if !tracking {
+			srv.DisableCommand("CLIENT")
+		}
+
+		db1, err := kvstore.Open(srv.DSN(0))
+		ast.Nil(err)
+		db2, err := kvstore.Open(srv.DSN(0))
+		ast.Nil(err)
+
+		c1 := db1.Namespace("app").NewNearCache(nil)
+		c2 := db2.Namespace("app").NewNearCache(nil)
+
+		ast.Nil(c1.Set("k", "v1", time.Minute))
+		ast.Equal("v1", cached(t, c1, "k"))
+		ast.Equal("v1", cached(t, c2, "k"))
+		ast.Equal(tracking, c1.Stats().Tracking)
+
+		// a write in one process evicts the key in the other
+		ast.Nil(c2.Set("k", "v2", 0))
+		eventually(t, c1, "k", "v2")
+		ast.True(c1.Stats().Invalidations > 0)
+
+		ast.Nil(c1.Delete("k"))
+
+		for i := 0; i < 100; i++ {
+			if _, err = c2.Get("k"); err == redis.ErrNil {
+				break
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		ast.Equal(redis.ErrNil, err)
+
+		// writes to other namespaces are ignored
+		other := db2.Namespace("other").NewNearCache(nil)
+		ast.Nil(c1.Set("x", "1", 0))
+		ast.Equal("1", cached(t, c1, "x"))
+		ast.Nil(other.Set("x", "2", 0))
+		ast.Equal("1", cached(t, c1, "x"))
+
+		if tracking {
+			// the server reports writes made without the cache
+			conn := db2.Namespace("app").Get()
+			_, err = conn.Do("SET", "x", "3")
+			conn.Close()
+			ast.Nil(err)
+			eventually(t, c1, "x", "3")
+		}
+
+		other.Close()
+		c1.Close()
+		c2.Close()
+		db1.Close()
+		db2.Close()
+		srv.Close()
+	}
+}
+
+func TestNearCacheBounds(t *testing.T) {
+	ast := assert.NewAssert(t)
+	srv, err := kvtest.NewServer()
+	ast.Nil(err)
+	defer srv.Close()
+
+	db, err := kvstore.Open(srv.DSN(0))
+	ast.Nil(err)
+	defer db.Close()
+
+	now := time.Now()
+	c := db.NewNearCache(&kvstore.NearCacheOptions{
+		MaxEntries: 2,
+		TTL:        time.Minute,
+		Now:        func() time.Time { return now },
+	})
+	defer c.Close()
+
+	for _, key := range []string{"a", "b", "c"} {
+		ast.Nil(c.Set(key, key, 0))
+	}
+
+	cached(t, c, "a")
+	cached(t, c, "b")
+	cached(t, c, "c")
+
+	stats := c.Stats()
+	ast.Equal(2, stats.Entries)
+	ast.True(stats.Evictions > 0)
+
+	// b and c are cached, a was evicted
+	hits := stats.Hits
+	c.Get("b")
+	c.Get("c")
+	ast.Equal(hits+2, c.Stats().Hits)
+	c.Get("a")
+	ast.Equal(hits+2, c.Stats().Hits)
+
+	// values expire after TTL
+	now = now.Add(2 * time.Minute)
+	c.Get("a")
+	ast.Equal(hits+2, c.Stats().Hits)
+
+	stats = c.Stats()
+	ast.True(stats.HitRatio() > 0 && stats.HitRatio() < 1)
+	ast.Equal(float64(stats.Hits)/float64(stats.Hits+stats.Misses), stats.HitRatio())
+}
@@ -0,0 +1,422 @@
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Publish posts message to channel and returns the number of clients that
+// received it.
+func (kv *KVStore) Publish(channel string, message interface{}) (int, error) {
+	conn := kv.Get()
+	defer conn.Close()
+	return redis.Int(conn.Do("PUBLISH", channel, message))
+}
+
+// Message is a message received on a subscribed channel.
+type Message struct {
+	// Pattern is the matching pattern for messages received through
+	// PSubscribe. It is empty otherwise.
+	Pattern string
+	Channel string
+	Data    []byte
+	// Array holds the payload instead of Data if it is an array, as are
+	// the key invalidations of client side caching.
+	Array [][]byte
+}
+
+// SubscriberState is the connection state of a Subscriber.
+type SubscriberState int
+
+const (
+	StateConnecting SubscriberState = iota
+	StateConnected
+	StateDisconnected
+	StateClosed
+)
+
+func (s SubscriberState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	case StateClosed:
+		return "closed"
+	}
+	return fmt.Sprintf("SubscriberState(%d)", int(s))
+}
+
+// SubscriberOptions configures a Subscriber. The zero value is valid.
+type SubscriberOptions struct {
+	// Handler is called for every message from the receiving goroutine.
+	// If nil, messages are delivered on the Messages channel instead.
+	Handler func(*Message)
+	// StateChanged is called on every change of connection state. err
+	// is the reason for a disconnect.
+	StateChanged func(state SubscriberState, err error)
+	// BufferSize is the capacity of the Messages channel. Defaults to
+	// 100.
+	BufferSize int
+	// MinBackoff and MaxBackoff bound the delay between reconnect
+	// attempts. They default to 50ms and 10s.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// PingInterval is how often an idle connection is checked. A
+	// connection which does not answer within two intervals is
+	// considered dead. Defaults to 30s.
+	PingInterval time.Duration
+	// OnConnect is called with every new connection before the
+	// subscriptions are restored on it, for commands such as CLIENT
+	// TRACKING which must be sent first. An error drops the connection.
+	OnConnect func(conn redis.Conn) error
+}
+
+var errSubscriberClosed = errors.New("kvstore: subscriber closed")
+
+// A Subscriber receives messages published to channels and patterns over
+// a dedicated connection. When the connection fails, the Subscriber
+// reconnects with backoff and subscribes to every channel and pattern
+// again. Messages published while disconnected are lost.
+type Subscriber struct {
+	kv       *KVStore
+	opts     SubscriberOptions
+	messages chan *Message
+	done     chan struct{}
+	wg       sync.WaitGroup
+
+	mu       sync.Mutex // guards fields below
+	channels map[string]struct{}
+	patterns map[string]struct{}
+	conn     redis.Conn
+	closed   bool
+}
+
+// NewSubscriber starts a Subscriber. opts may be nil.
+func (kv *KVStore) NewSubscriber(opts *SubscriberOptions) *Subscriber {
+	s := &Subscriber{
+		kv:       kv,
+		done:     make(chan struct{}),
+		channels: make(map[string]struct{}),
+		patterns: make(map[string]struct{}),
+	}
+
+	if opts != nil {
+		s.opts = *opts
+	}
+
+	if s.opts.BufferSize <= 0 {
+		s.opts.BufferSize = 100
+	}
+
+	if s.opts.MinBackoff <= 0 {
+		s.opts.MinBackoff = 50 * time.Millisecond
+	}
+
+	if s.opts.MaxBackoff <= 0 {
+		s.opts.MaxBackoff = 10 * time.Second
+	}
+
+	if s.opts.PingInterval <= 0 {
+		s.opts.PingInterval = 30 * time.Second
+	}
+
+	if s.opts.Handler == nil {
+		s.messages = make(chan *Message, s.opts.BufferSize)
+	}
+
+	s.wg.Add(1)
+	go s.run()
+	return s
+}
+
+// Messages returns the channel on which messages are delivered, or nil if
+// a Handler was given. The channel is closed by Close.
+func (s *Subscriber) Messages() <-chan *Message {
+	return s.messages
+}
+
+// Subscribe subscribes to channels.
+func (s *Subscriber) Subscribe(channels ...string) error {
+	return s.update("SUBSCRIBE", s.channels, true, channels)
+}
+
+// Unsubscribe unsubscribes from channels.
+func (s *Subscriber) Unsubscribe(channels ...string) error {
+	return s.update("UNSUBSCRIBE", s.channels, false, channels)
+}
+
+// PSubscribe subscribes to channels matching the glob patterns.
+func (s *Subscriber) PSubscribe(patterns ...string) error {
+	return s.update("PSUBSCRIBE", s.patterns, true, patterns)
+}
+
+// PUnsubscribe unsubscribes from patterns.
+func (s *Subscriber) PUnsubscribe(patterns ...string) error {
+	return s.update("PUNSUBSCRIBE", s.patterns, false, patterns)
+}
+
+// update records the change of subscriptions in set and sends it to the
+// server if connected. A failed send is repaired by the reconnect.
+func (s *Subscriber) update(cmd string, set map[string]struct{}, add bool, names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return errSubscriberClosed
+	}
+
+	for _, name := range names {
+		if add {
+			set[name] = struct{}{}
+		} else {
+			delete(set, name)
+		}
+	}
+
+	if s.conn == nil {
+		return nil
+	}
+
+	if err := s.conn.Send(cmd, redis.Args{}.AddFlat(names)...); err != nil {
+		return err
+	}
+
+	return s.conn.Flush()
+}
+
+// Close unsubscribes, closes the connection and waits for the receiving
+// goroutine to exit.
+func (s *Subscriber) Close() error {
+	s.mu.Lock()
+
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+
+	s.closed = true
+	close(s.done)
+
+	if s.conn != nil {
+		s.conn.Close()
+	}
+
+	s.mu.Unlock()
+	s.wg.Wait()
+
+	if s.messages != nil {
+		close(s.messages)
+	}
+
+	return nil
+}
+
+func (s *Subscriber) setState(state SubscriberState, err error) {
+	if s.opts.StateChanged != nil {
+		s.opts.StateChanged(state, err)
+	}
+}
+
+func (s *Subscriber) run() {
+	defer s.wg.Done()
+	defer s.setState(StateClosed, nil)
+
+	for n := 0; ; n++ {
+		s.setState(StateConnecting, nil)
+		conn, err := s.connect()
+
+		if err == errSubscriberClosed {
+			return
+		}
+
+		if err == nil {
+			n = 0
+			s.setState(StateConnected, nil)
+			err = s.receive(conn)
+
+			s.mu.Lock()
+			s.conn = nil
+			closed := s.closed
+			s.mu.Unlock()
+			conn.Close()
+
+			if closed {
+				return
+			}
+		}
+
+		s.setState(StateDisconnected, err)
+
+		if !sleep(backoff(n, s.opts.MinBackoff, s.opts.MaxBackoff), s.done) {
+			return
+		}
+	}
+}
+
+// connect dials a new connection and restores all subscriptions on it.
+func (s *Subscriber) connect() (redis.Conn, error) {
+	conn, err := s.kv.dialReadTimeout(2 * s.opts.PingInterval)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if s.opts.OnConnect != nil {
+		if err := s.opts.OnConnect(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		conn.Close()
+		return nil, errSubscriberClosed
+	}
+
+	if len(s.channels) > 0 {
+		conn.Send("SUBSCRIBE", redis.Args{}.AddFlat(keys(s.channels))...)
+	}
+
+	if len(s.patterns) > 0 {
+		conn.Send("PSUBSCRIBE", redis.Args{}.AddFlat(keys(s.patterns))...)
+	}
+
+	if err := conn.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	s.conn = conn
+	return conn, nil
+}
+
+// receive reads from conn until it fails, pinging the server while the
+// connection is idle.
+func (s *Subscriber) receive(conn redis.Conn) error {
+	stop := make(chan struct{})
+	defer close(stop)
+
+	go func() {
+		for sleep(s.opts.PingInterval, stop) {
+			s.mu.Lock()
+			conn.Send("PING")
+			err := conn.Flush()
+			s.mu.Unlock()
+
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		reply, err := conn.Receive()
+
+		if err != nil {
+			return err
+		}
+
+		msg, err := parseMessage(reply)
+
+		if err != nil {
+			return err
+		}
+
+		if msg == nil {
+			continue
+		}
+
+		if s.opts.Handler != nil {
+			s.opts.Handler(msg)
+			continue
+		}
+
+		select {
+		case s.messages <- msg:
+		case <-s.done:
+			return errSubscriberClosed
+		}
+	}
+}
+
+// parseMessage converts a push reply to a Message. It returns nil for
+// subscription confirmations and pongs, which are plain statuses while
+// nothing is subscribed.
+func parseMessage(reply interface{}) (*Message, error) {
+	if status, ok := reply.(string); ok && status == "PONG" {
+		return nil, nil
+	}
+
+	values, err := redis.Values(reply, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(values) == 0 {
+		return nil, errors.New("kvstore: empty pubsub reply")
+	}
+
+	kind, err := redis.String(values[0], nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch kind {
+	case "message":
+		if len(values) != 3 {
+			break
+		}
+
+		msg := new(Message)
+
+		if array, ok := values[2].([]interface{}); ok {
+			if msg.Array, err = redis.ByteSlices(array, nil); err != nil {
+				return nil, err
+			}
+
+			msg.Channel, err = redis.String(values[1], nil)
+			return msg, err
+		}
+
+		_, err = redis.Scan(values[1:], &msg.Channel, &msg.Data)
+		return msg, err
+	case "pmessage":
+		if len(values) != 4 {
+			break
+		}
+
+		msg := new(Message)
+		_, err := redis.Scan(values[1:], &msg.Pattern, &msg.Channel, &msg.Data)
+		return msg, err
+	case "subscribe", "unsubscribe", "psubscribe", "punsubscribe", "pong":
+		return nil, nil
+	}
+
+	return nil, fmt.Errorf("kvstore: unexpected pubsub reply %q", kind)
+}
+
+func keys(set map[string]struct{}) []string {
+	s := make([]string, 0, len(set))
+
+	for k := range set {
+		s = append(s, k)
+	}
+
+	return s
+}
@@ -0,0 +1,30 @@
+package kvstore
+
+import (
+	"testing"
+
+	"github.com/simonz05/util/assert"
+)
+
+func TestParseMessage(t *testing.T) {
+	ast := assert.NewAssert(t)
+
+	msg, err := parseMessage([]interface{}{[]byte("message"), []byte("ch"), []byte("data")})
+	ast.Nil(err)
+	ast.Equal("ch", msg.Channel)
+	ast.Equal("data", string(msg.Data))
+	ast.True(msg.Array == nil)
+
+	// client side caching invalidates keys with an array payload
+	msg, err = parseMessage([]interface{}{[]byte("message"), []byte("__redis__:invalidate"),
+		[]interface{}{[]byte("a"), []byte("b")}})
+	ast.Nil(err)
+	ast.Equal("__redis__:invalidate", msg.Channel)
+	ast.True(msg.Data == nil)
+	ast.Equal(2, len(msg.Array))
+	ast.Equal("b", string(msg.Array[1]))
+
+	msg, err = parseMessage([]interface{}{[]byte("subscribe"), []byte("ch"), int64(1)})
+	ast.Nil(err)
+	ast.True(msg == nil)
+}
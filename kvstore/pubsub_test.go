@@ -0,0 +1,129 @@
+package kvstore_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/simonz05/util/assert"
+	"github.com/simonz05/util/kvstore"
+	"github.com/simonz05/util/kvstore/kvtest"
+)
+
+// publish publishes until a subscriber receives the message, since
+// subscriptions are sent asynchronously.
+func publish(t *testing.T, db *kvstore.KVStore, channel, message string) {
+	for i := 0; i < 100; i++ {
+		n, err := db.Publish(channel, message)
+
+		if err == nil && n > 0 {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("no subscriber received %q on %s", message, channel)
+}
+
+func receive(t *testing.T, sub *kvstore.Subscriber) *kvstore.Message {
+	select {
+	case msg := <-sub.Messages():
+		return msg
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for message")
+	}
+	return nil
+}
+
+func TestSubscriber(t *testing.T) {
+	ast := assert.NewAssert(t)
+	srv, err := kvtest.NewServer()
+	ast.Nil(err)
+	defer srv.Close()
+
+	db, err := kvstore.Open(srv.DSN(0))
+	ast.Nil(err)
+	defer db.Close()
+
+	states := make(chan kvstore.SubscriberState, 100)
+	sub := db.NewSubscriber(&kvstore.SubscriberOptions{
+		MinBackoff: time.Millisecond,
+		MaxBackoff: 10 * time.Millisecond,
+		StateChanged: func(state kvstore.SubscriberState, err error) {
+			states <- state
+		},
+	})
+
+	ast.Nil(sub.Subscribe("invalidate"))
+	ast.Nil(sub.PSubscribe("session:*"))
+
+	publish(t, db, "invalidate", "key1")
+	msg := receive(t, sub)
+	ast.Equal("invalidate", msg.Channel)
+	ast.Equal("key1", string(msg.Data))
+
+	publish(t, db, "session:revoke", "abc")
+	msg = receive(t, sub)
+	ast.Equal("session:*", msg.Pattern)
+	ast.Equal("session:revoke", msg.Channel)
+	ast.Equal("abc", string(msg.Data))
+
+	// subscriptions are restored after the connection drops
+	srv.DisconnectAll()
+	publish(t, db, "invalidate", "key2")
+	msg = receive(t, sub)
+	ast.Equal("key2", string(msg.Data))
+
+	ast.Nil(sub.Close())
+	_, ok := <-sub.Messages()
+	ast.True(!ok)
+
+	close(states)
+	var seen []kvstore.SubscriberState
+
+	for s := range states {
+		seen = append(seen, s)
+	}
+
+	ast.Equal(kvstore.StateConnected, seen[1])
+	ast.Equal(kvstore.StateDisconnected, seen[2])
+	ast.Equal(kvstore.StateClosed, seen[len(seen)-1])
+}
+
+func TestSubscriberIdle(t *testing.T) {
+	ast := assert.NewAssert(t)
+	srv, err := kvtest.NewServer()
+	ast.Nil(err)
+	defer srv.Close()
+
+	db, err := kvstore.Open(srv.DSN(0))
+	ast.Nil(err)
+	defer db.Close()
+
+	states := make(chan kvstore.SubscriberState, 100)
+	sub := db.NewSubscriber(&kvstore.SubscriberOptions{
+		PingInterval: 20 * time.Millisecond,
+		StateChanged: func(state kvstore.SubscriberState, err error) {
+			states <- state
+		},
+	})
+
+	// pings are answered outside of subscribe mode, before the first
+	// subscription and after the last is removed
+	time.Sleep(100 * time.Millisecond)
+	ast.Nil(sub.Subscribe("invalidate"))
+	publish(t, db, "invalidate", "key1")
+	ast.Equal("key1", string(receive(t, sub).Data))
+	ast.Nil(sub.Unsubscribe("invalidate"))
+	time.Sleep(100 * time.Millisecond)
+
+	ast.Nil(sub.Close())
+	close(states)
+	var seen []kvstore.SubscriberState
+
+	for s := range states {
+		seen = append(seen, s)
+	}
+
+	ast.Equal([]kvstore.SubscriberState{kvstore.StateConnecting, kvstore.StateConnected, kvstore.StateClosed}, seen)
+}
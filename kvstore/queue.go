@@ -0,0 +1,551 @@
+package kvstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/simonz05/util/log"
+	"github.com/simonz05/util/syncutil"
+)
+
+// ErrLeaseLost is returned when acknowledging or failing a job whose
+// visibility timeout expired, so it may already run elsewhere.
+var ErrLeaseLost = errors.New("kvstore: job lease lost")
+
+// Job is a unit of work in a Queue.
+type Job struct {
+	ID         string    `json:"id"`
+	Payload    []byte    `json:"payload"`
+	Attempts   int       `json:"attempts"`
+	EnqueuedAt time.Time `json:"enqueued_at"`
+	LastError  string    `json:"last_error,omitempty"`
+}
+
+// QueueOptions configures a Queue. The zero value is valid.
+type QueueOptions struct {
+	// VisibilityTimeout is how long a dequeued job may run before it is
+	// considered abandoned and retried. Defaults to 30s.
+	VisibilityTimeout time.Duration
+	// MaxRetries is how many times a failed job is retried before it is
+	// moved to the dead letter list. Defaults to 3.
+	MaxRetries int
+	// MinBackoff and MaxBackoff bound the delay before a retry. They
+	// default to 1s and 10m.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// PollTimeout is how long Run waits for a job before it checks for
+	// shutdown. Defaults to 1s.
+	PollTimeout time.Duration
+	// Now returns the current time. Defaults to time.Now.
+	Now func() time.Time
+	// OnError is called by Run with the errors of acknowledging or
+	// failing job, and with a nil job for those of requeueing expired
+	// jobs. Defaults to logging them.
+	OnError func(job *Job, err error)
+}
+
+// QueueStats counts the jobs of a queue by state.
+type QueueStats struct {
+	Ready     int
+	Scheduled int
+	InFlight  int
+	Dead      int
+}
+
+// A Queue is a reliable job queue. Jobs are moved atomically from the
+// ready list to a processing list per worker and leased in the same step,
+// so a job is never lost when a worker dies: it is retried once its
+// visibility timeout expires.
+//
+// The queue uses these keys under its name:
+//
+//	name:jobs          hash of job id to job
+//	name:ready         list of job ids ready to run
+//	name:scheduled     sorted set of job ids by time to run
+//	name:inflight      sorted set of job ids by visibility deadline
+//	name:processing:w  list of job ids held by worker w
+//	name:lease:id      worker holding job id
+//	name:dead          list of job ids which ran out of retries
+type Queue struct {
+	kv   *KVStore
+	name string
+	opts QueueOptions
+}
+
+// NewQueue returns the queue with the given name. opts may be nil.
+func (kv *KVStore) NewQueue(name string, opts *QueueOptions) *Queue {
+	q := &Queue{kv: kv, name: name}
+
+	if opts != nil {
+		q.opts = *opts
+	}
+
+	if q.opts.VisibilityTimeout <= 0 {
+		q.opts.VisibilityTimeout = 30 * time.Second
+	}
+
+	if q.opts.MaxRetries <= 0 {
+		q.opts.MaxRetries = 3
+	}
+
+	if q.opts.MinBackoff <= 0 {
+		q.opts.MinBackoff = time.Second
+	}
+
+	if q.opts.MaxBackoff <= 0 {
+		q.opts.MaxBackoff = 10 * time.Minute
+	}
+
+	if q.opts.PollTimeout <= 0 {
+		q.opts.PollTimeout = time.Second
+	}
+
+	if q.opts.Now == nil {
+		q.opts.Now = time.Now
+	}
+
+	if q.opts.OnError == nil {
+		q.opts.OnError = q.logError
+	}
+
+	return q
+}
+
+func (q *Queue) logError(job *Job, err error) {
+	if job == nil {
+		log.Printf("kvstore: queue %s: requeueing expired jobs: %v", q.name, err)
+		return
+	}
+
+	log.Printf("kvstore: queue %s: finishing job %s: %v", q.name, job.ID, err)
+}
+
+func (q *Queue) key(parts ...string) string {
+	k := q.name
+
+	for _, p := range parts {
+		k += ":" + p
+	}
+
+	return k
+}
+
+func (q *Queue) nowMillis() int64 {
+	return q.opts.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// Enqueue adds a job which is ready to run.
+func (q *Queue) Enqueue(payload []byte) (*Job, error) {
+	return q.EnqueueIn(payload, 0)
+}
+
+// EnqueueIn adds a job which runs after delay.
+func (q *Queue) EnqueueIn(payload []byte, delay time.Duration) (*Job, error) {
+	id, err := randomToken()
+
+	if err != nil {
+		return nil, err
+	}
+
+	job := &Job{ID: id, Payload: payload, EnqueuedAt: q.opts.Now()}
+	data, err := json.Marshal(job)
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = q.kv.Tx(nil, 0, func(tx *Tx) error {
+		tx.Send("HSET", q.key("jobs"), id, data)
+
+		if delay > 0 {
+			return tx.Send("ZADD", q.key("scheduled"), q.nowMillis()+millis(delay), id)
+		}
+
+		return tx.Send("LPUSH", q.key("ready"), id)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return job, nil
+}
+
+// promote moves scheduled jobs which are due to the ready list.
+func (q *Queue) promote() error {
+	scheduled := q.key("scheduled")
+	now := q.nowMillis()
+
+	_, err := q.kv.Tx([]string{scheduled}, 10, func(tx *Tx) error {
+		ids, err := redis.Strings(tx.Do("ZRANGEBYSCORE", scheduled, "-inf", now, "LIMIT", 0, 100))
+
+		if err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			tx.Send("ZREM", scheduled, id)
+			tx.Send("LPUSH", q.key("ready"), id)
+		}
+
+		return nil
+	})
+
+	return err
+}
+
+// dequeueScript moves the next ready job to the processing list of a
+// worker and leases it in one step, so that a job is never held without
+// a visibility deadline. A job deleted while queued is dropped.
+//
+// KEYS[1] ready, KEYS[2] processing, KEYS[3] inflight, KEYS[4] jobs,
+// KEYS[5] lease key prefix
+// ARGV[1] visibility deadline in ms, ARGV[2] worker
+var dequeueScript = RegisterScript("kvstore.queue.dequeue", 5, `
+local id = redis.call("RPOPLPUSH", KEYS[1], KEYS[2])
+
+if not id then
+	return false
+end
+
+local data = redis.call("HGET", KEYS[4], id)
+
+if not data then
+	redis.call("LREM", KEYS[2], 1, id)
+	return false
+end
+
+redis.call("ZADD", KEYS[3], ARGV[1], id)
+redis.call("SET", KEYS[5] .. id, ARGV[2])
+return data
+`)
+
+// Dequeue waits up to timeout for a job and leases it to worker for the
+// visibility timeout. It returns nil if no job became ready in time. The
+// job must be passed to Ack or Fail when done.
+//
+// The ready list is polled with backoff rather than blocked on, since a
+// blocking pop cannot lease the job in the same step.
+func (q *Queue) Dequeue(worker string, timeout time.Duration) (*Job, error) {
+	deadline := time.Now().Add(timeout)
+
+	for n := 0; ; n++ {
+		job, err := q.dequeue(worker)
+
+		if job != nil || err != nil {
+			return job, err
+		}
+
+		wait := time.Until(deadline)
+
+		if wait <= 0 {
+			return nil, nil
+		}
+
+		if d := backoff(n, 10*time.Millisecond, maxPollInterval); d < wait {
+			wait = d
+		}
+
+		time.Sleep(wait)
+	}
+}
+
+// maxPollInterval bounds the delay between polls of Dequeue.
+const maxPollInterval = 250 * time.Millisecond
+
+// dequeue leases the next ready job to worker, or returns nil if there is
+// none.
+func (q *Queue) dequeue(worker string) (*Job, error) {
+	if err := q.promote(); err != nil {
+		return nil, err
+	}
+
+	conn := q.kv.Get()
+	defer conn.Close()
+
+	deadline := q.nowMillis() + millis(q.opts.VisibilityTimeout)
+	data, err := redis.Bytes(dequeueScript.Do(conn, q.key("ready"), q.key("processing", worker),
+		q.key("inflight"), q.key("jobs"), q.key("lease", ""), deadline, worker))
+
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	job := new(Job)
+
+	if err := json.Unmarshal(data, job); err != nil {
+		return nil, err
+	}
+
+	return job, nil
+}
+
+// Ack marks a job done and deletes it.
+func (q *Queue) Ack(worker string, job *Job) error {
+	return q.finish(worker, job.ID, func(tx *Tx) error {
+		return tx.Send("HDEL", q.key("jobs"), job.ID)
+	})
+}
+
+// Fail records that the job failed with reason and schedules a retry with
+// backoff, or moves the job to the dead letter list once it is out of
+// retries.
+func (q *Queue) Fail(worker string, job *Job, reason error) error {
+	job.Attempts++
+
+	if reason != nil {
+		job.LastError = reason.Error()
+	}
+
+	return q.finish(worker, job.ID, func(tx *Tx) error {
+		return q.retry(tx, job)
+	})
+}
+
+// finish releases the lease of worker on id and queues then in the same
+// transaction. It returns ErrLeaseLost if worker no longer holds id.
+func (q *Queue) finish(worker, id string, then func(tx *Tx) error) error {
+	lease := q.key("lease", id)
+
+	_, err := q.kv.Tx([]string{lease}, 10, func(tx *Tx) error {
+		owner, err := redis.String(tx.Do("GET", lease))
+
+		if err == redis.ErrNil || (err == nil && owner != worker) {
+			return ErrLeaseLost
+		}
+
+		if err != nil {
+			return err
+		}
+
+		q.release(tx, worker, id)
+		return then(tx)
+	})
+
+	return err
+}
+
+// release queues the removal of the lease of worker on id.
+func (q *Queue) release(tx *Tx, worker, id string) {
+	tx.Send("LREM", q.key("processing", worker), 1, id)
+	tx.Send("ZREM", q.key("inflight"), id)
+	tx.Send("DEL", q.key("lease", id))
+}
+
+// retry queues the update of job and either its retry or dead letter.
+func (q *Queue) retry(tx *Tx, job *Job) error {
+	data, err := json.Marshal(job)
+
+	if err != nil {
+		return err
+	}
+
+	tx.Send("HSET", q.key("jobs"), job.ID, data)
+
+	if job.Attempts > q.opts.MaxRetries {
+		return tx.Send("LPUSH", q.key("dead"), job.ID)
+	}
+
+	delay := backoff(job.Attempts-1, q.opts.MinBackoff, q.opts.MaxBackoff)
+	return tx.Send("ZADD", q.key("scheduled"), q.nowMillis()+millis(delay), job.ID)
+}
+
+// RequeueExpired retries jobs whose visibility timeout has expired and
+// returns how many were found.
+func (q *Queue) RequeueExpired() (int, error) {
+	conn := q.kv.Get()
+	ids, err := redis.Strings(conn.Do("ZRANGEBYSCORE", q.key("inflight"), "-inf", q.nowMillis(), "LIMIT", 0, 100))
+	conn.Close()
+
+	if err != nil {
+		return 0, err
+	}
+
+	for _, id := range ids {
+		if err := q.abandon(id, "", "visibility timeout expired"); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(ids), nil
+}
+
+// Recover retries every job left in the processing list of worker, as
+// after a crash. It must only be called while worker is not running.
+func (q *Queue) Recover(worker string) (int, error) {
+	conn := q.kv.Get()
+	ids, err := redis.Strings(conn.Do("LRANGE", q.key("processing", worker), 0, -1))
+	conn.Close()
+
+	if err != nil {
+		return 0, err
+	}
+
+	for _, id := range ids {
+		if err := q.abandon(id, worker, "worker "+worker+" stopped"); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(ids), nil
+}
+
+// abandon retries the job id held by worker, or by whoever holds its lease
+// if worker is empty. It does nothing if the job was finished meanwhile.
+func (q *Queue) abandon(id, worker, reason string) error {
+	lease := q.key("lease", id)
+
+	_, err := q.kv.Tx([]string{lease}, 10, func(tx *Tx) error {
+		owner, err := redis.String(tx.Do("GET", lease))
+
+		if err != nil && err != redis.ErrNil {
+			return err
+		}
+
+		if worker == "" {
+			if err == redis.ErrNil {
+				// acked or failed meanwhile
+				return nil
+			}
+
+			worker = owner
+		}
+
+		data, err := redis.Bytes(tx.Do("HGET", q.key("jobs"), id))
+
+		if err == redis.ErrNil {
+			q.release(tx, worker, id)
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		job := new(Job)
+
+		if err := json.Unmarshal(data, job); err != nil {
+			return err
+		}
+
+		job.Attempts++
+		job.LastError = reason
+		q.release(tx, worker, id)
+		return q.retry(tx, job)
+	})
+
+	return err
+}
+
+// Stats returns the number of jobs in each state.
+func (q *Queue) Stats() (*QueueStats, error) {
+	conn := q.kv.Get()
+	defer conn.Close()
+
+	conn.Send("LLEN", q.key("ready"))
+	conn.Send("ZCARD", q.key("scheduled"))
+	conn.Send("ZCARD", q.key("inflight"))
+	conn.Send("LLEN", q.key("dead"))
+
+	if err := conn.Flush(); err != nil {
+		return nil, err
+	}
+
+	var counts [4]int
+
+	for i := range counts {
+		n, err := redis.Int(conn.Receive())
+
+		if err != nil {
+			return nil, err
+		}
+
+		counts[i] = n
+	}
+
+	return &QueueStats{
+		Ready:     counts[0],
+		Scheduled: counts[1],
+		InFlight:  counts[2],
+		Dead:      counts[3],
+	}, nil
+}
+
+// Run processes jobs as worker with up to concurrency handlers at once
+// until ctx is done. A job is acknowledged if handler returns nil and
+// failed otherwise; errors doing so go to QueueOptions.OnError. Jobs left
+// behind by a previous run of the same worker are recovered first, and
+// expired leases of all workers are requeued periodically. Run waits for
+// running handlers before it returns.
+func (q *Queue) Run(ctx context.Context, worker string, concurrency int, handler func(*Job) error) error {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	if _, err := q.Recover(worker); err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for sleep(q.opts.VisibilityTimeout/2, ctx.Done()) {
+			if _, err := q.RequeueExpired(); err != nil {
+				q.opts.OnError(nil, err)
+			}
+		}
+	}()
+
+	gate := syncutil.NewGate(concurrency)
+
+	for n := 0; ctx.Err() == nil; {
+		gate.Start()
+		job, err := q.Dequeue(worker, q.opts.PollTimeout)
+
+		if err != nil || job == nil {
+			gate.Done()
+
+			if err != nil {
+				if !sleep(backoff(n, 10*time.Millisecond, q.opts.PollTimeout), ctx.Done()) {
+					break
+				}
+				n++
+			}
+
+			continue
+		}
+
+		n = 0
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer gate.Done()
+
+			var err error
+
+			if herr := handler(job); herr != nil {
+				err = q.Fail(worker, job, herr)
+			} else {
+				err = q.Ack(worker, job)
+			}
+
+			if err != nil {
+				q.opts.OnError(job, err)
+			}
+		}()
+	}
+
+	return nil
+}
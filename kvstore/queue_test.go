@@ -0,0 +1,210 @@
+package kvstore_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/simonz05/util/assert"
+	"github.com/simonz05/util/kvstore"
+	"github.com/simonz05/util/kvstore/kvtest"
+)
+
+func TestQueue(t *testing.T) {
+	ast := assert.NewAssert(t)
+	srv, err := kvtest.NewServer()
+	ast.Nil(err)
+	defer srv.Close()
+
+	db, err := kvstore.Open(srv.DSN(0))
+	ast.Nil(err)
+	defer db.Close()
+
+	now := time.Now()
+	q := db.NewQueue("jobs", &kvstore.QueueOptions{
+		VisibilityTimeout: time.Minute,
+		MaxRetries:        1,
+		Now:               func() time.Time { return now },
+	})
+
+	a, err := q.Enqueue([]byte("a"))
+	ast.Nil(err)
+	_, err = q.EnqueueIn([]byte("b"), time.Hour)
+	ast.Nil(err)
+
+	stats, err := q.Stats()
+	ast.Nil(err)
+	ast.Equal(kvstore.QueueStats{Ready: 1, Scheduled: 1}, *stats)
+
+	job, err := q.Dequeue("w1", 10*time.Millisecond)
+	ast.Nil(err)
+	ast.Equal(a.ID, job.ID)
+	ast.Equal("a", string(job.Payload))
+
+	// the job is leased as it is dequeued
+	stats, err = q.Stats()
+	ast.Nil(err)
+	ast.Equal(kvstore.QueueStats{Scheduled: 1, InFlight: 1}, *stats)
+
+	job, err = q.Dequeue("w1", 10*time.Millisecond)
+	ast.Nil(err)
+	ast.True(job == nil)
+
+	ast.Equal(kvstore.ErrLeaseLost, q.Ack("w2", a))
+	ast.Nil(q.Fail("w1", a, errors.New("boom")))
+	ast.Equal(kvstore.ErrLeaseLost, q.Ack("w1", a))
+
+	stats, err = q.Stats()
+	ast.Nil(err)
+	ast.Equal(kvstore.QueueStats{Scheduled: 2}, *stats)
+
+	// both the retry and the delayed job are due
+	now = now.Add(2 * time.Hour)
+	seen := map[string]*kvstore.Job{}
+
+	for i := 0; i < 2; i++ {
+		job, err := q.Dequeue("w1", 10*time.Millisecond)
+		ast.Nil(err)
+		seen[string(job.Payload)] = job
+	}
+
+	ast.Equal(1, seen["a"].Attempts)
+	ast.Equal("boom", seen["a"].LastError)
+	ast.Nil(q.Ack("w1", seen["b"]))
+
+	// the lease of a expires and it runs out of retries
+	now = now.Add(2 * time.Minute)
+	n, err := q.RequeueExpired()
+	ast.Nil(err)
+	ast.Equal(1, n)
+	ast.Equal(kvstore.ErrLeaseLost, q.Ack("w1", seen["a"]))
+
+	stats, err = q.Stats()
+	ast.Nil(err)
+	ast.Equal(kvstore.QueueStats{Dead: 1}, *stats)
+
+	// a crashed worker leaves its jobs behind
+	_, err = q.Enqueue([]byte("c"))
+	ast.Nil(err)
+	job, err = q.Dequeue("w1", 10*time.Millisecond)
+	ast.Nil(err)
+	ast.True(job != nil)
+
+	n, err = q.Recover("w1")
+	ast.Nil(err)
+	ast.Equal(1, n)
+
+	stats, err = q.Stats()
+	ast.Nil(err)
+	ast.Equal(kvstore.QueueStats{Scheduled: 1, Dead: 1}, *stats)
+
+	// Dequeue waits for a job to become ready
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		q.Enqueue([]byte("d"))
+	}()
+
+	job, err = q.Dequeue("w2", time.Second)
+	ast.Nil(err)
+	ast.Equal("d", string(job.Payload))
+}
+
+func TestQueueRun(t *testing.T) {
+	ast := assert.NewAssert(t)
+	srv, err := kvtest.NewServer()
+	ast.Nil(err)
+	defer srv.Close()
+
+	db, err := kvstore.Open(srv.DSN(0))
+	ast.Nil(err)
+	defer db.Close()
+
+	q := db.NewQueue("jobs", &kvstore.QueueOptions{
+		MinBackoff:  time.Millisecond,
+		MaxBackoff:  time.Millisecond,
+		PollTimeout: 10 * time.Millisecond,
+	})
+
+	for i := 0; i < 10; i++ {
+		_, err := q.Enqueue([]byte{byte(i)})
+		ast.Nil(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		mu   sync.Mutex
+		runs int
+		done = map[byte]bool{}
+	)
+
+	err = q.Run(ctx, "w1", 4, func(job *kvstore.Job) error {
+		mu.Lock()
+		defer mu.Unlock()
+		runs++
+
+		// every other job fails once
+		if job.Payload[0]%2 == 1 && job.Attempts == 0 {
+			return errors.New("retry")
+		}
+
+		done[job.Payload[0]] = true
+
+		if len(done) == 10 {
+			cancel()
+		}
+
+		return nil
+	})
+
+	ast.Nil(err)
+	ast.Equal(15, runs)
+
+	stats, err := q.Stats()
+	ast.Nil(err)
+	ast.Equal(kvstore.QueueStats{}, *stats)
+}
+
+func TestQueueRunErrors(t *testing.T) {
+	ast := assert.NewAssert(t)
+	srv, err := kvtest.NewServer()
+	ast.Nil(err)
+	defer srv.Close()
+
+	db, err := kvstore.Open(srv.DSN(0))
+	ast.Nil(err)
+	defer db.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		failed *kvstore.Job
+		ferr   error
+	)
+
+	q := db.NewQueue("jobs", &kvstore.QueueOptions{
+		PollTimeout: 10 * time.Millisecond,
+		OnError: func(job *kvstore.Job, err error) {
+			failed, ferr = job, err
+			cancel()
+		},
+	})
+
+	job, err := q.Enqueue([]byte("x"))
+	ast.Nil(err)
+
+	err = q.Run(ctx, "w1", 1, func(job *kvstore.Job) error {
+		// the lease is gone before the job is acknowledged
+		conn := db.Get()
+		defer conn.Close()
+		_, err := conn.Do("DEL", "jobs:lease:"+job.ID)
+		return err
+	})
+	ast.Nil(err)
+	ast.Equal(job.ID, failed.ID)
+	ast.Equal(kvstore.ErrLeaseLost, ferr)
+}
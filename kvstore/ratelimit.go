@@ -0,0 +1,294 @@
+package kvstore
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// slidingWindowScript keeps a log of request timestamps in a sorted set
+// and admits n requests if fewer than limit remain within the window.
+//
+// KEYS[1] log key
+// ARGV[1] limit, ARGV[2] window in ms, ARGV[3] n, ARGV[4] unique id
+var slidingWindowScript = RegisterScript("kvstore.ratelimit.sliding_window", 1, `
+redis.replicate_commands()
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local n = tonumber(ARGV[3])
+local t = redis.call("TIME")
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", now - window)
+local count = redis.call("ZCARD", KEYS[1])
+local allowed = 0
+
+if count + n <= limit then
+	for i = 1, n do
+		redis.call("ZADD", KEYS[1], now, ARGV[4] .. ":" .. i)
+	end
+	count = count + n
+	allowed = 1
+end
+
+-- the log is replenished and can expire once its newest entry leaves
+local retry = -1
+local reset = 0
+local newest = redis.call("ZRANGE", KEYS[1], -1, -1, "WITHSCORES")
+
+if #newest > 0 then
+	reset = tonumber(newest[2]) + window - now
+	redis.call("PEXPIRE", KEYS[1], reset)
+end
+
+-- n slots are free once the entry at count + n - limit leaves
+if allowed == 0 then
+	local idx = count + n - limit - 1
+	local entry = redis.call("ZRANGE", KEYS[1], idx, idx, "WITHSCORES")
+	retry = tonumber(entry[2]) + window - now
+end
+
+return {allowed, limit - count, retry, reset}
+`)
+
+// gcraScript implements the generic cell rate algorithm. The key holds
+// the theoretical arrival time of the next request in ms.
+//
+// KEYS[1] tat key
+// ARGV[1] burst, ARGV[2] rate, ARGV[3] period in ms, ARGV[4] n
+var gcraScript = RegisterScript("kvstore.ratelimit.gcra", 1, `
+redis.replicate_commands()
+local burst = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local period = tonumber(ARGV[3])
+local n = tonumber(ARGV[4])
+local t = redis.call("TIME")
+local now = tonumber(t[1]) * 1000 + tonumber(t[2]) / 1000
+
+local interval = period / rate
+local tolerance = interval * burst
+local tat = tonumber(redis.call("GET", KEYS[1]) or now)
+
+if tat < now then
+	tat = now
+end
+
+local newTat = tat + interval * n
+local diff = now - (newTat - tolerance)
+
+if diff < 0 then
+	local remaining = math.floor((now - (tat - tolerance)) / interval)
+	if remaining < 0 then
+		remaining = 0
+	end
+	return {0, remaining, tostring(-diff), tostring(tat - now)}
+end
+
+local reset = newTat - now
+-- tostring keeps 14 digits only, too few for a time in ms with a fraction
+redis.call("SET", KEYS[1], string.format("%.3f", newTat), "PX", math.ceil(reset))
+return {1, math.floor(diff / interval), "-1", tostring(reset)}
+`)
+
+// A Limit admits Rate requests per Period. Burst is the number of requests
+// the GCRA limiter admits at once after a quiet period; it defaults to
+// Rate. The sliding window limiter ignores Burst.
+type Limit struct {
+	Rate   int
+	Period time.Duration
+	Burst  int
+}
+
+// FailurePolicy decides the outcome of a rate limit check when redis
+// cannot be reached.
+type FailurePolicy int
+
+const (
+	// FailOpen admits requests when redis is unavailable.
+	FailOpen FailurePolicy = iota
+	// FailClosed denies requests when redis is unavailable.
+	FailClosed
+)
+
+// RateResult is the outcome of a rate limit check.
+type RateResult struct {
+	Allowed bool
+	// Remaining is the number of requests that would be admitted
+	// right after this one.
+	Remaining int
+	// RetryAfter is how long to wait before the request would be
+	// admitted. It is zero if the request was allowed.
+	RetryAfter time.Duration
+	// ResetAfter is how long until the limit is fully replenished.
+	ResetAfter time.Duration
+}
+
+// A RateLimiter enforces a Limit per key across every process sharing a
+// redis server. Keys are stored under prefix.
+type RateLimiter struct {
+	kv     *KVStore
+	prefix string
+	limit  Limit
+	policy FailurePolicy
+	gcra   bool
+}
+
+// NewSlidingWindowLimiter returns a limiter which logs the time of every
+// admitted request and admits at most limit.Rate within any window of
+// limit.Period. It is exact, but uses memory proportional to the rate.
+func (kv *KVStore) NewSlidingWindowLimiter(prefix string, limit Limit, policy FailurePolicy) *RateLimiter {
+	return &RateLimiter{kv: kv, prefix: prefix, limit: limit, policy: policy}
+}
+
+// NewGCRALimiter returns a token bucket limiter using the generic cell
+// rate algorithm. It spaces requests evenly over limit.Period while
+// allowing bursts of limit.Burst, and stores a single value per key.
+func (kv *KVStore) NewGCRALimiter(prefix string, limit Limit, policy FailurePolicy) *RateLimiter {
+	if limit.Burst <= 0 {
+		limit.Burst = limit.Rate
+	}
+
+	return &RateLimiter{kv: kv, prefix: prefix, limit: limit, policy: policy, gcra: true}
+}
+
+// Allow is shorthand for AllowN(key, 1).
+func (l *RateLimiter) Allow(key string) (*RateResult, error) {
+	return l.AllowN(key, 1)
+}
+
+// AllowN reports whether n requests for key are admitted, and consumes
+// them if so. If redis fails, AllowN returns the error together with a
+// result decided by the failure policy.
+func (l *RateLimiter) AllowN(key string, n int) (*RateResult, error) {
+	max := l.limit.Rate
+
+	if l.gcra {
+		max = l.limit.Burst
+	}
+
+	if n <= 0 || n > max || l.limit.Period <= 0 {
+		return nil, fmt.Errorf("kvstore: cannot admit %d requests with limit %d per %v", n, max, l.limit.Period)
+	}
+
+	conn := l.kv.Get()
+	defer conn.Close()
+
+	var (
+		reply interface{}
+		err   error
+	)
+
+	if l.gcra {
+		reply, err = gcraScript.Do(conn, l.key(key), l.limit.Burst, l.limit.Rate, millis(l.limit.Period), n)
+	} else {
+		var id string
+		id, err = randomToken()
+
+		if err == nil {
+			reply, err = slidingWindowScript.Do(conn, l.key(key), l.limit.Rate, millis(l.limit.Period), n, id)
+		}
+	}
+
+	if err != nil {
+		return l.fail(err)
+	}
+
+	res, err := parseRateResult(reply)
+
+	if err != nil {
+		return l.fail(err)
+	}
+
+	return res, nil
+}
+
+// Reset clears the recorded requests for key.
+func (l *RateLimiter) Reset(key string) error {
+	conn := l.kv.Get()
+	defer conn.Close()
+	_, err := conn.Do("DEL", l.key(key))
+	return err
+}
+
+func (l *RateLimiter) key(key string) string {
+	return l.prefix + ":" + key
+}
+
+func (l *RateLimiter) fail(err error) (*RateResult, error) {
+	if l.policy == FailOpen {
+		return &RateResult{Allowed: true, Remaining: l.limit.Rate}, err
+	}
+
+	return &RateResult{RetryAfter: l.limit.Period, ResetAfter: l.limit.Period}, err
+}
+
+// parseRateResult converts the {allowed, remaining, retry, reset} reply of
+// the limiter scripts. Durations are in milliseconds and a negative retry
+// means the request was allowed.
+func parseRateResult(reply interface{}) (*RateResult, error) {
+	values, err := redis.Values(reply, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(values) != 4 {
+		return nil, fmt.Errorf("kvstore: unexpected rate limit reply length %d", len(values))
+	}
+
+	allowed, err := redis.Int(values[0], nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	remaining, err := redis.Int(values[1], nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	retry, err := parseMillis(values[2])
+
+	if err != nil {
+		return nil, err
+	}
+
+	reset, err := parseMillis(values[3])
+
+	if err != nil {
+		return nil, err
+	}
+
+	if retry < 0 {
+		retry = 0
+	}
+
+	return &RateResult{
+		Allowed:    allowed == 1,
+		Remaining:  remaining,
+		RetryAfter: retry,
+		ResetAfter: reset,
+	}, nil
+}
+
+// parseMillis converts an integer or float string reply in milliseconds to
+// a duration.
+func parseMillis(v interface{}) (time.Duration, error) {
+	switch v := v.(type) {
+	case int64:
+		return time.Duration(v) * time.Millisecond, nil
+	case []byte:
+		f, err := strconv.ParseFloat(string(v), 64)
+
+		if err != nil {
+			return 0, err
+		}
+
+		return time.Duration(f * float64(time.Millisecond)), nil
+	}
+
+	return 0, fmt.Errorf("kvstore: unexpected type for duration, got type %T", v)
+}
@@ -0,0 +1,174 @@
+package kvstore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/simonz05/util/assert"
+	"github.com/simonz05/util/kvstore/kvtest"
+)
+
+func openTest(t *testing.T) (*kvtest.Server, *KVStore) {
+	srv, err := kvtest.NewServer()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := Open(srv.DSN(0))
+
+	if err != nil {
+		srv.Close()
+		t.Fatal(err)
+	}
+
+	return srv, db
+}
+
+func TestSlidingWindowLimiter(t *testing.T) {
+	ast := assert.NewAssert(t)
+	srv, db := openTest(t)
+	defer srv.Close()
+	defer db.Close()
+
+	l := db.NewSlidingWindowLimiter("rl", Limit{Rate: 3, Period: time.Minute}, FailClosed)
+	pttl := func() time.Duration {
+		conn := db.Get()
+		defer conn.Close()
+		ms, err := redis.Int64(conn.Do("PTTL", "rl:key"))
+		ast.Nil(err)
+		return time.Duration(ms) * time.Millisecond
+	}
+
+	res, err := l.Allow("key")
+	ast.Nil(err)
+	ast.True(res.Allowed)
+	ast.Equal(2, res.Remaining)
+	ast.Equal(time.Minute, res.ResetAfter)
+
+	srv.Advance(20 * time.Second)
+	res, err = l.AllowN("key", 2)
+	ast.Nil(err)
+	ast.True(res.Allowed)
+	ast.Equal(0, res.Remaining)
+	ast.Equal(time.Duration(0), res.RetryAfter)
+	ast.Equal(time.Minute, res.ResetAfter)
+
+	// the log lives until its newest entry leaves the window
+	srv.Advance(10 * time.Second)
+	ast.Equal(50*time.Second, pttl())
+
+	// a slot frees up when the first request leaves the window, two when
+	// the second does
+	res, err = l.Allow("key")
+	ast.Nil(err)
+	ast.True(!res.Allowed)
+	ast.Equal(0, res.Remaining)
+	ast.Equal(30*time.Second, res.RetryAfter)
+	ast.Equal(50*time.Second, res.ResetAfter)
+
+	res, err = l.AllowN("key", 2)
+	ast.Nil(err)
+	ast.True(!res.Allowed)
+	ast.Equal(50*time.Second, res.RetryAfter)
+
+	srv.Advance(30 * time.Second)
+	res, err = l.Allow("key")
+	ast.Nil(err)
+	ast.True(res.Allowed)
+	ast.Equal(0, res.Remaining)
+	ast.Equal(time.Minute, res.ResetAfter)
+	ast.Equal(time.Minute, pttl())
+
+	ast.Nil(l.Reset("key"))
+	res, err = l.AllowN("key", 3)
+	ast.Nil(err)
+	ast.True(res.Allowed)
+}
+
+func TestGCRALimiter(t *testing.T) {
+	ast := assert.NewAssert(t)
+	srv, db := openTest(t)
+	defer srv.Close()
+	defer db.Close()
+
+	// a request every 500ms, two at once
+	l := db.NewGCRALimiter("rl", Limit{Rate: 2, Period: time.Second}, FailClosed)
+	round := func(d time.Duration) time.Duration {
+		return d.Round(time.Millisecond)
+	}
+
+	res, err := l.Allow("key")
+	ast.Nil(err)
+	ast.True(res.Allowed)
+	ast.Equal(1, res.Remaining)
+	ast.Equal(500*time.Millisecond, round(res.ResetAfter))
+
+	res, err = l.Allow("key")
+	ast.Nil(err)
+	ast.True(res.Allowed)
+	ast.Equal(0, res.Remaining)
+	ast.Equal(time.Second, round(res.ResetAfter))
+
+	res, err = l.Allow("key")
+	ast.Nil(err)
+	ast.True(!res.Allowed)
+	ast.Equal(0, res.Remaining)
+	ast.Equal(500*time.Millisecond, round(res.RetryAfter))
+	ast.Equal(time.Second, round(res.ResetAfter))
+
+	srv.Advance(500 * time.Millisecond)
+	res, err = l.Allow("key")
+	ast.Nil(err)
+	ast.True(res.Allowed)
+	ast.Equal(0, res.Remaining)
+
+	srv.Advance(time.Second)
+	res, err = l.AllowN("key", 2)
+	ast.Nil(err)
+	ast.True(res.Allowed)
+}
+
+func TestRateLimiterFailurePolicy(t *testing.T) {
+	ast := assert.NewAssert(t)
+
+	// nothing listens on the discard port
+	db, err := Open("redis://127.0.0.1:9/0?dial_timeout=100ms")
+	ast.Nil(err)
+	defer db.Close()
+
+	limit := Limit{Rate: 10, Period: time.Minute}
+
+	res, err := db.NewGCRALimiter("rl", limit, FailOpen).Allow("key")
+	ast.NotNil(err)
+	ast.True(res.Allowed)
+
+	res, err = db.NewSlidingWindowLimiter("rl", limit, FailClosed).Allow("key")
+	ast.NotNil(err)
+	ast.True(!res.Allowed)
+	ast.Equal(time.Minute, res.RetryAfter)
+
+	_, err = db.NewSlidingWindowLimiter("rl", limit, FailOpen).AllowN("key", 11)
+	ast.NotNil(err)
+}
+
+func TestParseRateResult(t *testing.T) {
+	ast := assert.NewAssert(t)
+
+	res, err := parseRateResult([]interface{}{int64(1), int64(4), []byte("-1"), []byte("1500.5")})
+	ast.Nil(err)
+	ast.True(res.Allowed)
+	ast.Equal(4, res.Remaining)
+	ast.Equal(time.Duration(0), res.RetryAfter)
+	ast.Equal(1500500*time.Microsecond, res.ResetAfter)
+
+	res, err = parseRateResult([]interface{}{int64(0), int64(0), int64(250), int64(60000)})
+	ast.Nil(err)
+	ast.True(!res.Allowed)
+	ast.Equal(250*time.Millisecond, res.RetryAfter)
+	ast.Equal(time.Minute, res.ResetAfter)
+
+	_, err = parseRateResult([]interface{}{int64(1)})
+	ast.NotNil(err)
+}
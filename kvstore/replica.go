@@ -0,0 +1,234 @@
+package kvstore
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// ReplicaStatus is the outcome of the last health check of a replica.
+type ReplicaStatus struct {
+	Addr    string
+	Healthy bool
+	// Lag is how many bytes of the replication stream the replica was
+	// behind its primary, or -1 if the primary could not be read.
+	Lag int64
+	// Err is why the replica is unhealthy, if it is.
+	Err error
+}
+
+type replica struct {
+	pool *redis.Pool
+
+	mu     sync.Mutex
+	status ReplicaStatus
+}
+
+func (r *replica) healthy() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.status.Healthy
+}
+
+// check reads the replication state of r and compares its offset with
+// primary, that of the primary unless primaryErr is set. A replica is
+// healthy if it is connected to its primary, not syncing and within
+// maxLag bytes of it, if set.
+func (r *replica) check(primary int64, primaryErr error, maxLag int64) {
+	var offset int64
+	lag := int64(-1)
+	info, err := readInfo(r.pool)
+
+	if err == nil {
+		offset, err = replicaOffset(info)
+	}
+
+	if err == nil && primaryErr == nil {
+		// the replica is read last and may have caught up meanwhile
+		if lag = primary - offset; lag < 0 {
+			lag = 0
+		}
+	}
+
+	if err == nil && maxLag > 0 {
+		if primaryErr != nil {
+			err = fmt.Errorf("kvstore: replica %s lag unknown: %v", r.status.Addr, primaryErr)
+		} else if lag > maxLag {
+			err = fmt.Errorf("kvstore: replica %s lags %d bytes behind", r.status.Addr, lag)
+		}
+	}
+
+	r.mu.Lock()
+	r.status.Healthy = err == nil
+	r.status.Lag = lag
+	r.status.Err = err
+	r.mu.Unlock()
+}
+
+// replicaSet routes reads across replicas and checks their health in the
+// background. Replicas are unhealthy until their first check.
+type replicaSet struct {
+	primary  *redis.Pool
+	replicas []*replica
+	maxLag   int64
+	next     uint32
+
+	once sync.Once
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newReplicaSet(kv *KVStore) *replicaSet {
+	rs := &replicaSet{primary: kv.Pool, maxLag: kv.cfg.maxLag, done: make(chan struct{})}
+
+	for _, addr := range kv.cfg.replicas {
+		rs.replicas = append(rs.replicas, &replica{
+			pool:   kv.newPool(addr),
+			status: ReplicaStatus{Addr: addr, Err: fmt.Errorf("kvstore: replica %s not checked yet", addr)},
+		})
+	}
+
+	rs.wg.Add(1)
+	go rs.run(kv.cfg.replicaCheck)
+	return rs
+}
+
+func (rs *replicaSet) run(interval time.Duration) {
+	defer rs.wg.Done()
+
+	for {
+		rs.check()
+
+		if !sleep(interval, rs.done) {
+			return
+		}
+	}
+}
+
+func (rs *replicaSet) check() {
+	info, err := readInfo(rs.primary)
+	var offset int64
+
+	if err == nil {
+		offset, err = primaryOffset(info)
+	}
+
+	for _, r := range rs.replicas {
+		r.check(offset, err, rs.maxLag)
+	}
+}
+
+// pick returns the pool of the next healthy replica, or nil if none is.
+func (rs *replicaSet) pick() *redis.Pool {
+	n := len(rs.replicas)
+	start := int(atomic.AddUint32(&rs.next, 1) % uint32(n))
+
+	for i := 0; i < n; i++ {
+		if r := rs.replicas[(start+i)%n]; r.healthy() {
+			return r.pool
+		}
+	}
+
+	return nil
+}
+
+func (rs *replicaSet) status() []ReplicaStatus {
+	status := make([]ReplicaStatus, len(rs.replicas))
+
+	for i, r := range rs.replicas {
+		r.mu.Lock()
+		status[i] = r.status
+		r.mu.Unlock()
+	}
+
+	return status
+}
+
+func (rs *replicaSet) close() {
+	rs.once.Do(func() {
+		close(rs.done)
+		rs.wg.Wait()
+
+		for _, r := range rs.replicas {
+			r.pool.Close()
+		}
+	})
+}
+
+// Replicas returns the status of the read replicas given in the data
+// source name.
+func (kv *KVStore) Replicas() []ReplicaStatus {
+	if kv.replicas == nil {
+		return nil
+	}
+
+	return kv.replicas.status()
+}
+
+// readInfo returns the INFO replication section of a server in pool.
+func readInfo(pool *redis.Pool) (map[string]string, error) {
+	conn := pool.Get()
+	info, err := redis.String(conn.Do("INFO", "replication"))
+	conn.Close()
+
+	if err != nil {
+		return nil, err
+	}
+
+	fields := make(map[string]string)
+
+	for _, line := range strings.Split(info, "\n") {
+		line = strings.TrimSpace(line)
+
+		if i := strings.IndexByte(line, ':'); i > 0 && line[0] != '#' {
+			fields[line[:i]] = line[i+1:]
+		}
+	}
+
+	return fields, nil
+}
+
+// primaryOffset returns the offset of the replication stream written by a
+// primary, from its INFO replication fields.
+func primaryOffset(info map[string]string) (int64, error) {
+	if role := info["role"]; role != "master" {
+		return 0, fmt.Errorf("kvstore: primary has role %q", role)
+	}
+
+	return infoOffset(info, "master_repl_offset")
+}
+
+// replicaOffset returns the offset of the replication stream processed by
+// a replica, from its INFO replication fields. It fails if the server is
+// not a replica, has lost its primary or is syncing.
+func replicaOffset(info map[string]string) (int64, error) {
+	if role := info["role"]; role != "slave" && role != "replica" {
+		return 0, fmt.Errorf("kvstore: server role is %q, not replica", role)
+	}
+
+	if info["master_link_status"] != "up" {
+		return 0, fmt.Errorf("kvstore: replica link to primary is down")
+	}
+
+	if info["master_sync_in_progress"] == "1" {
+		return 0, fmt.Errorf("kvstore: replica is syncing with primary")
+	}
+
+	// master_repl_offset of a replica is its own offset as well
+	return infoOffset(info, "slave_repl_offset")
+}
+
+func infoOffset(info map[string]string, key string) (int64, error) {
+	n, err := strconv.ParseInt(info[key], 10, 64)
+
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("kvstore: invalid %s %q", key, info[key])
+	}
+
+	return n, nil
+}
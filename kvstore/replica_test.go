@@ -0,0 +1,110 @@
+package kvstore
+
+import (
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/simonz05/util/assert"
+	"github.com/simonz05/util/kvstore/kvtest"
+)
+
+func TestReplicaRouting(t *testing.T) {
+	ast := assert.NewAssert(t)
+	var servers []*kvtest.Server
+
+	for _, name := range []string{"primary", "r1", "r2"} {
+		srv, err := kvtest.NewServer()
+		ast.Nil(err)
+		defer srv.Close()
+
+		db, err := Open(srv.DSN(0))
+		ast.Nil(err)
+		conn := db.Get()
+		_, err = conn.Do("SET", "eu:who", name)
+		ast.Nil(err)
+		conn.Close()
+		db.Close()
+		servers = append(servers, srv)
+	}
+
+	primary, r1, r2 := servers[0], servers[1], servers[2]
+	kv, err := Open(primary.DSN(0) + "?replica=" + r1.Addr() + "," + r2.Addr() + "&max_lag=500")
+	ast.Nil(err)
+	defer kv.Close()
+
+	eu := kv.Namespace("eu")
+	reads := func(n int) map[string]int {
+		kv.replicas.check()
+		seen := make(map[string]int)
+
+		for i := 0; i < n; i++ {
+			conn := eu.GetReadOnly()
+			who, err := redis.String(conn.Do("GET", "who"))
+			ast.Nil(err)
+			conn.Close()
+			seen[who]++
+		}
+
+		return seen
+	}
+
+	// servers which are not replicas are never read from
+	ast.Equal(map[string]int{"primary": 4}, reads(4))
+
+	primary.SetReplOffset(1000)
+	r1.SetReplicaOf(primary.Addr(), true)
+	r1.SetReplOffset(1000)
+	r2.SetReplicaOf(primary.Addr(), true)
+	r2.SetReplOffset(100)
+	ast.Equal(map[string]int{"r1": 4}, reads(4))
+
+	status := kv.Replicas()
+	ast.Equal(2, len(status))
+	ast.True(status[0].Healthy)
+	ast.True(!status[1].Healthy)
+	ast.Equal(int64(0), status[0].Lag)
+	ast.Equal(int64(900), status[1].Lag)
+
+	r2.SetReplOffset(990)
+	ast.Equal(map[string]int{"r1": 2, "r2": 2}, reads(4))
+
+	r1.SetReplicaOf(primary.Addr(), false)
+	r2.Close()
+	ast.Equal(map[string]int{"primary": 4}, reads(4))
+
+	conn := eu.Get()
+	defer conn.Close()
+	who, err := redis.String(conn.Do("GET", "who"))
+	ast.Nil(err)
+	ast.Equal("primary", who)
+}
+
+func TestReplicationOffset(t *testing.T) {
+	ast := assert.NewAssert(t)
+	info := map[string]string{
+		"role":                    "slave",
+		"master_link_status":      "up",
+		"master_sync_in_progress": "0",
+		"slave_repl_offset":       "42",
+		"master_repl_offset":      "42",
+	}
+
+	offset, err := replicaOffset(info)
+	ast.Nil(err)
+	ast.Equal(int64(42), offset)
+
+	_, err = primaryOffset(info)
+	ast.NotNil(err)
+
+	info["master_sync_in_progress"] = "1"
+	_, err = replicaOffset(info)
+	ast.NotNil(err)
+
+	info = map[string]string{"role": "master", "master_repl_offset": "1000"}
+	offset, err = primaryOffset(info)
+	ast.Nil(err)
+	ast.Equal(int64(1000), offset)
+
+	_, err = replicaOffset(info)
+	ast.NotNil(err)
+}
@@ -0,0 +1,180 @@
+package kvstore
+
+import (
+	"context"
+	"errors"
+)
+
+// ScanOptions filters the elements returned by a scan. The zero value
+// returns every element.
+type ScanOptions struct {
+	// Match is a glob pattern elements must match.
+	Match string
+	// Count hints how many elements to fetch per round trip.
+	Count int
+	// Type restricts SCAN to keys holding the given type, such as
+	// "string" or "zset". It is ignored by the other scans.
+	Type string
+}
+
+// A ScanIterator walks a keyspace, set, hash or sorted set with the
+// cursor based SCAN family of commands, one page per round trip, without
+// blocking the server like KEYS or HGETALL would.
+//
+// Redis may return an element more than once during a scan. The iterator
+// remembers every element seen and skips repeats, so memory use grows with
+// the number of elements.
+//
+//	it := db.Scan(ctx, &kvstore.ScanOptions{Match: "session:*"})
+//	for it.Next() {
+//		fmt.Println(string(it.Item()))
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+type ScanIterator struct {
+	kv    *KVStore
+	ctx   context.Context
+	cmd   string
+	key   string
+	opts  ScanOptions
+	pairs bool
+
+	cursor int64
+	done   bool
+	buf    [][]byte
+	seen   map[string]struct{}
+	item   []byte
+	value  []byte
+	err    error
+}
+
+// Scan iterates the keys of the database with SCAN.
+func (kv *KVStore) Scan(ctx context.Context, opts *ScanOptions) *ScanIterator {
+	return kv.newScanIterator(ctx, "SCAN", "", opts, false)
+}
+
+// SScan iterates the members of the set at key with SSCAN.
+func (kv *KVStore) SScan(ctx context.Context, key string, opts *ScanOptions) *ScanIterator {
+	return kv.newScanIterator(ctx, "SSCAN", key, opts, false)
+}
+
+// HScan iterates the fields and values of the hash at key with HSCAN.
+func (kv *KVStore) HScan(ctx context.Context, key string, opts *ScanOptions) *ScanIterator {
+	return kv.newScanIterator(ctx, "HSCAN", key, opts, true)
+}
+
+// ZScan iterates the members and scores of the sorted set at key with
+// ZSCAN.
+func (kv *KVStore) ZScan(ctx context.Context, key string, opts *ScanOptions) *ScanIterator {
+	return kv.newScanIterator(ctx, "ZSCAN", key, opts, true)
+}
+
+func (kv *KVStore) newScanIterator(ctx context.Context, cmd, key string, opts *ScanOptions, pairs bool) *ScanIterator {
+	it := &ScanIterator{
+		kv:    kv,
+		ctx:   ctx,
+		cmd:   cmd,
+		key:   key,
+		pairs: pairs,
+		seen:  make(map[string]struct{}),
+	}
+
+	if opts != nil {
+		it.opts = *opts
+	}
+
+	return it
+}
+
+// Next advances to the next element. It returns false when the scan is
+// complete, the context is done or an error occurred.
+func (it *ScanIterator) Next() bool {
+	for it.err == nil {
+		for len(it.buf) > 0 {
+			it.item, it.buf = it.buf[0], it.buf[1:]
+			it.value = nil
+
+			if it.pairs {
+				if len(it.buf) == 0 {
+					it.err = errors.New("kvstore: odd number of elements in " + it.cmd + " reply")
+					return false
+				}
+
+				it.value, it.buf = it.buf[0], it.buf[1:]
+			}
+
+			if _, ok := it.seen[string(it.item)]; ok {
+				continue
+			}
+
+			it.seen[string(it.item)] = struct{}{}
+			return true
+		}
+
+		if it.done {
+			return false
+		}
+
+		it.fetch()
+	}
+
+	return false
+}
+
+// fetch reads the next page into buf.
+func (it *ScanIterator) fetch() {
+	if err := it.ctx.Err(); err != nil {
+		it.err = err
+		return
+	}
+
+	args := []interface{}{}
+
+	if it.key != "" {
+		args = append(args, it.key)
+	}
+
+	args = append(args, it.cursor)
+
+	if it.opts.Match != "" {
+		args = append(args, "MATCH", it.opts.Match)
+	}
+
+	if it.opts.Count > 0 {
+		args = append(args, "COUNT", it.opts.Count)
+	}
+
+	if it.opts.Type != "" && it.cmd == "SCAN" {
+		args = append(args, "TYPE", it.opts.Type)
+	}
+
+	conn := it.kv.Get()
+	defer conn.Close()
+	cursor, items, err := ScanReply(conn.Do(it.cmd, args...))
+
+	if err != nil {
+		it.err = err
+		return
+	}
+
+	it.cursor = cursor
+	it.done = cursor == 0
+	it.buf = items
+}
+
+// Item returns the current key, member or field.
+func (it *ScanIterator) Item() []byte {
+	return it.item
+}
+
+// Value returns the value of the current field for HScan, or the score of
+// the current member for ZScan. It is nil for Scan and SScan.
+func (it *ScanIterator) Value() []byte {
+	return it.value
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *ScanIterator) Err() error {
+	return it.err
+}
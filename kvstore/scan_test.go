@@ -0,0 +1,71 @@
+package kvstore_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/simonz05/util/assert"
+	"github.com/simonz05/util/kvstore"
+	"github.com/simonz05/util/kvstore/kvtest"
+)
+
+func TestScan(t *testing.T) {
+	ast := assert.NewAssert(t)
+	srv, err := kvtest.NewServer()
+	ast.Nil(err)
+	defer srv.Close()
+
+	db, err := kvstore.Open(srv.DSN(0))
+	ast.Nil(err)
+	defer db.Close()
+
+	conn := db.Get()
+	defer conn.Close()
+
+	for i := 0; i < 25; i++ {
+		_, err := conn.Do("SET", fmt.Sprintf("session:%02d", i), i)
+		ast.Nil(err)
+	}
+
+	_, err = conn.Do("ZADD", "index", 1, "a", 2, "b")
+	ast.Nil(err)
+
+	it := db.Scan(context.Background(), &kvstore.ScanOptions{Match: "session:*", Count: 4})
+	n := 0
+
+	for it.Next() {
+		n++
+
+		// a key inserted before the cursor makes the server return
+		// an element twice
+		if n == 6 {
+			_, err := conn.Do("SET", "a", 1)
+			ast.Nil(err)
+		}
+	}
+
+	ast.Nil(it.Err())
+	ast.Equal(25, n)
+
+	it = db.Scan(context.Background(), &kvstore.ScanOptions{Type: "zset"})
+	ast.True(it.Next())
+	ast.Equal("index", string(it.Item()))
+	ast.True(!it.Next())
+
+	it = db.ZScan(context.Background(), "index", nil)
+	var pairs []string
+
+	for it.Next() {
+		pairs = append(pairs, string(it.Item()), string(it.Value()))
+	}
+
+	ast.Nil(it.Err())
+	ast.Equal([]string{"a", "1", "b", "2"}, pairs)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	it = db.Scan(ctx, nil)
+	ast.True(!it.Next())
+	ast.Equal(context.Canceled, it.Err())
+}
@@ -0,0 +1,248 @@
+package kvstore
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Script is a Lua script with a fixed number of keys. The first call to
+// Do loads the script with SCRIPT LOAD; later calls run it by hash with
+// EVALSHA. If the server has lost the script, for example after a restart
+// or SCRIPT FLUSH, Do falls back to EVAL, which loads it again.
+//
+// Replies are untyped and are converted with the redis helpers or the
+// helpers of this package:
+//
+//	ids, err := kvstore.Ints(script.Do(conn, key, arg))
+type Script struct {
+	name     string
+	keyCount int
+	src      string
+	hash     string
+
+	mu     sync.Mutex
+	loaded bool
+}
+
+// NewScript returns a script taking keyCount keys. The script is not
+// registered; see RegisterScript.
+func NewScript(keyCount int, src string) *Script {
+	h := sha1.Sum([]byte(src))
+
+	return &Script{
+		keyCount: keyCount,
+		src:      src,
+		hash:     hex.EncodeToString(h[:]),
+	}
+}
+
+// Name returns the name the script was registered under, if any.
+func (s *Script) Name() string {
+	return s.name
+}
+
+// Hash returns the SHA1 digest of the script source.
+func (s *Script) Hash() string {
+	return s.hash
+}
+
+func (s *Script) args(spec string, keysAndArgs []interface{}) []interface{} {
+	args := make([]interface{}, 2+len(keysAndArgs))
+	args[0] = spec
+	args[1] = s.keyCount
+	copy(args[2:], keysAndArgs)
+	return args
+}
+
+func (s *Script) isLoaded() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.loaded
+}
+
+func (s *Script) setLoaded(loaded bool) {
+	s.mu.Lock()
+	s.loaded = loaded
+	s.mu.Unlock()
+}
+
+// Load loads the script into the server's script cache.
+func (s *Script) Load(c redis.Conn) error {
+	if _, err := c.Do("SCRIPT", "LOAD", s.src); err != nil {
+		return err
+	}
+
+	s.setLoaded(true)
+	return nil
+}
+
+// Do runs the script with the given keys followed by arguments.
+func (s *Script) Do(c redis.Conn, keysAndArgs ...interface{}) (interface{}, error) {
+	if len(keysAndArgs) < s.keyCount {
+		return nil, fmt.Errorf("kvstore: script %s expects %d keys, got %d arguments", s.label(), s.keyCount, len(keysAndArgs))
+	}
+
+	if !s.isLoaded() {
+		if err := s.Load(c); err != nil {
+			return nil, err
+		}
+	}
+
+	v, err := c.Do("EVALSHA", s.args(s.hash, keysAndArgs)...)
+
+	if isNoScript(err) {
+		s.setLoaded(false)
+		v, err = c.Do("EVAL", s.args(s.src, keysAndArgs)...)
+
+		if err == nil {
+			s.setLoaded(true)
+		}
+	}
+
+	return v, err
+}
+
+// Send queues the script with EVALSHA without waiting for the reply, for
+// use in pipelines and inside MULTI. Errors such as NOSCRIPT only show up
+// in the reply, so the script should be loaded with Load, or preloaded
+// through a registry, before the transaction starts.
+func (s *Script) Send(c redis.Conn, keysAndArgs ...interface{}) error {
+	if len(keysAndArgs) < s.keyCount {
+		return fmt.Errorf("kvstore: script %s expects %d keys, got %d arguments", s.label(), s.keyCount, len(keysAndArgs))
+	}
+
+	return c.Send("EVALSHA", s.args(s.hash, keysAndArgs)...)
+}
+
+// sendEval queues the script with EVAL, which needs no loaded script.
+func (s *Script) sendEval(c redis.Conn, keysAndArgs []interface{}) error {
+	if len(keysAndArgs) < s.keyCount {
+		return fmt.Errorf("kvstore: script %s expects %d keys, got %d arguments", s.label(), s.keyCount, len(keysAndArgs))
+	}
+
+	return c.Send("EVAL", s.args(s.src, keysAndArgs)...)
+}
+
+func (s *Script) label() string {
+	if s.name != "" {
+		return s.name
+	}
+
+	return s.hash[:8]
+}
+
+func isNoScript(err error) bool {
+	e, ok := err.(redis.Error)
+	return ok && strings.HasPrefix(string(e), "NOSCRIPT")
+}
+
+// A ScriptRegistry is a named set of scripts which can be preloaded
+// together, typically at startup.
+type ScriptRegistry struct {
+	mu      sync.Mutex
+	scripts map[string]*Script
+}
+
+// NewScriptRegistry returns an empty registry.
+func NewScriptRegistry() *ScriptRegistry {
+	return &ScriptRegistry{scripts: make(map[string]*Script)}
+}
+
+// Register declares a script under name. It panics if name is already
+// registered with a different source, as declarations are meant to be
+// package level variables.
+func (r *ScriptRegistry) Register(name string, keyCount int, src string) *Script {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if s, ok := r.scripts[name]; ok {
+		if s.src != src || s.keyCount != keyCount {
+			panic("kvstore: script " + name + " registered twice")
+		}
+		return s
+	}
+
+	s := NewScript(keyCount, src)
+	s.name = name
+	r.scripts[name] = s
+	return s
+}
+
+// Lookup returns the script registered under name, or nil.
+func (r *ScriptRegistry) Lookup(name string) *Script {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.scripts[name]
+}
+
+// Names returns the sorted names of all registered scripts.
+func (r *ScriptRegistry) Names() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	names := make([]string, 0, len(r.scripts))
+
+	for name := range r.scripts {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// Load loads every registered script in a single pipeline.
+func (r *ScriptRegistry) Load(c redis.Conn) error {
+	var scripts []*Script
+
+	for _, name := range r.Names() {
+		scripts = append(scripts, r.Lookup(name))
+	}
+
+	for _, s := range scripts {
+		if err := c.Send("SCRIPT", "LOAD", s.src); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Flush(); err != nil {
+		return err
+	}
+
+	for _, s := range scripts {
+		if _, err := c.Receive(); err != nil {
+			return fmt.Errorf("kvstore: loading script %s: %v", s.name, err)
+		}
+
+		s.setLoaded(true)
+	}
+
+	return nil
+}
+
+// Scripts is the default registry. The scripts used by this package are
+// registered here.
+var Scripts = NewScriptRegistry()
+
+// RegisterScript registers a script in the default registry.
+func RegisterScript(name string, keyCount int, src string) *Script {
+	return Scripts.Register(name, keyCount, src)
+}
+
+// LoadScripts preloads every script of the default registry.
+func (kv *KVStore) LoadScripts() error {
+	conn := kv.Get()
+	defer conn.Close()
+	return Scripts.Load(conn)
+}
+
+// Eval runs s on a pooled connection.
+func (kv *KVStore) Eval(s *Script, keysAndArgs ...interface{}) (interface{}, error) {
+	conn := kv.Get()
+	defer conn.Close()
+	return s.Do(conn, keysAndArgs...)
+}
@@ -0,0 +1,99 @@
+package kvstore
+
+import (
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/simonz05/util/assert"
+)
+
+// scriptConn records commands and emulates the script cache of a server.
+type scriptConn struct {
+	redis.Conn
+	cmds   []string
+	cache  map[string]bool
+	queued int
+}
+
+func (c *scriptConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	c.cmds = append(c.cmds, cmd)
+
+	switch cmd {
+	case "SCRIPT":
+		s := NewScript(0, args[1].(string))
+		c.cache[s.Hash()] = true
+		return []byte(s.Hash()), nil
+	case "EVALSHA":
+		if !c.cache[args[0].(string)] {
+			return nil, redis.Error("NOSCRIPT No matching script. Please use EVAL.")
+		}
+		return int64(1), nil
+	case "EVAL":
+		c.cache[NewScript(0, args[0].(string)).Hash()] = true
+		return int64(1), nil
+	}
+
+	return nil, nil
+}
+
+func (c *scriptConn) Send(cmd string, args ...interface{}) error {
+	c.cmds = append(c.cmds, cmd)
+	c.queued++
+	return nil
+}
+
+func (c *scriptConn) Flush() error { return nil }
+
+func (c *scriptConn) Receive() (interface{}, error) {
+	c.queued--
+	return []byte("ok"), nil
+}
+
+func TestScript(t *testing.T) {
+	ast := assert.NewAssert(t)
+	conn := &scriptConn{cache: make(map[string]bool)}
+	s := NewScript(1, "return 1")
+
+	// loaded lazily on first use
+	n, err := redis.Int(s.Do(conn, "key"))
+	ast.Nil(err)
+	ast.Equal(1, n)
+	ast.Equal([]string{"SCRIPT", "EVALSHA"}, conn.cmds)
+
+	// falls back to EVAL once the server lost the script
+	conn.cmds = nil
+	conn.cache = make(map[string]bool)
+	n, err = redis.Int(s.Do(conn, "key"))
+	ast.Nil(err)
+	ast.Equal(1, n)
+	ast.Equal([]string{"EVALSHA", "EVAL"}, conn.cmds)
+
+	_, err = s.Do(conn)
+	ast.NotNil(err)
+}
+
+func TestScriptRegistry(t *testing.T) {
+	ast := assert.NewAssert(t)
+	r := NewScriptRegistry()
+
+	a := r.Register("a", 1, "return 1")
+	ast.True(a == r.Register("a", 1, "return 1"))
+	r.Register("b", 0, "return 2")
+	ast.Equal([]string{"a", "b"}, r.Names())
+	ast.True(r.Lookup("c") == nil)
+
+	conn := &scriptConn{cache: make(map[string]bool)}
+	ast.Nil(r.Load(conn))
+	ast.Equal(0, conn.queued)
+	ast.True(a.isLoaded())
+
+	conn.cmds = nil
+	ast.Nil(a.Send(conn, "key"))
+	ast.Equal([]string{"EVALSHA"}, conn.cmds)
+
+	defer func() {
+		ast.NotNil(recover())
+	}()
+
+	r.Register("a", 1, "return 3")
+}
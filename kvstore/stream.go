@@ -0,0 +1,400 @@
+package kvstore
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// StreamEntry is an entry of a redis stream.
+type StreamEntry struct {
+	ID     string
+	Fields map[string]string
+}
+
+// A StreamProducer appends entries to a stream, trimming it to about
+// MaxLen entries.
+type StreamProducer struct {
+	kv     *KVStore
+	stream string
+	maxLen int64
+}
+
+// NewStreamProducer returns a producer for stream. If maxLen is positive
+// the stream is trimmed to roughly maxLen entries on every append; redis
+// trims whole nodes, so it may keep a few more.
+func (kv *KVStore) NewStreamProducer(stream string, maxLen int64) *StreamProducer {
+	return &StreamProducer{kv: kv, stream: stream, maxLen: maxLen}
+}
+
+// Add appends an entry with fields and returns its id.
+func (p *StreamProducer) Add(fields map[string]string) (string, error) {
+	if len(fields) == 0 {
+		return "", fmt.Errorf("kvstore: stream %s: entry has no fields", p.stream)
+	}
+
+	conn := p.kv.Get()
+	defer conn.Close()
+	return redis.String(conn.Do("XADD", p.addArgs(fields)...))
+}
+
+func (p *StreamProducer) addArgs(fields map[string]string) redis.Args {
+	args := redis.Args{p.stream}
+
+	if p.maxLen > 0 {
+		args = args.Add("MAXLEN", "~", p.maxLen)
+	}
+
+	args = args.Add("*")
+	names := make([]string, 0, len(fields))
+
+	for name := range fields {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		args = args.Add(name, fields[name])
+	}
+
+	return args
+}
+
+// ConsumerGroupOptions configures a ConsumerGroup. The zero value is valid.
+type ConsumerGroupOptions struct {
+	// StartID is the id after which a newly created group starts
+	// reading. Defaults to "$", only new entries; use "0" to replay the
+	// whole stream.
+	StartID string
+	// Count is the maximum number of entries read at once. Defaults to
+	// 10.
+	Count int
+	// Block is how long a read waits for new entries. Defaults to 1s.
+	// It must be below the read timeout of the connection pool.
+	Block time.Duration
+	// ClaimMinIdle is how long an entry may stay unacknowledged before
+	// it is claimed from its consumer, which is assumed dead, and
+	// delivered again. Defaults to one minute.
+	ClaimMinIdle time.Duration
+	// MaxDeliveries is how many times an entry is delivered before it is
+	// moved to the dead letter stream. Defaults to 5.
+	MaxDeliveries int
+	// DeadLetterStream receives entries which ran out of deliveries.
+	// Defaults to the stream name followed by ":dead".
+	DeadLetterStream string
+	// DeadLetterMaxLen trims the dead letter stream. Zero keeps all
+	// entries.
+	DeadLetterMaxLen int64
+}
+
+// A ConsumerGroup reads a stream as one consumer of a redis consumer
+// group. Each entry is delivered to a single consumer of the group and is
+// acknowledged once handled. Entries of consumers which die before
+// acknowledging are claimed by the others.
+type ConsumerGroup struct {
+	kv       *KVStore
+	stream   string
+	group    string
+	consumer string
+	opts     ConsumerGroupOptions
+	dead     *StreamProducer
+}
+
+// NewConsumerGroup returns consumer of group on stream. opts may be nil.
+func (kv *KVStore) NewConsumerGroup(stream, group, consumer string, opts *ConsumerGroupOptions) *ConsumerGroup {
+	g := &ConsumerGroup{kv: kv, stream: stream, group: group, consumer: consumer}
+
+	if opts != nil {
+		g.opts = *opts
+	}
+
+	if g.opts.StartID == "" {
+		g.opts.StartID = "$"
+	}
+
+	if g.opts.Count <= 0 {
+		g.opts.Count = 10
+	}
+
+	if g.opts.Block <= 0 {
+		g.opts.Block = time.Second
+	}
+
+	if g.opts.ClaimMinIdle <= 0 {
+		g.opts.ClaimMinIdle = time.Minute
+	}
+
+	if g.opts.MaxDeliveries <= 0 {
+		g.opts.MaxDeliveries = 5
+	}
+
+	if g.opts.DeadLetterStream == "" {
+		g.opts.DeadLetterStream = stream + ":dead"
+	}
+
+	g.dead = kv.NewStreamProducer(g.opts.DeadLetterStream, g.opts.DeadLetterMaxLen)
+	return g
+}
+
+// Create creates the group, and the stream if missing. It does nothing if
+// the group exists.
+func (g *ConsumerGroup) Create() error {
+	conn := g.kv.Get()
+	defer conn.Close()
+	_, err := conn.Do("XGROUP", "CREATE", g.stream, g.group, g.opts.StartID, "MKSTREAM")
+
+	if e, ok := err.(redis.Error); ok && strings.HasPrefix(string(e), "BUSYGROUP") {
+		return nil
+	}
+
+	return err
+}
+
+// Read returns up to Count new entries, waiting up to Block for them. It
+// returns no entries if none arrived in time.
+func (g *ConsumerGroup) Read() ([]*StreamEntry, error) {
+	return g.read(">", true)
+}
+
+// Pending returns the entries delivered to this consumer which it has not
+// acknowledged, as after a restart.
+func (g *ConsumerGroup) Pending() ([]*StreamEntry, error) {
+	return g.read("0", false)
+}
+
+func (g *ConsumerGroup) read(id string, block bool) ([]*StreamEntry, error) {
+	args := redis.Args{"GROUP", g.group, g.consumer, "COUNT", g.opts.Count}
+
+	if block {
+		args = args.Add("BLOCK", millis(g.opts.Block))
+	}
+
+	args = args.Add("STREAMS", g.stream, id)
+	conn := g.kv.Get()
+	defer conn.Close()
+	reply, err := conn.Do("XREADGROUP", args...)
+
+	if err != nil || reply == nil {
+		return nil, err
+	}
+
+	streams, err := redis.Values(reply, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*StreamEntry
+
+	for _, s := range streams {
+		pair, err := redis.Values(s, nil)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("kvstore: unexpected XREADGROUP reply length %d", len(pair))
+		}
+
+		e, err := StreamEntries(pair[1], nil)
+
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, e...)
+	}
+
+	return entries, nil
+}
+
+// Ack acknowledges the entries with ids.
+func (g *ConsumerGroup) Ack(ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	conn := g.kv.Get()
+	defer conn.Close()
+	_, err := conn.Do("XACK", redis.Args{g.stream, g.group}.AddFlat(ids)...)
+	return err
+}
+
+// Claim takes over up to Count entries which have been pending for at
+// least ClaimMinIdle, starting at the id start, and returns them with the
+// id to continue from; "0-0" once all pending entries were scanned.
+func (g *ConsumerGroup) Claim(start string) ([]*StreamEntry, string, error) {
+	conn := g.kv.Get()
+	defer conn.Close()
+	values, err := redis.Values(conn.Do("XAUTOCLAIM", g.stream, g.group, g.consumer,
+		millis(g.opts.ClaimMinIdle), start, "COUNT", g.opts.Count))
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	// redis 7 appends the ids of deleted entries, which it has already
+	// removed from the pending list
+	if len(values) < 2 {
+		return nil, "", fmt.Errorf("kvstore: unexpected XAUTOCLAIM reply length %d", len(values))
+	}
+
+	next, err := redis.String(values[0], nil)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	entries, err := StreamEntries(values[1], nil)
+	return entries, next, err
+}
+
+// deliveries returns how many times the pending entry id was delivered.
+func (g *ConsumerGroup) deliveries(id string) (int, error) {
+	conn := g.kv.Get()
+	defer conn.Close()
+	values, err := redis.Values(conn.Do("XPENDING", g.stream, g.group, id, id, 1))
+
+	if err != nil || len(values) == 0 {
+		return 0, err
+	}
+
+	info, err := redis.Values(values[0], nil)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if len(info) != 4 {
+		return 0, fmt.Errorf("kvstore: unexpected XPENDING reply length %d", len(info))
+	}
+
+	return redis.Int(info[3], nil)
+}
+
+// deadLetter moves e to the dead letter stream and acknowledges it. The
+// entry keeps its fields and gains its original stream and id.
+func (g *ConsumerGroup) deadLetter(e *StreamEntry) error {
+	fields := map[string]string{"stream": g.stream, "id": e.ID}
+
+	for k, v := range e.Fields {
+		if _, reserved := fields[k]; !reserved {
+			fields[k] = v
+		}
+	}
+
+	_, err := g.kv.Tx(nil, 0, func(tx *Tx) error {
+		tx.Send("XADD", g.dead.addArgs(fields)...)
+		return tx.Send("XACK", g.stream, g.group, e.ID)
+	})
+
+	return err
+}
+
+// handle runs handler on e and acknowledges it on success. Redelivered
+// entries which exceeded MaxDeliveries go to the dead letter stream
+// instead.
+func (g *ConsumerGroup) handle(e *StreamEntry, redelivered bool, handler func(*StreamEntry) error) error {
+	if e.Fields == nil {
+		// deleted from the stream while pending
+		return g.Ack(e.ID)
+	}
+
+	if redelivered {
+		n, err := g.deliveries(e.ID)
+
+		if err != nil {
+			return err
+		}
+
+		if n > g.opts.MaxDeliveries {
+			return g.deadLetter(e)
+		}
+	}
+
+	if err := handler(e); err != nil {
+		// left pending, to be claimed and retried
+		return nil
+	}
+
+	return g.Ack(e.ID)
+}
+
+// Run creates the group if missing and handles entries one at a time until
+// ctx is done. Entries left pending by an earlier run of this consumer are
+// handled first. An entry is acknowledged when handler returns nil;
+// otherwise it stays pending and is delivered again once it has been idle
+// for ClaimMinIdle, until it runs out of deliveries. Pending entries of
+// all consumers are claimed every ClaimMinIdle/2.
+func (g *ConsumerGroup) Run(ctx context.Context, handler func(*StreamEntry) error) error {
+	if err := g.Create(); err != nil {
+		return err
+	}
+
+	var (
+		failures  int
+		nextClaim time.Time
+		cursor    = "0-0"
+	)
+
+	pending, err := g.Pending()
+
+	if err != nil {
+		return err
+	}
+
+	for ctx.Err() == nil {
+		var (
+			entries     []*StreamEntry
+			redelivered bool
+			err         error
+		)
+
+		switch {
+		case len(pending) > 0:
+			entries, pending, redelivered = pending, nil, true
+		case !time.Now().Before(nextClaim):
+			var next string
+			entries, next, err = g.Claim(cursor)
+			redelivered = true
+
+			// a failed claim starts over at the next round
+			if err != nil {
+				next = "0-0"
+			}
+
+			if cursor = next; cursor == "0-0" {
+				nextClaim = time.Now().Add(g.opts.ClaimMinIdle / 2)
+			}
+		default:
+			entries, err = g.Read()
+		}
+
+		for _, e := range entries {
+			if err != nil || ctx.Err() != nil {
+				break
+			}
+
+			err = g.handle(e, redelivered, handler)
+		}
+
+		if err != nil {
+			if !sleep(backoff(failures, 10*time.Millisecond, g.opts.Block), ctx.Done()) {
+				break
+			}
+
+			failures++
+			continue
+		}
+
+		failures = 0
+	}
+
+	return nil
+}
@@ -0,0 +1,176 @@
+package kvstore_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/simonz05/util/assert"
+	"github.com/simonz05/util/kvstore"
+	"github.com/simonz05/util/kvstore/kvtest"
+)
+
+func TestConsumerGroup(t *testing.T) {
+	ast := assert.NewAssert(t)
+	srv, err := kvtest.NewServer()
+	ast.Nil(err)
+	defer srv.Close()
+
+	db, err := kvstore.Open(srv.DSN(0))
+	ast.Nil(err)
+	defer db.Close()
+
+	p := db.NewStreamProducer("events", 2)
+
+	for _, name := range []string{"a", "b", "c"} {
+		_, err := p.Add(map[string]string{"name": name})
+		ast.Nil(err)
+	}
+
+	conn := db.Get()
+	defer conn.Close()
+
+	n, err := redis.Int(conn.Do("XLEN", "events"))
+	ast.Nil(err)
+	ast.Equal(2, n)
+
+	opts := &kvstore.ConsumerGroupOptions{StartID: "0", Block: 10 * time.Millisecond}
+	c1 := db.NewConsumerGroup("events", "workers", "c1", opts)
+	ast.Nil(c1.Create())
+	ast.Nil(c1.Create())
+
+	entries, err := c1.Read()
+	ast.Nil(err)
+	ast.Equal(2, len(entries))
+	ast.Equal("b", entries[0].Fields["name"])
+	ast.Nil(c1.Ack(entries[0].ID))
+
+	entries, err = c1.Read()
+	ast.Nil(err)
+	ast.Equal(0, len(entries))
+
+	entries, err = c1.Pending()
+	ast.Nil(err)
+	ast.Equal(1, len(entries))
+	ast.Equal("c", entries[0].Fields["name"])
+
+	// c1 dies, and c2 claims its entry once it is idle
+	c2 := db.NewConsumerGroup("events", "workers", "c2", opts)
+	entries, _, err = c2.Claim("0-0")
+	ast.Nil(err)
+	ast.Equal(0, len(entries))
+
+	srv.Advance(2 * time.Minute)
+	entries, next, err := c2.Claim("0-0")
+	ast.Nil(err)
+	ast.Equal("0-0", next)
+	ast.Equal(1, len(entries))
+	ast.Equal("c", entries[0].Fields["name"])
+}
+
+func TestConsumerGroupRun(t *testing.T) {
+	ast := assert.NewAssert(t)
+	srv, err := kvtest.NewServer()
+	ast.Nil(err)
+	defer srv.Close()
+
+	db, err := kvstore.Open(srv.DSN(0))
+	ast.Nil(err)
+	defer db.Close()
+
+	g := db.NewConsumerGroup("events", "workers", "c1", &kvstore.ConsumerGroupOptions{
+		Block:         10 * time.Millisecond,
+		ClaimMinIdle:  20 * time.Millisecond,
+		MaxDeliveries: 2,
+	})
+	ast.Nil(g.Create())
+
+	p := db.NewStreamProducer("events", 0)
+	_, err = p.Add(map[string]string{"name": "poison"})
+	ast.Nil(err)
+	_, err = p.Add(map[string]string{"name": "ok"})
+	ast.Nil(err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var (
+		mu   sync.Mutex
+		runs = map[string]int{}
+		wg   sync.WaitGroup
+	)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ast.Nil(g.Run(ctx, func(e *kvstore.StreamEntry) error {
+			mu.Lock()
+			defer mu.Unlock()
+			runs[e.Fields["name"]]++
+
+			if e.Fields["name"] == "poison" {
+				return errors.New("poison")
+			}
+
+			return nil
+		}))
+	}()
+
+	conn := db.Get()
+	defer conn.Close()
+	var dead []*kvstore.StreamEntry
+
+	for i := 0; i < 500 && len(dead) == 0; i++ {
+		time.Sleep(5 * time.Millisecond)
+		srv.Advance(time.Minute)
+		dead, err = kvstore.StreamEntries(conn.Do("XRANGE", "events:dead", "-", "+"))
+		ast.Nil(err)
+	}
+
+	cancel()
+	wg.Wait()
+
+	ast.Equal(1, len(dead))
+	ast.Equal("poison", dead[0].Fields["name"])
+	ast.Equal("events", dead[0].Fields["stream"])
+	ast.Equal(map[string]int{"poison": 2, "ok": 1}, runs)
+
+	n, err := redis.Int(conn.Do("XACK", "events", "workers", dead[0].Fields["id"]))
+	ast.Nil(err)
+	ast.Equal(0, n)
+}
+
+func TestConsumerGroupRunClaimError(t *testing.T) {
+	ast := assert.NewAssert(t)
+	srv, err := kvtest.NewServer()
+	ast.Nil(err)
+	defer srv.Close()
+
+	db, err := kvstore.Open(srv.DSN(0))
+	ast.Nil(err)
+	defer db.Close()
+
+	// claims fail, but new entries are still read in between
+	srv.DisableCommand("XAUTOCLAIM")
+
+	g := db.NewConsumerGroup("events", "workers", "c1", &kvstore.ConsumerGroupOptions{
+		Block:        10 * time.Millisecond,
+		ClaimMinIdle: 20 * time.Millisecond,
+	})
+	ast.Nil(g.Create())
+
+	_, err = db.NewStreamProducer("events", 0).Add(map[string]string{"name": "a"})
+	ast.Nil(err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var handled string
+
+	ast.Nil(g.Run(ctx, func(e *kvstore.StreamEntry) error {
+		handled = e.Fields["name"]
+		cancel()
+		return nil
+	}))
+	ast.Equal("a", handled)
+}
@@ -0,0 +1,261 @@
+package kvstore
+
+import (
+	"expvar"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/simonz05/util/log"
+)
+
+// CommandInfo describes a command run on a connection from a KVStore.
+type CommandInfo struct {
+	Name string
+	// Args is the number of arguments and ArgBytes their total size.
+	Args     int
+	ArgBytes int
+	// Duration is the time from sending the command to receiving its
+	// reply. For pipelined commands it includes the commands before.
+	Duration time.Duration
+	Err      error
+}
+
+// A Hook is called after every command with its details. Hooks run on
+// the calling goroutine, so they must be fast and safe for concurrent use.
+type Hook func(info CommandInfo)
+
+// Stats are the counters of a KVStore. Connection counts are for the
+// primary pool; the other counters cover replicas too.
+type Stats struct {
+	// Active is the number of open connections, in use or idle, and
+	// Idle the number of idle ones.
+	Active int
+	Idle   int
+	// WaitCount is how many times Get had to wait for a connection
+	// because the pool was exhausted, and WaitDuration the total time
+	// spent waiting.
+	WaitCount    int64
+	WaitDuration time.Duration
+	Dials        int64
+	DialErrors   int64
+	// Commands counts the commands run, CommandErrors those which
+	// failed, including error replies, and SlowCommands those which
+	// took at least the slow_threshold of the data source name.
+	Commands      int64
+	CommandErrors int64
+	SlowCommands  int64
+}
+
+// blockingCommands wait for data by design and are never reported slow.
+var blockingCommands = map[string]bool{
+	"BLPOP":      true,
+	"BRPOP":      true,
+	"BRPOPLPUSH": true,
+	"BLMOVE":     true,
+	"BLMPOP":     true,
+	"BZPOPMIN":   true,
+	"BZPOPMAX":   true,
+	"BZMPOP":     true,
+	"XREAD":      true,
+	"XREADGROUP": true,
+}
+
+// instruments holds the hooks and counters shared by a KVStore and its
+// views.
+type instruments struct {
+	slow time.Duration
+
+	mu    sync.RWMutex
+	hooks []Hook
+
+	waits, waitNanos           int64
+	dials, dialErrors          int64
+	commands, errors, slowCmds int64
+}
+
+func (in *instruments) dialed(err error) {
+	atomic.AddInt64(&in.dials, 1)
+
+	if err != nil {
+		atomic.AddInt64(&in.dialErrors, 1)
+	}
+}
+
+func (in *instruments) record(info CommandInfo) {
+	atomic.AddInt64(&in.commands, 1)
+
+	if info.Err != nil {
+		atomic.AddInt64(&in.errors, 1)
+	}
+
+	if in.slow > 0 && info.Duration >= in.slow && !blockingCommands[info.Name] {
+		atomic.AddInt64(&in.slowCmds, 1)
+		log.Printf("kvstore: slow command %s took %v (%d args, %d bytes)", info.Name, info.Duration, info.Args, info.ArgBytes)
+	}
+
+	in.mu.RLock()
+	hooks := in.hooks
+	in.mu.RUnlock()
+
+	for _, h := range hooks {
+		h(info)
+	}
+}
+
+// AddHook registers h to be called after every command run on
+// connections from Get and GetReadOnly of kv and its views.
+func (kv *KVStore) AddHook(h Hook) {
+	kv.inst.mu.Lock()
+	defer kv.inst.mu.Unlock()
+	// copy on write, so record can call hooks without the lock
+	kv.inst.hooks = append(kv.inst.hooks[:len(kv.inst.hooks):len(kv.inst.hooks)], h)
+}
+
+// Stats returns the current counters of kv.
+func (kv *KVStore) Stats() Stats {
+	in := kv.inst
+
+	return Stats{
+		Active:        kv.Pool.ActiveCount(),
+		Idle:          kv.Pool.IdleCount(),
+		WaitCount:     atomic.LoadInt64(&in.waits),
+		WaitDuration:  time.Duration(atomic.LoadInt64(&in.waitNanos)),
+		Dials:         atomic.LoadInt64(&in.dials),
+		DialErrors:    atomic.LoadInt64(&in.dialErrors),
+		Commands:      atomic.LoadInt64(&in.commands),
+		CommandErrors: atomic.LoadInt64(&in.errors),
+		SlowCommands:  atomic.LoadInt64(&in.slowCmds),
+	}
+}
+
+// PublishStats exports the stats of kv as the expvar name, served as JSON
+// by the /debug/vars handler of the expvar package. Like expvar.Publish
+// it panics if name is already in use.
+func (kv *KVStore) PublishStats(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return kv.Stats()
+	}))
+}
+
+// getConn takes a connection from pool, counting the time spent waiting
+// for one when the pool is exhausted.
+func (kv *KVStore) getConn(pool *redis.Pool) redis.Conn {
+	waiting := pool.Wait && pool.MaxActive > 0 && pool.ActiveCount() >= pool.MaxActive
+	start := time.Now()
+	conn := pool.Get()
+
+	if waiting {
+		atomic.AddInt64(&kv.inst.waits, 1)
+		atomic.AddInt64(&kv.inst.waitNanos, int64(time.Since(start)))
+	}
+
+	return &tracedConn{Conn: conn, inst: kv.inst}
+}
+
+// tracedConn records every command it runs.
+type tracedConn struct {
+	redis.Conn
+	inst    *instruments
+	pending []CommandInfo
+	sent    []time.Time
+}
+
+func (c *tracedConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	start := time.Now()
+	reply, err := c.Conn.Do(cmd, args...)
+	end := time.Now()
+
+	// Do receives the replies of all pending commands, but only reports
+	// errors of its own; a connection error fails them all
+	var connErr error
+
+	if _, ok := err.(redis.Error); !ok {
+		connErr = err
+	}
+
+	for i, info := range c.pending {
+		info.Duration = end.Sub(c.sent[i])
+		info.Err = connErr
+		c.inst.record(info)
+	}
+
+	c.pending, c.sent = nil, nil
+
+	if cmd != "" {
+		info := commandInfo(cmd, args)
+		info.Duration = end.Sub(start)
+		info.Err = err
+		c.inst.record(info)
+	}
+
+	return reply, err
+}
+
+func (c *tracedConn) Send(cmd string, args ...interface{}) error {
+	info := commandInfo(cmd, args)
+
+	if err := c.Conn.Send(cmd, args...); err != nil {
+		info.Err = err
+		c.inst.record(info)
+		return err
+	}
+
+	c.pending = append(c.pending, info)
+	c.sent = append(c.sent, time.Now())
+	return nil
+}
+
+func (c *tracedConn) Receive() (interface{}, error) {
+	reply, err := c.Conn.Receive()
+
+	// replies beyond the commands sent are pub/sub messages
+	if len(c.pending) > 0 {
+		info := c.pending[0]
+		info.Duration = time.Since(c.sent[0])
+		info.Err = err
+		c.pending, c.sent = c.pending[1:], c.sent[1:]
+		c.inst.record(info)
+	}
+
+	return reply, err
+}
+
+func commandInfo(cmd string, args []interface{}) CommandInfo {
+	info := CommandInfo{Name: strings.ToUpper(cmd), Args: len(args)}
+
+	for _, arg := range args {
+		info.ArgBytes += argSize(arg)
+	}
+
+	return info
+}
+
+// argSize returns the size of arg as sent by redigo.
+func argSize(arg interface{}) int {
+	switch arg := arg.(type) {
+	case string:
+		return len(arg)
+	case []byte:
+		return len(arg)
+	case int:
+		return len(strconv.Itoa(arg))
+	case int64:
+		return len(strconv.FormatInt(arg, 10))
+	case float64:
+		return len(strconv.FormatFloat(arg, 'g', -1, 64))
+	case bool:
+		return 1
+	case nil:
+		return 0
+	case redis.Argument:
+		return argSize(arg.RedisArg())
+	}
+
+	// other types are sent as formatted by fmt, which is not worth
+	// doing twice
+	return 8
+}
@@ -0,0 +1,96 @@
+package kvstore_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/simonz05/util/assert"
+	"github.com/simonz05/util/kvstore"
+	"github.com/simonz05/util/kvstore/kvtest"
+)
+
+func TestHooksAndStats(t *testing.T) {
+	ast := assert.NewAssert(t)
+	srv, err := kvtest.NewServer()
+	ast.Nil(err)
+	defer srv.Close()
+
+	db, err := kvstore.Open(srv.DSN(0) + "?slow_threshold=1ns")
+	ast.Nil(err)
+	defer db.Close()
+
+	var (
+		mu    sync.Mutex
+		infos []kvstore.CommandInfo
+	)
+
+	db.AddHook(func(info kvstore.CommandInfo) {
+		mu.Lock()
+		infos = append(infos, info)
+		mu.Unlock()
+	})
+
+	conn := db.Namespace("eu").Get()
+	_, err = conn.Do("SET", "k", "value")
+	ast.Nil(err)
+	conn.Send("GET", "k")
+	conn.Send("INCR", "k")
+	ast.Nil(conn.Flush())
+	_, err = conn.Receive()
+	ast.Nil(err)
+	_, err = conn.Receive()
+	ast.NotNil(err)
+	conn.Close()
+
+	mu.Lock()
+	ast.Equal(3, len(infos))
+	ast.Equal("SET", infos[0].Name)
+	ast.Equal(2, infos[0].Args)
+	ast.Equal(len("eu:k")+len("value"), infos[0].ArgBytes)
+	ast.True(infos[0].Duration > 0)
+	ast.Equal("GET", infos[1].Name)
+	ast.Nil(infos[1].Err)
+	ast.NotNil(infos[2].Err)
+	mu.Unlock()
+
+	stats := db.Stats()
+	ast.Equal(int64(3), stats.Commands)
+	ast.Equal(int64(1), stats.CommandErrors)
+	ast.Equal(int64(3), stats.SlowCommands)
+	ast.Equal(int64(1), stats.Dials)
+	ast.Equal(1, stats.Active)
+	ast.Equal(1, stats.Idle)
+}
+
+func TestStatsWait(t *testing.T) {
+	ast := assert.NewAssert(t)
+	srv, err := kvtest.NewServer()
+	ast.Nil(err)
+	defer srv.Close()
+
+	db, err := kvstore.Open(srv.DSN(0) + "?max_active=1&wait=true")
+	ast.Nil(err)
+	defer db.Close()
+
+	conn := db.Get()
+	_, err = conn.Do("PING")
+	ast.Nil(err)
+
+	done := make(chan struct{})
+
+	go func() {
+		c := db.Get()
+		c.Do("PING")
+		c.Close()
+		close(done)
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	conn.Close()
+	<-done
+
+	stats := db.Stats()
+	ast.Equal(int64(1), stats.WaitCount)
+	ast.True(stats.WaitDuration >= 10*time.Millisecond)
+}
@@ -0,0 +1,140 @@
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// ErrTxAborted is returned by KVStore.Tx when the watched keys changed on
+// every attempt.
+var ErrTxAborted = errors.New("kvstore: transaction aborted, watched keys changed")
+
+// Tx is an optimistic transaction passed to the function given to
+// KVStore.Tx. Reads issued with Do run immediately and see the watched
+// keys; commands issued with Send are queued and run atomically by EXEC.
+type Tx struct {
+	conn  redis.Conn
+	multi bool
+}
+
+// Do runs a command immediately. It must not be called after Send.
+func (tx *Tx) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if tx.multi {
+		return nil, errors.New("kvstore: Tx.Do called after Send")
+	}
+
+	return tx.conn.Do(cmd, args...)
+}
+
+// Send queues a command for EXEC.
+func (tx *Tx) Send(cmd string, args ...interface{}) error {
+	if err := tx.begin(); err != nil {
+		return err
+	}
+
+	return tx.conn.Send(cmd, args...)
+}
+
+// SendScript queues s for EXEC. The script cache is per server and the
+// loaded flag of s may come from another server, so s is loaded on the
+// connection of the transaction first. Once commands are queued that is no
+// longer possible, and s is queued with EVAL and its whole source instead.
+func (tx *Tx) SendScript(s *Script, keysAndArgs ...interface{}) error {
+	if tx.multi {
+		return s.sendEval(tx.conn, keysAndArgs)
+	}
+
+	if err := s.Load(tx.conn); err != nil {
+		return err
+	}
+
+	if err := tx.begin(); err != nil {
+		return err
+	}
+
+	return s.Send(tx.conn, keysAndArgs...)
+}
+
+// begin starts queueing with MULTI unless already started.
+func (tx *Tx) begin() error {
+	if tx.multi {
+		return nil
+	}
+
+	if err := tx.conn.Send("MULTI"); err != nil {
+		return err
+	}
+
+	tx.multi = true
+	return nil
+}
+
+// Tx runs fn in a transaction which watches keys and returns the reply of
+// every queued command. If a watched key changes before EXEC, fn is run
+// again on fresh reads, up to maxRetries times before Tx gives up with
+// ErrTxAborted. If fn returns an error the transaction is discarded.
+//
+// If a queued command fails, Tx returns all replies together with the
+// first error.
+func (kv *KVStore) Tx(keys []string, maxRetries int, fn func(tx *Tx) error) ([]interface{}, error) {
+	conn := kv.Get()
+	defer conn.Close()
+
+	for n := 0; n <= maxRetries; n++ {
+		if n > 0 {
+			time.Sleep(backoff(n-1, time.Millisecond, 100*time.Millisecond))
+		}
+
+		if len(keys) > 0 {
+			if _, err := conn.Do("WATCH", redis.Args{}.AddFlat(keys)...); err != nil {
+				return nil, err
+			}
+		}
+
+		tx := &Tx{conn: conn}
+
+		if err := fn(tx); err != nil {
+			if tx.multi {
+				conn.Do("DISCARD")
+			} else {
+				conn.Do("UNWATCH")
+			}
+
+			return nil, err
+		}
+
+		if !tx.multi {
+			_, err := conn.Do("UNWATCH")
+			return nil, err
+		}
+
+		reply, err := conn.Do("EXEC")
+
+		if err != nil {
+			return nil, err
+		}
+
+		if reply == nil {
+			continue
+		}
+
+		replies, err := redis.Values(reply, nil)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for i, r := range replies {
+			if e, ok := r.(redis.Error); ok {
+				return replies, fmt.Errorf("kvstore: transaction command %d failed: %v", i, e)
+			}
+		}
+
+		return replies, nil
+	}
+
+	return nil, ErrTxAborted
+}
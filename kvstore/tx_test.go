@@ -0,0 +1,113 @@
+package kvstore_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/simonz05/util/assert"
+	"github.com/simonz05/util/kvstore"
+	"github.com/simonz05/util/kvstore/kvtest"
+)
+
+func TestTx(t *testing.T) {
+	ast := assert.NewAssert(t)
+	srv, err := kvtest.NewServer()
+	ast.Nil(err)
+	defer srv.Close()
+
+	db, err := kvstore.Open(srv.DSN(0))
+	ast.Nil(err)
+	defer db.Close()
+
+	conn := db.Get()
+	defer conn.Close()
+	_, err = conn.Do("SET", "counter", 1)
+	ast.Nil(err)
+
+	// a concurrent write on the first attempt forces a retry
+	attempts := 0
+	replies, err := db.Tx([]string{"counter"}, 3, func(tx *kvstore.Tx) error {
+		attempts++
+		n, err := redis.Int(tx.Do("GET", "counter"))
+
+		if err != nil {
+			return err
+		}
+
+		if attempts == 1 {
+			if _, err := conn.Do("SET", "counter", 10); err != nil {
+				return err
+			}
+		}
+
+		tx.Send("SET", "counter", n*2)
+		return tx.Send("GET", "counter")
+	})
+	ast.Nil(err)
+	ast.Equal(2, attempts)
+	ast.Equal(2, len(replies))
+	ast.Equal("20", string(replies[1].([]byte)))
+
+	// the retry budget runs out
+	_, err = db.Tx([]string{"counter"}, 1, func(tx *kvstore.Tx) error {
+		conn.Do("INCR", "counter")
+		return tx.Send("DEL", "counter")
+	})
+	ast.Equal(kvstore.ErrTxAborted, err)
+
+	// errors of queued commands are reported
+	_, err = conn.Do("SET", "name", "x")
+	ast.Nil(err)
+	replies, err = db.Tx(nil, 0, func(tx *kvstore.Tx) error {
+		tx.Send("INCR", "name")
+		return tx.Send("SET", "other", "y")
+	})
+	ast.NotNil(err)
+	ast.Equal(2, len(replies))
+
+	// an error from fn discards the transaction
+	failed := errors.New("failed")
+	_, err = db.Tx([]string{"other"}, 0, func(tx *kvstore.Tx) error {
+		tx.Send("DEL", "other")
+		return failed
+	})
+	ast.Equal(failed, err)
+
+	v, err := redis.String(conn.Do("GET", "other"))
+	ast.Nil(err)
+	ast.Equal("y", v)
+}
+
+func TestTxScript(t *testing.T) {
+	ast := assert.NewAssert(t)
+	script := kvstore.NewScript(1, `return redis.call("INCRBY", KEYS[1], ARGV[1])`)
+
+	// the script is loaded on one server only
+	for _, name := range []string{"first", "second"} {
+		srv, err := kvtest.NewServer()
+		ast.Nil(err)
+		defer srv.Close()
+
+		db, err := kvstore.Open(srv.DSN(0))
+		ast.Nil(err)
+		defer db.Close()
+
+		if name == "first" {
+			_, err = db.Eval(script, "n", 1)
+			ast.Nil(err)
+			continue
+		}
+
+		replies, err := db.Tx([]string{"n"}, 0, func(tx *kvstore.Tx) error {
+			if err := tx.SendScript(script, "n", 2); err != nil {
+				return err
+			}
+
+			// already queueing, so sent with EVAL
+			return tx.SendScript(script, "n", 3)
+		})
+		ast.Nil(err)
+		ast.Equal([]interface{}{int64(2), int64(5)}, replies)
+	}
+}
@@ -0,0 +1,56 @@
+package session
+
+import "time"
+
+// LastSeenInterval is the least time between the updates of LastSeenAt by
+// Seen, which bounds the writes of sessions read on every request.
+var LastSeenInterval = time.Minute
+
+// Seen records a request at now from the client at ip with userAgent. It
+// changes s, which must then be written, when the client changed or
+// LastSeenInterval passed since s was last seen, and reports whether it
+// did.
+func (p *Session) Seen(now time.Time, ip, userAgent string) bool {
+	changed := false
+
+	if p.IP != ip || p.UserAgent != userAgent {
+		p.IP, p.UserAgent = ip, userAgent
+		changed = true
+	}
+
+	if t := now.Unix(); changed || time.Duration(t-p.LastSeenAt)*time.Second >= LastSeenInterval {
+		p.LastSeenAt = t
+		changed = true
+	}
+
+	if p.CreatedAt == 0 {
+		p.CreatedAt = p.LastSeenAt
+		changed = true
+	}
+
+	if changed {
+		p.clean = false
+	}
+
+	return changed
+}
+
+// SetDevice sets the device label of s.
+func (p *Session) SetDevice(label string) {
+	if p.Device != label {
+		p.Device = label
+		p.clean = false
+	}
+}
+
+// created sets the creation time of s to now, unless set, as when stored
+// by New.
+func (p *Session) created(now time.Time) {
+	if p.CreatedAt == 0 {
+		p.CreatedAt = now.Unix()
+	}
+
+	if p.LastSeenAt == 0 {
+		p.LastSeenAt = p.CreatedAt
+	}
+}
@@ -0,0 +1,447 @@
+package session
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// Stored sessions are wrapped in an envelope: a zero byte, the version of
+// the format and the id of the codec, followed by the encoded session.
+// Sessions stored before the envelope are JSON objects and have version 0.
+// Reading an older version decodes it with the decoder of its version and
+// migrates it one version at a time to the current one.
+
+// CurrentVersion is the version of the session format written.
+const CurrentVersion = 1
+
+// envelopeMark starts an envelope; JSON never starts with it.
+const envelopeMark = 0
+
+// A Codec encodes sessions of the current version.
+type Codec interface {
+	// ID identifies the codec in envelopes.
+	ID() byte
+	Marshal(s *Session) ([]byte, error)
+	Unmarshal(data []byte, s *Session) error
+}
+
+var (
+	// JSONCodec encodes sessions as JSON, readable by other languages.
+	JSONCodec Codec = jsonCodec{}
+	// BinaryCodec encodes sessions compactly, as for cookies.
+	BinaryCodec Codec = binaryCodec{}
+)
+
+var codecs = map[byte]Codec{
+	JSONCodec.ID():   JSONCodec,
+	BinaryCodec.ID(): BinaryCodec,
+}
+
+// A decoder returns the record of its version from the payload of an
+// envelope, with the codec of the envelope, or from a whole record
+// without envelope, with a nil codec.
+type decoder func(payload []byte, codec Codec) (interface{}, error)
+
+// A migration converts a record of its version to the next version. The
+// records of CurrentVersion are *Session.
+type migration func(record interface{}) (interface{}, error)
+
+var (
+	decoders = map[int]decoder{
+		0: decodeV0,
+		1: decodeCurrent,
+	}
+	migrations = map[int]migration{
+		0: migrateV0,
+	}
+)
+
+// WriteVersion is the version of the format written by Encode, and so by
+// every storage. Setting it to 0 keeps writing the JSON of version 0,
+// whatever the codec, until every reader of the stored sessions has been
+// upgraded.
+var WriteVersion = CurrentVersion
+
+// Encode returns the envelope of s encoded with codec, or the JSON of
+// version 0 if WriteVersion is 0.
+func Encode(s *Session, codec Codec) ([]byte, error) {
+	if WriteVersion == 0 {
+		return encodeV0(s)
+	}
+
+	payload, err := codec.Marshal(s)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte{envelopeMark, CurrentVersion, codec.ID()}, payload...), nil
+}
+
+// aliasCodec marks envelopes holding the id a regenerated session moved
+// to in place of a session.
+const aliasCodec = 'a'
+
+// encodeAlias returns the record of an alias of id.
+func encodeAlias(id string) []byte {
+	return append([]byte{envelopeMark, CurrentVersion, aliasCodec}, id...)
+}
+
+// aliasOf returns the id the alias stored as data refers to, and whether
+// data is an alias.
+func aliasOf(data []byte) (string, bool) {
+	if len(data) < 3 || data[0] != envelopeMark || data[2] != aliasCodec {
+		return "", false
+	}
+
+	return string(data[3:]), true
+}
+
+// Decode returns the session stored as data in any known version.
+func Decode(data []byte) (*Session, error) {
+	s, _, err := decodeRecord(data)
+	return s, err
+}
+
+// decodeRecord returns the session stored as data and the envelope it
+// was read from; nil if data has no envelope or an outdated one.
+func decodeRecord(data []byte) (*Session, Codec, error) {
+	var (
+		version int
+		codec   Codec
+		payload = data
+	)
+
+	if len(data) > 0 && data[0] == envelopeMark {
+		if len(data) < 3 {
+			return nil, nil, errors.New("session: truncated envelope")
+		}
+
+		version = int(data[1])
+		payload = data[3:]
+
+		if codec = codecs[data[2]]; codec == nil {
+			return nil, nil, fmt.Errorf("session: unknown codec %d", data[2])
+		}
+	}
+
+	dec := decoders[version]
+
+	if dec == nil {
+		return nil, nil, fmt.Errorf("session: unknown version %d", version)
+	}
+
+	record, err := dec(payload, codec)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for v := version; v < CurrentVersion; v++ {
+		if record, err = migrations[v](record); err != nil {
+			return nil, nil, fmt.Errorf("session: migrating version %d: %v", v, err)
+		}
+	}
+
+	s, ok := record.(*Session)
+
+	if !ok {
+		return nil, nil, fmt.Errorf("session: version %d decoded to %T", version, record)
+	}
+
+	if version < CurrentVersion {
+		codec = nil
+	}
+
+	return s, codec, nil
+}
+
+func decodeCurrent(payload []byte, codec Codec) (interface{}, error) {
+	if codec == nil {
+		return nil, errors.New("session: version 1 needs an envelope")
+	}
+
+	s := new(Session)
+	return s, codec.Unmarshal(payload, s)
+}
+
+// sessionV0 is the record of version 0, the JSON of Session from before
+// the envelope, where the profile id may be a string.
+type sessionV0 struct {
+	Session
+	ProfileID json.RawMessage `json:"user_id,omitempty"`
+}
+
+func decodeV0(payload []byte, codec Codec) (interface{}, error) {
+	if codec != nil {
+		return nil, errors.New("session: version 0 has no envelope")
+	}
+
+	v0 := new(sessionV0)
+	return v0, json.Unmarshal(payload, v0)
+}
+
+// encodeV0 returns the JSON of s readable by version 0 readers, which
+// take the profile id for a string.
+func encodeV0(s *Session) ([]byte, error) {
+	v0 := sessionV0{Session: *s}
+
+	if s.ProfileID != 0 {
+		v0.ProfileID = json.RawMessage(strconv.Quote(strconv.Itoa(s.ProfileID)))
+	}
+
+	return json.Marshal(&v0)
+}
+
+func migrateV0(record interface{}) (interface{}, error) {
+	v0 := record.(*sessionV0)
+	s := v0.Session
+
+	if len(v0.ProfileID) > 0 {
+		var id json.Number
+
+		if err := json.Unmarshal(v0.ProfileID, &id); err != nil {
+			// not a number, but it may be a quoted one
+			var str string
+
+			if err := json.Unmarshal(v0.ProfileID, &str); err != nil {
+				return nil, err
+			}
+
+			id = json.Number(str)
+		}
+
+		n, err := strconv.Atoi(string(id))
+
+		if err != nil {
+			return nil, err
+		}
+
+		s.ProfileID = n
+	}
+
+	return &s, nil
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ID() byte { return 'j' }
+
+func (jsonCodec) Marshal(s *Session) ([]byte, error) {
+	return json.Marshal(s)
+}
+
+func (jsonCodec) Unmarshal(data []byte, s *Session) error {
+	return json.Unmarshal(data, s)
+}
+
+// binaryCodec writes every field as its tag, the length of its value and
+// the value, so that readers skip fields they do not know and fields can
+// be added without a new version. Zero fields are left out.
+type binaryCodec struct{}
+
+const (
+	tagMask = iota + 1
+	tagProfileID
+	tagLifetime
+	tagScope
+	tagValue
+	tagFlash
+	tagCreatedAt
+	tagLastSeenAt
+	tagIP
+	tagUserAgent
+	tagDevice
+	tagRevision
+)
+
+func (binaryCodec) ID() byte { return 'b' }
+
+func (binaryCodec) Marshal(s *Session) ([]byte, error) {
+	var w binaryWriter
+
+	if s.Mask != 0 {
+		w.uint(tagMask, uint64(s.Mask))
+	}
+
+	if s.ProfileID != 0 {
+		w.int(tagProfileID, int64(s.ProfileID))
+	}
+
+	if s.Lifetime != 0 {
+		w.int(tagLifetime, int64(s.Lifetime))
+	}
+
+	for _, scope := range s.Scopes {
+		w.field(tagScope, []byte(scope))
+	}
+
+	w.values(tagValue, s.Values)
+	w.values(tagFlash, s.Flashes)
+
+	if s.CreatedAt != 0 {
+		w.int(tagCreatedAt, s.CreatedAt)
+	}
+
+	if s.LastSeenAt != 0 {
+		w.int(tagLastSeenAt, s.LastSeenAt)
+	}
+
+	w.string(tagIP, s.IP)
+	w.string(tagUserAgent, s.UserAgent)
+	w.string(tagDevice, s.Device)
+
+	if s.Revision != 0 {
+		w.int(tagRevision, s.Revision)
+	}
+
+	return w.buf, nil
+}
+
+func (binaryCodec) Unmarshal(data []byte, s *Session) error {
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+
+		if n <= 0 {
+			return errCorrupt
+		}
+
+		data = data[n:]
+		size, n := binary.Uvarint(data)
+
+		if n <= 0 || uint64(len(data)-n) < size {
+			return errCorrupt
+		}
+
+		value := data[n : n+int(size)]
+		data = data[n+int(size):]
+		var err error
+
+		switch tag {
+		case tagMask:
+			var u uint64
+			u, err = readUvarint(value)
+			s.Mask = uint8(u)
+		case tagProfileID:
+			var i int64
+			i, err = readVarint(value)
+			s.ProfileID = int(i)
+		case tagLifetime:
+			var i int64
+			i, err = readVarint(value)
+			s.Lifetime = int(i)
+		case tagScope:
+			s.Scopes = append(s.Scopes, string(value))
+		case tagValue:
+			s.Values, err = readValue(s.Values, value)
+		case tagFlash:
+			s.Flashes, err = readValue(s.Flashes, value)
+		case tagCreatedAt:
+			s.CreatedAt, err = readVarint(value)
+		case tagLastSeenAt:
+			s.LastSeenAt, err = readVarint(value)
+		case tagIP:
+			s.IP = string(value)
+		case tagUserAgent:
+			s.UserAgent = string(value)
+		case tagDevice:
+			s.Device = string(value)
+		case tagRevision:
+			s.Revision, err = readVarint(value)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+var errCorrupt = errors.New("session: corrupt binary session")
+
+type binaryWriter struct {
+	buf []byte
+}
+
+func (w *binaryWriter) field(tag int, value []byte) {
+	var b [binary.MaxVarintLen64]byte
+	w.buf = append(w.buf, b[:binary.PutUvarint(b[:], uint64(tag))]...)
+	w.buf = append(w.buf, b[:binary.PutUvarint(b[:], uint64(len(value)))]...)
+	w.buf = append(w.buf, value...)
+}
+
+func (w *binaryWriter) uint(tag int, u uint64) {
+	var b [binary.MaxVarintLen64]byte
+	w.field(tag, b[:binary.PutUvarint(b[:], u)])
+}
+
+func (w *binaryWriter) int(tag int, i int64) {
+	var b [binary.MaxVarintLen64]byte
+	w.field(tag, b[:binary.PutVarint(b[:], i)])
+}
+
+// string writes v unless empty.
+func (w *binaryWriter) string(tag int, v string) {
+	if v != "" {
+		w.field(tag, []byte(v))
+	}
+}
+
+// values writes every value of m as a field holding the length of the
+// key, the key and the value, sorted by key.
+func (w *binaryWriter) values(tag int, m map[string]json.RawMessage) {
+	keys := make([]string, 0, len(m))
+
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		var b [binary.MaxVarintLen64]byte
+		value := append(b[:binary.PutUvarint(b[:], uint64(len(k)))], k...)
+		w.field(tag, append(value, m[k]...))
+	}
+}
+
+func readUvarint(b []byte) (uint64, error) {
+	u, n := binary.Uvarint(b)
+
+	if n != len(b) {
+		return 0, errCorrupt
+	}
+
+	return u, nil
+}
+
+func readVarint(b []byte) (int64, error) {
+	i, n := binary.Varint(b)
+
+	if n != len(b) {
+		return 0, errCorrupt
+	}
+
+	return i, nil
+}
+
+func readValue(m map[string]json.RawMessage, b []byte) (map[string]json.RawMessage, error) {
+	size, n := binary.Uvarint(b)
+
+	if n <= 0 || uint64(len(b)-n) < size {
+		return m, errCorrupt
+	}
+
+	if m == nil {
+		m = make(map[string]json.RawMessage)
+	}
+
+	key := string(b[n : n+int(size)])
+	m[key] = append(json.RawMessage(nil), b[n+int(size):]...)
+	return m, nil
+}
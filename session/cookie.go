@@ -0,0 +1,228 @@
+package session
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrTooLarge is returned when an encoded session exceeds the size limit
+// of a CookieStorage.
+var ErrTooLarge = errors.New("session: encoded session too large")
+
+// cookieVersion is the first byte of a token, for changes of the format.
+const cookieVersion = 1
+
+// CookieOptions configures a CookieStorage. The zero value is valid.
+type CookieOptions struct {
+	// Lifetime of sessions in seconds, unless set on the session.
+	// Defaults to DefaultLifetime.
+	Lifetime int
+	// Persistent sessions never expire, unless their own lifetime is
+	// set.
+	Persistent bool
+	// MaxSize bounds the length of a token, which must fit a cookie
+	// along with its name and attributes. Defaults to 4000.
+	MaxSize int
+	// Now returns the current time. Defaults to time.Now.
+	Now func() time.Time
+}
+
+// CookieStorage is a Storage which keeps nothing on the server. The
+// session, with its expiry, is encrypted and authenticated with AES-GCM
+// into a token which is the session id, to be stored by the client, for
+// instance with handler.SetSessionCookie.
+//
+// New, Write and Touch set a new id on the session, which must be sent
+// to the client again. Delete cannot revoke a token; the client must
+// forget it, and it stays valid until it expires.
+type CookieStorage struct {
+	opts  CookieOptions
+	aeads []cipher.AEAD
+}
+
+// NewCookieStorage returns a CookieStorage using the AES keys of 16, 24 or
+// 32 bytes, newest first. Sessions are encrypted with the first key and
+// decrypted with any, so a key is rotated by prepending a new one and
+// dropped once the sessions it encrypted have expired. opts may be nil.
+func NewCookieStorage(keys [][]byte, opts *CookieOptions) (*CookieStorage, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("session: cookie storage needs a key")
+	}
+
+	c := new(CookieStorage)
+
+	if opts != nil {
+		c.opts = *opts
+	}
+
+	for i, key := range keys {
+		block, err := aes.NewCipher(key)
+
+		if err != nil {
+			return nil, fmt.Errorf("session: key %d: %v", i, err)
+		}
+
+		aead, err := cipher.NewGCM(block)
+
+		if err != nil {
+			return nil, err
+		}
+
+		c.aeads = append(c.aeads, aead)
+	}
+
+	if c.opts.Lifetime <= 0 && !c.opts.Persistent {
+		c.opts.Lifetime = DefaultLifetime
+	}
+
+	if c.opts.MaxSize <= 0 {
+		c.opts.MaxSize = 4000
+	}
+
+	if c.opts.Now == nil {
+		c.opts.Now = time.Now
+	}
+
+	return c, nil
+}
+
+// lifetimeOf returns the lifetime of s in seconds, zero if it never
+// expires.
+func (c *CookieStorage) lifetimeOf(s *Session) int {
+	if s.Lifetime > 0 {
+		return s.Lifetime
+	}
+
+	return c.opts.Lifetime
+}
+
+// encode returns the token of s. The plaintext is the expiry in unix
+// seconds, zero for never, followed by s encoded with BinaryCodec; the
+// version byte is authenticated as additional data.
+func (c *CookieStorage) encode(s *Session) (string, error) {
+	data, err := Encode(s, BinaryCodec)
+
+	if err != nil {
+		return "", err
+	}
+
+	var expires int64
+
+	if lt := c.lifetimeOf(s); lt > 0 {
+		expires = c.opts.Now().Add(time.Duration(lt) * time.Second).Unix()
+	}
+
+	aead := c.aeads[0]
+	plain := make([]byte, 8, 8+len(data))
+	binary.BigEndian.PutUint64(plain, uint64(expires))
+	plain = append(plain, data...)
+
+	token := make([]byte, 1+aead.NonceSize(), 1+aead.NonceSize()+len(plain)+aead.Overhead())
+	token[0] = cookieVersion
+
+	if _, err := rand.Read(token[1:]); err != nil {
+		return "", err
+	}
+
+	token = aead.Seal(token, token[1:], plain, token[:1])
+	id := base64.RawURLEncoding.EncodeToString(token)
+
+	if len(id) > c.opts.MaxSize {
+		return "", ErrTooLarge
+	}
+
+	return id, nil
+}
+
+// decode returns the session of the token id, or ErrNotFound if it is
+// invalid or expired.
+func (c *CookieStorage) decode(id string) (*Session, error) {
+	if len(id) > c.opts.MaxSize {
+		return nil, ErrNotFound
+	}
+
+	token, err := base64.RawURLEncoding.DecodeString(id)
+
+	if err != nil || len(token) == 0 || token[0] != cookieVersion {
+		return nil, ErrNotFound
+	}
+
+	for _, aead := range c.aeads {
+		n := 1 + aead.NonceSize()
+
+		if len(token) < n+8+aead.Overhead() {
+			return nil, ErrNotFound
+		}
+
+		plain, err := aead.Open(nil, token[1:n], token[n:], token[:1])
+
+		if err != nil {
+			continue
+		}
+
+		expires := int64(binary.BigEndian.Uint64(plain))
+
+		if expires != 0 && c.opts.Now().Unix() >= expires {
+			return nil, ErrNotFound
+		}
+
+		return decode(id, plain[8:])
+	}
+
+	return nil, ErrNotFound
+}
+
+func (c *CookieStorage) New(s *Session) error {
+	s.created(c.opts.Now())
+	s.Revision++
+	id, err := c.encode(s)
+
+	if err != nil {
+		s.Revision--
+		return err
+	}
+
+	s.Id = id
+	return nil
+}
+
+func (c *CookieStorage) Read(id string) (*Session, error) {
+	return c.decode(id)
+}
+
+// Write sets the id of s to a new token holding s.
+func (c *CookieStorage) Write(s *Session) error {
+	if !s.Dirty() {
+		return nil
+	}
+
+	return s.written(c.New(s))
+}
+
+// Delete does nothing, as tokens cannot be revoked.
+func (c *CookieStorage) Delete(id string) error {
+	return nil
+}
+
+// Touch sets the id of s to a new token with the lifetime restarted, or
+// returns ErrNotFound if the current token has expired.
+func (c *CookieStorage) Touch(s *Session) error {
+	if _, err := c.decode(s.Id); err != nil {
+		return err
+	}
+
+	id, err := c.encode(s)
+
+	if err != nil {
+		return err
+	}
+
+	s.Id = id
+	return nil
+}
@@ -0,0 +1,384 @@
+package session
+
+import (
+	"sync"
+	"time"
+)
+
+// MemoryOptions configures a MemoryStorage. The zero value is valid.
+type MemoryOptions struct {
+	// Lifetime of sessions in seconds, unless set on the session.
+	// Defaults to DefaultLifetime.
+	Lifetime int
+	// Persistent sessions never expire, unless their own lifetime is
+	// set.
+	Persistent bool
+	// MaxSessions bounds the number of stored sessions. When full, the
+	// session closest to expiry makes room for a new one. Zero means no
+	// limit.
+	MaxSessions int
+	// JanitorInterval is how often expired sessions are removed.
+	// Defaults to one minute. If negative, expired sessions are only
+	// removed when read or to make room.
+	JanitorInterval time.Duration
+	// RegenerateGrace is how long the old id of a regenerated session
+	// is an alias of the new one. Defaults to DefaultRegenerateGrace. If
+	// negative, the old id is deleted at once.
+	RegenerateGrace time.Duration
+	// Now returns the current time. Defaults to time.Now.
+	Now func() time.Time
+}
+
+// MemoryStorage is a Storage keeping sessions in process memory, for
+// tests and single process deployments. Sessions are stored encoded, like
+// in redis, so changing a session after Write does not change the stored
+// one.
+type MemoryStorage struct {
+	opts      MemoryOptions
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+
+	mu       sync.Mutex // guards sessions
+	sessions map[string]*memoryEntry
+}
+
+type memoryEntry struct {
+	data []byte
+	// alias is the id a regenerated session moved to, in place of data.
+	alias    string
+	revision int64
+	// expires is zero for sessions which never expire.
+	expires time.Time
+}
+
+// NewMemoryStorage returns a MemoryStorage. opts may be nil. Close stops
+// its janitor.
+func NewMemoryStorage(opts *MemoryOptions) *MemoryStorage {
+	m := &MemoryStorage{
+		done:     make(chan struct{}),
+		sessions: make(map[string]*memoryEntry),
+	}
+
+	if opts != nil {
+		m.opts = *opts
+	}
+
+	if m.opts.Lifetime <= 0 && !m.opts.Persistent {
+		m.opts.Lifetime = DefaultLifetime
+	}
+
+	if m.opts.RegenerateGrace == 0 {
+		m.opts.RegenerateGrace = DefaultRegenerateGrace
+	}
+
+	if m.opts.JanitorInterval == 0 {
+		m.opts.JanitorInterval = time.Minute
+	}
+
+	if m.opts.Now == nil {
+		m.opts.Now = time.Now
+	}
+
+	if m.opts.JanitorInterval > 0 {
+		m.wg.Add(1)
+		go m.janitor()
+	}
+
+	return m
+}
+
+// lifetimeOf returns the lifetime of s in seconds, zero if it never
+// expires.
+func (m *MemoryStorage) lifetimeOf(s *Session) int {
+	if s.Lifetime > 0 {
+		return s.Lifetime
+	}
+
+	return m.opts.Lifetime
+}
+
+func (m *MemoryStorage) expiry(s *Session, now time.Time) time.Time {
+	if lt := m.lifetimeOf(s); lt > 0 {
+		return now.Add(time.Duration(lt) * time.Second)
+	}
+
+	return time.Time{}
+}
+
+func (e *memoryEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
+
+func (m *MemoryStorage) New(s *Session) error {
+	s.created(m.opts.Now())
+	return m.create(s, "")
+}
+
+// Regenerate stores s under a new id, making its current id an alias of
+// the new one for the grace period.
+func (m *MemoryStorage) Regenerate(s *Session) error {
+	return m.create(s, s.Id)
+}
+
+// create stores s under a new id which it sets on s, replacing the
+// session old with an alias if set.
+func (m *MemoryStorage) create(s *Session, old string) error {
+	rev := s.Revision
+
+	for i := 0; i < maxNewAttempts; i++ {
+		id, err := newID()
+
+		if err != nil {
+			return err
+		}
+
+		now := m.opts.Now()
+		m.mu.Lock()
+
+		if e := m.live(id, now); e != nil {
+			m.mu.Unlock()
+			continue
+		}
+
+		next := rev + 1
+
+		if old != "" {
+			e := m.live(old, now)
+
+			if e == nil || e.alias != "" {
+				m.mu.Unlock()
+				return ErrNotFound
+			}
+
+			if e.revision >= next {
+				next = e.revision + 1
+			}
+		}
+
+		err = m.storeRevision(id, s, next, now)
+
+		if err == nil && old != "" {
+			if m.opts.RegenerateGrace > 0 {
+				m.sessions[old] = &memoryEntry{alias: id, expires: now.Add(m.opts.RegenerateGrace)}
+			} else {
+				delete(m.sessions, old)
+			}
+		}
+
+		m.mu.Unlock()
+
+		if err != nil {
+			return err
+		}
+
+		s.Id = id
+		return nil
+	}
+
+	return errCollision
+}
+
+// storeRevision stores s with revision under id and sets the revision on
+// s. The caller holds m.mu.
+func (m *MemoryStorage) storeRevision(id string, s *Session, revision int64, now time.Time) error {
+	rev := s.Revision
+	s.Revision = revision
+	data, err := Encode(s, JSONCodec)
+
+	if err != nil {
+		s.Revision = rev
+		return err
+	}
+
+	m.store(id, &memoryEntry{data: data, revision: revision, expires: m.expiry(s, now)}, now)
+	return nil
+}
+
+// live returns the entry of id unless missing or expired. The caller
+// holds m.mu.
+func (m *MemoryStorage) live(id string, now time.Time) *memoryEntry {
+	e, ok := m.sessions[id]
+
+	if !ok {
+		return nil
+	}
+
+	if e.expired(now) {
+		delete(m.sessions, id)
+		return nil
+	}
+
+	return e
+}
+
+func (m *MemoryStorage) Read(id string) (*Session, error) {
+	now := m.opts.Now()
+	m.mu.Lock()
+	e := m.live(id, now)
+
+	for i := 0; e != nil && e.alias != ""; i++ {
+		if i == maxAliases {
+			e = nil
+			break
+		}
+
+		id = e.alias
+		e = m.live(id, now)
+	}
+
+	m.mu.Unlock()
+
+	if e == nil {
+		return nil, ErrNotFound
+	}
+
+	return decode(id, e.data)
+}
+
+func (m *MemoryStorage) Write(s *Session) error {
+	if !s.Dirty() {
+		return nil
+	}
+
+	return s.written(m.write(s, false))
+}
+
+// CompareAndWrite writes s if the stored session has the revision s was
+// read with.
+func (m *MemoryStorage) CompareAndWrite(s *Session) error {
+	if !s.Dirty() {
+		return nil
+	}
+
+	return s.written(m.write(s, true))
+}
+
+// write stores the next revision of s under its id, if the stored session
+// has the revision of s when cas is set. The next revision is above both
+// that of s and the stored one, so that sessions read before a blind write
+// conflict with it.
+func (m *MemoryStorage) write(s *Session, cas bool) error {
+	now := m.opts.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	next := s.Revision + 1
+	e := m.live(s.Id, now)
+
+	if e != nil && e.alias != "" {
+		e = nil
+	}
+
+	if cas {
+		if e == nil {
+			return ErrNotFound
+		}
+
+		if e.revision != s.Revision {
+			return ErrConflict
+		}
+	}
+
+	if e != nil && e.revision >= next {
+		next = e.revision + 1
+	}
+
+	return m.storeRevision(s.Id, s, next, now)
+}
+
+func (m *MemoryStorage) Delete(id string) error {
+	m.mu.Lock()
+	delete(m.sessions, id)
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *MemoryStorage) Touch(s *Session) error {
+	now := m.opts.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e := m.live(s.Id, now)
+
+	if e == nil || e.alias != "" {
+		return ErrNotFound
+	}
+
+	e.expires = m.expiry(s, now)
+	return nil
+}
+
+// Len returns the number of stored sessions, including expired sessions
+// not yet removed and the aliases of regenerated sessions.
+func (m *MemoryStorage) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.sessions)
+}
+
+// Close stops the janitor.
+func (m *MemoryStorage) Close() error {
+	m.closeOnce.Do(func() { close(m.done) })
+	m.wg.Wait()
+	return nil
+}
+
+// store sets the entry of id, making room for it if full. The caller holds
+// m.mu.
+func (m *MemoryStorage) store(id string, e *memoryEntry, now time.Time) {
+	if _, ok := m.sessions[id]; !ok && m.opts.MaxSessions > 0 && len(m.sessions) >= m.opts.MaxSessions {
+		m.removeExpired(now)
+
+		if len(m.sessions) >= m.opts.MaxSessions {
+			m.evict()
+		}
+	}
+
+	m.sessions[id] = e
+}
+
+// evict removes the session closest to expiry, preferring those which
+// expire over those which never do. The caller holds m.mu.
+func (m *MemoryStorage) evict() {
+	var (
+		victim string
+		first  *memoryEntry
+	)
+
+	for id, e := range m.sessions {
+		switch {
+		case first == nil,
+			first.expires.IsZero() && !e.expires.IsZero(),
+			!e.expires.IsZero() && e.expires.Before(first.expires):
+			victim, first = id, e
+		}
+	}
+
+	delete(m.sessions, victim)
+}
+
+// removeExpired removes the expired sessions. The caller holds m.mu.
+func (m *MemoryStorage) removeExpired(now time.Time) {
+	for id, e := range m.sessions {
+		if e.expired(now) {
+			delete(m.sessions, id)
+		}
+	}
+}
+
+func (m *MemoryStorage) janitor() {
+	defer m.wg.Done()
+	t := time.NewTicker(m.opts.JanitorInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			now := m.opts.Now()
+			m.mu.Lock()
+			m.removeExpired(now)
+			m.mu.Unlock()
+		case <-m.done:
+			return
+		}
+	}
+}
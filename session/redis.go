@@ -0,0 +1,874 @@
+package session
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/simonz05/util/kvstore"
+)
+
+// RedisOptions configures a redis Storage. The zero value is valid.
+type RedisOptions struct {
+	// Prefix is the namespace of the session keys.
+	Prefix string
+	// Lifetime of sessions in seconds, unless set on the session.
+	// Defaults to DefaultLifetime.
+	Lifetime int
+	// Persistent sessions never expire, unless their own lifetime is
+	// set.
+	Persistent bool
+	// MaxPerProfile bounds the number of live sessions of a profile.
+	// Creating one more evicts the session closest to expiry. Zero
+	// means no limit.
+	MaxPerProfile int
+	// NearCache keeps recently read sessions in process memory if set,
+	// so that reading a session on every request rarely reaches redis.
+	// Writes invalidate the session in all processes.
+	NearCache *kvstore.NearCacheOptions
+	// Codec encodes written sessions. Defaults to JSONCodec. Sessions
+	// written with any codec or an older version are read.
+	Codec Codec
+	// RegenerateGrace is how long the old id of a regenerated session
+	// is an alias of the new one. Defaults to DefaultRegenerateGrace. If
+	// negative, the old id is deleted at once.
+	RegenerateGrace time.Duration
+	// RewriteOnRead rewrites sessions read in an older version or with
+	// another codec, keeping their expiry, so that the stored sessions
+	// converge on the current format.
+	RewriteOnRead bool
+}
+
+// maxTxRetries bounds the retries of transactions on a profile index
+// changed concurrently.
+const maxTxRetries = 5
+
+var errIDTaken = errors.New("session: id taken")
+
+// redisBackend stores encoded sessions under their id. It keeps an index
+// of the sessions of every profile, updated with the sessions in MULTI
+// transactions, and pruned of expired sessions whenever written.
+type redisBackend struct {
+	lifetime      int
+	maxPerProfile int
+	codec         Codec
+	rewrite       bool
+	grace         time.Duration
+	db            *kvstore.KVStore
+	cache         *kvstore.NearCache
+	closeOnce     sync.Once
+}
+
+func NewRedisBackend(dns, prefix string, persistent bool) (Storage, error) {
+	return NewRedisStorage(dns, &RedisOptions{Prefix: prefix, Persistent: persistent})
+}
+
+// NewCachedRedisBackend returns a redis backend which keeps recently read
+// sessions in process memory. opts may be nil.
+func NewCachedRedisBackend(dns, prefix string, persistent bool, opts *kvstore.NearCacheOptions) (Storage, error) {
+	if opts == nil {
+		opts = new(kvstore.NearCacheOptions)
+	}
+
+	return NewRedisStorage(dns, &RedisOptions{Prefix: prefix, Persistent: persistent, NearCache: opts})
+}
+
+// NewRedisStorage returns a Storage keeping sessions in the redis server
+// of the data source name dns. opts may be nil. The storage implements
+// io.Closer; Close stops the near cache and closes the connections.
+func NewRedisStorage(dns string, opts *RedisOptions) (Storage, error) {
+	var o RedisOptions
+
+	if opts != nil {
+		o = *opts
+	}
+
+	if o.Lifetime <= 0 && !o.Persistent {
+		o.Lifetime = DefaultLifetime
+	}
+
+	if o.RegenerateGrace == 0 {
+		o.RegenerateGrace = DefaultRegenerateGrace
+	}
+
+	if o.Codec == nil {
+		o.Codec = JSONCodec
+	}
+
+	db, err := kvstore.Open(dns)
+
+	if err != nil {
+		return nil, err
+	}
+
+	conn := db.Get()
+	_, err = conn.Do("Ping")
+	conn.Close()
+
+	if err != nil {
+		return nil, err
+	}
+
+	rs := &redisBackend{
+		db:            db.Namespace(o.Prefix),
+		lifetime:      o.Lifetime,
+		maxPerProfile: o.MaxPerProfile,
+		codec:         o.Codec,
+		rewrite:       o.RewriteOnRead,
+		grace:         o.RegenerateGrace,
+	}
+
+	if o.NearCache != nil {
+		rs.cache = rs.db.NewNearCache(o.NearCache)
+	}
+
+	return rs, nil
+}
+
+// Close stops the near cache, if any, and closes the connections.
+func (rs *redisBackend) Close() error {
+	var err error
+
+	rs.closeOnce.Do(func() {
+		if rs.cache != nil {
+			err = rs.cache.Close()
+		}
+
+		if cerr := rs.db.Close(); err == nil {
+			err = cerr
+		}
+	})
+
+	return err
+}
+
+// lifetimeOf returns the lifetime of s in seconds, zero if it never
+// expires.
+func (rs *redisBackend) lifetimeOf(s *Session) int {
+	if s.Lifetime > 0 {
+		return s.Lifetime
+	}
+
+	return rs.lifetime
+}
+
+func (rs *redisBackend) New(s *Session) error {
+	s.created(time.Now())
+	return rs.create(s, "")
+}
+
+// Regenerate stores s under a new id, making its current id an alias of
+// the new one for the grace period.
+func (rs *redisBackend) Regenerate(s *Session) error {
+	return rs.create(s, s.Id)
+}
+
+// create stores s under a new id which it sets on s, replacing the
+// session old with an alias if set.
+func (rs *redisBackend) create(s *Session, old string) error {
+	for i := 0; i < maxNewAttempts; i++ {
+		id, err := newID()
+
+		if err != nil {
+			return err
+		}
+
+		err = rs.store(id, s, storeCond{create: true, old: old})
+
+		if err == errIDTaken {
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		s.Id = id
+		return nil
+	}
+
+	return errCollision
+}
+
+func (rs *redisBackend) Read(id string) (*Session, error) {
+	var data []byte
+
+	for i := 0; ; i++ {
+		var err error
+		data, err = rs.get(id)
+
+		if err == redis.ErrNil {
+			return nil, ErrNotFound
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		to, ok := aliasOf(data)
+
+		if !ok {
+			break
+		}
+
+		if i == maxAliases {
+			return nil, ErrNotFound
+		}
+
+		id = to
+	}
+
+	s, codec, err := decodeRecord(data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if rs.rewrite && codec != rs.codec && WriteVersion == CurrentVersion {
+		// the session is read all the same if it cannot be rewritten,
+		// and rewriting is tried again on the next read
+		rs.rewriteRecord(id, s, data)
+	}
+
+	s.Id = id
+	s.markClean()
+	return s, nil
+}
+
+// rewriteRecord replaces data, the stored encoding of s under id, with
+// its current encoding, unless it changed since read.
+func (rs *redisBackend) rewriteRecord(id string, s *Session, data []byte) error {
+	upgraded, err := Encode(s, rs.codec)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = rs.db.Tx([]string{id}, 0, func(tx *kvstore.Tx) error {
+		current, err := redis.Bytes(tx.Do("GET", id))
+
+		if err == redis.ErrNil || err == nil && !bytes.Equal(current, data) {
+			// deleted or written since
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		ttl, err := redis.Int64(tx.Do("PTTL", id))
+
+		if err != nil {
+			return err
+		}
+
+		if ttl > 0 {
+			return tx.Send("PSETEX", id, ttl, upgraded)
+		}
+
+		return tx.Send("SET", id, upgraded)
+	})
+
+	if err == kvstore.ErrTxAborted {
+		// written since, in the current format if by this version
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return rs.invalidate(id)
+}
+
+func (rs *redisBackend) get(id string) ([]byte, error) {
+	if rs.cache != nil {
+		return rs.cache.Get(id)
+	}
+
+	conn := rs.db.GetReadOnly()
+	defer conn.Close()
+	return redis.Bytes(conn.Do("GET", id))
+}
+
+func (rs *redisBackend) Write(s *Session) error {
+	if !s.Dirty() {
+		return nil
+	}
+
+	return s.written(rs.store(s.Id, s, storeCond{}))
+}
+
+// CompareAndWrite writes s if the stored session has the revision s was
+// read with.
+func (rs *redisBackend) CompareAndWrite(s *Session) error {
+	if !s.Dirty() {
+		return nil
+	}
+
+	return s.written(rs.store(s.Id, s, storeCond{cas: true}))
+}
+
+// storeCond holds the conditions and side effects of store.
+type storeCond struct {
+	// create fails with errIDTaken if the id is in use.
+	create bool
+	// old is replaced with an alias of the id, or fails with ErrNotFound
+	// if missing.
+	old string
+	// cas fails with ErrConflict unless the stored session has the
+	// revision of s, or with ErrNotFound if missing.
+	cas bool
+}
+
+// store writes the next revision of s under id if cond holds, and sets it
+// on s. The next revision is above both that of s and the stored one, so
+// that sessions read before a blind write conflict with it. Sessions of a
+// profile are added to its index, evicting its oldest sessions beyond
+// MaxPerProfile.
+func (rs *redisBackend) store(id string, s *Session, cond storeCond) error {
+	old := cond.old
+	rev := s.Revision
+	lt := rs.lifetimeOf(s)
+	keys := []string{id}
+	index := indexKey(s.ProfileID)
+
+	if old != "" {
+		keys = append(keys, old)
+	}
+
+	if s.ProfileID != 0 {
+		keys = append(keys, index)
+	}
+
+	var evicted []string
+
+	_, err := rs.db.Tx(keys, maxTxRetries, func(tx *kvstore.Tx) error {
+		evicted = nil
+
+		if cond.create {
+			taken, err := redis.Bool(tx.Do("EXISTS", id))
+
+			if err != nil {
+				return err
+			}
+
+			if taken {
+				return errIDTaken
+			}
+		}
+
+		next := rev + 1
+		// profiles whose index may list the stored sessions
+		var previous []int
+
+		if old != "" {
+			stored, err := storedSession(tx, old)
+
+			if err != nil {
+				return err
+			}
+
+			if stored == nil {
+				return ErrNotFound
+			}
+
+			if stored.Revision >= next {
+				next = stored.Revision + 1
+			}
+
+			previous = append(previous, stored.ProfileID)
+		}
+
+		if !cond.create {
+			stored, err := storedSession(tx, id)
+
+			if err != nil {
+				return err
+			}
+
+			if cond.cas && stored == nil {
+				return ErrNotFound
+			}
+
+			if cond.cas && stored.Revision != rev {
+				return ErrConflict
+			}
+
+			if stored != nil {
+				if stored.Revision >= next {
+					next = stored.Revision + 1
+				}
+
+				previous = append(previous, stored.ProfileID)
+			}
+		}
+
+		s.Revision = next
+		data, err := Encode(s, rs.codec)
+
+		if err != nil {
+			return err
+		}
+
+		var u *indexUpdate
+
+		if s.ProfileID != 0 {
+			var err error
+
+			if u, err = readIndex(tx, index, lt); err != nil {
+				return err
+			}
+
+			if evicted, err = rs.overCap(tx, u, id, old); err != nil {
+				return err
+			}
+		}
+
+		if lt > 0 {
+			tx.Send("SETEX", id, lt, data)
+		} else {
+			tx.Send("SET", id, data)
+		}
+
+		if old != "" {
+			if rs.grace > 0 {
+				tx.Send("PSETEX", old, int64(rs.grace/time.Millisecond), encodeAlias(id))
+			} else {
+				tx.Send("DEL", old)
+			}
+		}
+
+		// the session left the profiles it was stored with before; the
+		// indexes need no WATCH as the session keys are watched
+		for i, profileID := range previous {
+			if profileID == 0 || profileID == s.ProfileID || i > 0 && profileID == previous[i-1] {
+				continue
+			}
+
+			if old != "" {
+				tx.Send("ZREM", indexKey(profileID), id, old)
+			} else {
+				tx.Send("ZREM", indexKey(profileID), id)
+			}
+		}
+
+		if u == nil {
+			return nil
+		}
+
+		if old != "" {
+			tx.Send("ZREM", index, old)
+		}
+
+		if len(evicted) > 0 {
+			tx.Send("DEL", redis.Args{}.AddFlat(evicted)...)
+			tx.Send("ZREM", redis.Args{index}.AddFlat(evicted)...)
+		}
+
+		return u.send(tx, id, false)
+	})
+
+	if err != nil {
+		s.Revision = rev
+		return err
+	}
+
+	if old != "" {
+		evicted = append(evicted, old)
+	}
+
+	return rs.invalidate(append(evicted, id)...)
+}
+
+// storedSession returns the session stored under id, or nil if there is
+// none; aliases and records which cannot be decoded are none.
+func storedSession(tx *kvstore.Tx, id string) (*Session, error) {
+	data, err := redis.Bytes(tx.Do("GET", id))
+
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := Decode(data)
+
+	if err != nil {
+		return nil, nil
+	}
+
+	return s, nil
+}
+
+// overCap returns the oldest sessions in the index of u which must go to
+// make room for id, replacing old if set.
+func (rs *redisBackend) overCap(tx *kvstore.Tx, u *indexUpdate, id, old string) ([]string, error) {
+	if rs.maxPerProfile <= 0 {
+		return nil, nil
+	}
+
+	ids, err := redis.Strings(tx.Do("ZRANGEBYSCORE", u.index, "("+strconv.FormatInt(u.now, 10), "+inf"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	others := ids[:0]
+
+	for _, other := range ids {
+		if other != id && other != old {
+			others = append(others, other)
+		}
+	}
+
+	if n := len(others) + 1 - rs.maxPerProfile; n > 0 {
+		return others[:n], nil
+	}
+
+	return nil, nil
+}
+
+// invalidate removes ids from the near cache of every process, which the
+// server does by itself if it supports client side caching.
+func (rs *redisBackend) invalidate(ids ...string) error {
+	if rs.cache == nil {
+		return nil
+	}
+
+	return rs.cache.Invalidate(ids...)
+}
+
+func (rs *redisBackend) Delete(id string) error {
+	_, err := rs.db.Tx([]string{id}, maxTxRetries, func(tx *kvstore.Tx) error {
+		stored, err := storedSession(tx, id)
+
+		if err != nil {
+			return err
+		}
+
+		// a session which cannot be decoded is deleted all the same; at
+		// worst its profile index keeps the id until it expires
+		tx.Send("DEL", id)
+
+		if stored != nil && stored.ProfileID != 0 {
+			tx.Send("ZREM", indexKey(stored.ProfileID), id)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return rs.invalidate(id)
+}
+
+func (rs *redisBackend) Touch(s *Session) error {
+	lt := rs.lifetimeOf(s)
+	index := indexKey(s.ProfileID)
+	var keys []string
+
+	if s.ProfileID != 0 {
+		keys = []string{index}
+	}
+
+	replies, err := rs.db.Tx(keys, maxTxRetries, func(tx *kvstore.Tx) error {
+		var u *indexUpdate
+
+		if s.ProfileID != 0 {
+			var err error
+
+			if u, err = readIndex(tx, index, lt); err != nil {
+				return err
+			}
+		}
+
+		if lt > 0 {
+			tx.Send("EXPIRE", s.Id, lt)
+		} else {
+			tx.Send("EXISTS", s.Id)
+		}
+
+		if u == nil {
+			return nil
+		}
+
+		return u.send(tx, s.Id, true)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if ok, _ := redis.Bool(replies[0], nil); !ok {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// indexKey returns the key of the index of the sessions of profileID, a
+// sorted set of session ids scored by their expiry in unix seconds, or
+// +inf for sessions which never expire.
+func indexKey(profileID int) string {
+	return "profile:" + strconv.Itoa(profileID)
+}
+
+// doer runs commands, as connections and transactions do.
+type doer interface {
+	Do(cmd string, args ...interface{}) (interface{}, error)
+}
+
+// serverTime returns the clock of the redis server in unix seconds. Index
+// scores follow it, so that they agree with the expiry of keys.
+func serverTime(conn doer) (int64, error) {
+	t, err := redis.Int64s(conn.Do("TIME"))
+
+	if err != nil {
+		return 0, err
+	}
+
+	if len(t) != 2 {
+		return 0, errors.New("session: unexpected TIME reply")
+	}
+
+	return t[0], nil
+}
+
+// indexUpdate adds a session to a profile index, which lives as long as
+// its longest lived session.
+type indexUpdate struct {
+	index string
+	now   int64
+	score float64
+	// keep is the latest expiry in the index, +inf if any session never
+	// expires.
+	keep float64
+}
+
+// readIndex prepares adding a session with lifetime lt to index.
+func readIndex(tx *kvstore.Tx, index string, lt int) (*indexUpdate, error) {
+	now, err := serverTime(tx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	u := &indexUpdate{index: index, now: now, score: math.Inf(1)}
+
+	if lt > 0 {
+		u.score = float64(now + int64(lt))
+	}
+
+	top, err := redis.Strings(tx.Do("ZREVRANGE", index, 0, 0, "WITHSCORES"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	u.keep = u.score
+
+	if len(top) == 2 {
+		if f, err := strconv.ParseFloat(top[1], 64); err == nil && f > u.keep {
+			u.keep = f
+		}
+	}
+
+	return u, nil
+}
+
+// send queues the update for id, which is only updated if already indexed
+// when xx is set, and the removal of expired sessions.
+func (u *indexUpdate) send(tx *kvstore.Tx, id string, xx bool) error {
+	args := redis.Args{u.index}
+
+	if xx {
+		args = args.Add("XX")
+	}
+
+	tx.Send("ZADD", args.Add(u.score, id)...)
+	tx.Send("ZREMRANGEBYSCORE", u.index, "-inf", u.now)
+
+	if math.IsInf(u.keep, 1) {
+		return tx.Send("PERSIST", u.index)
+	}
+
+	return tx.Send("EXPIRE", u.index, int64(u.keep)-u.now)
+}
+
+// List returns the live sessions of profileID, soonest to expire first.
+func (rs *redisBackend) List(profileID int) ([]*SessionInfo, error) {
+	conn := rs.db.Get()
+	defer conn.Close()
+	now, err := serverTime(conn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := redis.Strings(conn.Do("ZRANGEBYSCORE", indexKey(profileID), "("+strconv.FormatInt(now, 10), "+inf", "WITHSCORES"))
+
+	if err != nil || len(values) == 0 {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(values)/2)
+
+	for i := 0; i < len(values); i += 2 {
+		ids = append(ids, values[i])
+	}
+
+	data, err := redis.ByteSlices(conn.Do("MGET", redis.Args{}.AddFlat(ids)...))
+
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []*SessionInfo
+
+	for i, id := range ids {
+		if data[i] == nil {
+			// deleted or expired since
+			continue
+		}
+
+		s, err := decode(id, data[i])
+
+		if err != nil || s.ProfileID != profileID {
+			// the session changed profile after it was indexed
+			continue
+		}
+
+		info := &SessionInfo{Session: s}
+
+		if score, _ := strconv.ParseFloat(values[2*i+1], 64); !math.IsInf(score, 1) {
+			info.Expires = time.Unix(int64(score), 0)
+		}
+
+		infos = append(infos, info)
+	}
+
+	return infos, nil
+}
+
+func (rs *redisBackend) Revoke(profileID int, id string) error {
+	index := indexKey(profileID)
+	var moved bool
+
+	_, err := rs.db.Tx([]string{index, id}, maxTxRetries, func(tx *kvstore.Tx) error {
+		if _, err := redis.Float64(tx.Do("ZSCORE", index, id)); err != nil {
+			if err == redis.ErrNil {
+				return ErrNotFound
+			}
+
+			return err
+		}
+
+		stored, err := storedSession(tx, id)
+
+		if err != nil {
+			return err
+		}
+
+		// a session which moved to another profile is only unlisted
+		moved = stored != nil && stored.ProfileID != profileID
+
+		if !moved {
+			tx.Send("DEL", id)
+		}
+
+		return tx.Send("ZREM", index, id)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if moved {
+		return ErrNotFound
+	}
+
+	return rs.invalidate(id)
+}
+
+func (rs *redisBackend) RevokeAll(profileID int) (int, error) {
+	return rs.RevokeAllExcept(profileID, "")
+}
+
+func (rs *redisBackend) RevokeAllExcept(profileID int, keep string) (int, error) {
+	index := indexKey(profileID)
+	var listed, revoked []string
+
+	replies, err := rs.db.Tx([]string{index}, maxTxRetries, func(tx *kvstore.Tx) error {
+		ids, err := redis.Strings(tx.Do("ZRANGE", index, 0, -1))
+
+		if err != nil {
+			return err
+		}
+
+		listed, revoked = listed[:0], revoked[:0]
+
+		for _, id := range ids {
+			if id != keep {
+				listed = append(listed, id)
+			}
+		}
+
+		if len(listed) == 0 {
+			return nil
+		}
+
+		// the sessions are watched too, so that none moves to another
+		// profile before it is deleted
+		if _, err := tx.Do("WATCH", redis.Args{}.AddFlat(listed)...); err != nil {
+			return err
+		}
+
+		values, err := redis.ByteSlices(tx.Do("MGET", redis.Args{}.AddFlat(listed)...))
+
+		if err != nil {
+			return err
+		}
+
+		for i, data := range values {
+			if data == nil {
+				// expired, only unlisted
+				continue
+			}
+
+			if s, err := Decode(data); err == nil && s.ProfileID != profileID {
+				// moved to another profile, only unlisted
+				continue
+			}
+
+			revoked = append(revoked, listed[i])
+		}
+
+		if len(revoked) > 0 {
+			tx.Send("DEL", redis.Args{}.AddFlat(revoked)...)
+		}
+
+		return tx.Send("ZREM", redis.Args{index}.AddFlat(listed)...)
+	})
+
+	if err != nil || len(revoked) == 0 {
+		return 0, err
+	}
+
+	// DEL counts the sessions which had not expired yet
+	n, err := redis.Int(replies[0], nil)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return n, rs.invalidate(revoked...)
+}
@@ -0,0 +1,147 @@
+package session
+
+import (
+	"sort"
+	"strings"
+)
+
+// ScopeFull and ScopeAdmin are the scopes of FullMask and AdminMask.
+// Sessions stored with the mask bits have these scopes, and granting them
+// sets the bits, so that readers of the masks keep working.
+const (
+	ScopeFull  = "full"
+	ScopeAdmin = "admin"
+)
+
+var legacyScopes = []struct {
+	mask  uint8
+	scope string
+}{
+	{FullMask, ScopeFull},
+	{AdminMask, ScopeAdmin},
+}
+
+func legacyMask(scope string) uint8 {
+	for _, l := range legacyScopes {
+		if l.scope == scope {
+			return l.mask
+		}
+	}
+
+	return 0
+}
+
+// AllScopes returns the scopes granted to s, including those of its mask
+// bits, sorted.
+func (p *Session) AllScopes() []string {
+	scopes := append([]string(nil), p.Scopes...)
+
+	for _, l := range legacyScopes {
+		if p.Mask&l.mask != 0 && !contains(scopes, l.scope) {
+			scopes = append(scopes, l.scope)
+		}
+	}
+
+	sort.Strings(scopes)
+	return scopes
+}
+
+// HasScope reports whether a scope granted to s matches scope.
+func (p *Session) HasScope(scope string) bool {
+	if m := legacyMask(scope); m != 0 && p.Mask&m != 0 {
+		return true
+	}
+
+	for _, granted := range p.Scopes {
+		if matchScope(granted, scope) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GrantScope grants scopes to s.
+func (p *Session) GrantScope(scopes ...string) {
+	for _, scope := range scopes {
+		if scope == "" {
+			continue
+		}
+
+		if m := legacyMask(scope); m != 0 {
+			p.Set(m)
+			continue
+		}
+
+		if !contains(p.Scopes, scope) {
+			p.Scopes = append(p.Scopes, scope)
+			p.clean = false
+		}
+	}
+
+	sort.Strings(p.Scopes)
+}
+
+// RevokeScope revokes scopes from s. Only granted scopes are revoked, so
+// revoking "keys:write" from a session granted "keys:*" leaves it
+// matching.
+func (p *Session) RevokeScope(scopes ...string) {
+	for _, scope := range scopes {
+		if m := legacyMask(scope); m != 0 {
+			p.Unset(m)
+			continue
+		}
+
+		for i, granted := range p.Scopes {
+			if granted == scope {
+				p.Scopes = append(p.Scopes[:i], p.Scopes[i+1:]...)
+				p.clean = false
+				break
+			}
+		}
+	}
+
+	if len(p.Scopes) == 0 {
+		p.Scopes = nil
+	}
+}
+
+// matchScope reports whether the granted scope matches scope.
+func matchScope(granted, scope string) bool {
+	if granted == scope {
+		return true
+	}
+
+	g := strings.Split(granted, ":")
+	s := strings.Split(scope, ":")
+
+	for i, seg := range g {
+		if i == len(s) {
+			return false
+		}
+
+		if seg == "*" {
+			if i == len(g)-1 {
+				return true
+			}
+
+			continue
+		}
+
+		if seg != s[i] {
+			return false
+		}
+	}
+
+	return len(g) == len(s)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -1,12 +1,11 @@
 package session
 
 import (
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
-	"fmt"
-	"strconv"
-
-	"github.com/garyburd/redigo/redis"
-	"github.com/simonz05/util/kvstore"
+	"errors"
+	"time"
 )
 
 const (
@@ -14,30 +13,67 @@ const (
 	AdminMask
 )
 
+// ErrNotFound is returned for sessions which do not exist or have
+// expired.
+var ErrNotFound = errors.New("session: not found")
+
+// ErrConflict is returned by CompareAndWrite when the session was written
+// since read.
+var ErrConflict = errors.New("session: revision conflict")
+
 type Session struct {
 	Id        string `json:"-"`
 	Mask      uint8  `json:"m,omitempty"`
 	ProfileID int    `json:"user_id,omitempty"`
+	// Lifetime in seconds overrides the lifetime of the storage for
+	// this session.
+	Lifetime int `json:"lt,omitempty"`
+	// Scopes are the permissions granted besides the mask bits, colon
+	// separated names such as "keys:read". A "*" segment matches any
+	// single segment in its place, and any number of segments when
+	// last: "keys:*" grants "keys:read" and "keys:read:own" but not
+	// "keys", and "*" grants everything.
+	Scopes []string `json:"s,omitempty"`
+	// Values and Flashes hold JSON encoded values, set with the typed
+	// setters, so that they keep their type through any Storage.
+	Values  map[string]json.RawMessage `json:"v,omitempty"`
+	Flashes map[string]json.RawMessage `json:"f,omitempty"`
+	// CreatedAt and LastSeenAt are unix seconds, set by the storages on
+	// New and by Seen. IP and UserAgent are those of the last request
+	// seen, and Device is a label chosen by the user, all for showing
+	// where a profile is logged in.
+	CreatedAt  int64  `json:"ca,omitempty"`
+	LastSeenAt int64  `json:"ls,omitempty"`
+	IP         string `json:"ip,omitempty"`
+	UserAgent  string `json:"ua,omitempty"`
+	Device     string `json:"dv,omitempty"`
+	// Revision counts the writes of the session, for CompareAndWrite.
+	Revision int64 `json:"rev,omitempty"`
+
+	// clean is set by Read and Write and cleared by changes through
+	// methods. snapshot is a copy of the fields as read or written, to
+	// find changes made to them directly.
+	clean    bool
+	snapshot *Session
 }
 
-type sessionString struct {
-	ProfileID string `json:"user_id,omitempty"`
-}
-
+// HasAdmin reports whether p has the admin scope and a profile.
 func (p *Session) HasAdmin() bool {
-	return (p.Mask&AdminMask) != 0 && p.ProfileID != 0
+	return p.HasScope(ScopeAdmin) && p.ProfileID != 0
 }
 
 func (p *Session) HasFull() bool {
-	return (p.Mask & FullMask) != 0
+	return p.HasScope(ScopeFull)
 }
 
 func (p *Session) Set(mask uint8) {
 	p.Mask |= mask
+	p.clean = false
 }
 
 func (p *Session) Unset(mask uint8) {
 	p.Mask &^= mask
+	p.clean = false
 }
 
 var (
@@ -45,91 +81,158 @@ var (
 	DefaultLifetime = 24 * 60 * 60
 )
 
+// Storage stores sessions. Sessions expire after their lifetime unless
+// touched, which restarts it.
 type Storage interface {
-	Read(string) (*Session, error)
-	Write(*Session) error
+	// New stores s under a new random id, which it sets on s, and sets
+	// the creation time of s unless set.
+	New(s *Session) error
+	// Read returns the session id, or ErrNotFound.
+	Read(id string) (*Session, error)
+	// Write stores s, creating or replacing it whatever its revision,
+	// and restarts its lifetime. It does nothing if s is not dirty.
+	Write(s *Session) error
+	// Delete removes the session id. Deleting a missing session is not
+	// an error.
+	Delete(id string) error
+	// Touch restarts the lifetime of s, or returns ErrNotFound if it has
+	// expired.
+	Touch(s *Session) error
 }
 
-type redisBackend struct {
-	prefix     string
-	lifetime   int
-	persistent bool
-	db         *kvstore.KVStore
+// A Regenerator moves sessions to new ids, as the redis and memory
+// storages do.
+type Regenerator interface {
+	// Regenerate stores s under a new random id, which it sets on s,
+	// and makes the old id an alias of the new one for a grace period,
+	// so that requests in flight with the old id still find s. It
+	// returns ErrNotFound if s has expired.
+	Regenerate(s *Session) error
 }
 
-func NewRedisBackend(dns, prefix string, persistent bool) (Storage, error) {
-	db, err := kvstore.Open(dns)
-
-	if err != nil {
-		return nil, err
+// Regenerate moves s to a new id, as after a login or a gain of rights,
+// so that an id known before, such as one fixed by an attacker, does not
+// grant them. Storages which are not Regenerators store s anew and delete
+// the old id.
+func Regenerate(storage Storage, s *Session) error {
+	if r, ok := storage.(Regenerator); ok {
+		return r.Regenerate(s)
 	}
 
-	conn := db.Get()
-	_, err = conn.Do("Ping")
-	conn.Close()
+	old := s.Id
 
-	if err != nil {
-		return nil, err
+	if err := storage.New(s); err != nil {
+		return err
 	}
 
-	return &redisBackend{
-		prefix:     prefix,
-		db:         db,
-		lifetime:   DefaultLifetime,
-		persistent: persistent,
-	}, nil
+	return storage.Delete(old)
 }
 
-func (rs *redisBackend) key(id string) string {
-	return fmt.Sprintf("%s:%s", rs.prefix, id)
+// DefaultRegenerateGrace is how long the old id of a regenerated session
+// stays an alias of the new one, unless set on the storage.
+const DefaultRegenerateGrace = 30 * time.Second
+
+// maxAliases bounds the aliases followed to read a session, which is more
+// than one only if regenerated again within the grace period.
+const maxAliases = 3
+
+// A CompareAndSwapper writes sessions only if not written since read, as
+// the redis and memory storages do.
+type CompareAndSwapper interface {
+	// CompareAndWrite stores s like Write if the stored session has
+	// the revision of s, or returns ErrConflict. It returns ErrNotFound
+	// if s has expired.
+	CompareAndWrite(s *Session) error
 }
 
-func (rs *redisBackend) Read(id string) (*Session, error) {
-	conn := rs.db.Get()
-	defer conn.Close()
-	data, err := redis.Bytes(conn.Do("GET", rs.key(id)))
+// Update reads the session id, changes it with fn and writes it unless
+// written since read, in which case it tries again, up to maxRetries
+// times before giving up with ErrConflict. fn must only change the session
+// it is given, as it may run more than once. Storages which are not
+// CompareAndSwappers write the session blindly.
+func Update(storage Storage, id string, maxRetries int, fn func(s *Session) error) (*Session, error) {
+	for n := 0; n <= maxRetries; n++ {
+		s, err := storage.Read(id)
 
-	if err != nil {
-		return nil, err
-	}
+		if err != nil {
+			return nil, err
+		}
 
-	s := new(Session)
+		if err := fn(s); err != nil {
+			return nil, err
+		}
 
-	if err = json.Unmarshal(data, s); err != nil {
-		// try to read profileID as string
-		ss := new(sessionString)
+		cas, ok := storage.(CompareAndSwapper)
 
-		if err = json.Unmarshal(data, ss); err != nil {
-			return nil, err
+		if !ok {
+			return s, storage.Write(s)
 		}
 
-		profileID, err := strconv.Atoi(ss.ProfileID)
+		err = cas.CompareAndWrite(s)
 
-		if err != nil {
-			return nil, err
+		if err == ErrConflict {
+			continue
 		}
 
-		s.ProfileID = profileID
+		return s, err
 	}
 
-	s.Id = id
-	return s, nil
+	return nil, ErrConflict
+}
+
+// SessionInfo describes a session of a profile.
+type SessionInfo struct {
+	Session *Session
+	// Expires is zero for sessions which never expire.
+	Expires time.Time
 }
 
-func (rs *redisBackend) Write(s *Session) error {
-	data, err := json.Marshal(s)
+// An Index finds the sessions of a profile, as implemented by the redis
+// Storage. Revoked sessions are deleted.
+type Index interface {
+	// List returns the live sessions of profileID, soonest to expire
+	// first.
+	List(profileID int) ([]*SessionInfo, error)
+	// Revoke revokes the session id of profileID, or returns
+	// ErrNotFound if profileID has no such session.
+	Revoke(profileID int, id string) error
+	// RevokeAll revokes every session of profileID, as after a password
+	// change, and returns how many were live.
+	RevokeAll(profileID int) (int, error)
+	// RevokeAllExcept revokes every session of profileID but keep, the
+	// current one, and returns how many were live.
+	RevokeAllExcept(profileID int, keep string) (int, error)
+}
 
-	if err != nil {
-		return err
+// idBytes is the number of random bytes of a session id.
+const idBytes = 32
+
+// maxNewAttempts bounds the retries of New on id collisions, which only
+// a broken random source makes likely.
+const maxNewAttempts = 3
+
+var errCollision = errors.New("session: could not find an unused id")
+
+// newID returns a session id read from the cryptographic random source.
+func newID() (string, error) {
+	b := make([]byte, idBytes)
+
+	if _, err := rand.Read(b); err != nil {
+		return "", err
 	}
 
-	conn := rs.db.Get()
-	defer conn.Close()
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// decode returns the session id stored as data.
+func decode(id string, data []byte) (*Session, error) {
+	s, err := Decode(data)
 
-	if rs.persistent {
-		_, err = conn.Do("SET", rs.key(s.Id), data)
-	} else {
-		_, err = conn.Do("SETEX", rs.key(s.Id), rs.lifetime, data)
+	if err != nil {
+		return nil, err
 	}
-	return err
+
+	s.Id = id
+	s.markClean()
+	return s, nil
 }
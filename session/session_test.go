@@ -1,11 +1,13 @@
 package session
 
 import (
+	"bytes"
 	"encoding/json"
 	"testing"
 	"time"
 
 	"github.com/simonz05/util/assert"
+	"github.com/simonz05/util/kvstore/kvtest"
 )
 
 type backendTest struct {
@@ -15,11 +17,22 @@ type backendTest struct {
 	sleep int
 }
 
+// fields returns a copy of s without the bookkeeping of its changes, to
+// compare sessions by their fields.
+func fields(s *Session) Session {
+	c := *s
+	c.clean, c.snapshot = false, nil
+	return c
+}
+
 func TestBackend(t *testing.T) {
 	ast := assert.NewAssert(t)
 
-	DefaultLifetime = 1
-	redisStorage, err := NewRedisBackend("redis://:@localhost:6379/15", "dev", false)
+	srv, err := kvtest.NewServer()
+	ast.Nil(err)
+	defer srv.Close()
+
+	redisStorage, err := NewRedisStorage(srv.DSN(15), &RedisOptions{Prefix: "dev", Lifetime: 1})
 	ast.Nil(err)
 
 	backends := []Storage{
@@ -29,20 +42,20 @@ func TestBackend(t *testing.T) {
 	backendTests := []backendTest{
 		{
 			got:   &Session{Id: "1"},
-			exp:   &Session{Id: "1"},
+			exp:   &Session{Id: "1", Revision: 1},
 			err:   nil,
 			sleep: 0,
 		},
 		{
 			got:   &Session{Id: "1", Mask: AdminMask | FullMask},
-			exp:   &Session{Id: "1", Mask: AdminMask | FullMask},
+			exp:   &Session{Id: "1", Mask: AdminMask | FullMask, Revision: 2},
 			err:   nil,
 			sleep: 0,
 		},
 		{
 			got:   &Session{Id: "1"},
 			exp:   nil,
-			err:   nil,
+			err:   ErrNotFound,
 			sleep: 2,
 		},
 	}
@@ -53,7 +66,7 @@ func TestBackend(t *testing.T) {
 			ast.Nil(err)
 
 			if test.sleep > 0 {
-				time.Sleep(time.Duration(int(time.Second) * test.sleep))
+				srv.Advance(time.Duration(test.sleep) * time.Second)
 			}
 
 			ses, err := backend.Read(test.got.Id)
@@ -61,12 +74,43 @@ func TestBackend(t *testing.T) {
 			if test.err != nil {
 				ast.Equal(test.err, err)
 			} else {
-				ast.Equal(test.exp, ses)
+				// sessions are read clean
+				ast.True(!ses.Dirty())
+				ast.Equal(fields(test.exp), fields(ses))
 			}
 		}
 	}
 }
 
+func TestCachedBackend(t *testing.T) {
+	ast := assert.NewAssert(t)
+
+	srv, err := kvtest.NewServer()
+	ast.Nil(err)
+	defer srv.Close()
+
+	s1, err := NewCachedRedisBackend(srv.DSN(0), "dev", true, nil)
+	ast.Nil(err)
+	s2, err := NewCachedRedisBackend(srv.DSN(0), "dev", true, nil)
+	ast.Nil(err)
+
+	ast.Nil(s1.Write(&Session{Id: "1", ProfileID: 1}))
+	ses, err := s2.Read("1")
+	ast.Nil(err)
+	ast.Equal(1, ses.ProfileID)
+
+	// a write through one backend is seen by the other
+	ast.Nil(s1.Write(&Session{Id: "1", ProfileID: 2}))
+
+	for i := 0; i < 100 && ses.ProfileID != 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+		ses, err = s2.Read("1")
+		ast.Nil(err)
+	}
+
+	ast.Equal(2, ses.ProfileID)
+}
+
 func TestSession(t *testing.T) {
 	ast := assert.NewAssert(t)
 
@@ -91,6 +135,264 @@ func TestSession(t *testing.T) {
 	ast.True(p.HasFull())
 }
 
+func TestValues(t *testing.T) {
+	ast := assert.NewAssert(t)
+	storage := NewMemoryStorage(nil)
+	defer storage.Close()
+
+	type tenant struct {
+		ID   int64
+		Name string
+	}
+
+	now := time.Now()
+	ses := &Session{ProfileID: 1}
+	ses.SetString("locale", "sv")
+	ses.SetInt64("big", 1<<62+1)
+	ses.SetBool("beta", true)
+	ses.SetTime("login", now)
+	ast.Nil(ses.SetJSON("tenant", &tenant{1, "acme"}))
+	ast.Nil(ses.AddFlash("notice", "saved"))
+	ast.Nil(storage.New(ses))
+
+	ses, err := storage.Read(ses.Id)
+	ast.Nil(err)
+	ast.True(!ses.Dirty())
+
+	locale, ok := ses.GetString("locale")
+	ast.True(ok)
+	ast.Equal("sv", locale)
+	big, ok := ses.GetInt64("big")
+	ast.True(ok)
+	ast.Equal(int64(1<<62+1), big)
+	beta, ok := ses.GetBool("beta")
+	ast.True(ok && beta)
+	login, ok := ses.GetTime("login")
+	ast.True(ok && login.Equal(now))
+	var tn tenant
+	ok, err = ses.GetJSON("tenant", &tn)
+	ast.True(ok)
+	ast.Nil(err)
+	ast.Equal("acme", tn.Name)
+
+	// wrong types and missing keys are not found
+	_, ok = ses.GetInt64("locale")
+	ast.True(!ok)
+	_, ok = ses.GetString("missing")
+	ast.True(!ok)
+	ast.True(!ses.Dirty())
+
+	// flashes are removed once read
+	var notice string
+	ok, err = ses.Flash("notice", &notice)
+	ast.True(ok)
+	ast.Nil(err)
+	ast.Equal("saved", notice)
+	ast.True(ses.Dirty())
+	ast.Nil(storage.Write(ses))
+
+	ses, err = storage.Read(ses.Id)
+	ast.Nil(err)
+	ok, err = ses.Flash("notice", &notice)
+	ast.True(!ok)
+	ast.Nil(err)
+
+	// clean sessions are not written
+	ses, err = storage.Read(ses.Id)
+	ast.Nil(err)
+	rev := ses.Revision
+	ses.DeleteValue("missing")
+	ast.True(!ses.Dirty())
+	ast.Nil(storage.Write(ses))
+	got, err := storage.Read(ses.Id)
+	ast.Nil(err)
+	ast.Equal(rev, got.Revision)
+
+	// unless marked dirty
+	ses.MarkDirty()
+	ast.Nil(storage.Write(ses))
+	got, err = storage.Read(ses.Id)
+	ast.Nil(err)
+	ast.Equal(rev+1, got.Revision)
+
+	// fields assigned directly are written
+	ses = got
+	ses.ProfileID = 2
+	ses.Values["locale"] = []byte(`"en"`)
+	ast.True(ses.Dirty())
+	ast.Nil(storage.Write(ses))
+	ast.True(!ses.Dirty())
+	got, err = storage.Read(ses.Id)
+	ast.Nil(err)
+	ast.Equal(2, got.ProfileID)
+
+	// written sessions are clean until changed again
+	rev = got.Revision
+	ast.Nil(storage.Write(ses))
+	got, err = storage.Read(ses.Id)
+	ast.Nil(err)
+	ast.Equal(rev, got.Revision)
+	locale, _ = got.GetString("locale")
+	ast.Equal("en", locale)
+
+	// the legacy encoding with a string profile id is read with values
+	got, err = decode("1", []byte(`{"m":2,"user_id":"5","v":{"locale":"en"}}`))
+	ast.Nil(err)
+	ast.Equal(5, got.ProfileID)
+	ast.True(got.HasAdmin())
+	locale, _ = got.GetString("locale")
+	ast.Equal("en", locale)
+}
+
+func TestScopes(t *testing.T) {
+	ast := assert.NewAssert(t)
+
+	p := &Session{ProfileID: 1}
+	p.GrantScope("keys:*", "profile:read", ScopeFull)
+	ast.True(p.HasScope("keys:read"))
+	ast.True(p.HasScope("keys:read:own"))
+	ast.True(!p.HasScope("keys"))
+	ast.True(p.HasScope("profile:read"))
+	ast.True(!p.HasScope("profile:write"))
+	ast.True(p.HasFull())
+	ast.True(!p.HasAdmin())
+
+	// legacy scopes are kept as mask bits
+	ast.Equal(FullMask, p.Mask)
+	ast.Equal([]string{"keys:*", "profile:read"}, p.Scopes)
+	ast.Equal([]string{"full", "keys:*", "profile:read"}, p.AllScopes())
+
+	p.GrantScope("users:*:read")
+	ast.True(p.HasScope("users:1:read"))
+	ast.True(!p.HasScope("users:1:write"))
+
+	p.RevokeScope("keys:*", ScopeFull)
+	ast.True(!p.HasScope("keys:read"))
+	ast.True(!p.HasFull())
+	ast.Equal(uint8(0), p.Mask)
+
+	// sessions stored with masks have the legacy scopes
+	p = &Session{ProfileID: 1, Mask: FullMask | AdminMask}
+	ast.True(p.HasScope(ScopeAdmin))
+	ast.True(p.HasAdmin())
+
+	p = &Session{ProfileID: 1}
+	p.GrantScope("*")
+	ast.True(p.HasScope("anything:at:all"))
+	ast.True(p.HasAdmin())
+}
+
+func TestCodecs(t *testing.T) {
+	ast := assert.NewAssert(t)
+
+	ses := &Session{Mask: AdminMask, ProfileID: -3, Lifetime: 60}
+	ses.Seen(time.Unix(1500000000, 0), "192.0.2.1", "curl/7.0")
+	ses.SetDevice("laptop")
+	ses.GrantScope("keys:*", "profile:read")
+	ses.SetString("locale", "en")
+	ast.Nil(ses.AddFlash("notice", "saved"))
+
+	for _, codec := range []Codec{JSONCodec, BinaryCodec} {
+		data, err := Encode(ses, codec)
+		ast.Nil(err)
+		got, err := Decode(data)
+		ast.Nil(err)
+		ast.Equal(ses, got)
+
+		_, c, err := decodeRecord(data)
+		ast.Nil(err)
+		ast.Equal(codec, c)
+	}
+
+	// the empty session encodes to the bare envelope in binary
+	data, err := Encode(&Session{}, BinaryCodec)
+	ast.Nil(err)
+	ast.Equal([]byte{envelopeMark, CurrentVersion, 'b'}, data)
+
+	// binary readers skip fields they do not know
+	data, err = Encode(&Session{ProfileID: 7}, BinaryCodec)
+	ast.Nil(err)
+	got, err := Decode(append(data, 99, 2, 'h', 'i'))
+	ast.Nil(err)
+	ast.Equal(7, got.ProfileID)
+
+	_, err = Decode(data[:len(data)-1])
+	ast.Equal(errCorrupt, err)
+
+	// version 0 is migrated, with the profile id as number or string
+	for _, legacy := range []string{`{"m":2,"user_id":5}`, `{"m":2,"user_id":"5"}`} {
+		got, codec, err := decodeRecord([]byte(legacy))
+		ast.Nil(err)
+		ast.Equal(5, got.ProfileID)
+		ast.True(got.HasAdmin())
+		ast.True(codec == nil)
+	}
+
+	_, err = Decode([]byte(`{"user_id":"five"}`))
+	ast.NotNil(err)
+	_, err = Decode([]byte{envelopeMark, CurrentVersion + 1, 'j', '{', '}'})
+	ast.NotNil(err)
+	_, err = Decode([]byte{envelopeMark, CurrentVersion, 'x', '{', '}'})
+	ast.NotNil(err)
+
+	// version 0 is written for old readers, whatever the codec
+	WriteVersion = 0
+	defer func() { WriteVersion = CurrentVersion }()
+
+	data, err = Encode(ses, BinaryCodec)
+	ast.Nil(err)
+	ast.Equal(byte('{'), data[0])
+	ast.True(bytes.Contains(data, []byte(`"user_id":"-3"`)))
+	got, err = Decode(data)
+	ast.Nil(err)
+	ast.Equal(ses, got)
+
+	storage := NewMemoryStorage(nil)
+	defer storage.Close()
+	ast.Nil(storage.New(ses))
+	got, err = storage.Read(ses.Id)
+	ast.Nil(err)
+	ast.Equal(-3, got.ProfileID)
+}
+
+func TestActivity(t *testing.T) {
+	ast := assert.NewAssert(t)
+
+	now := time.Unix(1500000000, 0)
+	storage := NewMemoryStorage(&MemoryOptions{Now: func() time.Time { return now }})
+	defer storage.Close()
+
+	ses := &Session{ProfileID: 1}
+	ast.Nil(storage.New(ses))
+	ast.Equal(now.Unix(), ses.CreatedAt)
+	ast.Equal(now.Unix(), ses.LastSeenAt)
+
+	ses, err := storage.Read(ses.Id)
+	ast.Nil(err)
+	ast.True(ses.Seen(now.Add(time.Second), "192.0.2.1", "curl/7.0"))
+	ast.Equal(now.Unix()+1, ses.LastSeenAt)
+	ast.Nil(storage.Write(ses))
+
+	// last seen is throttled while the client is the same
+	ses, err = storage.Read(ses.Id)
+	ast.Nil(err)
+	ast.True(!ses.Seen(now.Add(LastSeenInterval), "192.0.2.1", "curl/7.0"))
+	ast.True(!ses.Dirty())
+	ast.True(ses.Seen(now.Add(LastSeenInterval+time.Second), "192.0.2.1", "curl/7.0"))
+	ast.Equal(now.Add(LastSeenInterval+time.Second).Unix(), ses.LastSeenAt)
+
+	ast.True(ses.Seen(now.Add(LastSeenInterval+2*time.Second), "192.0.2.2", "curl/7.0"))
+	ast.Equal("192.0.2.2", ses.IP)
+	ast.Equal(now.Unix(), ses.CreatedAt)
+
+	ses.SetDevice("laptop")
+	ast.Nil(storage.Write(ses))
+	got, err := storage.Read(ses.Id)
+	ast.Nil(err)
+	ast.Equal("laptop", got.Device)
+	ast.Equal("192.0.2.2", got.IP)
+}
+
 func TestPersistance(t *testing.T) {
 	ast := assert.NewAssert(t)
 
@@ -128,3 +430,17 @@ func BenchmarkPersistance(b *testing.B) {
 		}
 	}
 }
+
+func BenchmarkBinaryCodec(b *testing.B) {
+	p1 := &Session{}
+	p1.Set(AdminMask)
+	p1.ProfileID = 1
+
+	for i := 0; i < b.N; i++ {
+		_, err := Encode(p1, BinaryCodec)
+
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
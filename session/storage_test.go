@@ -0,0 +1,519 @@
+package session
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/simonz05/util/assert"
+	"github.com/simonz05/util/kvstore"
+	"github.com/simonz05/util/kvstore/kvtest"
+)
+
+// testStorage is the conformance suite of Storage implementations. open
+// returns an empty storage with the given default lifetime, and advance
+// moves its clock. Storages which are not revocable keep deleted sessions
+// until they expire.
+func testStorage(t *testing.T, open func(lifetime int, persistent bool) Storage, advance func(time.Duration), revocable bool) {
+	ast := assert.NewAssert(t)
+	storage := open(10, false)
+
+	s1 := &Session{ProfileID: 1}
+	ast.Nil(storage.New(s1))
+	ast.True(len(s1.Id) >= 43)
+
+	s2 := &Session{ProfileID: 1}
+	ast.Nil(storage.New(s2))
+	ast.True(s1.Id != s2.Id)
+
+	ses, err := storage.Read(s1.Id)
+	ast.Nil(err)
+	ast.True(!ses.Dirty())
+	ast.Equal(fields(s1), fields(ses))
+
+	_, err = storage.Read("missing")
+	ast.Equal(ErrNotFound, err)
+
+	// the stored session does not change with the written one
+	s1.Set(AdminMask)
+	ast.Nil(storage.Write(s1))
+	s1.Unset(AdminMask)
+	ses, err = storage.Read(s1.Id)
+	ast.Nil(err)
+	ast.True(ses.HasAdmin())
+	ast.Nil(storage.Write(s1))
+
+	// touching slides the expiry
+	advance(8 * time.Second)
+	ast.Nil(storage.Touch(s1))
+	advance(8 * time.Second)
+	_, err = storage.Read(s1.Id)
+	ast.Nil(err)
+	_, err = storage.Read(s2.Id)
+	ast.Equal(ErrNotFound, err)
+	ast.Equal(ErrNotFound, storage.Touch(s2))
+
+	// the lifetime of a session overrides the storage default
+	s3 := &Session{Lifetime: 60}
+	ast.Nil(storage.New(s3))
+	advance(30 * time.Second)
+	ses, err = storage.Read(s3.Id)
+	ast.Nil(err)
+	ast.Equal(60, ses.Lifetime)
+
+	// written sessions expire too
+	s4 := &Session{Id: "written"}
+	ast.Nil(storage.Write(s4))
+	advance(11 * time.Second)
+	_, err = storage.Read(s4.Id)
+	ast.Equal(ErrNotFound, err)
+
+	ast.Nil(storage.Delete(s1.Id))
+	ast.Nil(storage.Delete(s1.Id))
+
+	if revocable {
+		_, err = storage.Read(s1.Id)
+		ast.Equal(ErrNotFound, err)
+	}
+
+	// regenerated sessions move to a new id, and storages which are
+	// Regenerators keep the old one as an alias for the grace period
+	old := s3.Id
+	s3.SetString("k", "v")
+	ast.Nil(Regenerate(storage, s3))
+	ast.True(s3.Id != old)
+	ses, err = storage.Read(s3.Id)
+	ast.Nil(err)
+	v, _ := ses.GetString("k")
+	ast.Equal("v", v)
+
+	if _, ok := storage.(Regenerator); ok {
+		ses, err = storage.Read(old)
+		ast.Nil(err)
+		ast.Equal(s3.Id, ses.Id)
+		ast.Equal(ErrNotFound, Regenerate(storage, &Session{Id: old}))
+		ast.Equal(ErrNotFound, Regenerate(storage, &Session{Id: "missing"}))
+
+		advance(DefaultRegenerateGrace)
+		_, err = storage.Read(old)
+		ast.Equal(ErrNotFound, err)
+		_, err = storage.Read(s3.Id)
+		ast.Nil(err)
+	}
+
+	// conditional writes fail once the session was written since read
+	if cas, ok := storage.(CompareAndSwapper); ok {
+		a, err := storage.Read(s3.Id)
+		ast.Nil(err)
+		b, err := storage.Read(s3.Id)
+		ast.Nil(err)
+		a.SetString("k", "a")
+		ast.Nil(cas.CompareAndWrite(a))
+		b.SetString("k", "b")
+		ast.Equal(ErrConflict, cas.CompareAndWrite(b))
+		ast.Equal(a.Revision-1, b.Revision)
+
+		missing := &Session{Id: "missing"}
+		ast.Equal(ErrNotFound, cas.CompareAndWrite(missing))
+
+		// Update reads again after a conflict
+		n := 0
+		ses, err = Update(storage, s3.Id, 1, func(ses *Session) error {
+			if n++; n == 1 {
+				ast.Nil(storage.Write(b))
+			}
+
+			ses.SetInt64("n", int64(n))
+			return nil
+		})
+		ast.Nil(err)
+		ast.Equal(2, n)
+		ses, err = storage.Read(s3.Id)
+		ast.Nil(err)
+		k, _ := ses.GetString("k")
+		ast.Equal("b", k)
+		got, _ := ses.GetInt64("n")
+		ast.Equal(int64(2), got)
+
+		_, err = Update(storage, s3.Id, 0, func(ses *Session) error {
+			ses.SetInt64("n", 3)
+			b.MarkDirty()
+			return storage.Write(b)
+		})
+		ast.Equal(ErrConflict, err)
+	}
+
+	// persistent sessions never expire, unless their lifetime is set
+	persistent := open(0, true)
+	s5, s6 := &Session{}, &Session{Lifetime: 60}
+	ast.Nil(persistent.New(s5))
+	ast.Nil(persistent.New(s6))
+	advance(365 * 24 * time.Hour)
+	ast.Nil(persistent.Touch(s5))
+	_, err = persistent.Read(s5.Id)
+	ast.Nil(err)
+	_, err = persistent.Read(s6.Id)
+	ast.Equal(ErrNotFound, err)
+}
+
+func TestRedisStorage(t *testing.T) {
+	for _, cached := range []bool{false, true} {
+		srv, err := kvtest.NewServer()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		n := 0
+		open := func(lifetime int, persistent bool) Storage {
+			n++
+			opts := &RedisOptions{Prefix: fmt.Sprint("test", n), Lifetime: lifetime, Persistent: persistent}
+
+			if cached {
+				// the cache must expire sessions on the clock of
+				// the server
+				opts.NearCache = &kvstore.NearCacheOptions{Now: srv.Now}
+			}
+
+			storage, err := NewRedisStorage(srv.DSN(0), opts)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			return storage
+		}
+
+		testStorage(t, open, srv.Advance, true)
+		srv.Close()
+	}
+}
+
+func TestRewriteOnRead(t *testing.T) {
+	ast := assert.NewAssert(t)
+
+	srv, err := kvtest.NewServer()
+	ast.Nil(err)
+	defer srv.Close()
+
+	storage, err := NewRedisStorage(srv.DSN(0), &RedisOptions{Prefix: "rw", Codec: BinaryCodec, RewriteOnRead: true})
+	ast.Nil(err)
+
+	conn, err := redis.Dial("tcp", srv.Addr())
+	ast.Nil(err)
+	defer conn.Close()
+	legacy := []byte(`{"m":1,"user_id":"4"}`)
+	_, err = conn.Do("SETEX", "rw:old", 100, legacy)
+	ast.Nil(err)
+
+	ses, err := storage.Read("old")
+	ast.Nil(err)
+	ast.Equal(4, ses.ProfileID)
+	ast.True(ses.HasFull())
+	ast.True(!ses.Dirty())
+
+	// the record is rewritten in the current version, keeping its expiry
+	data, err := redis.Bytes(conn.Do("GET", "rw:old"))
+	ast.Nil(err)
+	ast.Equal([]byte{envelopeMark, CurrentVersion, 'b'}, data[:3])
+	ttl, err := redis.Int(conn.Do("TTL", "rw:old"))
+	ast.Nil(err)
+	ast.True(ttl > 90 && ttl <= 100)
+
+	got, err := storage.Read("old")
+	ast.Nil(err)
+	ast.Equal(fields(ses), fields(got))
+
+	// without the option records are read as stored
+	plain, err := NewRedisStorage(srv.DSN(0), &RedisOptions{Prefix: "rw"})
+	ast.Nil(err)
+	_, err = conn.Do("SET", "rw:kept", legacy)
+	ast.Nil(err)
+	_, err = plain.Read("kept")
+	ast.Nil(err)
+	data, err = redis.Bytes(conn.Do("GET", "rw:kept"))
+	ast.Nil(err)
+	ast.Equal(legacy, data)
+}
+
+func TestConcurrentUpdate(t *testing.T) {
+	ast := assert.NewAssert(t)
+
+	srv, err := kvtest.NewServer()
+	ast.Nil(err)
+	defer srv.Close()
+
+	redisStorage, err := NewRedisStorage(srv.DSN(0), nil)
+	ast.Nil(err)
+	memory := NewMemoryStorage(nil)
+	defer memory.Close()
+
+	for _, storage := range []Storage{redisStorage, memory} {
+		ses := &Session{ProfileID: 1}
+		ast.Nil(storage.New(ses))
+
+		const workers, updates = 4, 10
+		var wg sync.WaitGroup
+
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+
+				for j := 0; j < updates; j++ {
+					_, err := Update(storage, ses.Id, 100, func(s *Session) error {
+						n, _ := s.GetInt64("n")
+						s.SetInt64("n", n+1)
+						return nil
+					})
+
+					if err != nil {
+						t.Error(err)
+					}
+				}
+			}()
+		}
+
+		wg.Wait()
+		ses, err = storage.Read(ses.Id)
+		ast.Nil(err)
+		n, _ := ses.GetInt64("n")
+		ast.Equal(int64(workers*updates), n)
+	}
+}
+
+// clock is a manual clock for MemoryStorage.
+type clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+func TestMemoryStorage(t *testing.T) {
+	c := &clock{now: time.Now()}
+	var opened []*MemoryStorage
+
+	testStorage(t, func(lifetime int, persistent bool) Storage {
+		m := NewMemoryStorage(&MemoryOptions{Lifetime: lifetime, Persistent: persistent, Now: c.Now})
+		opened = append(opened, m)
+		return m
+	}, c.Advance, true)
+
+	for _, m := range opened {
+		m.Close()
+	}
+}
+
+func TestMemoryStorageLimits(t *testing.T) {
+	ast := assert.NewAssert(t)
+	c := &clock{now: time.Now()}
+	m := NewMemoryStorage(&MemoryOptions{
+		Lifetime:        10,
+		MaxSessions:     2,
+		JanitorInterval: time.Millisecond,
+		Now:             c.Now,
+	})
+	defer m.Close()
+
+	// the session closest to expiry makes room
+	ast.Nil(m.Write(&Session{Id: "a", Lifetime: 20}))
+	ast.Nil(m.Write(&Session{Id: "b"}))
+	ast.Nil(m.Write(&Session{Id: "c", Lifetime: 30}))
+	ast.Equal(2, m.Len())
+	_, err := m.Read("b")
+	ast.Equal(ErrNotFound, err)
+	_, err = m.Read("a")
+	ast.Nil(err)
+
+	// the janitor removes expired sessions
+	c.Advance(time.Minute)
+
+	for i := 0; i < 100 && m.Len() > 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	ast.Equal(0, m.Len())
+}
+
+func TestCookieStorage(t *testing.T) {
+	ast := assert.NewAssert(t)
+	c := &clock{now: time.Now()}
+	oldKey := bytes.Repeat([]byte{1}, 16)
+	newKey := bytes.Repeat([]byte{2}, 32)
+
+	testStorage(t, func(lifetime int, persistent bool) Storage {
+		storage, err := NewCookieStorage([][]byte{newKey}, &CookieOptions{Lifetime: lifetime, Persistent: persistent, Now: c.Now})
+		ast.Nil(err)
+		return storage
+	}, c.Advance, false)
+
+	_, err := NewCookieStorage([][]byte{[]byte("short")}, nil)
+	ast.NotNil(err)
+
+	// sessions encrypted with the old key are read after rotation
+	old, err := NewCookieStorage([][]byte{oldKey}, nil)
+	ast.Nil(err)
+	rotated, err := NewCookieStorage([][]byte{newKey, oldKey}, nil)
+	ast.Nil(err)
+	current, err := NewCookieStorage([][]byte{newKey}, nil)
+	ast.Nil(err)
+
+	ses := &Session{ProfileID: 1}
+	ast.Nil(old.New(ses))
+	got, err := rotated.Read(ses.Id)
+	ast.Nil(err)
+	ast.Equal(1, got.ProfileID)
+	_, err = current.Read(ses.Id)
+	ast.Equal(ErrNotFound, err)
+
+	ast.Nil(rotated.Write(ses))
+	_, err = current.Read(ses.Id)
+	ast.Nil(err)
+
+	// tampered tokens are rejected
+	tampered := []byte(ses.Id)
+	tampered[len(tampered)/2] ^= 1
+	_, err = rotated.Read(string(tampered))
+	ast.Equal(ErrNotFound, err)
+
+	small, err := NewCookieStorage([][]byte{newKey}, &CookieOptions{MaxSize: 50})
+	ast.Nil(err)
+	ast.Equal(ErrTooLarge, small.New(&Session{ProfileID: 1, Lifetime: 1 << 30}))
+}
+
+func TestProfileIndex(t *testing.T) {
+	for _, cached := range []bool{false, true} {
+		ast := assert.NewAssert(t)
+		srv, err := kvtest.NewServer()
+		ast.Nil(err)
+
+		opts := &RedisOptions{Prefix: "dev", Lifetime: 100, MaxPerProfile: 3}
+
+		if cached {
+			opts.NearCache = &kvstore.NearCacheOptions{Now: srv.Now}
+		}
+
+		storage, err := NewRedisStorage(srv.DSN(0), opts)
+		ast.Nil(err)
+		index := storage.(Index)
+
+		var sessions []*Session
+
+		for i := 0; i < 3; i++ {
+			s := &Session{ProfileID: 1, Lifetime: 10 * (i + 1)}
+			ast.Nil(storage.New(s))
+			sessions = append(sessions, s)
+		}
+
+		other := &Session{ProfileID: 2}
+		ast.Nil(storage.New(other))
+
+		infos, err := index.List(1)
+		ast.Nil(err)
+		ast.Equal(3, len(infos))
+		ast.Equal(sessions[0].Id, infos[0].Session.Id)
+		ast.Equal(srv.Now().Unix()+10, infos[0].Expires.Unix())
+
+		// expired sessions drop out of the list
+		srv.Advance(15 * time.Second)
+		infos, err = index.List(1)
+		ast.Nil(err)
+		ast.Equal(2, len(infos))
+
+		// a session leaving the profile is not listed
+		ses, err := storage.Read(sessions[1].Id)
+		ast.Nil(err)
+		ses.ProfileID = 3
+		ast.Nil(storage.Write(ses))
+		infos, err = index.List(1)
+		ast.Nil(err)
+		ast.Equal(1, len(infos))
+		ast.Equal(sessions[2].Id, infos[0].Session.Id)
+		infos, err = index.List(3)
+		ast.Nil(err)
+		ast.Equal(1, len(infos))
+
+		// nor revoked through the old profile, even from a stale entry
+		moved := ses.Id
+		ast.Equal(ErrNotFound, index.Revoke(1, moved))
+		conn, err := redis.Dial("tcp", srv.Addr())
+		ast.Nil(err)
+		defer conn.Close()
+		_, err = conn.Do("ZADD", "dev:profile:1", "+inf", moved)
+		ast.Nil(err)
+		ast.Equal(ErrNotFound, index.Revoke(1, moved))
+		_, err = storage.Read(moved)
+		ast.Nil(err)
+
+		// touching moves the expiry in the index
+		ast.Nil(storage.Touch(sessions[2]))
+		infos, err = index.List(1)
+		ast.Nil(err)
+		ast.Equal(srv.Now().Unix()+30, infos[0].Expires.Unix())
+
+		// the cap evicts the session closest to expiry
+		for i := 0; i < 3; i++ {
+			ast.Nil(storage.New(&Session{ProfileID: 1, Lifetime: 1000 + i}))
+		}
+
+		infos, err = index.List(1)
+		ast.Nil(err)
+		ast.Equal(3, len(infos))
+		_, err = storage.Read(sessions[2].Id)
+		ast.Equal(ErrNotFound, err)
+
+		keep := infos[2].Session.Id
+		ast.Equal(ErrNotFound, index.Revoke(2, keep))
+		ast.Nil(index.Revoke(1, infos[0].Session.Id))
+		_, err = storage.Read(infos[0].Session.Id)
+		ast.Equal(ErrNotFound, err)
+
+		_, err = conn.Do("ZADD", "dev:profile:1", "+inf", moved)
+		ast.Nil(err)
+		n, err := index.RevokeAllExcept(1, keep)
+		ast.Nil(err)
+		ast.Equal(1, n)
+		_, err = storage.Read(moved)
+		ast.Nil(err)
+		infos, err = index.List(1)
+		ast.Nil(err)
+		ast.Equal(1, len(infos))
+		ast.Equal(keep, infos[0].Session.Id)
+
+		ast.Nil(storage.Delete(keep))
+		infos, err = index.List(1)
+		ast.Nil(err)
+		ast.Equal(0, len(infos))
+
+		n, err = index.RevokeAll(2)
+		ast.Nil(err)
+		ast.Equal(1, n)
+		_, err = storage.Read(other.Id)
+		ast.Equal(ErrNotFound, err)
+
+		// closing stops the near cache and releases the connections
+		closer := storage.(io.Closer)
+		ast.Nil(closer.Close())
+		ast.Nil(closer.Close())
+		_, err = storage.Read(keep)
+		ast.True(err != nil && err != ErrNotFound)
+
+		srv.Close()
+	}
+}
@@ -0,0 +1,226 @@
+package session
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+)
+
+// Dirty reports whether s was changed since it was read or written with
+// Write, through its methods or by assigning to its fields. Other sessions
+// are always dirty. Storages skip writing clean sessions.
+func (p *Session) Dirty() bool {
+	return !p.clean || !p.snapshot.equal(p)
+}
+
+// MarkDirty marks s as changed, so that it is written even if unchanged.
+func (p *Session) MarkDirty() {
+	p.clean, p.snapshot = false, nil
+}
+
+// markClean records s as unchanged, keeping a copy of its fields to find
+// the changes made by assigning to them.
+func (p *Session) markClean() {
+	c := &Session{
+		Mask:       p.Mask,
+		ProfileID:  p.ProfileID,
+		Lifetime:   p.Lifetime,
+		Scopes:     append([]string(nil), p.Scopes...),
+		Values:     copyValues(p.Values),
+		Flashes:    copyValues(p.Flashes),
+		CreatedAt:  p.CreatedAt,
+		LastSeenAt: p.LastSeenAt,
+		IP:         p.IP,
+		UserAgent:  p.UserAgent,
+		Device:     p.Device,
+		Revision:   p.Revision,
+	}
+	p.clean, p.snapshot = true, c
+}
+
+// written marks s clean if it was written without error, so that it is
+// not written again unless changed. It returns err.
+func (p *Session) written(err error) error {
+	if err == nil {
+		p.markClean()
+	}
+
+	return err
+}
+
+// equal reports whether p and q have the same stored fields.
+func (p *Session) equal(q *Session) bool {
+	if p.Mask != q.Mask || p.ProfileID != q.ProfileID || p.Lifetime != q.Lifetime ||
+		p.CreatedAt != q.CreatedAt || p.LastSeenAt != q.LastSeenAt || p.IP != q.IP ||
+		p.UserAgent != q.UserAgent || p.Device != q.Device || p.Revision != q.Revision ||
+		len(p.Scopes) != len(q.Scopes) {
+		return false
+	}
+
+	for i := range p.Scopes {
+		if p.Scopes[i] != q.Scopes[i] {
+			return false
+		}
+	}
+
+	return equalValues(p.Values, q.Values) && equalValues(p.Flashes, q.Flashes)
+}
+
+func copyValues(m map[string]json.RawMessage) map[string]json.RawMessage {
+	if m == nil {
+		return nil
+	}
+
+	c := make(map[string]json.RawMessage, len(m))
+
+	for k, v := range m {
+		c[k] = append(json.RawMessage(nil), v...)
+	}
+
+	return c
+}
+
+func equalValues(a, b map[string]json.RawMessage) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for k, v := range a {
+		if w, ok := b[k]; !ok || !bytes.Equal(v, w) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (p *Session) get(key string, v interface{}) bool {
+	data, ok := p.Values[key]
+	return ok && json.Unmarshal(data, v) == nil
+}
+
+func (p *Session) set(key string, v interface{}) error {
+	data, err := json.Marshal(v)
+
+	if err != nil {
+		return err
+	}
+
+	if p.Values == nil {
+		p.Values = make(map[string]json.RawMessage)
+	}
+
+	p.Values[key] = data
+	p.clean = false
+	return nil
+}
+
+// GetString returns the string value of key, and whether it is set and is
+// a string.
+func (p *Session) GetString(key string) (string, bool) {
+	var v string
+	ok := p.get(key, &v)
+	return v, ok
+}
+
+// SetString sets the value of key to v.
+func (p *Session) SetString(key, v string) {
+	p.set(key, v)
+}
+
+// GetInt64 returns the integer value of key, and whether it is set and is
+// an integer.
+func (p *Session) GetInt64(key string) (int64, bool) {
+	var v int64
+	ok := p.get(key, &v)
+	return v, ok
+}
+
+// SetInt64 sets the value of key to v.
+func (p *Session) SetInt64(key string, v int64) {
+	p.set(key, v)
+}
+
+// GetBool returns the boolean value of key, and whether it is set and is a
+// boolean.
+func (p *Session) GetBool(key string) (bool, bool) {
+	var v bool
+	ok := p.get(key, &v)
+	return v, ok
+}
+
+// SetBool sets the value of key to v.
+func (p *Session) SetBool(key string, v bool) {
+	p.set(key, v)
+}
+
+// GetTime returns the time value of key, and whether it is set and is a
+// time.
+func (p *Session) GetTime(key string) (time.Time, bool) {
+	var v time.Time
+	ok := p.get(key, &v)
+	return v, ok
+}
+
+// SetTime sets the value of key to t, kept with nanosecond precision.
+func (p *Session) SetTime(key string, t time.Time) {
+	p.set(key, t)
+}
+
+// GetJSON decodes the value of key into v and reports whether it is set.
+func (p *Session) GetJSON(key string, v interface{}) (bool, error) {
+	data, ok := p.Values[key]
+
+	if !ok {
+		return false, nil
+	}
+
+	return true, json.Unmarshal(data, v)
+}
+
+// SetJSON sets the value of key to the JSON encoding of v.
+func (p *Session) SetJSON(key string, v interface{}) error {
+	return p.set(key, v)
+}
+
+// DeleteValue removes the value of key.
+func (p *Session) DeleteValue(key string) {
+	if _, ok := p.Values[key]; ok {
+		delete(p.Values, key)
+		p.clean = false
+	}
+}
+
+// AddFlash sets the flash value of key to the JSON encoding of v. A flash
+// value is removed once read with Flash, as for a message shown after a
+// redirect.
+func (p *Session) AddFlash(key string, v interface{}) error {
+	data, err := json.Marshal(v)
+
+	if err != nil {
+		return err
+	}
+
+	if p.Flashes == nil {
+		p.Flashes = make(map[string]json.RawMessage)
+	}
+
+	p.Flashes[key] = data
+	p.clean = false
+	return nil
+}
+
+// Flash decodes the flash value of key into v, removes it and reports
+// whether it was set. The session must be written for the removal to
+// last.
+func (p *Session) Flash(key string, v interface{}) (bool, error) {
+	data, ok := p.Flashes[key]
+
+	if !ok {
+		return false, nil
+	}
+
+	delete(p.Flashes, key)
+	p.clean = false
+	return true, json.Unmarshal(data, v)
+}